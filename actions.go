@@ -0,0 +1,326 @@
+package dataversego
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/emaporta/dataversego/requests"
+)
+
+// Literal represents a value that is written verbatim in the url of a function call,
+// e.g. an enum value like "Microsoft.Dynamics.CRM.EntityFilters'Entity'" or an Edm.Guid.
+type Literal string
+
+// ExecuteFunction invokes a dataverse function, bound or unbound.
+//
+// It takes a single argument of type 'ExecuteFunctionSignature', which is a struct containing the following fields:
+//   - Auth: a struct containing authentication information
+//   - Name: the name of the function (e.g. "WhoAmI")
+//   - TableName: the name of the table the function is bound to, empty for unbound functions
+//   - Id: the ID of the entry the function is bound to, empty for unbound or collection-bound functions
+//   - Parameters: a map of parameter names to values, passed through "@p" aliases
+//   - Response: an optional pointer to a struct where the response will be decoded
+//   - Options: the 'requests.RequestOptions' of the requests (impersonation, MSCRM headers)
+//
+// The return value is a map of strings to interface{} values representing the response, and an error value, which will be nil if the function completed successfully.
+//
+// Example:
+//
+//	var whoami struct {
+//	  UserId string
+//	}
+//	_, err := ExecuteFunction(ExecuteFunctionSignature{
+//	  Auth: Auth{Token: "Token", Url: "https://url.crm.dynamics.com"},
+//	  Name: "WhoAmI",
+//	  Response: &whoami,
+//	})
+//	if err != nil {
+//	  log.Fatal(err)
+//	}
+//	fmt.Println(whoami.UserId)
+func ExecuteFunction(parameter ExecuteFunctionSignature) (ent map[string]any, err error) {
+	parameter.Auth = parameter.Auth.withOptions(parameter.Options).withOperation("ExecuteFunction", parameter.TableName)
+	defer func() { parameter.Auth.endOperation(err) }()
+	if !parameter.Auth.isSet() {
+		err = errors.New("Empty auth")
+		return
+	}
+	if len(parameter.Name) == 0 {
+		err = errors.New("Empty name")
+		return
+	}
+	if len(parameter.Id) > 0 && len(parameter.TableName) == 0 {
+		err = errors.New("Empty table")
+		return
+	}
+
+	ent, err = executeFunction(parameter.Auth, parameter.TableName, parameter.Id, parameter.Name, parameter.Parameters)
+	if err != nil {
+		return
+	}
+
+	if parameter.Response != nil {
+		err = decodeMap(ent, parameter.Response)
+	}
+	return
+}
+
+// ExecuteAction invokes a dataverse action or custom API, bound or unbound.
+//
+// It takes a single argument of type 'ExecuteActionSignature', which is a struct containing the following fields:
+//   - Auth: a struct containing authentication information
+//   - Name: the name of the action (e.g. "QualifyLead")
+//   - TableName: the name of the table the action is bound to, empty for unbound actions
+//   - Id: the ID of the entry the action is bound to, empty for unbound or collection-bound actions
+//   - Parameters: a map of parameter names to values, sent as JSON payload. Entity parameters can be set with an 'EntityReference' value or a pointer to one.
+//   - Response: an optional pointer to a struct where the response will be decoded
+//   - Options: the 'requests.RequestOptions' of the requests (impersonation, MSCRM headers)
+//
+// The return value is a map of strings to interface{} values representing the response, and an error value, which will be nil if the function completed successfully.
+//
+// Example:
+//
+//	ent, err := ExecuteAction(ExecuteActionSignature{
+//	  Auth: Auth{Token: "Token", Url: "https://url.crm.dynamics.com"},
+//	  Name: "QualifyLead",
+//	  TableName: "leads",
+//	  Id: "123",
+//	  Parameters: map[string]any{
+//	    "CreateAccount": true,
+//	    "CreateContact": true,
+//	    "CreateOpportunity": false,
+//	    "Status": 3,
+//	  },
+//	})
+//	if err != nil {
+//	  log.Fatal(err)
+//	}
+//	fmt.Println(ent)
+func ExecuteAction(parameter ExecuteActionSignature) (ent map[string]any, err error) {
+	parameter.Auth = parameter.Auth.withOptions(parameter.Options).withOperation("ExecuteAction", parameter.TableName)
+	defer func() { parameter.Auth.endOperation(err) }()
+	if !parameter.Auth.isSet() {
+		err = errors.New("Empty auth")
+		return
+	}
+	if len(parameter.Name) == 0 {
+		err = errors.New("Empty name")
+		return
+	}
+	if len(parameter.Id) > 0 && len(parameter.TableName) == 0 {
+		err = errors.New("Empty table")
+		return
+	}
+
+	ent, err = executeAction(parameter.Auth, parameter.TableName, parameter.Id, parameter.Name, parameter.Parameters)
+	if err != nil {
+		return
+	}
+
+	if parameter.Response != nil && ent != nil {
+		err = decodeMap(ent, parameter.Response)
+	}
+	return
+}
+
+// INTERNAL METHODS
+
+func executeFunction(auth Authorization, tableName string, id string, name string, parameters map[string]any) (ent map[string]any, err error) {
+	parameters, err = resolveFunctionParameters(auth, parameters)
+	if err != nil {
+		return
+	}
+	call, err := writeFunctionCall(name, parameters)
+	if err != nil {
+		return
+	}
+	resp, err := auth.do(requests.Request{
+		Method: "GET",
+		Path:   fmt.Sprintf("%v/%v", auth.apiPath(), writeOperationPath(tableName, id, call)),
+	})
+	if err != nil {
+		return
+	}
+	ent = resp.Value
+
+	return
+}
+
+func executeAction(auth Authorization, tableName string, id string, name string, parameters map[string]any) (ent map[string]any, err error) {
+	payload, err := writeActionPayload(auth, parameters)
+	if err != nil {
+		return
+	}
+	resp, err := auth.do(requests.Request{
+		Method:    "POST",
+		Path:      fmt.Sprintf("%v/%v", auth.apiPath(), writeOperationPath(tableName, id, name)),
+		Body:      payload,
+		Operation: "ExecuteAction",
+	})
+	if err != nil {
+		return
+	}
+	ent = resp.Value
+
+	return
+}
+
+// writeOperationPath returns the path of a function or action, relative to the Web API root.
+// Bound operations must be qualified with the "Microsoft.Dynamics.CRM" namespace.
+func writeOperationPath(tableName string, id string, operation string) string {
+	if len(tableName) == 0 {
+		return operation
+	}
+
+	path := tableName
+	if len(id) > 0 {
+		path = fmt.Sprintf("%v(%v)", path, id)
+	}
+	if !strings.Contains(strings.SplitN(operation, "(", 2)[0], ".") {
+		operation = "Microsoft.Dynamics.CRM." + operation
+	}
+	return fmt.Sprintf("%v/%v", path, operation)
+}
+
+// writeFunctionCall converts a function name and its parameters into the function call syntax,
+// passing every value through a parameter alias.
+//
+// Example:
+//
+//	call, _ := writeFunctionCall("RetrieveTotalRecordCount", map[string]any{"EntityNames": []string{"account"}})
+//	fmt.Println(call) // RetrieveTotalRecordCount(EntityNames=@p1)?@p1=%5B%22account%22%5D
+func writeFunctionCall(name string, parameters map[string]any) (call string, err error) {
+	keys := make([]string, 0, len(parameters))
+	for key := range parameters {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	aliases := make([]string, len(keys))
+	values := make([]string, len(keys))
+	for i, key := range keys {
+		literal, errLiteral := writeFunctionLiteral(parameters[key])
+		if errLiteral != nil {
+			err = errLiteral
+			return
+		}
+		aliases[i] = fmt.Sprintf("%v=@p%v", key, i+1)
+		values[i] = fmt.Sprintf("@p%v=%v", i+1, url.QueryEscape(literal))
+	}
+
+	call = fmt.Sprintf("%v(%v)", name, strings.Join(aliases, ","))
+	if len(values) > 0 {
+		call = fmt.Sprintf("%v?%v", call, strings.Join(values, "&"))
+	}
+	return
+}
+
+// resolveFunctionParameters returns a copy of the parameters of a function where every 'EntityReference' value,
+// or pointer to one, is resolved, e.g. for a reference read from a lookup with its logical name only.
+func resolveFunctionParameters(auth Authorization, parameters map[string]any) (resolved map[string]any, err error) {
+	resolved = make(map[string]any, len(parameters))
+
+	for key, value := range parameters {
+		var ref EntityReference
+		switch v := value.(type) {
+		case EntityReference:
+			ref = v
+		case *EntityReference:
+			if v == nil {
+				err = fmt.Errorf("Empty entity reference for %v", key)
+				return
+			}
+			ref = *v
+		default:
+			resolved[key] = value
+			continue
+		}
+		if resolved[key], err = ref.resolve(auth); err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+// writeFunctionLiteral converts a parameter value into its representation in a function call.
+func writeFunctionLiteral(value any) (literal string, err error) {
+	switch v := value.(type) {
+	case nil:
+		literal = "null"
+	case Literal:
+		literal = string(v)
+	case string:
+		literal = fmt.Sprintf("'%v'", strings.ReplaceAll(v, "'", "''"))
+	case bool, int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64, float32, float64, json.Number, Decimal:
+		literal = fmt.Sprintf("%v", v)
+	case Money:
+		literal = v.Amount.String()
+	case time.Time:
+		literal = v.Format(time.RFC3339)
+	case EntityReference:
+		literal = fmt.Sprintf(`{"@odata.id":"%v"}`, strings.TrimPrefix(writeEntityReference(v), "/"))
+	default:
+		jsonStr, errMarsh := json.Marshal(v)
+		if errMarsh != nil {
+			err = errMarsh
+			return
+		}
+		literal = string(jsonStr)
+	}
+	return
+}
+
+// writeActionPayload returns a copy of the action parameters where every 'EntityReference' value, or pointer
+// to one, is replaced by the typed entity expected by the action, using the table metadata.
+func writeActionPayload(auth Authorization, parameters map[string]any) (payload map[string]any, err error) {
+	payload = make(map[string]any, len(parameters))
+
+	for key, value := range parameters {
+		var ref EntityReference
+		switch v := value.(type) {
+		case EntityReference:
+			ref = v
+		case *EntityReference:
+			if v == nil {
+				err = fmt.Errorf("Empty entity reference for %v", key)
+				return
+			}
+			ref = *v
+		default:
+			payload[key] = value
+			continue
+		}
+		if !ref.isSet() {
+			err = fmt.Errorf("Empty entity reference for %v", key)
+			return
+		}
+		if ref, err = ref.resolve(auth); err != nil {
+			return
+		}
+
+		def, errDef := RetrieveEntityDefinition(auth, ref.TableName)
+		if errDef != nil {
+			err = errDef
+			return
+		}
+
+		entity := map[string]any{
+			"@odata.type": "Microsoft.Dynamics.CRM." + def.LogicalName,
+		}
+		if len(ref.Id) > 0 {
+			entity[def.PrimaryIdAttribute] = ref.Id
+		}
+		for k, v := range ref.AlternateKeys {
+			entity[k] = v
+		}
+		payload[key] = entity
+	}
+
+	return
+}
@@ -1,8 +1,115 @@
 package dataversego
 
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+)
+
 type BatchObject struct {
-	predicate string
-	table     string
-	idrow     string
-	object    map[string]any
+	predicate    string
+	table        string
+	idrow        string
+	object       map[string]any
+	relationship string
+	target       *EntityReference
+}
+
+// NewAssociateBatchObject creates a batch object that associates an entry to a source entry through a relationship.
+//
+// It takes the following arguments:
+//   - tableName: the name of the table of the source entry
+//   - id: the ID of the source entry
+//   - relationship: the navigation property of the relationship
+//   - target: a struct representing the entry to associate
+//
+// Example:
+//
+//	obj := NewAssociateBatchObject("lists", "123", "listcontact_association", EntityReference{TableName: "contacts", Id: "456"})
+func NewAssociateBatchObject(tableName string, id string, relationship string, target EntityReference) BatchObject {
+	return BatchObject{
+		predicate:    "POST",
+		table:        tableName,
+		idrow:        id,
+		relationship: relationship,
+		target:       &target,
+	}
+}
+
+// NewDisassociateBatchObject creates a batch object that removes the association between a source entry
+// and an entry through a relationship. Pass a nil target to clear a single-valued navigation property.
+//
+// It takes the following arguments:
+//   - tableName: the name of the table of the source entry
+//   - id: the ID of the source entry
+//   - relationship: the navigation property of the relationship
+//   - target: a pointer to a struct representing the entry to disassociate
+//
+// Example:
+//
+//	obj := NewDisassociateBatchObject("lists", "123", "listcontact_association", &EntityReference{TableName: "contacts", Id: "456"})
+func NewDisassociateBatchObject(tableName string, id string, relationship string, target *EntityReference) BatchObject {
+	return BatchObject{
+		predicate:    "DELETE",
+		table:        tableName,
+		idrow:        id,
+		relationship: relationship,
+		target:       target,
+	}
+}
+
+// path returns the resource path of the operation, relative to the Web API root.
+func (b BatchObject) path(auth Authorization) (path string) {
+	path = b.table
+	if len(b.idrow) > 0 {
+		path = fmt.Sprintf("%v(%v)", path, b.idrow)
+	}
+	if len(b.relationship) > 0 {
+		path = fmt.Sprintf("%v/%v/$ref", path, b.relationship)
+		if b.predicate == "DELETE" && b.target != nil {
+			path = fmt.Sprintf("%v?$id=%v", path, url.QueryEscape(writeEntityUrl(auth, *b.target)))
+		}
+	}
+	return
+}
+
+// body returns the payload of the operation.
+func (b BatchObject) body(auth Authorization) map[string]any {
+	if len(b.relationship) > 0 && b.predicate == "POST" && b.target != nil {
+		return map[string]any{
+			"@odata.id": writeEntityUrl(auth, *b.target),
+		}
+	}
+	return b.object
+}
+
+// part returns the changeset part of the operation, with its Content-ID. The operations without a payload
+// (deletions and disassociations) are sent without a Content-Type and a body.
+func (b BatchObject) part(auth Authorization, contentId int) (part string, err error) {
+	part += "Content-Type: application/http\n"
+	part += "Content-Transfer-Encoding:binary\n"
+	part += fmt.Sprintf("Content-ID: %v\n\n", contentId)
+	part += fmt.Sprintf("%v %v/%v HTTP/1.1\n", b.predicate, auth.apiUrl(), b.path(auth))
+
+	row := b.body(auth)
+	if row == nil {
+		part += "\n"
+		return
+	}
+
+	// Replace the entity references with the corresponding @odata.bind keys.
+	if len(b.relationship) == 0 {
+		if row, err = bindEntityReferences(auth, b.table, row); err != nil {
+			return
+		}
+	}
+
+	// Marshal the `row` data into a JSON string.
+	jsonStr, err := json.Marshal(row)
+	if err != nil {
+		return
+	}
+	part += "Content-Type: application/json\n\n"
+	part += fmt.Sprintf("%v\n", string(jsonStr))
+	return
 }
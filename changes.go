@@ -0,0 +1,328 @@
+package dataversego
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/emaporta/dataversego/requests"
+)
+
+// ChangeKind represents the kind of a change returned by change tracking.
+type ChangeKind int
+
+const (
+	// ChangeUpserted is a new or updated entry.
+	ChangeUpserted ChangeKind = iota
+	// ChangeDeleted is a deleted entry ($deletedEntity tombstone).
+	ChangeDeleted
+)
+
+// The 'ChangeEvent' struct represents a change of an entry returned by change tracking.
+// It contains the following fields:
+//   - Kind: the kind of change (ChangeUpserted or ChangeDeleted)
+//   - Id: the ID of the changed entry
+//   - Row: a map of strings to interface{} values representing the entry, nil for deleted entries
+type ChangeEvent struct {
+	Kind ChangeKind
+	Id   string
+	Row  map[string]any
+}
+
+// DeltaTokenStore persists the delta tokens of change tracking, so an incremental sync can resume after a restart.
+//
+// Load returns an empty token when no token was saved for the key.
+type DeltaTokenStore interface {
+	Load(key string) (token string, err error)
+	Save(key string, token string) error
+}
+
+// The 'FileDeltaTokenStore' struct is a 'DeltaTokenStore' that keeps the delta tokens in a JSON file.
+// It contains the following fields:
+//   - Path: the path of the JSON file, created on the first save
+type FileDeltaTokenStore struct {
+	Path string
+	mu   sync.Mutex
+}
+
+// Load returns the delta token saved for the key, or an empty token if none was saved.
+func (s *FileDeltaTokenStore) Load(key string) (token string, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tokens, err := s.read()
+	token = tokens[key]
+	return
+}
+
+// Save saves the delta token for the key, replacing the file atomically.
+func (s *FileDeltaTokenStore) Save(key string, token string) (err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tokens, err := s.read()
+	if err != nil {
+		return
+	}
+	tokens[key] = token
+
+	jsonStr, err := json.MarshalIndent(tokens, "", "  ")
+	if err != nil {
+		return
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(s.Path), filepath.Base(s.Path)+".*.tmp")
+	if err != nil {
+		return
+	}
+	defer os.Remove(tmp.Name())
+	if _, err = tmp.Write(jsonStr); err != nil {
+		tmp.Close()
+		return
+	}
+	if err = tmp.Close(); err != nil {
+		return
+	}
+	err = os.Rename(tmp.Name(), s.Path)
+	return
+}
+
+func (s *FileDeltaTokenStore) read() (tokens map[string]string, err error) {
+	tokens = map[string]string{}
+	content, err := os.ReadFile(s.Path)
+	if errors.Is(err, os.ErrNotExist) {
+		err = nil
+		return
+	}
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal(content, &tokens)
+	return
+}
+
+// RetrieveChanges retrieves the entries of a dataverse table changed since a delta token, using change tracking.
+//
+// It takes a single argument of type 'RetrieveChangesSignature', which is a struct containing the following fields:
+//   - Auth: a struct containing authentication information
+//   - TableName: the name of the table to retrieve the changes from, change tracking must be enabled on the table
+//   - Columns: a slice of strings representing the columns to be retrieved
+//   - ColumnsString: a string representing the columns to be retrieved (comma separated)
+//   - DeltaToken: the delta token returned by the previous call, empty to retrieve all the entries
+//   - Options: the 'requests.RequestOptions' of the requests (impersonation, MSCRM headers)
+//
+// The return value is a slice of 'ChangeEvent' structs, the delta token to use for the next call, and an error value, which will be nil if the function completed successfully.
+//
+// Example:
+//
+//	changes, token, err := RetrieveChanges(RetrieveChangesSignature{
+//	  Auth: Auth{Token: "Token", Url: "https://url.crm.dynamics.com"},
+//	  TableName: "contacts",
+//	  Columns: []string{"fullname"},
+//	})
+//	if err != nil {
+//	  log.Fatal(err)
+//	}
+//	fmt.Println(changes, token)
+func RetrieveChanges(parameter RetrieveChangesSignature) (changes []ChangeEvent, deltaToken string, err error) {
+	parameter.Auth = parameter.Auth.withOptions(parameter.Options).withOperation("RetrieveChanges", parameter.TableName)
+	defer func() { parameter.Auth.endOperation(err) }()
+	if !parameter.Auth.isSet() {
+		err = errors.New("Empty auth")
+		return
+	}
+	if len(parameter.TableName) == 0 {
+		err = errors.New("Empty table")
+		return
+	}
+	selectStatement := parameter.ColumnsString
+	if len(parameter.Columns) > 0 {
+		selectStatement = strings.Join(parameter.Columns, ",")
+	}
+
+	deltaToken, err = retrieveChanges(parameter.Auth, parameter.TableName, selectStatement, parameter.DeltaToken, func(page []ChangeEvent) error {
+		changes = append(changes, page...)
+		return nil
+	})
+	return
+}
+
+// SyncChanges performs an incremental sync of a dataverse table: it loads the delta token from the store,
+// retrieves the changes page by page, passes them to the handler as they arrive and saves the new delta token
+// once every change was handled.
+//
+// It takes a single argument of type 'SyncChangesSignature', which is a struct containing the following fields:
+//   - Auth: a struct containing authentication information
+//   - TableName: the name of the table to sync, change tracking must be enabled on the table
+//   - Columns: a slice of strings representing the columns to be retrieved
+//   - ColumnsString: a string representing the columns to be retrieved (comma separated)
+//   - Store: the 'DeltaTokenStore' where the delta token is persisted
+//   - Key: the key of the delta token in the store, TableName if empty
+//   - Handler: a function called for every change, in order. Returning an error stops the sync without saving the token.
+//   - Options: the 'requests.RequestOptions' of the requests (impersonation, MSCRM headers)
+//
+// If the saved token has expired, the service answers with an error: remove the token from the store to start a full sync.
+//
+// The return value is an error value, which will be nil if the function completed successfully.
+//
+// Example:
+//
+//	err := SyncChanges(SyncChangesSignature{
+//	  Auth: Auth{Token: "Token", Url: "https://url.crm.dynamics.com"},
+//	  TableName: "contacts",
+//	  Store: &FileDeltaTokenStore{Path: "tokens.json"},
+//	  Handler: func(change ChangeEvent) error {
+//	    fmt.Println(change)
+//	    return nil
+//	  },
+//	})
+//	if err != nil {
+//	  log.Fatal(err)
+//	}
+func SyncChanges(parameter SyncChangesSignature) (err error) {
+	parameter.Auth = parameter.Auth.withOptions(parameter.Options).withOperation("SyncChanges", parameter.TableName)
+	defer func() { parameter.Auth.endOperation(err) }()
+	if !parameter.Auth.isSet() {
+		err = errors.New("Empty auth")
+		return
+	}
+	if len(parameter.TableName) == 0 {
+		err = errors.New("Empty table")
+		return
+	}
+	if parameter.Store == nil {
+		err = errors.New("Empty store")
+		return
+	}
+	if parameter.Handler == nil {
+		err = errors.New("Empty handler")
+		return
+	}
+	key := parameter.Key
+	if len(key) == 0 {
+		key = parameter.TableName
+	}
+
+	token, err := parameter.Store.Load(key)
+	if err != nil {
+		return
+	}
+
+	selectStatement := parameter.ColumnsString
+	if len(parameter.Columns) > 0 {
+		selectStatement = strings.Join(parameter.Columns, ",")
+	}
+
+	// The changes are handled page by page, the token is saved once the last page was handled.
+	token, err = retrieveChanges(parameter.Auth, parameter.TableName, selectStatement, token, func(page []ChangeEvent) (err error) {
+		for _, change := range page {
+			if err = parameter.Handler(change); err != nil {
+				return
+			}
+		}
+		return
+	})
+	if err != nil {
+		return
+	}
+
+	err = parameter.Store.Save(key, token)
+	return
+}
+
+// INTERNAL METHODS
+
+// retrieveChanges retrieves the changes of a table since a delta token, passing every page of changes to the
+// handler as it arrives, and returns the new delta token.
+func retrieveChanges(auth Authorization, tableName string, columns string, deltaToken string, handle func(page []ChangeEvent) error) (newDeltaToken string, err error) {
+	def, err := RetrieveEntityDefinition(auth, tableName)
+	if err != nil {
+		return
+	}
+
+	path := fmt.Sprintf("%v/%v", auth.apiPath(), tableName)
+	query := url.Values{}
+	if len(columns) > 0 {
+		query.Set("$select", columns)
+	}
+	if len(deltaToken) > 0 {
+		query.Set("$deltatoken", deltaToken)
+	}
+	headers := map[string]string{
+		"Prefer": "odata.track-changes",
+	}
+
+	// Follow the pages until the delta link is returned.
+	for len(path) > 0 {
+		resp, errGet := auth.do(requests.Request{
+			Method:  "GET",
+			Path:    path,
+			Query:   query,
+			Headers: headers,
+		})
+		if errGet != nil {
+			err = errGet
+			return
+		}
+		ent := resp.Value
+
+		var page []ChangeEvent
+		values, _ := ent["value"].([]any)
+		for _, value := range values {
+			row, ok := value.(map[string]any)
+			if !ok {
+				continue
+			}
+			context, _ := row["@odata.context"].(string)
+			if strings.HasSuffix(context, "$deletedEntity") {
+				id, _ := row["id"].(string)
+				page = append(page, ChangeEvent{Kind: ChangeDeleted, Id: id})
+				continue
+			}
+			id, _ := row[def.PrimaryIdAttribute].(string)
+			page = append(page, ChangeEvent{Kind: ChangeUpserted, Id: id, Row: row})
+		}
+		if err = handle(page); err != nil {
+			return
+		}
+
+		// The next page is requested with the path and the query of the next link.
+		path, query = "", nil
+		if nextLink, ok := ent["@odata.nextLink"].(string); ok {
+			parsed, errParse := url.Parse(nextLink)
+			if errParse != nil {
+				err = errParse
+				return
+			}
+			path, query = parsed.Path, parsed.Query()
+		}
+		if deltaLink, ok := ent["@odata.deltaLink"].(string); ok {
+			newDeltaToken, err = readDeltaToken(deltaLink)
+			if err != nil {
+				return
+			}
+		}
+	}
+
+	if len(newDeltaToken) == 0 {
+		err = fmt.Errorf("No delta link returned for table %v, change tracking may be disabled", tableName)
+	}
+	return
+}
+
+// readDeltaToken extracts the $deltatoken query option from a delta link.
+func readDeltaToken(deltaLink string) (token string, err error) {
+	parsed, err := url.Parse(deltaLink)
+	if err != nil {
+		return
+	}
+	token = parsed.Query().Get("$deltatoken")
+	if len(token) == 0 {
+		err = fmt.Errorf("No delta token in %v", deltaLink)
+	}
+	return
+}
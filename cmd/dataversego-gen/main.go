@@ -0,0 +1,75 @@
+// Command dataversego-gen generates typed Go stubs for the custom APIs of a Dataverse organization.
+//
+// Usage:
+//
+//	dataversego-gen -client CLIENTID -secret SECRET -tenant TENANTID -url ORGURL -package customapis -out customapis.go [-names new_A,new_B]
+//
+// It can be used with go:generate:
+//
+//	//go:generate go run github.com/emaporta/dataversego/cmd/dataversego-gen -package customapis -out customapis.go
+//
+// The client ID, secret, tenant ID and organization URL default to the DATAVERSE_CLIENT_ID,
+// DATAVERSE_CLIENT_SECRET, DATAVERSE_TENANT_ID and DATAVERSE_URL environment variables.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/emaporta/dataversego"
+)
+
+func main() {
+	if err := run(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// run generates the stubs, the output file is removed if the generation fails.
+func run() (err error) {
+	client := flag.String("client", os.Getenv("DATAVERSE_CLIENT_ID"), "client ID of the application user")
+	secret := flag.String("secret", os.Getenv("DATAVERSE_CLIENT_SECRET"), "client secret of the application user")
+	tenant := flag.String("tenant", os.Getenv("DATAVERSE_TENANT_ID"), "tenant ID")
+	orgUrl := flag.String("url", os.Getenv("DATAVERSE_URL"), "organization URL")
+	packageName := flag.String("package", "customapis", "package name of the generated file")
+	out := flag.String("out", "", "output file, standard output if empty")
+	names := flag.String("names", "", "comma separated unique names of the custom APIs, all if empty")
+	flag.Parse()
+
+	auth, err := dataversego.Authenticate(*client, *secret, *tenant, *orgUrl)
+	if err != nil {
+		return
+	}
+
+	var uniqueNames []string
+	if len(*names) > 0 {
+		uniqueNames = strings.Split(*names, ",")
+	}
+	apis, err := dataversego.RetrieveCustomAPIs(dataversego.RetrieveCustomAPIsSignature{
+		Auth:        auth,
+		UniqueNames: uniqueNames,
+	})
+	if err != nil {
+		return
+	}
+
+	if len(*out) == 0 {
+		return dataversego.GenerateCustomAPIStubs(os.Stdout, *packageName, apis)
+	}
+
+	w, err := os.Create(*out)
+	if err != nil {
+		return
+	}
+	err = dataversego.GenerateCustomAPIStubs(w, *packageName, apis)
+	if errClose := w.Close(); err == nil {
+		err = errClose
+	}
+	if err != nil {
+		os.Remove(*out)
+	}
+	return
+}
@@ -0,0 +1,153 @@
+package dataversego
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+
+	"github.com/emaporta/dataversego/requests"
+)
+
+// Binding types of a custom API, as stored in the 'bindingtype' column.
+const (
+	CustomAPIBindingGlobal           = 0
+	CustomAPIBindingEntity           = 1
+	CustomAPIBindingEntityCollection = 2
+)
+
+// Types of custom API request parameters and response properties, as stored in the 'type' column.
+const (
+	CustomAPITypeBoolean          = 0
+	CustomAPITypeDateTime         = 1
+	CustomAPITypeDecimal          = 2
+	CustomAPITypeEntity           = 3
+	CustomAPITypeEntityCollection = 4
+	CustomAPITypeEntityReference  = 5
+	CustomAPITypeFloat            = 6
+	CustomAPITypeInteger          = 7
+	CustomAPITypeMoney            = 8
+	CustomAPITypePicklist         = 9
+	CustomAPITypeString           = 10
+	CustomAPITypeStringArray      = 11
+	CustomAPITypeGuid             = 12
+)
+
+// The 'CustomAPI' struct represents the definition of a custom API.
+// It contains the following fields:
+//   - UniqueName: the unique name of the custom API, used to invoke it
+//   - DisplayName: the display name of the custom API
+//   - Description: the description of the custom API
+//   - BindingType: the binding type of the custom API (see the CustomAPIBinding constants)
+//   - BoundEntityLogicalName: the logical name of the table the custom API is bound to
+//   - BoundEntitySetName: the name of the entity set the custom API is bound to
+//   - IsFunction: a boolean value indicating whether the custom API is a function or an action
+//   - RequestParameters: a slice of 'CustomAPIParameter' structs representing the request parameters
+//   - ResponseProperties: a slice of 'CustomAPIParameter' structs representing the response properties
+type CustomAPI struct {
+	UniqueName             string               `json:"uniquename"`
+	DisplayName            string               `json:"displayname"`
+	Description            string               `json:"description"`
+	BindingType            int                  `json:"bindingtype"`
+	BoundEntityLogicalName string               `json:"boundentitylogicalname"`
+	BoundEntitySetName     string               `json:"-"`
+	IsFunction             bool                 `json:"isfunction"`
+	RequestParameters      []CustomAPIParameter `json:"CustomAPIRequestParameters"`
+	ResponseProperties     []CustomAPIParameter `json:"CustomAPIResponseProperties"`
+}
+
+// The 'CustomAPIParameter' struct represents a request parameter or a response property of a custom API.
+// It contains the following fields:
+//   - UniqueName: the unique name of the parameter, used as key in the payload
+//   - Description: the description of the parameter
+//   - Type: the type of the parameter (see the CustomAPIType constants)
+//   - LogicalEntityName: the logical name of the table for entity typed parameters
+//   - IsOptional: a boolean value indicating whether the parameter is optional (request parameters only)
+type CustomAPIParameter struct {
+	UniqueName        string `json:"uniquename"`
+	Description       string `json:"description"`
+	Type              int    `json:"type"`
+	LogicalEntityName string `json:"logicalentityname"`
+	IsOptional        bool   `json:"isoptional"`
+}
+
+// RetrieveCustomAPIs retrieves the custom API definitions, with their request parameters and response properties.
+//
+// It takes a single argument of type 'RetrieveCustomAPIsSignature', which is a struct containing the following fields:
+//   - Auth: a struct containing authentication information
+//   - UniqueNames: an optional slice of strings to restrict the custom APIs retrieved
+//   - Options: the 'requests.RequestOptions' of the requests (impersonation, MSCRM headers)
+//
+// The return value is a slice of 'CustomAPI' structs, and an error value, which will be nil if the function completed successfully.
+//
+// Example:
+//
+//	apis, err := RetrieveCustomAPIs(RetrieveCustomAPIsSignature{
+//	  Auth: Auth{Token: "Token", Url: "https://url.crm.dynamics.com"},
+//	  UniqueNames: []string{"new_DoSomething"},
+//	})
+//	if err != nil {
+//	  log.Fatal(err)
+//	}
+//	fmt.Println(apis)
+func RetrieveCustomAPIs(parameter RetrieveCustomAPIsSignature) (apis []CustomAPI, err error) {
+	parameter.Auth = parameter.Auth.withOptions(parameter.Options).withOperation("RetrieveCustomAPIs", "")
+	defer func() { parameter.Auth.endOperation(err) }()
+	if !parameter.Auth.isSet() {
+		err = errors.New("Empty auth")
+		return
+	}
+
+	filter := Filter{Kind: "or"}
+	for _, name := range parameter.UniqueNames {
+		filter.Conditions = append(filter.Conditions, Condition{Key: "uniquename", Condition: "eq", Value: fmt.Sprintf("'%v'", name)})
+	}
+	filterStatement := ""
+	if len(filter.Conditions) > 0 {
+		filterStatement = writeFilter(filter)
+	}
+
+	apis, err = retrieveCustomAPIs(parameter.Auth, filterStatement)
+	return
+}
+
+// INTERNAL METHODS
+
+func retrieveCustomAPIs(auth Authorization, filter string) (apis []CustomAPI, err error) {
+	query := url.Values{
+		"$select": {"uniquename,displayname,description,bindingtype,boundentitylogicalname,isfunction"},
+		"$expand": {"CustomAPIRequestParameters($select=uniquename,description,type,logicalentityname,isoptional),CustomAPIResponseProperties($select=uniquename,description,type,logicalentityname)"},
+	}
+	if len(filter) > 0 {
+		query.Set("$filter", filter)
+	}
+	resp, err := auth.do(requests.Request{
+		Method: "GET",
+		Path:   auth.apiPath() + "/customapis",
+		Query:  query,
+	})
+	if err != nil {
+		return
+	}
+	ent := resp.Value
+
+	var result struct {
+		Value []CustomAPI `json:"value"`
+	}
+	if err = decodeMap(ent, &result); err != nil {
+		return
+	}
+	apis = result.Value
+
+	// Bound custom APIs are invoked through the entity set, not the logical name.
+	for i := range apis {
+		if apis[i].BindingType == CustomAPIBindingGlobal || len(apis[i].BoundEntityLogicalName) == 0 {
+			continue
+		}
+		apis[i].BoundEntitySetName, err = retrieveEntitySetName(auth, apis[i].BoundEntityLogicalName)
+		if err != nil {
+			return
+		}
+	}
+
+	return
+}
@@ -1,10 +1,23 @@
 package dataversego
 
 import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
 	"regexp"
+	"strconv"
 	"strings"
 	"testing"
+	"time"
+
+	"github.com/emaporta/dataversego/dataversetest"
+	"github.com/emaporta/dataversego/requests"
 )
 
 func TestFilterFunction(t *testing.T) {
@@ -55,23 +68,41 @@ func TestIsSetFilter(t *testing.T) {
 }
 
 func TestRetrieve(t *testing.T) {
+	server := dataversetest.NewServer()
+	defer server.Close()
+	id := server.Insert("contacts", map[string]any{"firstname": "test", "lastname": "fromgo"})
+
 	retrieveParams := RetrieveSignature{
-		Auth:          Authorization{Token: "AAAA", Url: "fakeurl", Expiration: 123},
-		TableName:     "aaaa",
-		Id:            "123",
-		ColumnsString: "",
+		Auth:          Authorization{Token: "AAAA", Url: server.URL, Expiration: 123},
+		TableName:     "contacts",
+		Id:            id,
+		ColumnsString: "lastname",
 		Printerror:    false,
 	}
 	ent, err := Retrieve(retrieveParams)
 	if err != nil {
 		t.Fatalf("%v", err)
 	}
-	if ent["isfake"] != true {
-		t.Fatalf("Not fake, something went wrong: %v", ent)
+	if ent["lastname"] != "fromgo" || ent["contactid"] != id {
+		t.Fatalf("Wrong entry: %v", ent)
+	}
+	if _, ok := ent["firstname"]; ok {
+		t.Fatalf("Column not selected returned: %v", ent)
+	}
+
+	retrieveParams.Id = "00000000-0000-0000-0000-000000000000"
+	if _, err = Retrieve(retrieveParams); err == nil {
+		t.Fatalf("Expected error for missing entry")
 	}
 }
 
 func TestRetrieveMultiple(t *testing.T) {
+	server := dataversetest.NewServer()
+	defer server.Close()
+	for _, name := range []string{"Kate", "Carl", "John", "Claire"} {
+		server.Insert("contacts", map[string]any{"fullname": name})
+	}
+
 	filter := Filter{
 		Kind:       "or",
 		Conditions: []Condition{{Key: "startswith(fullname,'K')"}, {Key: "startswith(fullname,'C')"}},
@@ -79,8 +110,8 @@ func TestRetrieveMultiple(t *testing.T) {
 	columns := []string{"fullname"}
 
 	retrieveParams := RetrieveMultipleSignature{
-		Auth:      Authorization{Token: "AAAA", Url: "fakeurl", Expiration: 123},
-		TableName: "aaaa",
+		Auth:      Authorization{Token: "AAAA", Url: server.URL, Expiration: 123},
+		TableName: "contacts",
 		Columns:   columns,
 		Filter:    filter,
 	}
@@ -88,14 +119,16 @@ func TestRetrieveMultiple(t *testing.T) {
 	if err != nil {
 		t.Fatalf("%v", err)
 	}
-	if ent["isfake"] != true {
-		t.Fatalf("Not fake, something went wrong: %v", ent)
+	values := ent["value"].([]any)
+	if len(values) != 3 || values[0].(map[string]any)["fullname"] != "Kate" {
+		t.Fatalf("Wrong entries: %v", ent)
 	}
 }
 
 func TestCreate(t *testing.T) {
-
-	auth := Authenticate(conf_appid, conf_secret, conf_tenant, conf_url)
+	server := dataversetest.NewServer()
+	defer server.Close()
+	auth := Authorization{Token: "AAAA", Url: server.URL, Expiration: 123}
 
 	createParams := CreateUpdateSignature{
 		Auth:      auth,
@@ -117,6 +150,9 @@ func TestCreate(t *testing.T) {
 	if !(len(matches) > 0) {
 		t.Fatalf("Not valid ID: %v", id)
 	}
+	if row, ok := server.Row("contacts", id); !ok || row["lastname"] != "fromgo" {
+		t.Fatalf("Entry not created: %v", row)
+	}
 
 	deleteParams := DeleteSignature{
 		Auth:       auth,
@@ -129,11 +165,15 @@ func TestCreate(t *testing.T) {
 	if err != nil {
 		t.Fatalf("%v", err)
 	}
+	if _, ok := server.Row("contacts", id); ok {
+		t.Fatalf("Entry not deleted")
+	}
 }
 
 func TestUpdate(t *testing.T) {
-
-	auth := Authenticate(conf_appid, conf_secret, conf_tenant, conf_url)
+	server := dataversetest.NewServer()
+	defer server.Close()
+	auth := Authorization{Token: "AAAA", Url: server.URL, Expiration: 123}
 
 	createParams := CreateUpdateSignature{
 		Auth:      auth,
@@ -175,26 +215,23 @@ func TestUpdate(t *testing.T) {
 	if !(len(matches) > 0) {
 		t.Fatalf("Not valid ID: %v", id)
 	}
-
-	deleteParams := DeleteSignature{
-		Auth:       auth,
-		TableName:  "contacts",
-		Id:         id,
-		Printerror: true,
+	if row, _ := server.Row("contacts", id); row["firstname"] != "test" || row["lastname"] != "fromgo_updated" {
+		t.Fatalf("Entry not updated: %v", row)
 	}
 
-	err = Delete(deleteParams)
-	if err != nil {
-		t.Fatalf("%v", err)
+	// A concurrent update is refused.
+	server.InjectFault(dataversetest.Fault{Method: "PATCH", StatusCode: http.StatusPreconditionFailed, Times: 1})
+	if _, err = CreateUpdate(updateParams); err == nil || !strings.Contains(err.Error(), "412") {
+		t.Fatalf("Expected precondition failed error: %v", err)
 	}
 }
 
 func TestDelete(t *testing.T) {
-
-	auth := Authenticate(conf_appid, conf_secret, conf_tenant, conf_url)
+	server := dataversetest.NewServer()
+	defer server.Close()
 
 	deleteParams := DeleteSignature{
-		Auth:       auth,
+		Auth:       Authorization{Token: "AAAA", Url: server.URL, Expiration: 123},
 		TableName:  "contacts",
 		Id:         "3b33503f-7481-ed11-81ac-00224888b9a9",
 		Printerror: true,
@@ -208,7 +245,9 @@ func TestDelete(t *testing.T) {
 }
 
 func TestBatch(t *testing.T) {
-	auth := Authenticate(conf_appid, conf_secret, conf_tenant, conf_url)
+	server := dataversetest.NewServer()
+	defer server.Close()
+	auth := Authorization{Token: "AAAA", Url: server.URL, Expiration: 123}
 
 	var arrObject [5]BatchObject
 
@@ -231,8 +270,1238 @@ func TestBatch(t *testing.T) {
 
 	err := Batch(batchParams)
 	if err != nil {
-		t.Fatalf("%v", "Expected error!")
-	} else {
-		t.Logf("Success!")
+		t.Fatalf("%v", err)
+	}
+	rows := server.Rows("contacts")
+	if len(rows) != 5 || rows[4]["lastname"] != "fromgo_4" {
+		t.Fatalf("Wrong entries: %v", rows)
+	}
+
+	// The change set is rolled back when an operation fails.
+	server.InjectFault(dataversetest.Fault{Method: "POST", Path: "contacts", StatusCode: http.StatusPreconditionFailed, Times: 1})
+	if err = Batch(batchParams); err == nil {
+		t.Fatalf("Expected error")
+	}
+	if rows = server.Rows("contacts"); len(rows) != 5 {
+		t.Fatalf("Change set not rolled back: %v", len(rows))
+	}
+}
+
+func TestWriteEntityReference(t *testing.T) {
+	path := writeEntityReference(EntityReference{TableName: "accounts", Id: "00000000-0000-0000-0000-000000000001"})
+	if path != "/accounts(00000000-0000-0000-0000-000000000001)" {
+		t.Fatalf("writeEntityReference = %q", path)
+	}
+
+	path = writeEntityReference(EntityReference{TableName: "accounts", AlternateKeys: map[string]any{"name": "O'Neil", "accountnumber": 12}})
+	if path != "/accounts(accountnumber=12,name='O''Neil')" {
+		t.Fatalf("writeEntityReference = %q", path)
+	}
+}
+
+func TestBindEntityReferences(t *testing.T) {
+	auth := Authorization{Token: "AAAA", Url: "https://bind.crm.dynamics.com", Expiration: 123}
+	entityDefinitionCache.Store(auth.Url+"|contacts", EntityDefinition{
+		LogicalName:   "contact",
+		EntitySetName: "contacts",
+		ManyToOneRelationships: []Relationship{
+			{ReferencingAttribute: "parentcustomerid", ReferencedEntity: "account", ReferencingEntityNavigationPropertyName: "parentcustomerid_account"},
+			{ReferencingAttribute: "parentcustomerid", ReferencedEntity: "contact", ReferencingEntityNavigationPropertyName: "parentcustomerid_contact"},
+		},
+	})
+	entityDefinitionCache.Store(auth.Url+"|accounts", EntityDefinition{LogicalName: "account", EntitySetName: "accounts"})
+
+	row := map[string]any{
+		"lastname":         "fromgo",
+		"parentcustomerid": EntityReference{TableName: "accounts", Id: "00000000-0000-0000-0000-000000000001"},
+	}
+	bound, err := bindEntityReferences(auth, "contacts", row)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if bound["parentcustomerid_account@odata.bind"] != "/accounts(00000000-0000-0000-0000-000000000001)" {
+		t.Fatalf("Wrong binding: %v", bound)
+	}
+	if _, ok := bound["parentcustomerid"]; ok {
+		t.Fatalf("Lookup key not removed: %v", bound)
+	}
+	if _, ok := row["parentcustomerid"]; !ok {
+		t.Fatalf("Original row modified: %v", row)
+	}
+
+	_, err = bindEntityReferences(auth, "contacts", map[string]any{"ownerid": EntityReference{TableName: "accounts", Id: "1"}})
+	if err == nil {
+		t.Fatalf("Expected error for unknown lookup")
+	}
+
+	var empty *EntityReference
+	_, err = bindEntityReferences(auth, "contacts", map[string]any{"parentcustomerid": empty})
+	if err == nil || err.Error() != "Empty entity reference for parentcustomerid" {
+		t.Fatalf("Expected error for nil lookup: %v", err)
+	}
+}
+
+func TestAssociate(t *testing.T) {
+	server := dataversetest.NewServer()
+	defer server.Close()
+	server.Insert("lists", map[string]any{"listid": "123"})
+
+	auth := Authorization{Token: "AAAA", Url: server.URL, Expiration: 123}
+	err := Associate(AssociateSignature{
+		Auth:         auth,
+		TableName:    "lists",
+		Id:           "123",
+		Relationship: "listcontact_association",
+		Targets:      []EntityReference{{TableName: "contacts", Id: "456"}, {TableName: "contacts", Id: "789"}},
+	})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if associated := server.Associations("lists", "123", "listcontact_association"); len(associated) != 2 || associated[0] != server.URL+"/api/data/v9.1/contacts(456)" {
+		t.Fatalf("Wrong associations: %v", associated)
+	}
+
+	err = Disassociate(DisassociateSignature{
+		Auth:         auth,
+		TableName:    "lists",
+		Id:           "123",
+		Relationship: "listcontact_association",
+		Targets:      []EntityReference{{TableName: "contacts", Id: "456"}},
+	})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if associated := server.Associations("lists", "123", "listcontact_association"); len(associated) != 1 || associated[0] != server.URL+"/api/data/v9.1/contacts(789)" {
+		t.Fatalf("Wrong associations: %v", associated)
+	}
+
+	err = Associate(AssociateSignature{Auth: auth, TableName: "lists", Id: "123", Relationship: "listcontact_association"})
+	if err == nil {
+		t.Fatalf("Expected error for empty targets")
+	}
+}
+
+func TestAssociateBatchObject(t *testing.T) {
+	auth := Authorization{Token: "AAAA", Url: "https://org.crm.dynamics.com", Expiration: 123}
+	target := EntityReference{TableName: "contacts", Id: "456"}
+
+	obj := NewAssociateBatchObject("lists", "123", "listcontact_association", target)
+	if obj.path(auth) != "lists(123)/listcontact_association/$ref" {
+		t.Fatalf("Wrong path: %v", obj.path(auth))
+	}
+	if obj.body(auth)["@odata.id"] != "https://org.crm.dynamics.com/api/data/v9.1/contacts(456)" {
+		t.Fatalf("Wrong body: %v", obj.body(auth))
+	}
+
+	obj = NewDisassociateBatchObject("lists", "123", "listcontact_association", &target)
+	want := "lists(123)/listcontact_association/$ref?$id=https%3A%2F%2Forg.crm.dynamics.com%2Fapi%2Fdata%2Fv9.1%2Fcontacts%28456%29"
+	if obj.path(auth) != want {
+		t.Fatalf("Wrong path: %v", obj.path(auth))
+	}
+	if obj.body(auth) != nil {
+		t.Fatalf("Unexpected body: %v", obj.body(auth))
+	}
+	part, err := obj.part(auth, 1)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	wantPart := "Content-Type: application/http\n" +
+		"Content-Transfer-Encoding:binary\n" +
+		"Content-ID: 1\n\n" +
+		"DELETE https://org.crm.dynamics.com/api/data/v9.1/" + want + " HTTP/1.1\n\n"
+	if part != wantPart {
+		t.Fatalf("Wrong part: %q", part)
+	}
+}
+
+func TestWriteFunctionCall(t *testing.T) {
+	call, err := writeFunctionCall("WhoAmI", nil)
+	if err != nil || call != "WhoAmI()" {
+		t.Fatalf("writeFunctionCall = %q, %v", call, err)
+	}
+
+	call, err = writeFunctionCall("RetrieveTotalRecordCount", map[string]any{"EntityNames": []string{"account", "contact"}})
+	want := "RetrieveTotalRecordCount(EntityNames=@p1)?@p1=%5B%22account%22%2C%22contact%22%5D"
+	if err != nil || call != want {
+		t.Fatalf("writeFunctionCall = %q, want %q", call, want)
+	}
+
+	call, err = writeFunctionCall("RetrieveUserPrivilegeByPrivilegeName", map[string]any{"PrivilegeName": "prvReadAccount", "Count": 2})
+	want = "RetrieveUserPrivilegeByPrivilegeName(Count=@p1,PrivilegeName=@p2)?@p1=2&@p2=%27prvReadAccount%27"
+	if err != nil || call != want {
+		t.Fatalf("writeFunctionCall = %q, want %q", call, want)
+	}
+}
+
+func TestWriteOperationPath(t *testing.T) {
+	if path := writeOperationPath("", "", "WhoAmI()"); path != "WhoAmI()" {
+		t.Fatalf("Wrong unbound path: %v", path)
+	}
+	if path := writeOperationPath("leads", "123", "QualifyLead"); path != "leads(123)/Microsoft.Dynamics.CRM.QualifyLead" {
+		t.Fatalf("Wrong bound path: %v", path)
+	}
+	if path := writeOperationPath("accounts", "", "new_Custom.Api"); path != "accounts/new_Custom.Api" {
+		t.Fatalf("Wrong qualified path: %v", path)
+	}
+}
+
+func TestExecuteFunction(t *testing.T) {
+	server := dataversetest.NewServer()
+	defer server.Close()
+	server.Handle("GET", "WhoAmI()", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]any{"UserId": "123"})
+	})
+
+	var response struct {
+		UserId string
+	}
+	_, err := ExecuteFunction(ExecuteFunctionSignature{
+		Auth:     Authorization{Token: "AAAA", Url: server.URL, Expiration: 123},
+		Name:     "WhoAmI",
+		Response: &response,
+	})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if response.UserId != "123" {
+		t.Fatalf("Wrong response: %v", response)
+	}
+}
+
+func TestExecuteWithLogicalNameReference(t *testing.T) {
+	server := dataversetest.NewServer()
+	defer server.Close()
+	server.AddEntitySet(dataversetest.EntitySet{Name: "accounts", LogicalName: "account", PrimaryIdAttribute: "accountid"})
+	var payload map[string]any
+	server.Handle("POST", "new_Check", func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&payload)
+		json.NewEncoder(w).Encode(map[string]any{})
+	})
+	var query string
+	server.Handle("GET", "new_Find(Account=@p1)", func(w http.ResponseWriter, r *http.Request) {
+		query = r.URL.Query().Get("@p1")
+		json.NewEncoder(w).Encode(map[string]any{})
+	})
+
+	// A reference read from a lookup only has the logical name of its table.
+	auth := Authorization{Token: "AAAA", Url: server.URL, Expiration: 123}
+	ref := EntityReference{LogicalName: "account", Id: "123"}
+	_, err := ExecuteAction(ExecuteActionSignature{Auth: auth, Name: "new_Check", Parameters: map[string]any{"Target": ref}})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if target, _ := payload["Target"].(map[string]any); target["@odata.type"] != "Microsoft.Dynamics.CRM.account" || target["accountid"] != "123" {
+		t.Fatalf("Wrong payload: %v", payload)
+	}
+
+	_, err = ExecuteFunction(ExecuteFunctionSignature{Auth: auth, Name: "new_Find", Parameters: map[string]any{"Account": ref}})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if query != `{"@odata.id":"accounts(123)"}` {
+		t.Fatalf("Wrong parameter: %v", query)
+	}
+}
+
+func TestWriteActionPayload(t *testing.T) {
+	auth := Authorization{Token: "AAAA", Url: "https://action.crm.dynamics.com", Expiration: 123}
+	entityDefinitionCache.Store(auth.Url+"|accounts", EntityDefinition{LogicalName: "account", EntitySetName: "accounts", PrimaryIdAttribute: "accountid"})
+
+	payload, err := writeActionPayload(auth, map[string]any{
+		"Target":                 EntityReference{TableName: "accounts", Id: "123"},
+		"PerformParentingChecks": false,
+	})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	target := payload["Target"].(map[string]any)
+	if target["@odata.type"] != "Microsoft.Dynamics.CRM.account" || target["accountid"] != "123" {
+		t.Fatalf("Wrong target: %v", target)
+	}
+	if payload["PerformParentingChecks"] != false {
+		t.Fatalf("Wrong payload: %v", payload)
+	}
+
+	// The optional entity parameters of the generated stubs are pointers.
+	payload, err = writeActionPayload(auth, map[string]any{"Target": &EntityReference{TableName: "accounts", Id: "456"}})
+	if target, _ := payload["Target"].(map[string]any); err != nil || target["accountid"] != "456" {
+		t.Fatalf("Wrong pointer target: %v %v", payload, err)
+	}
+	var empty *EntityReference
+	if _, err = writeActionPayload(auth, map[string]any{"Target": empty}); err == nil {
+		t.Fatalf("Expected error for nil reference")
+	}
+	if _, err = resolveFunctionParameters(auth, map[string]any{"Target": empty}); err == nil {
+		t.Fatalf("Expected error for nil reference")
+	}
+	parameters, err := resolveFunctionParameters(auth, map[string]any{"Target": &EntityReference{TableName: "accounts", Id: "456"}})
+	if ref, _ := parameters["Target"].(EntityReference); err != nil || ref.TableName != "accounts" || ref.Id != "456" {
+		t.Fatalf("Wrong pointer parameter: %v %v", parameters, err)
+	}
+}
+
+func TestGenerateCustomAPIStubs(t *testing.T) {
+	apis := []CustomAPI{
+		{
+			UniqueName:         "new_CalculateDiscount",
+			Description:        "Calculates the discount of an account.",
+			BindingType:        CustomAPIBindingEntity,
+			BoundEntitySetName: "accounts",
+			RequestParameters: []CustomAPIParameter{
+				{UniqueName: "Amount", Type: CustomAPITypeDecimal},
+				{UniqueName: "ValidUntil", Type: CustomAPITypeDateTime, IsOptional: true},
+				{UniqueName: "Contact", Type: CustomAPITypeEntityReference, IsOptional: true},
+			},
+			ResponseProperties: []CustomAPIParameter{
+				{UniqueName: "Discount", Type: CustomAPITypeDecimal},
+			},
+		},
+		{
+			UniqueName: "new_get_status",
+			IsFunction: true,
+			ResponseProperties: []CustomAPIParameter{
+				{UniqueName: "Status", Type: CustomAPITypeString},
+			},
+		},
+	}
+
+	var source strings.Builder
+	if err := GenerateCustomAPIStubs(&source, "customapis", apis); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	expected := []string{
+		"package customapis",
+		"\"time\"",
+		"type NewCalculateDiscountRequest struct",
+		"ValidUntil *time.Time",
+		"Contact    *dataversego.EntityReference",
+		"Discount dataversego.Decimal `json:\"Discount\"`",
+		"func NewCalculateDiscount(auth dataversego.Authorization, id string, request NewCalculateDiscountRequest) (response NewCalculateDiscountResponse, err error)",
+		"parameters[\"ValidUntil\"] = *request.ValidUntil",
+		"TableName:  \"accounts\"",
+		"func NewGetStatus(auth dataversego.Authorization, request NewGetStatusRequest) (response NewGetStatusResponse, err error)",
+		"dataversego.ExecuteFunction(dataversego.ExecuteFunctionSignature{",
+	}
+	for _, e := range expected {
+		if !strings.Contains(source.String(), e) {
+			t.Fatalf("Generated source doesn't contain %q:\n%v", e, source.String())
+		}
+	}
+
+	apis[0].RequestParameters[0].Type = 99
+	if err := GenerateCustomAPIStubs(&source, "customapis", apis); err == nil {
+		t.Fatalf("Expected error for unknown type")
+	}
+
+	collision := []CustomAPI{{UniqueName: "new_get_status"}, {UniqueName: "new_GetStatus"}}
+	if err := GenerateCustomAPIStubs(&source, "customapis", collision); err == nil {
+		t.Fatalf("Expected error for the same Go name")
+	}
+}
+
+func TestUploadDownloadFile(t *testing.T) {
+	var stored []byte
+	var actions []string
+	var patched http.Header
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "PATCH" {
+			patched = r.Header
+			stored, _ = io.ReadAll(r.Body)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		var payload map[string]any
+		json.NewDecoder(r.Body).Decode(&payload)
+		w.Header().Set("Content-Type", "application/json")
+
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/$value"):
+			var first, last int
+			fmt.Sscanf(r.Header.Get("Range"), "bytes=%d-%d", &first, &last)
+			if last >= len(stored) {
+				last = len(stored) - 1
+			}
+			w.Header().Set("x-ms-file-name", "notes.txt")
+			w.Header().Set("x-ms-file-size", strconv.Itoa(len(stored)))
+			w.WriteHeader(http.StatusPartialContent)
+			w.Write(stored[first : last+1])
+		case strings.HasSuffix(r.URL.Path, "/InitializeFileBlocksUpload"):
+			stored = nil
+			json.NewEncoder(w).Encode(map[string]any{"FileContinuationToken": "token"})
+		case strings.HasSuffix(r.URL.Path, "/UploadBlock"):
+			block, _ := base64.StdEncoding.DecodeString(payload["BlockData"].(string))
+			stored = append(stored, block...)
+			w.WriteHeader(http.StatusNoContent)
+		case strings.HasSuffix(r.URL.Path, "/CommitFileBlocksUpload"):
+			if len(payload["BlockList"].([]any)) != 3 || payload["MimeType"] != "text/plain; charset=utf-8" {
+				t.Fatalf("Wrong commit: %v", payload)
+			}
+			json.NewEncoder(w).Encode(map[string]any{"FileId": "file", "FileSizeInBytes": len(stored)})
+		case strings.HasSuffix(r.URL.Path, "/InitializeFileBlocksDownload"):
+			json.NewEncoder(w).Encode(map[string]any{"FileContinuationToken": "token", "FileSizeInBytes": len(stored), "FileName": "notes.txt", "IsChunkingSupported": true})
+		case strings.HasSuffix(r.URL.Path, "/DownloadBlock"):
+			offset := int(payload["Offset"].(float64))
+			end := offset + int(payload["BlockLength"].(float64))
+			if end > len(stored) {
+				end = len(stored)
+			}
+			json.NewEncoder(w).Encode(map[string]any{"Data": stored[offset:end]})
+		default:
+			t.Fatalf("Unexpected request %v %v", r.Method, r.URL)
+		}
+		actions = append(actions, r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:])
+	}))
+	defer server.Close()
+
+	previousBlockSize := fileBlockSize
+	fileBlockSize = 4
+	defer func() { fileBlockSize = previousBlockSize }()
+
+	auth := Authorization{Token: "AAAA", Url: server.URL, Expiration: 123}
+	entityDefinitionCache.Store(auth.Url+"|accounts", EntityDefinition{LogicalName: "account", EntitySetName: "accounts", PrimaryIdAttribute: "accountid"})
+
+	err := UploadFile(UploadFileSignature{
+		Auth:      auth,
+		TableName: "accounts",
+		Id:        "123",
+		Column:    "new_file",
+		FileName:  "notes.txt",
+		Content:   strings.NewReader("0123456789"),
+	})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if string(stored) != "0123456789" {
+		t.Fatalf("Wrong content uploaded: %q", stored)
+	}
+
+	var content bytes.Buffer
+	fileName, err := DownloadFile(DownloadFileSignature{
+		Auth:      auth,
+		TableName: "accounts",
+		Id:        "123",
+		Column:    "new_file",
+		Content:   &content,
+	})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if fileName != "notes.txt" || content.String() != "0123456789" {
+		t.Fatalf("Wrong content downloaded: %v %q", fileName, content.String())
+	}
+	want := "InitializeFileBlocksUpload,UploadBlock,UploadBlock,UploadBlock,CommitFileBlocksUpload,$value,InitializeFileBlocksDownload,DownloadBlock,DownloadBlock"
+	if strings.Join(actions, ",") != want {
+		t.Fatalf("Wrong actions: %v", actions)
+	}
+
+	// Full-size images larger than a block can't be downloaded with the actions.
+	_, err = DownloadFile(DownloadFileSignature{Auth: auth, TableName: "accounts", Id: "123", Column: "new_file", FullSize: true, Content: &content})
+	if err == nil {
+		t.Fatalf("Expected error for a large full-size image")
+	}
+
+	// Files up to a block are transferred in a single request.
+	fileBlockSize = 1024
+	content.Reset()
+	actions = nil
+	_, err = DownloadFile(DownloadFileSignature{Auth: auth, TableName: "accounts", Id: "123", Column: "new_file", Content: &content})
+	if err != nil || content.String() != "0123456789" || strings.Join(actions, ",") != "$value" {
+		t.Fatalf("Wrong single request download: %q %v %v", content.String(), err, actions)
+	}
+
+	// The MIME type of a small file is sent with its single request.
+	err = UploadFile(UploadFileSignature{
+		Auth:      auth,
+		TableName: "accounts",
+		Id:        "123",
+		Column:    "new_file",
+		FileName:  "contract",
+		MimeType:  "application/pdf",
+		Content:   strings.NewReader("%PDF"),
+	})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if patched.Get("Content-Type") != "application/pdf" || patched.Get("x-ms-file-name") != "contract" || string(stored) != "%PDF" {
+		t.Fatalf("Wrong single request upload: %v %q", patched, stored)
+	}
+}
+
+func TestNotes(t *testing.T) {
+	var created map[string]any
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case r.URL.Path == "/api/data/v9.1/organizations":
+			json.NewEncoder(w).Encode(map[string]any{"value": []any{map[string]any{"maxuploadfilesize": 16}}})
+		case r.Method == "POST" && r.URL.Path == "/api/data/v9.1/annotations":
+			json.NewDecoder(r.Body).Decode(&created)
+			w.Header().Set("OData-EntityId", r.URL.String()+"(00000000-0000-0000-0000-000000000002)")
+			w.WriteHeader(http.StatusNoContent)
+		case r.URL.Path == "/api/data/v9.1/annotations":
+			if r.URL.Query().Get("$filter") != "(_objectid_value eq 123)" {
+				t.Fatalf("Wrong filter: %v", r.URL.Query().Get("$filter"))
+			}
+			json.NewEncoder(w).Encode(map[string]any{"value": []any{map[string]any{"annotationid": "2", "filename": "notes.txt", "filesize": 10, "isdocument": true}}})
+		case r.URL.Path == "/api/data/v9.1/annotations(2)":
+			json.NewEncoder(w).Encode(map[string]any{"annotationid": "2", "filename": "notes.txt", "documentbody": created["documentbody"]})
+		default:
+			t.Fatalf("Unexpected request %v %v", r.Method, r.URL)
+		}
+	}))
+	defer server.Close()
+
+	auth := Authorization{Token: "AAAA", Url: server.URL, Expiration: 123}
+	entityDefinitionCache.Store(auth.Url+"|accounts", EntityDefinition{LogicalName: "account", EntitySetName: "accounts", PrimaryIdAttribute: "accountid"})
+	entityDefinitionCache.Store(auth.Url+"|annotations", EntityDefinition{
+		LogicalName:   "annotation",
+		EntitySetName: "annotations",
+		ManyToOneRelationships: []Relationship{
+			{ReferencingAttribute: "objectid", ReferencedEntity: "account", ReferencingEntityNavigationPropertyName: "objectid_account"},
+		},
+	})
+
+	id, err := AttachNote(AttachFileSignature{
+		Auth:      auth,
+		TableName: "accounts",
+		Id:        "123",
+		Subject:   "Notes",
+		FileName:  "notes.txt",
+		Content:   strings.NewReader("0123456789"),
+	})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if id != "00000000-0000-0000-0000-000000000002" {
+		t.Fatalf("Wrong id: %v", id)
+	}
+	if created["objectid_account@odata.bind"] != "/accounts(123)" || created["mimetype"] != "text/plain; charset=utf-8" {
+		t.Fatalf("Wrong note: %v", created)
+	}
+
+	_, err = AttachNote(AttachFileSignature{Auth: auth, TableName: "accounts", Id: "123", FileName: "big.txt", Content: strings.NewReader("01234567890123456789")})
+	if err == nil {
+		t.Fatalf("Expected error for file exceeding the maximum size")
+	}
+
+	notes, err := RetrieveNotes(RetrieveNotesSignature{Auth: auth, Id: "123"})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if len(notes) != 1 || notes[0].FileName != "notes.txt" || notes[0].FileSize != 10 {
+		t.Fatalf("Wrong notes: %v", notes)
+	}
+
+	var content bytes.Buffer
+	note, err := DownloadNote(DownloadNoteSignature{Auth: auth, Id: "2", Content: &content})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if note.FileName != "notes.txt" || content.String() != "0123456789" {
+		t.Fatalf("Wrong note content: %v %q", note, content.String())
+	}
+}
+
+func TestSyncChanges(t *testing.T) {
+	pages := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Prefer") != "odata.track-changes" {
+			t.Fatalf("Missing Prefer header")
+		}
+		if r.Header.Get("CallerObjectId") != "00000000-0000-0000-0000-000000000001" {
+			t.Fatalf("Missing impersonation header")
+		}
+		pages++
+		base := "http://" + r.Host + r.URL.Path
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Query().Get("$deltatoken") {
+		case "":
+			if r.URL.Query().Get("page") == "" {
+				json.NewEncoder(w).Encode(map[string]any{
+					"value":           []any{map[string]any{"contactid": "1", "fullname": "A"}},
+					"@odata.nextLink": base + "?page=2",
+				})
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]any{
+				"value":            []any{map[string]any{"contactid": "2", "fullname": "B"}},
+				"@odata.deltaLink": base + "?$select=fullname&$deltatoken=100%2101",
+			})
+		case "100!01":
+			json.NewEncoder(w).Encode(map[string]any{
+				"value": []any{
+					map[string]any{"contactid": "2", "fullname": "B2"},
+					map[string]any{"@odata.context": "https://org/api/data/v9.1/$metadata#contacts/$deletedEntity", "id": "1", "reason": "deleted"},
+				},
+				"@odata.deltaLink": base + "?$deltatoken=200%2101",
+			})
+		default:
+			t.Fatalf("Unexpected token %v", r.URL.Query().Get("$deltatoken"))
+		}
+	}))
+	defer server.Close()
+
+	auth := Authorization{Token: "AAAA", Url: server.URL, Expiration: 123}
+	entityDefinitionCache.Store(auth.Url+"|contacts", EntityDefinition{LogicalName: "contact", EntitySetName: "contacts", PrimaryIdAttribute: "contactid"})
+	store := &FileDeltaTokenStore{Path: t.TempDir() + "/tokens.json"}
+
+	var changes []ChangeEvent
+	sync := SyncChangesSignature{
+		Auth:      auth,
+		TableName: "contacts",
+		Columns:   []string{"fullname"},
+		Store:     store,
+		Handler: func(change ChangeEvent) error {
+			// The changes of a page are handled before the next page is requested.
+			if change.Id == "1" && change.Kind == ChangeUpserted && pages != 1 {
+				t.Fatalf("First page handled after %v pages", pages)
+			}
+			changes = append(changes, change)
+			return nil
+		},
+		Options: requests.RequestOptions{CallerObjectId: "00000000-0000-0000-0000-000000000001"},
+	}
+
+	if err := SyncChanges(sync); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if len(changes) != 2 || changes[0].Id != "1" || changes[1].Id != "2" || changes[1].Kind != ChangeUpserted {
+		t.Fatalf("Wrong initial changes: %v", changes)
+	}
+	if token, _ := store.Load("contacts"); token != "100!01" {
+		t.Fatalf("Wrong saved token: %v", token)
+	}
+
+	// A new store on the same file resumes from the saved token.
+	sync.Store = &FileDeltaTokenStore{Path: store.Path}
+	changes = nil
+	if err := SyncChanges(sync); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if len(changes) != 2 || changes[0].Row["fullname"] != "B2" || changes[1].Kind != ChangeDeleted || changes[1].Id != "1" {
+		t.Fatalf("Wrong delta changes: %v", changes)
+	}
+	if token, _ := store.Load("contacts"); token != "200!01" {
+		t.Fatalf("Wrong saved token: %v", token)
+	}
+}
+
+func TestAuthorizationClient(t *testing.T) {
+	var requested string
+	client := &requests.Client{
+		Transport: requests.RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			requested = req.URL.String()
+			return &http.Response{
+				StatusCode: http.StatusOK,
+				Header:     http.Header{},
+				Body:       io.NopCloser(strings.NewReader(`{"contactid": "123"}`)),
+				Request:    req,
+			}, nil
+		}),
+	}
+
+	ent, err := Retrieve(RetrieveSignature{
+		Auth:      Authorization{Token: "AAAA", Url: "https://org.crm.dynamics.com", Expiration: 123, Client: client},
+		TableName: "contacts",
+		Id:        "123",
+	})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if requested != "https://org.crm.dynamics.com/api/data/v9.1/contacts(123)" || ent["contactid"] != "123" {
+		t.Fatalf("Client not used: %v %v", requested, ent)
+	}
+}
+
+func TestCassette(t *testing.T) {
+	path := t.TempDir() + "/contacts.json"
+	run := func(auth Authorization) (id string, ent map[string]any) {
+		id, err := CreateUpdate(CreateUpdateSignature{
+			Auth:      auth,
+			TableName: "contacts",
+			Row:       map[string]any{"lastname": "fromgo", "emailaddress1": "test@contoso.com"},
+		})
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		if ent, err = Retrieve(RetrieveSignature{Auth: auth, TableName: "contacts", Id: id, ColumnsString: "lastname,emailaddress1"}); err != nil {
+			t.Fatalf("%v", err)
+		}
+		objects := []BatchObject{
+			{object: map[string]any{"lastname": "batch_0"}, predicate: "POST", table: "contacts"},
+			{object: map[string]any{"lastname": "batch_1"}, predicate: "POST", table: "contacts"},
+		}
+		if err = Batch(BatchOperationSignature{Auth: auth, Objects: objects}); err != nil {
+			t.Fatalf("%v", err)
+		}
+		return
+	}
+
+	server := dataversetest.NewServer()
+	recorder := dataversetest.NewCassette(t, path, dataversetest.ModeRecord)
+	recorder.ScrubFields = []string{"emailaddress1"}
+	recordedId, _ := run(Authorization{Token: "AAAA", Url: server.URL, Expiration: 123, Client: &requests.Client{Transport: recorder}})
+	server.Close()
+	if err := recorder.Save(); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	content, _ := os.ReadFile(path)
+	if len(recorder.Interactions()) != 3 || bytes.Contains(content, []byte("AAAA")) ||
+		bytes.Contains(content, []byte("test@contoso.com")) || bytes.Contains(content, []byte(server.URL)) {
+		t.Fatalf("Cassette not scrubbed: %s", content)
+	}
+
+	// The cassette is replayed against another url, without server.
+	player := dataversetest.NewCassette(t, path, dataversetest.ModeReplay)
+	player.ScrubFields = recorder.ScrubFields
+	auth := Authorization{Token: "BBBB", Url: "https://org.crm.dynamics.com", Expiration: 123, Client: &requests.Client{Transport: player}}
+	id, ent := run(auth)
+	if id != recordedId || ent["lastname"] != "fromgo" || ent["emailaddress1"] != dataversetest.Redacted {
+		t.Fatalf("Wrong replay: %v %v", id, ent)
+	}
+
+	player.T = nil
+	req, _ := http.NewRequest("GET", "https://org.crm.dynamics.com/api/data/v9.1/contacts("+id+")", nil)
+	if _, err := player.RoundTrip(req); err == nil {
+		t.Fatalf("Expected error for an unmatched request")
+	}
+}
+
+func TestAuthenticateWithProvider(t *testing.T) {
+	expiration := time.Now().Add(time.Hour)
+	auth, err := AuthenticateWithProvider(requests.StaticTokenProvider{AccessToken: requests.AccessToken{Token: "AAAA", ExpiresOn: expiration}}, "https://org.crm.dynamics.com")
+	if err != nil || auth.Token != "AAAA" || auth.Url != "https://org.crm.dynamics.com" || auth.Expiration != expiration.Unix() {
+		t.Fatalf("Wrong authorization: %v %v", auth, err)
+	}
+	if _, err = AuthenticateWithProvider(requests.StaticTokenProvider{}, "https://org.crm.dynamics.com"); err == nil {
+		t.Fatalf("Expected error")
+	}
+}
+
+func TestRequestErrors(t *testing.T) {
+	// A wrong secret returns an error instead of panicking.
+	tokens := dataversetest.NewTokenServer()
+	defer tokens.Close()
+	tokens.AddClient("clientid", "secret")
+	authorityHost := requests.DefaultClient.AuthorityHost
+	requests.DefaultClient.AuthorityHost = tokens.URL
+	defer func() { requests.DefaultClient.AuthorityHost = authorityHost }()
+
+	auth, err := Authenticate("clientid", "wrong", "tenantid", "https://org.crm.dynamics.com")
+	var authErr *requests.AuthenticationError
+	if !errors.As(err, &authErr) || authErr.Code != "invalid_client" || auth.isSet() {
+		t.Fatalf("Wrong error: %v %v", auth, err)
+	}
+	if auth, err = Authenticate("clientid", "secret", "tenantid", "https://org.crm.dynamics.com"); err != nil || !auth.isSet() {
+		t.Fatalf("Wrong authorization: %v %v", auth, err)
+	}
+
+	// The network is down.
+	server := dataversetest.NewServer()
+	server.Close()
+	auth = Authorization{Token: "AAAA", Url: server.URL, Expiration: 123}
+	if _, err = CreateUpdate(CreateUpdateSignature{Auth: auth, TableName: "contacts", Row: map[string]any{"lastname": "fromgo"}}); err == nil {
+		t.Fatalf("Expected error")
+	}
+	if _, err = CreateUpdate(CreateUpdateSignature{Auth: auth, TableName: "contacts", Id: "00000000-0000-0000-0000-000000000001", Row: map[string]any{"lastname": "fromgo"}}); err == nil {
+		t.Fatalf("Expected error")
+	}
+	if _, err = Retrieve(RetrieveSignature{Auth: auth, TableName: "contacts", Id: "00000000-0000-0000-0000-000000000001"}); err == nil {
+		t.Fatalf("Expected error")
+	}
+
+	// The created row has no OData-EntityId header.
+	responses := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer responses.Close()
+	auth = Authorization{Token: "AAAA", Url: responses.URL, Expiration: 123}
+	id, err := CreateUpdate(CreateUpdateSignature{Auth: auth, TableName: "contacts", Row: map[string]any{"lastname": "fromgo"}})
+	if err == nil || !strings.Contains(err.Error(), "OData-EntityId") {
+		t.Fatalf("Expected error: %v %v", id, err)
+	}
+}
+
+func TestApiVersion(t *testing.T) {
+	server := dataversetest.NewServer()
+	defer server.Close()
+
+	var paths []string
+	client := &requests.Client{
+		ApiVersion: "9.2",
+		Middlewares: []requests.Middleware{func(next http.RoundTripper) http.RoundTripper {
+			return requests.RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+				paths = append(paths, req.URL.Path)
+				return next.RoundTrip(req)
+			})
+		}},
+	}
+	auth := Authorization{Token: "AAAA", Url: server.URL + "/", Expiration: 123, Client: client}
+
+	id, err := CreateUpdate(CreateUpdateSignature{Auth: auth, TableName: "contacts", Row: map[string]any{"lastname": "fromgo"}})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	objects := []BatchObject{
+		{object: map[string]any{"lastname": "batch"}, predicate: "PATCH", table: "contacts", idrow: id},
+	}
+	if err = Batch(BatchOperationSignature{Auth: auth, Objects: objects}); err != nil {
+		t.Fatalf("%v", err)
+	}
+	ent, err := Retrieve(RetrieveSignature{Auth: auth, TableName: "contacts", Id: id})
+	if err != nil || ent["lastname"] != "batch" {
+		t.Fatalf("Wrong entry: %v %v", ent, err)
+	}
+
+	expected := []string{"/api/data/v9.2/contacts", "/api/data/v9.2/$batch", "/api/data/v9.2/contacts(" + id + ")"}
+	if strings.Join(paths, ",") != strings.Join(expected, ",") {
+		t.Fatalf("Wrong paths: %v", paths)
+	}
+	received := server.Requests()
+	if !bytes.Contains(received[1].Body, []byte("PATCH "+server.URL+"/api/data/v9.2/contacts("+id+") HTTP/1.1")) {
+		t.Fatalf("Wrong batch operation: %s", received[1].Body)
+	}
+}
+
+func TestDiscovery(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/discovery/v9.2/Instances" || r.Header.Get("Authorization") != "Bearer AAAA" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write([]byte(`{"value": [
+			{"Id": "1", "UniqueName": "unq1", "UrlName": "contoso", "FriendlyName": "Contoso", "State": 0, "Url": "https://contoso.crm.dynamics.com", "ApiUrl": "https://contoso.api.crm.dynamics.com", "LastUpdated": "2024-05-01T10:00:00Z"},
+			{"Id": "2", "UniqueName": "unq2", "UrlName": "contoso-test", "FriendlyName": "Contoso", "State": 0, "Url": "https://contoso-test.crm.dynamics.com"},
+			{"Id": "3", "UniqueName": "unq3", "UrlName": "fabrikam", "FriendlyName": "Fabrikam", "State": 1, "Url": "https://fabrikam.crm4.dynamics.com"}
+		]}`))
+	}))
+	defer server.Close()
+	auth := Authorization{Token: "AAAA", Url: server.URL, Expiration: 123}
+
+	instances, err := RetrieveInstances(RetrieveInstancesSignature{Auth: auth})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if len(instances) != 3 || instances[0].ApiUrl != "https://contoso.api.crm.dynamics.com" || instances[0].LastUpdated.Year() != 2024 || instances[2].State != InstanceStateDisabled {
+		t.Fatalf("Wrong instances: %+v", instances)
+	}
+
+	cases := []struct {
+		name     string
+		expected string
+	}{
+		{"UNQ2", "2"},
+		{"contoso", "1"},
+		{"fabrikam", "3"},
+		{"Fabrikam", "3"},
+		{"Contoso", "1"},
+	}
+	for _, c := range cases {
+		instance, err := FindInstance(FindInstanceSignature{Auth: auth, Name: c.name})
+		if err != nil || instance.Id != c.expected {
+			t.Errorf("%v: wrong instance %+v %v", c.name, instance, err)
+		}
+	}
+
+	if _, err = findInstance(instances[:2], "CONTOSO (test)"); err == nil {
+		t.Fatalf("Expected error")
+	}
+	instances[0].UrlName = "contoso-prod"
+	if _, err = findInstance(instances, "contoso"); err == nil || !strings.Contains(err.Error(), "Several") {
+		t.Fatalf("Expected error: %v", err)
+	}
+}
+
+func TestPreferOptions(t *testing.T) {
+	server := dataversetest.NewServer()
+	defer server.Close()
+	server.AddEntitySet(dataversetest.EntitySet{
+		Name:               "contacts",
+		LogicalName:        "contact",
+		PrimaryIdAttribute: "contactid",
+		Lookups:            []dataversetest.Lookup{{Attribute: "parentcustomerid", ReferencedEntity: "account", NavigationProperty: "parentcustomerid_account"}},
+	})
+	accountId := server.Insert("accounts", map[string]any{"name": "Contoso"})
+	auth := Authorization{Token: "AAAA", Url: server.URL, Expiration: 123}
+
+	// The created record is returned with its annotations.
+	var record Record
+	id, err := CreateUpdate(CreateUpdateSignature{
+		Auth:               auth,
+		TableName:          "contacts",
+		Row:                map[string]any{"lastname": "fromgo", "parentcustomerid": EntityReference{TableName: "accounts", Id: accountId}},
+		Record:             &record,
+		IncludeAnnotations: AnnotationsAll,
+	})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if record["contactid"] != id || record["lastname"] != "fromgo" || record["_parentcustomerid_value"] != accountId {
+		t.Fatalf("Wrong record: %v", record)
+	}
+	if record.LookupLogicalName("_parentcustomerid_value") != "account" || record.AssociatedNavigationProperty("_parentcustomerid_value") != "parentcustomerid_account" {
+		t.Fatalf("Wrong annotations: %v", record)
+	}
+	received := server.Requests()
+	if prefer := received[len(received)-1].Header.Get("Prefer"); prefer != `return=representation,odata.include-annotations="*"` {
+		t.Fatalf("Wrong Prefer header: %v", prefer)
+	}
+
+	id, err = CreateUpdate(CreateUpdateSignature{Auth: auth, TableName: "contacts", Id: id, Row: map[string]any{"firstname": "test"}, Record: &record})
+	if err != nil || record["firstname"] != "test" || record["lastname"] != "fromgo" || record.LookupLogicalName("_parentcustomerid_value") != "" {
+		t.Fatalf("Wrong record: %v %v", record, err)
+	}
+
+	// The annotations are only returned when requested.
+	server.Insert("contacts", map[string]any{"contactid": id, "statuscode": 1, "statuscode@" + AnnotationFormattedValue: "Active"})
+	ent, err := Retrieve(RetrieveSignature{Auth: auth, TableName: "contacts", Id: id, ColumnsString: "statuscode"})
+	if _, ok := Record(ent).FormattedValue("statuscode"); err != nil || ok {
+		t.Fatalf("Unexpected annotations: %v %v", ent, err)
+	}
+	ent, err = Retrieve(RetrieveSignature{Auth: auth, TableName: "contacts", Id: id, ColumnsString: "statuscode,_parentcustomerid_value", IncludeAnnotations: AnnotationFormattedValue})
+	if label, ok := Record(ent).FormattedValue("statuscode"); err != nil || !ok || label != "Active" || Record(ent).LookupLogicalName("_parentcustomerid_value") != "" {
+		t.Fatalf("Wrong annotations: %v %v", ent, err)
+	}
+	ents, err := RetrieveMultiple(RetrieveMultipleSignature{Auth: auth, TableName: "contacts", IncludeAnnotations: AnnotationsAll})
+	values, _ := ents["value"].([]any)
+	if err != nil || len(values) != 1 {
+		t.Fatalf("Wrong entries: %v %v", ents, err)
+	}
+	if labels := Record(values[0].(map[string]any)).FormattedValues(); len(labels) != 1 || labels["statuscode"] != "Active" {
+		t.Fatalf("Wrong formatted values: %v", labels)
+	}
+
+	// Without OData-EntityId header, the ID is read from the returned record.
+	server.Handle("POST", "accounts", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{"accountid": "00000000-0000-0000-0000-000000000002", "name": "Fabrikam"}`))
+	})
+	id, err = CreateUpdate(CreateUpdateSignature{Auth: auth, TableName: "accounts", Row: map[string]any{"name": "Fabrikam"}, Record: &record})
+	if err != nil || id != "00000000-0000-0000-0000-000000000002" {
+		t.Fatalf("Wrong id: %v %v", id, err)
+	}
+}
+
+func TestRequestOptions(t *testing.T) {
+	server := dataversetest.NewServer()
+	defer server.Close()
+	auth := Authorization{Token: "AAAA", Url: server.URL, Expiration: 123, Client: &requests.Client{Options: requests.RequestOptions{Tag: "client"}}}
+
+	_, err := CreateUpdate(CreateUpdateSignature{
+		Auth:      auth,
+		TableName: "contacts",
+		Row:       map[string]any{"lastname": "fromgo"},
+		Options:   requests.RequestOptions{CallerObjectId: "00000000-0000-0000-0000-000000000001", DetectDuplicates: requests.Bool(true)},
+	})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	received := server.Requests()
+	header := received[len(received)-1].Header
+	if header.Get("CallerObjectId") != "00000000-0000-0000-0000-000000000001" || header.Get("MSCRM.SuppressDuplicateDetection") != "false" || header.Get("MSCRM.tag") != "client" {
+		t.Fatalf("Wrong headers: %v", header)
+	}
+
+	// The options of an operation don't leak into the next ones.
+	if _, err = RetrieveMultiple(RetrieveMultipleSignature{Auth: auth, TableName: "contacts"}); err != nil {
+		t.Fatalf("%v", err)
+	}
+	received = server.Requests()
+	if header = received[len(received)-1].Header; header.Get("CallerObjectId") != "" || header.Get("MSCRM.tag") != "client" {
+		t.Fatalf("Wrong headers: %v", header)
+	}
+
+	objects := []BatchObject{{object: map[string]any{"lastname": "batch"}, predicate: "POST", table: "contacts"}}
+	if err = Batch(BatchOperationSignature{Auth: auth, Objects: objects, Options: requests.RequestOptions{BypassCustomPluginExecution: requests.Bool(true)}}); err != nil {
+		t.Fatalf("%v", err)
+	}
+	received = server.Requests()
+	batch := received[len(received)-2]
+	if batch.Path != "$batch" || batch.Header.Get("MSCRM.BypassCustomPluginExecution") != "true" {
+		t.Fatalf("Wrong batch request: %v %v", batch.Path, batch.Header)
+	}
+}
+
+func TestRecordGetters(t *testing.T) {
+	record := Record{
+		"fullname":                "test fromgo",
+		"contactid":               "00000000-0000-0000-0000-000000000001",
+		"birthdate":               "1990-05-17",
+		"createdon":               "2024-01-31T10:00:00Z",
+		"creditlimit":             1234.5,
+		"statuscode":              float64(2),
+		"_parentcustomerid_value": "00000000-0000-0000-0000-000000000002",
+		"_parentcustomerid_value@" + AnnotationLookupLogicalName: "account",
+		"_ownerid_value": nil,
+		"@odata.etag":    `W/"1234"`,
+		"@odata.context": "https://org.crm.dynamics.com/api/data/v9.1/$metadata#contacts(fullname,contactid)/$entity",
+	}
+
+	if value, err := record.GetString("fullname"); err != nil || value != "test fromgo" {
+		t.Fatalf("Wrong string: %v %v", value, err)
+	}
+	if value, err := record.GetGUID("contactid"); err != nil || value != "00000000-0000-0000-0000-000000000001" {
+		t.Fatalf("Wrong GUID: %v %v", value, err)
+	}
+	if _, err := record.GetGUID("fullname"); err == nil {
+		t.Fatalf("Expected error")
+	}
+	if value, err := record.GetTime("birthdate"); err != nil || !value.Equal(time.Date(1990, 5, 17, 0, 0, 0, 0, time.UTC)) {
+		t.Fatalf("Wrong date: %v %v", value, err)
+	}
+	if value, err := record.GetTime("createdon"); err != nil || !value.Equal(time.Date(2024, 1, 31, 10, 0, 0, 0, time.UTC)) {
+		t.Fatalf("Wrong time: %v %v", value, err)
+	}
+	if value, err := record.GetDecimal("creditlimit"); err != nil || value != "1234.5" {
+		t.Fatalf("Wrong decimal: %v %v", value, err)
+	}
+	if value, err := record.GetOptionSet("statuscode"); err != nil || value != 2 {
+		t.Fatalf("Wrong choice: %v %v", value, err)
+	}
+	if _, err := record.GetOptionSet("creditlimit"); err == nil {
+		t.Fatalf("Expected error")
+	}
+	if _, err := record.GetString("missing"); err == nil {
+		t.Fatalf("Expected error")
+	}
+	ref, err := record.GetEntityReference("parentcustomerid")
+	if err != nil || ref.LogicalName != "account" || ref.Id != "00000000-0000-0000-0000-000000000002" {
+		t.Fatalf("Wrong reference: %v %v", ref, err)
+	}
+	if ref, err = record.GetEntityReference("_ownerid_value"); err != nil || ref.isSet() {
+		t.Fatalf("Wrong null reference: %v %v", ref, err)
+	}
+	if record.ETag() != `W/"1234"` || record.TableName() != "contacts" {
+		t.Fatalf("Wrong etag or table: %v %v", record.ETag(), record.TableName())
+	}
+}
+
+func TestRecords(t *testing.T) {
+	server := dataversetest.NewServer()
+	defer server.Close()
+	server.AddEntitySet(dataversetest.EntitySet{
+		Name:               "contacts",
+		LogicalName:        "contact",
+		PrimaryIdAttribute: "contactid",
+		Lookups:            []dataversetest.Lookup{{Attribute: "parentcustomerid", ReferencedEntity: "account", NavigationProperty: "parentcustomerid_account"}},
+	})
+	server.AddEntitySet(dataversetest.EntitySet{Name: "accounts", LogicalName: "account", PrimaryIdAttribute: "accountid"})
+	accountId := server.Insert("accounts", map[string]any{"name": "Contoso"})
+	auth := Authorization{Token: "AAAA", Url: server.URL, Expiration: 123}
+
+	id, err := CreateUpdate(CreateUpdateSignature{
+		Auth:      auth,
+		TableName: "contacts",
+		Row:       map[string]any{"lastname": "fromgo", "parentcustomerid": EntityReference{TableName: "accounts", Id: accountId}},
+	})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	record, err := Retrieve(RetrieveSignature{Auth: auth, TableName: "contacts", Id: id, IncludeAnnotations: AnnotationLookupLogicalName})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if record.TableName() != "contacts" || len(record.ETag()) == 0 {
+		t.Fatalf("Wrong record: %v", record)
+	}
+
+	// The reference read from a lookup is set on another row through the logical name of its table.
+	ref, err := record.GetEntityReference("parentcustomerid")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	_, err = CreateUpdate(CreateUpdateSignature{Auth: auth, TableName: "contacts", Row: map[string]any{"lastname": "copy", "parentcustomerid": ref}})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	ents, err := RetrieveMultiple(RetrieveMultipleSignature{Auth: auth, TableName: "contacts", IncludeAnnotations: AnnotationsAll})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	records := ents.Records()
+	if len(records) != 2 {
+		t.Fatalf("Wrong entries: %v", ents)
+	}
+	for _, record := range records {
+		if ref, err := record.GetEntityReference("_parentcustomerid_value"); err != nil || ref.Id != accountId || record.TableName() != "contacts" {
+			t.Fatalf("Wrong record: %v %v", record, err)
+		}
+	}
+	for _, value := range ents["value"].([]any) {
+		if _, found := value.(map[string]any)["@odata.context"]; found {
+			t.Fatalf("Entry of the collection modified: %v", value)
+		}
+	}
+}
+
+func TestDecimal(t *testing.T) {
+	d, err := ParseDecimal("+1234.5650")
+	if err != nil || d.String() != "1234.5650" || d.Round(2) != "1234.57" || d.Round(0) != "1235" {
+		t.Fatalf("Wrong decimal: %v %v %v", d, d.Round(2), err)
+	}
+	if _, err = ParseDecimal("12,5"); err == nil {
+		t.Fatalf("Expected error")
+	}
+	if NewDecimal(0.1) != "0.1" || Decimal("").String() != "0" {
+		t.Fatalf("Wrong decimal: %v", NewDecimal(0.1))
+	}
+	jsonStr, err := json.Marshal(map[string]any{"amount": Decimal("12345678901234.123456789"), "zero": Decimal("")})
+	if err != nil || string(jsonStr) != `{"amount":12345678901234.123456789,"zero":0}` {
+		t.Fatalf("Wrong JSON: %s %v", jsonStr, err)
+	}
+	var decoded struct{ Amount, Text, Null Decimal }
+	if err = json.Unmarshal([]byte(`{"Amount": 1.10, "Text": "2.5", "Null": null}`), &decoded); err != nil || decoded.Amount != "1.10" || decoded.Text != "2.5" || decoded.Null != "" {
+		t.Fatalf("Wrong decoded decimals: %+v %v", decoded, err)
+	}
+}
+
+func TestMoney(t *testing.T) {
+	server := dataversetest.NewServer()
+	defer server.Close()
+	server.AddEntitySet(dataversetest.EntitySet{
+		Name:               "invoices",
+		LogicalName:        "invoice",
+		PrimaryIdAttribute: "invoiceid",
+		Attributes: []dataversetest.Attribute{
+			{LogicalName: "totalamount", Type: "MoneyAttributeMetadata", Properties: map[string]any{"Precision": 2, "PrecisionSource": PrecisionSourceCurrency}},
+			{LogicalName: "freightamount", Type: "MoneyAttributeMetadata", Properties: map[string]any{"Precision": 3, "PrecisionSource": PrecisionSourceAttribute}},
+		},
+	})
+	currencyId := server.Insert("transactioncurrencies", map[string]any{"isocurrencycode": "JPY", "currencyprecision": 0})
+	auth := Authorization{Token: "AAAA", Url: server.URL, Expiration: 123}
+
+	// The amounts keep their precision on the way to the server and back.
+	total, _ := ParseDecimal("12345678901234.123456789")
+	id, err := CreateUpdate(CreateUpdateSignature{
+		Auth:      auth,
+		TableName: "invoices",
+		Row:       map[string]any{"totalamount": total, "freightamount": Money{Amount: "0.1234"}, "_transactioncurrencyid_value": currencyId},
+	})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	invoice, err := Retrieve(RetrieveSignature{Auth: auth, TableName: "invoices", Id: id})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if amount, err := invoice.GetDecimal("totalamount"); err != nil || amount != total {
+		t.Fatalf("Wrong amount: %v %v", amount, err)
+	}
+
+	money, err := RetrieveMoney(RetrieveMoneySignature{Auth: auth, Record: invoice, Column: "totalamount"})
+	if err != nil || money.Currency.Id != currencyId || money.Precision != 0 || money.String() != "12345678901234" {
+		t.Fatalf("Wrong money: %+v %v", money, err)
+	}
+	money, err = RetrieveMoney(RetrieveMoneySignature{Auth: auth, Record: invoice, Column: "freightamount"})
+	if err != nil || money.Precision != 3 || money.Rounded() != "0.123" {
+		t.Fatalf("Wrong money: %+v %v", money, err)
+	}
+	if _, err = RetrieveMoney(RetrieveMoneySignature{Auth: auth, Record: Record{"totalamount": 1}, Column: "totalamount"}); err == nil {
+		t.Fatalf("Expected error")
+	}
+}
+
+func TestDateTimeColumn(t *testing.T) {
+	server := dataversetest.NewServer()
+	defer server.Close()
+	server.AddEntitySet(dataversetest.EntitySet{
+		Name:               "contacts",
+		LogicalName:        "contact",
+		PrimaryIdAttribute: "contactid",
+		Attributes: []dataversetest.Attribute{
+			{LogicalName: "birthdate", Type: "DateTimeAttributeMetadata", Properties: map[string]any{"DateTimeBehavior": map[string]any{"Value": DateTimeBehaviorDateOnly}, "Format": "DateOnly"}},
+			{LogicalName: "lastusedincampaign", Type: "DateTimeAttributeMetadata", Properties: map[string]any{"DateTimeBehavior": map[string]any{"Value": DateTimeBehaviorUserLocal}, "Format": "DateAndTime"}},
+			{LogicalName: "new_checkin", Type: "DateTimeAttributeMetadata", Properties: map[string]any{"DateTimeBehavior": map[string]any{"Value": DateTimeBehaviorTimeZoneIndependent}, "Format": "DateAndTime"}},
+		},
+	})
+	auth := Authorization{Token: "AAAA", Url: server.URL, Expiration: 123}
+	location := time.FixedZone("UTC+2", 2*60*60)
+	moment := time.Date(2024, 1, 31, 1, 30, 0, 0, location)
+
+	tests := []struct {
+		column string
+		value  string
+		parsed time.Time
+	}{
+		{"birthdate", "2024-01-31", time.Date(2024, 1, 31, 0, 0, 0, 0, location)},
+		{"lastusedincampaign", "2024-01-30T23:30:00Z", moment},
+		{"new_checkin", "2024-01-31T01:30:00Z", moment},
+	}
+	for _, test := range tests {
+		col, err := RetrieveDateTimeColumn(auth, "contacts", test.column)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		if value := col.Format(moment); value != test.value {
+			t.Fatalf("Wrong value of %v: %v", test.column, value)
+		}
+		parsed, err := col.Parse(test.value, location)
+		if err != nil || !parsed.Equal(test.parsed) || parsed.Location() != location {
+			t.Fatalf("Wrong time of %v: %v %v", test.column, parsed, err)
+		}
+	}
+
+	if _, err := RetrieveDateTimeColumn(auth, "contacts", "fullname"); err == nil {
+		t.Fatalf("Expected error")
+	}
+}
+
+func TestUserTimeZone(t *testing.T) {
+	server := dataversetest.NewServer()
+	defer server.Close()
+	server.AddEntitySet(dataversetest.EntitySet{Name: "usersettingscollection", LogicalName: "usersettings", PrimaryIdAttribute: "systemuserid"})
+	userId := server.Insert("usersettingscollection", map[string]any{"timezonecode": 110})
+	server.Insert("timezonedefinitions", map[string]any{"timezonecode": 110, "standardname": "W. Europe Standard Time"})
+	server.Handle("GET", "WhoAmI()", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]any{"UserId": userId})
+	})
+	server.Handle("GET", "LocalTimeFromUtcTime(TimeZoneCode=@p1,UtcTime=@p2)", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("@p1") != "110" || r.URL.Query().Get("@p2") != "2024-07-01T10:00:00Z" {
+			t.Errorf("Wrong parameters: %v", r.URL.RawQuery)
+		}
+		json.NewEncoder(w).Encode(map[string]any{"LocalTime": "2024-07-01T12:00:00Z"})
+	})
+	server.Handle("GET", "UtcTimeFromLocalTime(LocalTime=@p1,TimeZoneCode=@p2)", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("@p1") != "2024-07-01T12:00:00Z" {
+			t.Errorf("Wrong parameters: %v", r.URL.RawQuery)
+		}
+		json.NewEncoder(w).Encode(map[string]any{"UtcTime": "2024-07-01T10:00:00Z"})
+	})
+	auth := Authorization{Token: "AAAA", Url: server.URL, Expiration: 123}
+
+	tz, err := RetrieveUserTimeZone(RetrieveUserTimeZoneSignature{Auth: auth})
+	if err != nil || tz.Code != 110 || tz.StandardName != "W. Europe Standard Time" {
+		t.Fatalf("Wrong time zone: %+v %v", tz, err)
+	}
+
+	utc := time.Date(2024, 7, 1, 10, 0, 0, 0, time.UTC)
+	local, err := LocalTimeFromUtcTime(LocalTimeFromUtcTimeSignature{Auth: auth, TimeZone: tz, UtcTime: utc})
+	if _, offset := local.Zone(); err != nil || !local.Equal(utc) || offset != 2*60*60 || local.Hour() != 12 {
+		t.Fatalf("Wrong local time: %v %v", local, err)
+	}
+	converted, err := UtcTimeFromLocalTime(UtcTimeFromLocalTimeSignature{Auth: auth, TimeZone: tz, LocalTime: local})
+	if err != nil || !converted.Equal(utc) || converted.Location() != time.UTC {
+		t.Fatalf("Wrong UTC time: %v %v", converted, err)
+	}
+
+	// Without auth, the times are converted with the IANA location of the time zone.
+	if tz.Location == nil {
+		t.Skip("Time zone database not available")
+	}
+	local, err = LocalTimeFromUtcTime(LocalTimeFromUtcTimeSignature{TimeZone: tz, UtcTime: utc})
+	if err != nil || local.Hour() != 12 || local.Location().String() != "Europe/Berlin" {
+		t.Fatalf("Wrong local time: %v %v", local, err)
+	}
+	converted, err = UtcTimeFromLocalTime(UtcTimeFromLocalTimeSignature{TimeZone: tz, LocalTime: time.Date(2024, 7, 1, 12, 0, 0, 0, time.UTC)})
+	if err != nil || !converted.Equal(utc) {
+		t.Fatalf("Wrong UTC time: %v %v", converted, err)
+	}
+	if _, err = LocalTimeFromUtcTime(LocalTimeFromUtcTimeSignature{TimeZone: UserTimeZone{Code: 110}, UtcTime: utc}); err == nil {
+		t.Fatalf("Expected error")
 	}
 }
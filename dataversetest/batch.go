@@ -0,0 +1,197 @@
+package dataversetest
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"strings"
+)
+
+// serveBatch handles a $batch request. The operations of a change set are applied atomically: if one of them
+// fails, the change set is rolled back and only the error is returned. Unless the odata.continue-on-error
+// preference is set, the processing stops at the first failed operation and the batch fails with 400.
+func (s *Server) serveBatch(w http.ResponseWriter, r *http.Request) {
+	_, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || len(params["boundary"]) == 0 {
+		writeError(w, http.StatusBadRequest, "The batch request must have a multipart/mixed content type with a boundary")
+		return
+	}
+	continueOnError := strings.Contains(r.Header.Get("Prefer"), "odata.continue-on-error")
+
+	var responses bytes.Buffer
+	writer := multipart.NewWriter(&responses)
+	writer.SetBoundary("batchresponse_" + newGUID())
+	status := http.StatusOK
+
+	reader := multipart.NewReader(r.Body, params["boundary"])
+	for {
+		part, errPart := reader.NextPart()
+		if errPart == io.EOF {
+			break
+		}
+		if errPart != nil {
+			writeError(w, http.StatusBadRequest, errPart.Error())
+			return
+		}
+
+		var ok bool
+		mediaType, partParams, _ := mime.ParseMediaType(part.Header.Get("Content-Type"))
+		if mediaType == "multipart/mixed" {
+			ok = s.serveChangeset(writer, part, partParams["boundary"], r)
+		} else {
+			rec := s.serveBatchOperation(part, r)
+			writeBatchResponse(writer, part.Header.Get("Content-ID"), rec)
+			ok = rec.Code < 400
+		}
+		if !ok && !continueOnError {
+			status = http.StatusBadRequest
+			break
+		}
+	}
+	writer.Close()
+
+	w.Header().Set("Content-Type", "multipart/mixed; boundary="+writer.Boundary())
+	w.Header().Set("OData-Version", "4.0")
+	w.WriteHeader(status)
+	w.Write(responses.Bytes())
+}
+
+// serveChangeset applies the operations of a change set, rolling them back if one of them fails.
+// It returns false if an operation failed.
+func (s *Server) serveChangeset(writer *multipart.Writer, changeset io.Reader, boundary string, r *http.Request) bool {
+	saved := s.snapshot()
+
+	var responses bytes.Buffer
+	changesetWriter := multipart.NewWriter(&responses)
+	changesetWriter.SetBoundary("changesetresponse_" + newGUID())
+
+	reader := multipart.NewReader(changeset, boundary)
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		rec, contentID := httptest.NewRecorder(), ""
+		if err != nil {
+			writeError(rec, http.StatusBadRequest, err.Error())
+		} else {
+			rec, contentID = s.serveBatchOperation(part, r), part.Header.Get("Content-ID")
+		}
+
+		if rec.Code >= 400 {
+			s.restore(saved)
+			writeBatchResponse(writer, contentID, rec)
+			return false
+		}
+		writeBatchResponse(changesetWriter, contentID, rec)
+	}
+	changesetWriter.Close()
+
+	partWriter, _ := writer.CreatePart(textproto.MIMEHeader{
+		"Content-Type": {"multipart/mixed; boundary=" + changesetWriter.Boundary()},
+	})
+	partWriter.Write(responses.Bytes())
+	return true
+}
+
+// serveBatchOperation parses an operation of a batch, an HTTP request without content length, and serves it.
+func (s *Server) serveBatchOperation(operation io.Reader, r *http.Request) (rec *httptest.ResponseRecorder) {
+	rec = httptest.NewRecorder()
+
+	reader := textproto.NewReader(bufio.NewReader(operation))
+	line, err := reader.ReadLine()
+	fields := strings.Fields(line)
+	if err != nil || len(fields) < 2 {
+		writeError(rec, http.StatusBadRequest, fmt.Sprintf("Invalid batch operation: %v", line))
+		return
+	}
+	header, _ := reader.ReadMIMEHeader()
+	body, _ := io.ReadAll(reader.R)
+
+	// The url of an operation is either absolute or relative to the api root.
+	target := fields[1]
+	if i := strings.Index(target, "api/data/"); i >= 0 {
+		target = "/" + target[i:]
+	} else {
+		version, _, _ := apiPath(r.URL.Path)
+		target = fmt.Sprintf("/api/data/%v/%v", version, strings.TrimPrefix(target, "/"))
+	}
+
+	req, err := http.NewRequest(fields[0], "http://"+r.Host+target, bytes.NewReader(bytes.TrimSpace(body)))
+	if err != nil {
+		writeError(rec, http.StatusBadRequest, err.Error())
+		return
+	}
+	req.Header = http.Header(header)
+	if len(req.Header.Get("Authorization")) == 0 {
+		req.Header.Set("Authorization", r.Header.Get("Authorization"))
+	}
+
+	version, path, ok := apiPath(req.URL.Path)
+	if !ok {
+		writeError(rec, http.StatusNotFound, fmt.Sprintf("Resource not found: %v", req.URL.Path))
+		return
+	}
+	s.serve(rec, req, version, path)
+	return
+}
+
+// writeBatchResponse writes the response of an operation as a part of the batch response.
+func writeBatchResponse(writer *multipart.Writer, contentID string, rec *httptest.ResponseRecorder) {
+	header := textproto.MIMEHeader{
+		"Content-Type":              {"application/http"},
+		"Content-Transfer-Encoding": {"binary"},
+	}
+	if len(contentID) > 0 {
+		header.Set("Content-ID", contentID)
+	}
+	part, _ := writer.CreatePart(header)
+
+	fmt.Fprintf(part, "HTTP/1.1 %v %v\r\n", rec.Code, http.StatusText(rec.Code))
+	rec.Header().Write(part)
+	fmt.Fprint(part, "\r\n")
+	part.Write(rec.Body.Bytes())
+}
+
+// snapshot is a copy of the entries of the entity sets, to roll back a change set.
+type snapshot map[string]entitySet
+
+func (s *Server) snapshot() snapshot {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	copied := snapshot{}
+	for name, set := range s.sets {
+		c := entitySet{
+			EntitySet:    set.EntitySet,
+			ids:          append([]string(nil), set.ids...),
+			rows:         make(map[string]map[string]any, len(set.rows)),
+			associations: make(map[string][]string, len(set.associations)),
+		}
+		for id, row := range set.rows {
+			c.rows[id] = copyRow(row)
+		}
+		for key, associated := range set.associations {
+			c.associations[key] = append([]string(nil), associated...)
+		}
+		copied[name] = c
+	}
+	return copied
+}
+
+func (s *Server) restore(copied snapshot) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.sets = map[string]*entitySet{}
+	for name, set := range copied {
+		set := set
+		s.sets[name] = &set
+	}
+}
@@ -0,0 +1,418 @@
+package dataversetest
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"unicode/utf8"
+)
+
+// CassetteMode is the mode of a 'Cassette'.
+type CassetteMode int
+
+const (
+	// ModeReplay serves the recorded interactions, without sending any request.
+	ModeReplay CassetteMode = iota
+	// ModeRecord sends the requests and records the interactions.
+	ModeRecord
+)
+
+// Redacted replaces the scrubbed values in the cassettes.
+const Redacted = "REDACTED"
+
+// baseURLPlaceholder replaces the scheme and host of the requests in the cassettes, so a cassette recorded
+// against an organization can be replayed against any url.
+const baseURLPlaceholder = "{{baseurl}}"
+
+// scrubbedHeaders are the headers never recorded.
+var scrubbedHeaders = []string{"Authorization", "Cookie", "Set-Cookie"}
+
+// scrubbedParameters are the query parameters, form fields and JSON fields always redacted.
+var scrubbedParameters = []string{
+	"access_token", "refresh_token", "id_token", "client_secret", "client_assertion",
+	"code", "code_verifier", "password", "sig", "token", "$deltatoken", "sessiontoken",
+}
+
+// boundaryRegexp matches the multipart boundaries declared in a body, e.g. in the change sets of a batch.
+var boundaryRegexp = regexp.MustCompile(`boundary=("?)([^\s;"]+)`)
+
+// The 'Cassette' struct is an http.RoundTripper recording the Dataverse requests and their responses to a golden
+// file, and serving them back deterministically. It is meant to be set as 'Transport' of a requests.Client.
+// It contains the following fields:
+//   - Path: the path of the golden file (JSON)
+//   - Mode: the mode of the cassette, ModeRecord or ModeReplay
+//   - Transport: the RoundTripper sending the requests in record mode, http.DefaultTransport if nil
+//   - ScrubHeaders: additional headers not recorded, Authorization and cookies are never recorded
+//   - ScrubFields: additional query parameters, form fields and JSON fields (at any depth) redacted in the
+//     recorded requests and responses. Tokens and secrets are always redacted. The requests are matched after
+//     the scrubbing, so the same fields must be set in record and replay mode.
+//   - T: the test, failed when a request has no recorded interaction in replay mode
+//
+// Requests are matched by method, normalized url (without scheme and host, sorted query) and normalized body
+// (sorted JSON keys, stable multipart boundaries). Identical requests are served in the recorded order.
+//
+// Example:
+//
+//	mode := dataversetest.ModeReplay
+//	if os.Getenv("DATAVERSE_RECORD") != "" {
+//	  mode = dataversetest.ModeRecord
+//	}
+//	cassette := dataversetest.NewCassette(t, "testdata/contacts.json", mode)
+//	cassette.ScrubFields = []string{"emailaddress1"}
+//	auth := dataversego.Authorization{Token: token, Url: orgUrl, Client: &requests.Client{Transport: cassette}}
+type Cassette struct {
+	Path         string
+	Mode         CassetteMode
+	Transport    http.RoundTripper
+	ScrubHeaders []string
+	ScrubFields  []string
+	T            testing.TB
+
+	mu           sync.Mutex
+	loaded       bool
+	interactions []Interaction
+	used         []bool
+}
+
+// The 'Interaction' struct is a request and its response, as stored in a cassette.
+type Interaction struct {
+	Request  RecordedMessage `json:"request"`
+	Response RecordedMessage `json:"response"`
+}
+
+// The 'RecordedMessage' struct is a request or a response stored in a cassette.
+// It contains the following fields:
+//   - Method: the method of the request
+//   - URL: the normalized url of the request, without scheme and host
+//   - StatusCode: the status code of the response
+//   - Header: the headers, without the scrubbed ones
+//   - Body: the body, if valid UTF-8
+//   - BodyBase64: the body encoded in base64, if not valid UTF-8 (e.g. file content)
+type RecordedMessage struct {
+	Method     string      `json:"method,omitempty"`
+	URL        string      `json:"url,omitempty"`
+	StatusCode int         `json:"status,omitempty"`
+	Header     http.Header `json:"header,omitempty"`
+	Body       string      `json:"body,omitempty"`
+	BodyBase64 string      `json:"body_base64,omitempty"`
+}
+
+// The 'cassetteFile' struct is the content of a golden file.
+type cassetteFile struct {
+	Interactions []Interaction `json:"interactions"`
+}
+
+// NewCassette returns a cassette for a test. In record mode the golden file is written when the test ends,
+// in replay mode the test fails for every request without a recorded interaction.
+//
+// Example:
+//
+//	cassette := dataversetest.NewCassette(t, "testdata/contacts.json", dataversetest.ModeReplay)
+//	client := &requests.Client{Transport: cassette}
+func NewCassette(t testing.TB, path string, mode CassetteMode) *Cassette {
+	c := &Cassette{Path: path, Mode: mode, T: t}
+	if mode == ModeRecord {
+		t.Cleanup(func() {
+			if err := c.Save(); err != nil {
+				t.Errorf("cassette: %v", err)
+			}
+		})
+	}
+	return c
+}
+
+// RoundTrip records or replays a request.
+func (c *Cassette) RoundTrip(req *http.Request) (resp *http.Response, err error) {
+	var body []byte
+	if req.Body != nil {
+		body, err = io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return
+		}
+	}
+	recorded := c.recordRequest(req, body)
+
+	if c.Mode == ModeRecord {
+		return c.record(req, body, recorded)
+	}
+	return c.replay(req, recorded)
+}
+
+// Save writes the recorded interactions to the golden file, creating its directory if needed.
+func (c *Cassette) Save() (err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	jsonStr, err := json.MarshalIndent(cassetteFile{Interactions: c.interactions}, "", "  ")
+	if err != nil {
+		return
+	}
+	if err = os.MkdirAll(filepath.Dir(c.Path), 0o755); err != nil {
+		return
+	}
+	err = os.WriteFile(c.Path, append(jsonStr, '\n'), 0o644)
+	return
+}
+
+// Interactions returns the interactions recorded or loaded by the cassette, e.g. to check the scrubbing in a test.
+func (c *Cassette) Interactions() []Interaction {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return append([]Interaction(nil), c.interactions...)
+}
+
+// INTERNAL METHODS
+
+func (c *Cassette) record(req *http.Request, body []byte, recorded RecordedMessage) (resp *http.Response, err error) {
+	transport := c.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+
+	sent := req.Clone(req.Context())
+	sent.Body = io.NopCloser(bytes.NewReader(body))
+	resp, err = transport.RoundTrip(sent)
+	if err != nil {
+		return
+	}
+	respBody, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(respBody))
+
+	response := RecordedMessage{
+		StatusCode: resp.StatusCode,
+		Header:     c.scrubHeader(resp.Header, baseURL(req)),
+	}
+	setBody(&response, c.scrubBody(resp.Header.Get("Content-Type"), respBody, baseURL(req)))
+
+	c.mu.Lock()
+	c.interactions = append(c.interactions, Interaction{Request: recorded, Response: response})
+	c.used = append(c.used, true)
+	c.mu.Unlock()
+	return
+}
+
+func (c *Cassette) replay(req *http.Request, recorded RecordedMessage) (resp *http.Response, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.loaded {
+		if err = c.load(); err != nil {
+			c.fail("%v", err)
+			return
+		}
+	}
+
+	for i, interaction := range c.interactions {
+		if c.used[i] || !matchRequest(interaction.Request, recorded) {
+			continue
+		}
+		c.used[i] = true
+		resp, err = buildResponse(req, interaction.Response)
+		return
+	}
+
+	err = fmt.Errorf("cassette %v: no recorded interaction for %v %v", c.Path, recorded.Method, recorded.URL)
+	c.fail("%v\n%v", err, recorded.Body)
+	return
+}
+
+// load reads the golden file. The lock must be held.
+func (c *Cassette) load() (err error) {
+	content, err := os.ReadFile(c.Path)
+	if err != nil {
+		return
+	}
+	var file cassetteFile
+	if err = json.Unmarshal(content, &file); err != nil {
+		return fmt.Errorf("cassette %v: %v", c.Path, err)
+	}
+	c.interactions = file.Interactions
+	c.used = make([]bool, len(file.Interactions))
+	c.loaded = true
+	return
+}
+
+// fail fails the test, if any. It can be called from the goroutines sending the requests.
+func (c *Cassette) fail(format string, args ...any) {
+	if c.T != nil {
+		c.T.Errorf(format, args...)
+	}
+}
+
+// recordRequest returns the normalized and scrubbed representation of a request, used for matching.
+func (c *Cassette) recordRequest(req *http.Request, body []byte) (recorded RecordedMessage) {
+	base := baseURL(req)
+	recorded = RecordedMessage{
+		Method: req.Method,
+		URL:    c.normalizeURL(req.URL),
+		Header: c.scrubHeader(req.Header, base),
+	}
+	setBody(&recorded, c.scrubBody(req.Header.Get("Content-Type"), body, base))
+	return
+}
+
+func (c *Cassette) isScrubbed(key string) bool {
+	for _, scrubbed := range scrubbedParameters {
+		if strings.EqualFold(key, scrubbed) {
+			return true
+		}
+	}
+	for _, scrubbed := range c.ScrubFields {
+		if strings.EqualFold(key, scrubbed) {
+			return true
+		}
+	}
+	return false
+}
+
+// normalizeURL returns the path and the sorted query of a url, with the scrubbed parameters redacted.
+func (c *Cassette) normalizeURL(u *url.URL) string {
+	query := u.Query()
+	for key := range query {
+		if c.isScrubbed(key) {
+			query.Set(key, Redacted)
+		}
+	}
+	normalized := u.EscapedPath()
+	if len(query) > 0 {
+		normalized += "?" + query.Encode()
+	}
+	return normalized
+}
+
+func (c *Cassette) scrubHeader(header http.Header, base string) http.Header {
+	scrubbed := http.Header{}
+	for key, values := range header {
+		skip := false
+		for _, h := range append(scrubbedHeaders, c.ScrubHeaders...) {
+			skip = skip || strings.EqualFold(key, h)
+		}
+		if skip {
+			continue
+		}
+		for _, value := range values {
+			scrubbed.Add(key, strings.ReplaceAll(value, base, baseURLPlaceholder))
+		}
+	}
+	return scrubbed
+}
+
+// scrubBody redacts the scrubbed fields of a JSON or form body and normalizes it: sorted JSON keys,
+// base url replaced by a placeholder and stable multipart boundaries.
+func (c *Cassette) scrubBody(contentType string, body []byte, base string) []byte {
+	if len(body) == 0 {
+		return body
+	}
+
+	switch {
+	case strings.HasPrefix(contentType, "application/x-www-form-urlencoded"):
+		form, err := url.ParseQuery(string(body))
+		if err == nil {
+			for key := range form {
+				if c.isScrubbed(key) {
+					form.Set(key, Redacted)
+				}
+			}
+			body = []byte(form.Encode())
+		}
+	case strings.HasPrefix(contentType, "multipart/"):
+		// Boundaries are random, they are replaced by stable ones.
+		for i, match := range boundaryRegexp.FindAllSubmatch(append([]byte(contentType+" "), body...), -1) {
+			body = bytes.ReplaceAll(body, match[2], []byte(fmt.Sprintf("boundary_%v", i)))
+		}
+	default:
+		var value any
+		if err := json.Unmarshal(body, &value); err == nil {
+			if jsonStr, err := json.Marshal(c.scrubJSON(value)); err == nil {
+				body = jsonStr
+			}
+		}
+	}
+
+	return bytes.ReplaceAll(body, []byte(base), []byte(baseURLPlaceholder))
+}
+
+func (c *Cassette) scrubJSON(value any) any {
+	switch v := value.(type) {
+	case map[string]any:
+		for key, field := range v {
+			if c.isScrubbed(key) {
+				v[key] = Redacted
+				continue
+			}
+			v[key] = c.scrubJSON(field)
+		}
+	case []any:
+		for i := range v {
+			v[i] = c.scrubJSON(v[i])
+		}
+	}
+	return value
+}
+
+// matchRequest reports whether a recorded request matches a request, by method, normalized url and body.
+func matchRequest(recorded RecordedMessage, req RecordedMessage) bool {
+	return recorded.Method == req.Method && recorded.URL == req.URL && recorded.Body == req.Body && recorded.BodyBase64 == req.BodyBase64
+}
+
+// buildResponse builds the response of a replayed interaction, with the base url of the request.
+func buildResponse(req *http.Request, recorded RecordedMessage) (resp *http.Response, err error) {
+	base := baseURL(req)
+	body := []byte(strings.ReplaceAll(recorded.Body, baseURLPlaceholder, base))
+	if len(recorded.BodyBase64) > 0 {
+		body, err = base64.StdEncoding.DecodeString(recorded.BodyBase64)
+		if err != nil {
+			return
+		}
+	}
+
+	header := http.Header{}
+	for key, values := range recorded.Header {
+		for _, value := range values {
+			header.Add(key, strings.ReplaceAll(value, baseURLPlaceholder, base))
+		}
+	}
+	header.Del("Content-Length")
+
+	resp = &http.Response{
+		Status:        fmt.Sprintf("%v %v", recorded.StatusCode, http.StatusText(recorded.StatusCode)),
+		StatusCode:    recorded.StatusCode,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          io.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}
+	return
+}
+
+func setBody(message *RecordedMessage, body []byte) {
+	if utf8.Valid(body) {
+		message.Body = string(body)
+		return
+	}
+	message.BodyBase64 = base64.StdEncoding.EncodeToString(body)
+}
+
+// baseURL returns the scheme and host of a request (e.g. "https://org.crm.dynamics.com").
+func baseURL(req *http.Request) string {
+	return fmt.Sprintf("%v://%v", req.URL.Scheme, req.URL.Host)
+}
@@ -0,0 +1,556 @@
+package dataversetest
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// applyQuery filters, sorts, limits and projects the entries according to the $filter, $orderby, $top and
+// $select query options. The returned entries are copies.
+func applyQuery(rows []map[string]any, query url.Values, primaryIdAttribute string) (result []map[string]any, err error) {
+	result = []map[string]any{}
+
+	if filter := query.Get("$filter"); len(filter) > 0 {
+		expr, errParse := parseFilter(filter)
+		if errParse != nil {
+			err = errParse
+			return
+		}
+		for _, row := range rows {
+			if truthy(expr(row)) {
+				result = append(result, row)
+			}
+		}
+	} else {
+		result = append(result, rows...)
+	}
+
+	if orderBy := query.Get("$orderby"); len(orderBy) > 0 {
+		sortRows(result, orderBy)
+	}
+
+	if top := query.Get("$top"); len(top) > 0 {
+		n, errTop := strconv.Atoi(top)
+		if errTop != nil || n < 0 {
+			err = fmt.Errorf("Invalid $top: %v", top)
+			return
+		}
+		if n < len(result) {
+			result = result[:n]
+		}
+	}
+
+	for i := range result {
+		result[i] = selectColumns(result[i], query, primaryIdAttribute)
+	}
+	return
+}
+
+// selectColumns returns a copy of an entry with the columns of the $select and $expand query options only,
+// together with the primary key and the etag. Every column is returned without $select.
+func selectColumns(row map[string]any, query url.Values, primaryIdAttribute string) map[string]any {
+	selectStatement := query.Get("$select")
+	if len(selectStatement) == 0 {
+		return copyRow(row)
+	}
+
+	columns := strings.Split(selectStatement, ",")
+	// Expanded navigation properties are returned as well, e.g. "ManyToOneRelationships($select=SchemaName)".
+	for _, expand := range splitTopLevel(query.Get("$expand")) {
+		columns = append(columns, strings.SplitN(expand, "(", 2)[0])
+	}
+
+	selected := map[string]any{
+		primaryIdAttribute: row[primaryIdAttribute],
+	}
+	if etag, ok := row["@odata.etag"]; ok {
+		selected["@odata.etag"] = etag
+	}
+	for _, column := range columns {
+		column = strings.TrimSpace(column)
+		if len(column) == 0 {
+			continue
+		}
+		selected[column] = row[column]
+	}
+	return selected
+}
+
+// annotate returns a projected entry with the annotations requested by the odata.include-annotations preference
+// (e.g. "*" or "OData.Community.Display.V1.FormattedValue"): the annotations of its columns in the stored entry
+// (e.g. "statuscode@OData.Community.Display.V1.FormattedValue") and the lookuplogicalname and
+// associatednavigationproperty annotations of its lookups. Without the preference, the annotations are removed.
+func annotate(selected map[string]any, stored map[string]any, lookups []Lookup, prefer string) map[string]any {
+	var patterns []string
+	if match := includeAnnotationsRegexp.FindStringSubmatch(prefer); match != nil {
+		patterns = strings.Split(match[1], ",")
+	}
+	requested := func(annotation string) bool {
+		for _, pattern := range patterns {
+			pattern = strings.TrimSpace(pattern)
+			if pattern == "*" || pattern == annotation ||
+				(strings.HasSuffix(pattern, ".*") && strings.HasPrefix(annotation, strings.TrimSuffix(pattern, "*"))) {
+				return true
+			}
+		}
+		return false
+	}
+
+	for key := range selected {
+		if column, annotation, found := strings.Cut(key, "@"); found && len(column) > 0 && !requested(annotation) {
+			delete(selected, key)
+		}
+	}
+	for key, value := range stored {
+		column, annotation, found := strings.Cut(key, "@")
+		if _, ok := selected[column]; found && ok && len(column) > 0 && requested(annotation) {
+			selected[key] = value
+		}
+	}
+	for _, lookup := range lookups {
+		column := fmt.Sprintf("_%v_value", lookup.Attribute)
+		if _, ok := selected[column]; !ok {
+			continue
+		}
+		if requested(lookupLogicalNameAnnotation) {
+			selected[column+"@"+lookupLogicalNameAnnotation] = lookup.ReferencedEntity
+		}
+		if requested(navigationPropertyAnnotation) {
+			selected[column+"@"+navigationPropertyAnnotation] = lookup.NavigationProperty
+		}
+	}
+	return selected
+}
+
+// The annotations of the lookups, and the regular expression reading the requested annotations from the Prefer header.
+const (
+	lookupLogicalNameAnnotation  = "Microsoft.Dynamics.CRM.lookuplogicalname"
+	navigationPropertyAnnotation = "Microsoft.Dynamics.CRM.associatednavigationproperty"
+)
+
+var includeAnnotationsRegexp = regexp.MustCompile(`odata\.include-annotations="?([^"]*)"?`)
+
+// splitTopLevel splits a comma separated list, ignoring the commas in parentheses.
+func splitTopLevel(list string) (items []string) {
+	depth, start := 0, 0
+	for i, r := range list {
+		switch r {
+		case '(':
+			depth++
+		case ')':
+			depth--
+		case ',':
+			if depth == 0 {
+				items = append(items, list[start:i])
+				start = i + 1
+			}
+		}
+	}
+	if start < len(list) {
+		items = append(items, list[start:])
+	}
+	return
+}
+
+// sortRows sorts the entries according to an $orderby query option (e.g. "lastname desc,firstname").
+func sortRows(rows []map[string]any, orderBy string) {
+	type order struct {
+		column string
+		desc   bool
+	}
+	var orders []order
+	for _, item := range strings.Split(orderBy, ",") {
+		fields := strings.Fields(item)
+		if len(fields) == 0 {
+			continue
+		}
+		orders = append(orders, order{column: fields[0], desc: len(fields) > 1 && strings.EqualFold(fields[1], "desc")})
+	}
+
+	sort.SliceStable(rows, func(i, j int) bool {
+		for _, o := range orders {
+			a, b := rows[i][o.column], rows[j][o.column]
+			// Null values come first in ascending order.
+			var c int
+			switch {
+			case a == nil && b == nil:
+				continue
+			case a == nil:
+				c = -1
+			case b == nil:
+				c = 1
+			default:
+				c, _ = compareValues(a, b)
+			}
+			if c == 0 {
+				continue
+			}
+			if o.desc {
+				return c > 0
+			}
+			return c < 0
+		}
+		return false
+	})
+}
+
+// compareValues compares two values of an entry or a filter. Numbers are compared as numbers, everything else
+// as case-insensitive strings, as the default collation of dataverse. It returns false if the values can't be compared.
+func compareValues(a any, b any) (c int, ok bool) {
+	if a == nil || b == nil {
+		return 0, a == nil && b == nil
+	}
+
+	af, aIsNumber := toNumber(a)
+	bf, bIsNumber := toNumber(b)
+	if aIsNumber && bIsNumber {
+		switch {
+		case af < bf:
+			return -1, true
+		case af > bf:
+			return 1, true
+		}
+		return 0, true
+	}
+
+	return strings.Compare(strings.ToLower(fmt.Sprint(a)), strings.ToLower(fmt.Sprint(b))), true
+}
+
+func toNumber(v any) (f float64, ok bool) {
+	switch n := v.(type) {
+	case float64:
+		return n, true
+	case int:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case json.Number:
+		f, err := n.Float64()
+		return f, err == nil
+	}
+	return
+}
+
+func truthy(v any) bool {
+	b, _ := v.(bool)
+	return b
+}
+
+// FILTER PARSER
+
+// filterExpr is a compiled $filter expression, evaluated against an entry.
+type filterExpr func(row map[string]any) any
+
+const (
+	tokenWord = iota
+	tokenString
+	tokenOpen
+	tokenClose
+	tokenComma
+	tokenEquals
+)
+
+type filterToken struct {
+	kind int
+	text string
+}
+
+// value returns the literal value of a token: a string, a number, a boolean or nil.
+// Unquoted values that are not numbers (e.g. GUIDs and dates) are returned as strings.
+func (t filterToken) value() any {
+	if t.kind == tokenString {
+		return t.text
+	}
+	switch t.text {
+	case "null":
+		return nil
+	case "true":
+		return true
+	case "false":
+		return false
+	}
+	if f, err := strconv.ParseFloat(t.text, 64); err == nil {
+		return f
+	}
+	return t.text
+}
+
+// isLiteral reports whether a word is a literal rather than a column name.
+func (t filterToken) isLiteral() bool {
+	if t.kind == tokenString {
+		return true
+	}
+	switch t.text {
+	case "null", "true", "false":
+		return true
+	}
+	return len(t.text) > 0 && (t.text[0] >= '0' && t.text[0] <= '9' || t.text[0] == '-')
+}
+
+// tokenize splits an expression into words, quoted strings, parentheses, commas and equal signs.
+func tokenize(expression string) (tokens []filterToken, err error) {
+	for i := 0; i < len(expression); {
+		switch c := expression[i]; c {
+		case ' ', '\t':
+			i++
+		case '(':
+			tokens = append(tokens, filterToken{kind: tokenOpen, text: "("})
+			i++
+		case ')':
+			tokens = append(tokens, filterToken{kind: tokenClose, text: ")"})
+			i++
+		case ',':
+			tokens = append(tokens, filterToken{kind: tokenComma, text: ","})
+			i++
+		case '=':
+			tokens = append(tokens, filterToken{kind: tokenEquals, text: "="})
+			i++
+		case '\'':
+			// Quotes are escaped by doubling them.
+			var text strings.Builder
+			i++
+			for {
+				if i >= len(expression) {
+					err = fmt.Errorf("Unterminated string in %v", expression)
+					return
+				}
+				if expression[i] == '\'' {
+					if i+1 < len(expression) && expression[i+1] == '\'' {
+						text.WriteByte('\'')
+						i += 2
+						continue
+					}
+					i++
+					break
+				}
+				text.WriteByte(expression[i])
+				i++
+			}
+			tokens = append(tokens, filterToken{kind: tokenString, text: text.String()})
+		default:
+			start := i
+			for i < len(expression) && !strings.ContainsRune(" \t(),='", rune(expression[i])) {
+				i++
+			}
+			tokens = append(tokens, filterToken{kind: tokenWord, text: expression[start:i]})
+		}
+	}
+	return
+}
+
+// filterParser is a recursive descent parser of the $filter expressions, supporting the comparison operators
+// (eq, ne, gt, ge, lt, le), the logical operators (and, or, not), parentheses and the string functions
+// contains, startswith, endswith, tolower and toupper.
+type filterParser struct {
+	tokens []filterToken
+	pos    int
+}
+
+// parseFilter compiles a $filter expression.
+//
+// Example:
+//
+//	expr, _ := parseFilter("(startswith(fullname,'K') or age gt 30)")
+//	fmt.Println(expr(map[string]any{"fullname": "Kate", "age": 25.0})) // true
+func parseFilter(filter string) (expr filterExpr, err error) {
+	tokens, err := tokenize(filter)
+	if err != nil {
+		return
+	}
+	p := &filterParser{tokens: tokens}
+	expr, err = p.parseOr()
+	if err == nil && p.pos < len(p.tokens) {
+		err = fmt.Errorf("Unexpected %v in $filter %v", p.tokens[p.pos].text, filter)
+	}
+	return
+}
+
+func (p *filterParser) peek() (t filterToken, ok bool) {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos], true
+	}
+	return
+}
+
+func (p *filterParser) peekWord(word string) bool {
+	t, ok := p.peek()
+	return ok && t.kind == tokenWord && t.text == word
+}
+
+func (p *filterParser) expect(kind int) (err error) {
+	t, ok := p.peek()
+	if !ok || t.kind != kind {
+		return fmt.Errorf("Unexpected end of $filter")
+	}
+	p.pos++
+	return
+}
+
+func (p *filterParser) parseOr() (expr filterExpr, err error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return
+	}
+	for p.peekWord("or") {
+		p.pos++
+		l := left
+		r, errRight := p.parseAnd()
+		if errRight != nil {
+			return nil, errRight
+		}
+		left = func(row map[string]any) any { return truthy(l(row)) || truthy(r(row)) }
+	}
+	return left, nil
+}
+
+func (p *filterParser) parseAnd() (expr filterExpr, err error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return
+	}
+	for p.peekWord("and") {
+		p.pos++
+		l := left
+		r, errRight := p.parseNot()
+		if errRight != nil {
+			return nil, errRight
+		}
+		left = func(row map[string]any) any { return truthy(l(row)) && truthy(r(row)) }
+	}
+	return left, nil
+}
+
+func (p *filterParser) parseNot() (expr filterExpr, err error) {
+	if !p.peekWord("not") {
+		return p.parseComparison()
+	}
+	p.pos++
+	inner, err := p.parseNot()
+	if err != nil {
+		return
+	}
+	return func(row map[string]any) any { return !truthy(inner(row)) }, nil
+}
+
+func (p *filterParser) parseComparison() (expr filterExpr, err error) {
+	left, err := p.parsePrimary()
+	if err != nil {
+		return
+	}
+	t, ok := p.peek()
+	if !ok || t.kind != tokenWord {
+		return left, nil
+	}
+
+	var compare func(c int, ok bool) bool
+	switch t.text {
+	case "eq":
+		compare = func(c int, ok bool) bool { return ok && c == 0 }
+	case "ne":
+		compare = func(c int, ok bool) bool { return !ok || c != 0 }
+	case "gt":
+		compare = func(c int, ok bool) bool { return ok && c > 0 }
+	case "ge":
+		compare = func(c int, ok bool) bool { return ok && c >= 0 }
+	case "lt":
+		compare = func(c int, ok bool) bool { return ok && c < 0 }
+	case "le":
+		compare = func(c int, ok bool) bool { return ok && c <= 0 }
+	default:
+		return left, nil
+	}
+	p.pos++
+
+	right, err := p.parsePrimary()
+	if err != nil {
+		return
+	}
+	return func(row map[string]any) any { return compare(compareValues(left(row), right(row))) }, nil
+}
+
+func (p *filterParser) parsePrimary() (expr filterExpr, err error) {
+	t, ok := p.peek()
+	if !ok {
+		return nil, fmt.Errorf("Unexpected end of $filter")
+	}
+	p.pos++
+
+	switch {
+	case t.kind == tokenOpen:
+		expr, err = p.parseOr()
+		if err == nil {
+			err = p.expect(tokenClose)
+		}
+		return
+	case t.isLiteral():
+		value := t.value()
+		return func(map[string]any) any { return value }, nil
+	case t.kind != tokenWord:
+		return nil, fmt.Errorf("Unexpected %v in $filter", t.text)
+	}
+
+	next, ok := p.peek()
+	if !ok || next.kind != tokenOpen {
+		column := t.text
+		return func(row map[string]any) any { return row[column] }, nil
+	}
+
+	// Function call.
+	p.pos++
+	var args []filterExpr
+	for {
+		arg, errArg := p.parseOr()
+		if errArg != nil {
+			return nil, errArg
+		}
+		args = append(args, arg)
+		if next, _ := p.peek(); next.kind != tokenComma {
+			break
+		}
+		p.pos++
+	}
+	if err = p.expect(tokenClose); err != nil {
+		return
+	}
+	return compileFunction(t.text, args)
+}
+
+// compileFunction compiles a call to one of the supported string functions.
+func compileFunction(name string, args []filterExpr) (expr filterExpr, err error) {
+	str := func(v any) string {
+		if v == nil {
+			return ""
+		}
+		return strings.ToLower(fmt.Sprint(v))
+	}
+
+	switch {
+	case (name == "tolower" || name == "toupper") && len(args) == 1:
+		return func(row map[string]any) any {
+			if name == "toupper" {
+				return strings.ToUpper(fmt.Sprint(args[0](row)))
+			}
+			return strings.ToLower(fmt.Sprint(args[0](row)))
+		}, nil
+	case len(args) != 2:
+		return nil, fmt.Errorf("Unsupported function %v with %v arguments", name, len(args))
+	}
+
+	var match func(s string, sub string) bool
+	switch name {
+	case "contains":
+		match = strings.Contains
+	case "startswith":
+		match = strings.HasPrefix
+	case "endswith":
+		match = strings.HasSuffix
+	default:
+		return nil, fmt.Errorf("Unsupported function %v", name)
+	}
+	return func(row map[string]any) any { return match(str(args[0](row)), str(args[1](row))) }, nil
+}
@@ -0,0 +1,835 @@
+// Package dataversetest provides an in-memory Dataverse Web API server for tests.
+//
+// The server keeps the entries of its entity sets in memory and handles the requests sent by the
+// dataversego package: retrieve and retrieve multiple with $select, $filter, $top and $orderby, create (POST),
+// update and upsert (PATCH), delete, associations ($ref), $batch and the entity definitions of the registered
+// entity sets, with the metadata of their attributes. Numbers are stored with their precision. The return=representation and odata.include-annotations preferences are honored: the annotations
+// stored with an entry (e.g. "statuscode@OData.Community.Display.V1.FormattedValue") and the annotations of the
+// lookups are returned when requested. Faults such as throttling (429) or concurrency errors (412) can be injected,
+// and any other endpoint (functions, actions...) can be served by a custom handler.
+//
+// The package also provides a 'Cassette', a transport recording the requests sent to a real organization to
+// golden files and replaying them, for integration tests without network, and a 'TokenServer' standing in
+// for the token endpoints of the Microsoft identity platform and of the managed identities.
+//
+// Example:
+//
+//	server := dataversetest.NewServer()
+//	defer server.Close()
+//	server.AddEntitySet(dataversetest.EntitySet{Name: "contacts", LogicalName: "contact", PrimaryIdAttribute: "contactid"})
+//	id := server.Insert("contacts", map[string]any{"fullname": "John Doe"})
+//	ent, err := dataversego.Retrieve(dataversego.RetrieveSignature{
+//	  Auth: dataversego.Authorization{Token: "token", Url: server.URL},
+//	  TableName: "contacts",
+//	  Id: id,
+//	})
+package dataversetest
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+)
+
+// The 'EntitySet' struct describes an entity set of the server.
+// It contains the following fields:
+//   - Name: the name of the entity set, used in the urls (e.g. "contacts")
+//   - LogicalName: the logical name of the table (e.g. "contact")
+//   - PrimaryIdAttribute: the name of the primary key column (e.g. "contactid")
+//   - Lookups: the lookup columns of the table, returned as many-to-one relationships by the entity definitions
+//   - Attributes: the metadata of the columns of the table, returned by the attributes of the entity definitions
+//
+// Entity sets that are not registered are created on first use, with the logical name and the primary key
+// derived from the name (e.g. "contact" and "contactid" for "contacts").
+type EntitySet struct {
+	Name               string
+	LogicalName        string
+	PrimaryIdAttribute string
+	Lookups            []Lookup
+	Attributes         []Attribute
+}
+
+// The 'Attribute' struct describes the metadata of a column of a table, served at
+// "EntityDefinitions(LogicalName='<table>')/Attributes(LogicalName='<column>')", optionally cast to its type
+// (e.g. "/Microsoft.Dynamics.CRM.MoneyAttributeMetadata").
+// It contains the following fields:
+//   - LogicalName: the logical name of the column (e.g. "creditlimit")
+//   - Type: the type of the metadata (e.g. "MoneyAttributeMetadata" or "DateTimeAttributeMetadata")
+//   - Properties: the properties of the metadata (e.g. {"Precision": 2, "PrecisionSource": 0})
+type Attribute struct {
+	LogicalName string
+	Type        string
+	Properties  map[string]any
+}
+
+// The 'Lookup' struct describes a lookup column of a table.
+// It contains the following fields:
+//   - Attribute: the logical name of the lookup column (e.g. "parentcustomerid")
+//   - ReferencedEntity: the logical name of the referenced table (e.g. "account")
+//   - NavigationProperty: the single-valued navigation property of the lookup (e.g. "parentcustomerid_account")
+//
+// Values bound through "<NavigationProperty>@odata.bind" are stored in the "_<Attribute>_value" column.
+type Lookup struct {
+	Attribute          string
+	ReferencedEntity   string
+	NavigationProperty string
+}
+
+// The 'Fault' struct describes an error returned by the server instead of handling a request.
+// It contains the following fields:
+//   - Method: the method of the requests to fail, every method if empty
+//   - Path: the prefix of the path of the requests to fail, relative to the api root (e.g. "contacts" or "$batch"),
+//     every path if empty. The operations of a batch are matched as well as the batch request itself.
+//   - StatusCode: the status code of the error (e.g. 429 or 412)
+//   - Header: additional headers of the response (e.g. Retry-After)
+//   - Times: the number of requests to fail, every request if 0
+type Fault struct {
+	Method     string
+	Path       string
+	StatusCode int
+	Header     http.Header
+	Times      int
+}
+
+// The 'RecordedRequest' struct represents a request received by the server.
+// It contains the following fields:
+//   - Method: the method of the request
+//   - Path: the path of the request relative to the api root, with the query (e.g. "contacts?$select=fullname")
+//   - Header: the headers of the request
+//   - Body: the body of the request
+type RecordedRequest struct {
+	Method string
+	Path   string
+	Header http.Header
+	Body   []byte
+}
+
+// The 'Server' struct is an in-memory Dataverse Web API server, listening on a local address.
+// It contains the following fields:
+//   - URL: the url of the organization, to be used as 'Url' of the authorization
+type Server struct {
+	URL string
+
+	server   *httptest.Server
+	mu       sync.Mutex
+	sets     map[string]*entitySet
+	faults   []*fault
+	handlers map[string]http.HandlerFunc
+	requests []RecordedRequest
+	version  int64
+}
+
+// entitySet holds the entries of an entity set, in insertion order.
+type entitySet struct {
+	EntitySet
+	ids          []string
+	rows         map[string]map[string]any
+	associations map[string][]string
+}
+
+// fault is an injected fault with the number of requests already failed.
+type fault struct {
+	Fault
+	served int
+}
+
+// errorCodes are the dataverse error codes of the status codes returned by the server.
+var errorCodes = map[int]string{
+	http.StatusBadRequest:         "0x80040203",
+	http.StatusNotFound:           "0x80040217",
+	http.StatusPreconditionFailed: "0x80060882",
+	http.StatusTooManyRequests:    "0x80072322",
+	http.StatusNotImplemented:     "0x80040216",
+}
+
+// NewServer starts a new in-memory server. It must be closed with Close when done.
+//
+// Example:
+//
+//	server := dataversetest.NewServer()
+//	defer server.Close()
+func NewServer() *Server {
+	s := &Server{
+		sets:     map[string]*entitySet{},
+		handlers: map[string]http.HandlerFunc{},
+	}
+	s.server = httptest.NewServer(s)
+	s.URL = s.server.URL
+	return s
+}
+
+// Close shuts down the server.
+func (s *Server) Close() {
+	s.server.Close()
+}
+
+// AddEntitySet registers an entity set, replacing any entity set with the same name and its entries.
+func (s *Server) AddEntitySet(set EntitySet) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(set.LogicalName) == 0 {
+		set.LogicalName = logicalName(set.Name)
+	}
+	if len(set.PrimaryIdAttribute) == 0 {
+		set.PrimaryIdAttribute = set.LogicalName + "id"
+	}
+	s.sets[set.Name] = &entitySet{
+		EntitySet:    set,
+		rows:         map[string]map[string]any{},
+		associations: map[string][]string{},
+	}
+}
+
+// Insert adds an entry to an entity set, as a POST request would, and returns its ID.
+// The ID is generated if the primary key column is not set.
+//
+// Example:
+//
+//	id := server.Insert("contacts", map[string]any{"fullname": "John Doe"})
+func (s *Server) Insert(entitySet string, row map[string]any) (id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	set := s.entitySet(entitySet)
+	id, _ = row[set.PrimaryIdAttribute].(string)
+	if len(id) == 0 {
+		id = newGUID()
+	}
+	s.store(set, id, row)
+	return
+}
+
+// Row returns a copy of an entry of an entity set, and whether it exists.
+func (s *Server) Row(entitySet string, id string) (row map[string]any, ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored, ok := s.entitySet(entitySet).rows[strings.ToLower(id)]
+	if ok {
+		row = copyRow(stored)
+	}
+	return
+}
+
+// Rows returns a copy of the entries of an entity set, in insertion order.
+func (s *Server) Rows(entitySet string) (rows []map[string]any) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	set := s.entitySet(entitySet)
+	for _, id := range set.ids {
+		rows = append(rows, copyRow(set.rows[id]))
+	}
+	return
+}
+
+// Associations returns the urls of the entries associated to an entry through a collection-valued
+// navigation property (e.g. a many-to-many relationship).
+func (s *Server) Associations(entitySet string, id string, relationship string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]string(nil), s.entitySet(entitySet).associations[associationKey(id, relationship)]...)
+}
+
+// InjectFault makes the server return an error for the requests matching the fault.
+//
+// Example:
+//
+//	server.InjectFault(dataversetest.Fault{
+//	  StatusCode: http.StatusTooManyRequests,
+//	  Header: http.Header{"Retry-After": {"1"}},
+//	  Times: 1,
+//	})
+func (s *Server) InjectFault(f Fault) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.faults = append(s.faults, &fault{Fault: f})
+}
+
+// Handle registers a handler for the requests with the given method and path, relative to the api root and
+// without query (e.g. "WhoAmI()" or "accounts(123)/Microsoft.Dynamics.CRM.new_Action"). Handlers take
+// precedence over the entity sets.
+//
+// Example:
+//
+//	server.Handle("GET", "WhoAmI()", func(w http.ResponseWriter, r *http.Request) {
+//	  json.NewEncoder(w).Encode(map[string]any{"UserId": "123"})
+//	})
+func (s *Server) Handle(method string, path string, handler http.HandlerFunc) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.handlers[method+" "+path] = handler
+}
+
+// Requests returns the requests received by the server, including the operations of the batches.
+func (s *Server) Requests() []RecordedRequest {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]RecordedRequest(nil), s.requests...)
+}
+
+// ServeHTTP handles a request sent to the server.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	version, path, ok := apiPath(r.URL.Path)
+	if !ok {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("Resource not found: %v", r.URL.Path))
+		return
+	}
+	s.serve(w, r, version, path)
+}
+
+// INTERNAL METHODS
+
+func (s *Server) serve(w http.ResponseWriter, r *http.Request, version string, path string) {
+	body, _ := io.ReadAll(r.Body)
+	r.Body = io.NopCloser(bytes.NewReader(body))
+
+	recordedPath := path
+	if len(r.URL.RawQuery) > 0 {
+		recordedPath += "?" + r.URL.RawQuery
+	}
+	s.mu.Lock()
+	s.requests = append(s.requests, RecordedRequest{Method: r.Method, Path: recordedPath, Header: r.Header.Clone(), Body: body})
+	handler := s.handlers[r.Method+" "+path]
+	s.mu.Unlock()
+
+	if f := s.takeFault(r.Method, path); f != nil {
+		for key, values := range f.Header {
+			w.Header()[key] = values
+		}
+		writeError(w, f.StatusCode, http.StatusText(f.StatusCode))
+		return
+	}
+
+	switch {
+	case path == "$batch" && r.Method == http.MethodPost:
+		s.serveBatch(w, r)
+	case handler != nil:
+		handler(w, r)
+	default:
+		s.serveEntitySet(w, r, version, path, body)
+	}
+}
+
+// takeFault returns the first fault matching a request, if any, and removes the faults used up.
+func (s *Server) takeFault(method string, path string) *Fault {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, f := range s.faults {
+		if len(f.Method) > 0 && f.Method != method || !strings.HasPrefix(path, f.Path) {
+			continue
+		}
+		f.served++
+		if f.Times > 0 && f.served >= f.Times {
+			s.faults = append(s.faults[:i], s.faults[i+1:]...)
+		}
+		return &f.Fault
+	}
+	return nil
+}
+
+func (s *Server) serveEntitySet(w http.ResponseWriter, r *http.Request, version string, path string, body []byte) {
+	segments := strings.Split(path, "/")
+	name, key, hasKey := parseSegment(segments[0])
+	base := fmt.Sprintf("%v/api/data/%v/", s.URL, version)
+
+	if name == "EntityDefinitions" && r.Method == http.MethodGet && len(segments) == 1 {
+		s.serveEntityDefinitions(w, r, base, key, hasKey)
+		return
+	}
+	if name == "EntityDefinitions" && r.Method == http.MethodGet && hasKey && len(segments) <= 3 && strings.HasPrefix(segments[1], "Attributes(") {
+		s.serveAttribute(w, r, key, segments[1:])
+		return
+	}
+
+	switch {
+	case len(segments) == 1 && !hasKey && r.Method == http.MethodGet:
+		s.retrieveMultiple(w, r, base, name)
+	case len(segments) == 1 && hasKey && r.Method == http.MethodGet:
+		s.retrieve(w, r, base, name, key)
+	case len(segments) == 1 && !hasKey && r.Method == http.MethodPost:
+		s.create(w, r, base, name, body)
+	case len(segments) == 1 && hasKey && r.Method == http.MethodPatch:
+		s.upsert(w, r, base, name, key, body)
+	case len(segments) == 1 && hasKey && r.Method == http.MethodDelete:
+		s.delete(w, r, name, key)
+	case len(segments) == 3 && hasKey && segments[2] == "$ref" && r.Method == http.MethodPost:
+		s.associate(w, name, key, segments[1], body)
+	case len(segments) == 3 && hasKey && segments[2] == "$ref" && r.Method == http.MethodDelete:
+		s.disassociate(w, r, name, key, segments[1])
+	default:
+		writeError(w, http.StatusNotImplemented, fmt.Sprintf("Not implemented by dataversetest: %v %v", r.Method, path))
+	}
+}
+
+func (s *Server) retrieveMultiple(w http.ResponseWriter, r *http.Request, base string, name string) {
+	s.mu.Lock()
+	set := s.entitySet(name)
+	rows := make([]map[string]any, 0, len(set.ids))
+	for _, id := range set.ids {
+		rows = append(rows, set.rows[id])
+	}
+	rows, err := applyQuery(rows, r.URL.Query(), set.PrimaryIdAttribute)
+	for i := range rows {
+		id, _ := rows[i][set.PrimaryIdAttribute].(string)
+		rows[i] = annotate(rows[i], set.rows[strings.ToLower(id)], set.Lookups, r.Header.Get("Prefer"))
+	}
+	s.mu.Unlock()
+
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"@odata.context": base + "$metadata#" + name,
+		"value":          rows,
+	})
+}
+
+func (s *Server) retrieve(w http.ResponseWriter, r *http.Request, base string, name string, key string) {
+	s.mu.Lock()
+	set := s.entitySet(name)
+	id, row := s.find(set, key)
+	if row != nil {
+		row = annotate(selectColumns(row, r.URL.Query(), set.PrimaryIdAttribute), row, set.Lookups, r.Header.Get("Prefer"))
+		row["@odata.context"] = base + "$metadata#" + name + "/$entity"
+	}
+	s.mu.Unlock()
+
+	if row == nil {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("%v With Id = %v Does Not Exist", set.LogicalName, id))
+		return
+	}
+	writeJSON(w, http.StatusOK, row)
+}
+
+func (s *Server) create(w http.ResponseWriter, r *http.Request, base string, name string, body []byte) {
+	var row map[string]any
+	if err := readRow(body, &row); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	s.mu.Lock()
+	set := s.entitySet(name)
+	id, _ := row[set.PrimaryIdAttribute].(string)
+	if len(id) == 0 {
+		id = newGUID()
+	}
+	if _, exists := set.rows[strings.ToLower(id)]; exists {
+		s.mu.Unlock()
+		writeError(w, http.StatusPreconditionFailed, "A record with matching key values already exists.")
+		return
+	}
+	stored := s.store(set, id, row)
+	stored = annotate(selectColumns(stored, r.URL.Query(), set.PrimaryIdAttribute), stored, set.Lookups, r.Header.Get("Prefer"))
+	stored["@odata.context"] = base + "$metadata#" + name + "/$entity"
+	s.mu.Unlock()
+
+	w.Header().Set("OData-EntityId", fmt.Sprintf("%v%v(%v)", base, name, id))
+	if strings.Contains(r.Header.Get("Prefer"), "return=representation") {
+		writeJSON(w, http.StatusCreated, stored)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) upsert(w http.ResponseWriter, r *http.Request, base string, name string, key string, body []byte) {
+	var row map[string]any
+	if err := readRow(body, &row); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	s.mu.Lock()
+	set := s.entitySet(name)
+	id, existing := s.find(set, key)
+	status, message := checkPreconditions(r, existing)
+	if status != 0 {
+		s.mu.Unlock()
+		writeError(w, status, message)
+		return
+	}
+	if existing == nil {
+		// Alternate keys are set on the new entry.
+		if keys, ok := parseAlternateKeys(key); ok {
+			for k, v := range keys {
+				row[k] = v
+			}
+		}
+	}
+	stored := s.store(set, id, row)
+	stored = annotate(selectColumns(stored, r.URL.Query(), set.PrimaryIdAttribute), stored, set.Lookups, r.Header.Get("Prefer"))
+	stored["@odata.context"] = base + "$metadata#" + name + "/$entity"
+	s.mu.Unlock()
+
+	w.Header().Set("OData-EntityId", fmt.Sprintf("%v%v(%v)", base, name, id))
+	if strings.Contains(r.Header.Get("Prefer"), "return=representation") {
+		writeJSON(w, http.StatusOK, stored)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) delete(w http.ResponseWriter, r *http.Request, name string, key string) {
+	s.mu.Lock()
+	set := s.entitySet(name)
+	id, existing := s.find(set, key)
+	if existing == nil {
+		s.mu.Unlock()
+		writeError(w, http.StatusNotFound, fmt.Sprintf("%v With Id = %v Does Not Exist", set.LogicalName, id))
+		return
+	}
+	if status, message := checkPreconditions(r, existing); status != 0 {
+		s.mu.Unlock()
+		writeError(w, status, message)
+		return
+	}
+	id = strings.ToLower(id)
+	delete(set.rows, id)
+	for i := range set.ids {
+		if set.ids[i] == id {
+			set.ids = append(set.ids[:i], set.ids[i+1:]...)
+			break
+		}
+	}
+	s.mu.Unlock()
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) associate(w http.ResponseWriter, name string, key string, relationship string, body []byte) {
+	var ref struct {
+		Id string `json:"@odata.id"`
+	}
+	if err := json.Unmarshal(body, &ref); err != nil || len(ref.Id) == 0 {
+		writeError(w, http.StatusBadRequest, "Missing @odata.id")
+		return
+	}
+
+	s.mu.Lock()
+	set := s.entitySet(name)
+	id, existing := s.find(set, key)
+	if existing != nil {
+		k := associationKey(id, relationship)
+		set.associations[k] = append(set.associations[k], ref.Id)
+	}
+	s.mu.Unlock()
+
+	if existing == nil {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("%v With Id = %v Does Not Exist", set.LogicalName, id))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) disassociate(w http.ResponseWriter, r *http.Request, name string, key string, relationship string) {
+	target := r.URL.Query().Get("$id")
+
+	s.mu.Lock()
+	set := s.entitySet(name)
+	id, existing := s.find(set, key)
+	if existing != nil {
+		k := associationKey(id, relationship)
+		var kept []string
+		for _, associated := range set.associations[k] {
+			if len(target) > 0 && associated != target {
+				kept = append(kept, associated)
+			}
+		}
+		set.associations[k] = kept
+	}
+	s.mu.Unlock()
+
+	if existing == nil {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("%v With Id = %v Does Not Exist", set.LogicalName, id))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// serveEntityDefinitions serves the entity definitions of the entity sets, with their lookups as many-to-one relationships.
+func (s *Server) serveEntityDefinitions(w http.ResponseWriter, r *http.Request, base string, key string, hasKey bool) {
+	s.mu.Lock()
+	var rows []map[string]any
+	for _, set := range s.sets {
+		relationships := []any{}
+		for _, lookup := range set.Lookups {
+			relationships = append(relationships, map[string]any{
+				"SchemaName":           fmt.Sprintf("%v_%v", set.LogicalName, lookup.NavigationProperty),
+				"ReferencingAttribute": lookup.Attribute,
+				"ReferencedEntity":     lookup.ReferencedEntity,
+				"ReferencingEntityNavigationPropertyName": lookup.NavigationProperty,
+			})
+		}
+		rows = append(rows, map[string]any{
+			"MetadataId":             set.Name,
+			"LogicalName":            set.LogicalName,
+			"EntitySetName":          set.Name,
+			"PrimaryIdAttribute":     set.PrimaryIdAttribute,
+			"ManyToOneRelationships": relationships,
+		})
+	}
+	s.mu.Unlock()
+
+	if hasKey {
+		keys, _ := parseAlternateKeys(key)
+		for _, row := range rows {
+			if matchKeys(row, keys) {
+				writeJSON(w, http.StatusOK, selectColumns(row, r.URL.Query(), "MetadataId"))
+				return
+			}
+		}
+		writeError(w, http.StatusNotFound, fmt.Sprintf("Could not find entity %v", key))
+		return
+	}
+
+	rows, err := applyQuery(rows, r.URL.Query(), "MetadataId")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"@odata.context": base + "$metadata#EntityDefinitions",
+		"value":          rows,
+	})
+}
+
+// serveAttribute serves the metadata of a column of an entity set, the segments being the attribute key and the
+// optional cast to its type.
+func (s *Server) serveAttribute(w http.ResponseWriter, r *http.Request, key string, segments []string) {
+	tableKeys, _ := parseAlternateKeys(key)
+	_, attributeKey, _ := parseSegment(segments[0])
+	attributeKeys, _ := parseAlternateKeys(attributeKey)
+
+	s.mu.Lock()
+	var attribute *Attribute
+	for _, set := range s.sets {
+		if set.LogicalName != tableKeys["LogicalName"] {
+			continue
+		}
+		for i := range set.Attributes {
+			if set.Attributes[i].LogicalName == attributeKeys["LogicalName"] {
+				attribute = &set.Attributes[i]
+			}
+		}
+	}
+	var row map[string]any
+	if attribute != nil {
+		row = map[string]any{
+			"@odata.type": "#Microsoft.Dynamics.CRM." + attribute.Type,
+			"MetadataId":  attribute.LogicalName,
+			"LogicalName": attribute.LogicalName,
+		}
+		for property, value := range attribute.Properties {
+			row[property] = value
+		}
+	}
+	s.mu.Unlock()
+
+	if attribute == nil || len(segments) == 2 && segments[1] != "Microsoft.Dynamics.CRM."+attribute.Type {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("Could not find attribute %v", attributeKey))
+		return
+	}
+	writeJSON(w, http.StatusOK, selectColumns(row, r.URL.Query(), "MetadataId"))
+}
+
+// entitySet returns an entity set by name, creating it if needed. The lock must be held.
+func (s *Server) entitySet(name string) *entitySet {
+	set, ok := s.sets[name]
+	if !ok {
+		set = &entitySet{
+			EntitySet:    EntitySet{Name: name, LogicalName: logicalName(name), PrimaryIdAttribute: logicalName(name) + "id"},
+			rows:         map[string]map[string]any{},
+			associations: map[string][]string{},
+		}
+		s.sets[name] = set
+	}
+	return set
+}
+
+// find returns the ID and the entry matching a key, either an ID or alternate keys. The lock must be held.
+// The returned ID is the key itself, or a new ID for unknown alternate keys.
+func (s *Server) find(set *entitySet, key string) (id string, row map[string]any) {
+	keys, ok := parseAlternateKeys(key)
+	if !ok {
+		return key, set.rows[strings.ToLower(key)]
+	}
+	for _, id := range set.ids {
+		if matchKeys(set.rows[id], keys) {
+			return id, set.rows[id]
+		}
+	}
+	return newGUID(), nil
+}
+
+// store merges the columns into the entry with the given ID, creating it if needed, and returns it.
+// The lock must be held.
+func (s *Server) store(set *entitySet, id string, row map[string]any) map[string]any {
+	id = strings.ToLower(id)
+	stored, ok := set.rows[id]
+	if !ok {
+		stored = map[string]any{}
+		set.rows[id] = stored
+		set.ids = append(set.ids, id)
+	}
+
+	for key, value := range row {
+		navigation, isBind := strings.CutSuffix(key, "@odata.bind")
+		if !isBind {
+			stored[key] = value
+			continue
+		}
+		attribute := navigation
+		for _, lookup := range set.Lookups {
+			if lookup.NavigationProperty == navigation {
+				attribute = lookup.Attribute
+			}
+		}
+		ref, _ := value.(string)
+		_, refKey, _ := parseSegment(ref[strings.LastIndex(ref, "/")+1:])
+		stored[fmt.Sprintf("_%v_value", attribute)] = refKey
+	}
+
+	s.version++
+	stored[set.PrimaryIdAttribute] = id
+	stored["@odata.etag"] = fmt.Sprintf(`W/"%v"`, s.version)
+	return stored
+}
+
+// checkPreconditions checks the If-Match and If-None-Match headers of a request against an entry, nil if missing.
+func checkPreconditions(r *http.Request, existing map[string]any) (status int, message string) {
+	ifMatch := r.Header.Get("If-Match")
+	ifNoneMatch := r.Header.Get("If-None-Match")
+	switch {
+	case ifMatch == "*" && existing == nil:
+		return http.StatusNotFound, "The record doesn't exist."
+	case len(ifMatch) > 0 && ifMatch != "*" && (existing == nil || existing["@odata.etag"] != ifMatch):
+		return http.StatusPreconditionFailed, "The version of the existing record doesn't match the RowVersion property provided."
+	case ifNoneMatch == "*" && existing != nil:
+		return http.StatusPreconditionFailed, "A record with matching key values already exists."
+	}
+	return
+}
+
+// apiPath splits the path of a request into the version of the api and the path relative to the api root.
+//
+// Example:
+//
+//	version, path, _ := apiPath("/api/data/v9.1/contacts(123)")
+//	fmt.Println(version, path) // v9.1 contacts(123)
+func apiPath(requestPath string) (version string, path string, ok bool) {
+	rest, ok := strings.CutPrefix(strings.TrimLeft(requestPath, "/"), "api/data/")
+	if !ok {
+		return
+	}
+	version, path, ok = strings.Cut(rest, "/")
+	return
+}
+
+// parseSegment splits a path segment into the name and the key in parentheses, if any.
+func parseSegment(segment string) (name string, key string, hasKey bool) {
+	name, key, hasKey = strings.Cut(segment, "(")
+	key = strings.TrimSuffix(key, ")")
+	return
+}
+
+// parseAlternateKeys parses alternate keys (e.g. "accountnumber='123',name='O”Neil'").
+// It returns false if the key is an ID.
+func parseAlternateKeys(key string) (keys map[string]any, ok bool) {
+	if !strings.Contains(key, "=") {
+		return
+	}
+	tokens, err := tokenize(key)
+	if err != nil {
+		return
+	}
+	keys = map[string]any{}
+	for i := 0; i < len(tokens); i += 4 {
+		if i+2 >= len(tokens) || tokens[i].kind != tokenWord || tokens[i+1].kind != tokenEquals {
+			return nil, false
+		}
+		keys[tokens[i].text] = tokens[i+2].value()
+	}
+	ok = len(keys) > 0
+	return
+}
+
+// matchKeys reports whether an entry has the values of the alternate keys.
+func matchKeys(row map[string]any, keys map[string]any) bool {
+	for k, v := range keys {
+		if c, ok := compareValues(row[k], v); !ok || c != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func associationKey(id string, relationship string) string {
+	return strings.ToLower(id) + "|" + relationship
+}
+
+// logicalName derives the logical name of a table from its entity set name (e.g. "contact" for "contacts").
+func logicalName(entitySet string) string {
+	if name, ok := strings.CutSuffix(entitySet, "ies"); ok {
+		return name + "y"
+	}
+	return strings.TrimSuffix(entitySet, "s")
+}
+
+func copyRow(row map[string]any) map[string]any {
+	copied := make(map[string]any, len(row))
+	for k, v := range row {
+		copied[k] = v
+	}
+	return copied
+}
+
+// newGUID returns a random (version 4) GUID.
+func newGUID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// readRow decodes the JSON body of a request, keeping the precision of its numbers as the Web API does.
+func readRow(body []byte, row *map[string]any) error {
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	return decoder.Decode(row)
+}
+
+func writeJSON(w http.ResponseWriter, status int, body any) {
+	w.Header().Set("Content-Type", "application/json; odata.metadata=minimal")
+	w.Header().Set("OData-Version", "4.0")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+// writeError writes an error in the format of the Web API.
+func writeError(w http.ResponseWriter, status int, message string) {
+	code, ok := errorCodes[status]
+	if !ok {
+		code = errorCodes[http.StatusNotImplemented]
+	}
+	writeJSON(w, status, map[string]any{
+		"error": map[string]any{
+			"code":    code,
+			"message": message,
+		},
+	})
+}
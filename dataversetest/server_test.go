@@ -0,0 +1,145 @@
+package dataversetest
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func get(t *testing.T, rawURL string) (status int, body map[string]any) {
+	resp, err := http.Get(rawURL)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer resp.Body.Close()
+	json.NewDecoder(resp.Body).Decode(&body)
+	return resp.StatusCode, body
+}
+
+func TestQuery(t *testing.T) {
+	server := NewServer()
+	defer server.Close()
+	for i, name := range []string{"Kate", "Carl", "John", "Claire", "O'Neil"} {
+		server.Insert("contacts", map[string]any{"fullname": name, "age": 20 + i*5, "parentcustomerid": nil})
+	}
+
+	cases := []struct {
+		query    string
+		expected string
+	}{
+		{"$filter=" + url.QueryEscape("(startswith(fullname,'K') or startswith(fullname,'c'))"), "Kate,Carl,Claire"},
+		{"$filter=" + url.QueryEscape("age ge 30 and not contains(fullname,'oh')"), "Claire,O'Neil"},
+		{"$filter=" + url.QueryEscape("fullname eq 'O''Neil'"), "O'Neil"},
+		{"$filter=" + url.QueryEscape("parentcustomerid eq null and age lt 25"), "Kate"},
+		{"$orderby=" + url.QueryEscape("fullname desc") + "&$top=2", "O'Neil,Kate"},
+	}
+	for _, c := range cases {
+		status, body := get(t, server.URL+"/api/data/v9.2/contacts?$select=fullname&"+c.query)
+		if status != http.StatusOK {
+			t.Fatalf("%v: status %v %v", c.query, status, body)
+		}
+		var names []string
+		for _, value := range body["value"].([]any) {
+			row := value.(map[string]any)
+			if _, ok := row["age"]; ok {
+				t.Fatalf("Column not selected returned: %v", row)
+			}
+			names = append(names, row["fullname"].(string))
+		}
+		if strings.Join(names, ",") != c.expected {
+			t.Errorf("%v: got %v, expected %v", c.query, names, c.expected)
+		}
+	}
+
+	if status, _ := get(t, server.URL+"/api/data/v9.2/contacts?$filter="+url.QueryEscape("fullname eq 'unterminated")); status != http.StatusBadRequest {
+		t.Fatalf("Expected bad request, got %v", status)
+	}
+}
+
+func TestConcurrency(t *testing.T) {
+	server := NewServer()
+	defer server.Close()
+	server.AddEntitySet(EntitySet{Name: "accounts", PrimaryIdAttribute: "accountid"})
+	id := server.Insert("accounts", map[string]any{"accountnumber": "A1", "name": "Contoso"})
+	row, _ := server.Row("accounts", id)
+
+	patch := func(path string, header http.Header) int {
+		req, _ := http.NewRequest("PATCH", server.URL+"/api/data/v9.1/"+path, strings.NewReader(`{"name": "Fabrikam"}`))
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	if status := patch("accounts(accountnumber='A1')", http.Header{"If-Match": {`W/"0"`}}); status != http.StatusPreconditionFailed {
+		t.Fatalf("Expected precondition failed, got %v", status)
+	}
+	if status := patch("accounts(accountnumber='A1')", http.Header{"If-Match": {row["@odata.etag"].(string)}}); status != http.StatusNoContent {
+		t.Fatalf("Expected no content, got %v", status)
+	}
+	if updated, _ := server.Row("accounts", id); updated["name"] != "Fabrikam" {
+		t.Fatalf("Entry not updated: %v", updated)
+	}
+	if status := patch("accounts(accountnumber='A2')", http.Header{"If-Match": {"*"}}); status != http.StatusNotFound {
+		t.Fatalf("Expected not found, got %v", status)
+	}
+	if status := patch("accounts(accountnumber='A2')", nil); status != http.StatusNoContent || len(server.Rows("accounts")) != 2 {
+		t.Fatalf("Entry not upserted: %v", status)
+	}
+
+	server.InjectFault(Fault{StatusCode: http.StatusTooManyRequests, Header: http.Header{"Retry-After": {"1"}}, Times: 1})
+	resp, _ := http.Get(server.URL + "/api/data/v9.1/accounts")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusTooManyRequests || resp.Header.Get("Retry-After") != "1" {
+		t.Fatalf("Fault not injected: %v", resp.StatusCode)
+	}
+	if status, _ := get(t, server.URL+"/api/data/v9.1/accounts"); status != http.StatusOK {
+		t.Fatalf("Fault not removed: %v", status)
+	}
+}
+
+func TestEntityDefinitions(t *testing.T) {
+	server := NewServer()
+	defer server.Close()
+	server.AddEntitySet(EntitySet{
+		Name:        "contacts",
+		LogicalName: "contact",
+		Lookups:     []Lookup{{Attribute: "parentcustomerid", ReferencedEntity: "account", NavigationProperty: "parentcustomerid_account"}},
+	})
+
+	status, body := get(t, server.URL+"/api/data/v9.1/EntityDefinitions?$select=LogicalName,EntitySetName,PrimaryIdAttribute&$filter="+
+		url.QueryEscape("EntitySetName eq 'contacts'")+"&$expand=ManyToOneRelationships($select=ReferencingAttribute)")
+	values, _ := body["value"].([]any)
+	if status != http.StatusOK || len(values) != 1 {
+		t.Fatalf("Wrong definitions: %v %v", status, body)
+	}
+	def := values[0].(map[string]any)
+	if def["PrimaryIdAttribute"] != "contactid" || len(def["ManyToOneRelationships"].([]any)) != 1 {
+		t.Fatalf("Wrong definition: %v", def)
+	}
+
+	if _, body = get(t, server.URL+"/api/data/v9.1/EntityDefinitions(LogicalName='contact')?$select=EntitySetName"); body["EntitySetName"] != "contacts" {
+		t.Fatalf("Wrong definition: %v", body)
+	}
+
+	// Lookups are bound through their navigation property.
+	req, _ := http.NewRequest("POST", server.URL+"/api/data/v9.1/contacts", strings.NewReader(`{"parentcustomerid_account@odata.bind": "/accounts(123)"}`))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	resp.Body.Close()
+	if rows := server.Rows("contacts"); len(rows) != 1 || rows[0]["_parentcustomerid_value"] != "123" {
+		t.Fatalf("Lookup not bound: %v", rows)
+	}
+	if !strings.HasPrefix(resp.Header.Get("OData-EntityId"), server.URL+"/api/data/v9.1/contacts(") {
+		t.Fatalf("Wrong entity id: %v", resp.Header.Get("OData-EntityId"))
+	}
+}
@@ -0,0 +1,339 @@
+package dataversetest
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// IdentityHeader is the secret expected by the App Service managed identity endpoint of a 'TokenServer'.
+const IdentityHeader = "identity-header"
+
+// The 'TokenServer' struct is a stand-in for the Microsoft identity platform and the managed identity endpoints,
+// issuing opaque tokens ("token-1", "token-2"...) to test the token providers. It serves:
+//   - POST /{tenant}/oauth2/v2.0/token: the token endpoint, set as 'AuthorityHost' of a requests.Client, with the
+//     client credentials, device code, authorization code (PKCE) and refresh token grants
+//   - POST /{tenant}/oauth2/v2.0/devicecode: the device code endpoint, the codes being approved by ApproveDeviceCode
+//   - GET /{tenant}/oauth2/v2.0/authorize: the authorization endpoint, signing the user in without interaction and
+//     redirecting to the redirect URI with the authorization code
+//   - GET /metadata/identity/oauth2/token: the Instance Metadata Service endpoint, requiring the "Metadata: true" header
+//   - GET /msi/token: the App Service endpoint (IDENTITY_ENDPOINT), requiring the IdentityHeader secret
+//
+// It contains the following fields:
+//   - URL: the base URL of the server
+//   - ExpiresIn: the validity of the tokens in seconds, 3599 by default
+//   - DeviceCodeInterval: the polling interval of the device code flow in seconds, 1 by default
+//
+// Refresh tokens ("refresh-1"...) are issued by the delegated grants, and rotated when redeemed.
+//
+// Example:
+//
+//	tokens := dataversetest.NewTokenServer()
+//	defer tokens.Close()
+//	tokens.AddClient("clientid", "secret")
+//	client := &requests.Client{AuthorityHost: tokens.URL}
+//	token, err := client.GetAuthorization("clientid", "secret", "tenantid", "https://org.crm.dynamics.com")
+type TokenServer struct {
+	URL                string
+	ExpiresIn          int
+	DeviceCodeInterval int
+
+	server        *httptest.Server
+	mu            sync.Mutex
+	clients       map[string]string
+	issued        int
+	requests      []TokenRequest
+	deviceCodes   map[string]*deviceCode
+	authCodes     map[string]authCode
+	refreshTokens map[string]bool
+}
+
+// deviceCode is a device code issued by a 'TokenServer'.
+type deviceCode struct {
+	userCode string
+	approved bool
+}
+
+// authCode is an authorization code issued by a 'TokenServer', with its PKCE challenge.
+type authCode struct {
+	challenge   string
+	redirectUri string
+}
+
+// The 'TokenRequest' struct is a request received by a 'TokenServer'.
+// It contains the following fields:
+//   - Endpoint: the path of the endpoint
+//   - Tenant: the tenant of the token endpoint
+//   - Values: the form of a POST request, the query of a GET request
+type TokenRequest struct {
+	Endpoint string
+	Tenant   string
+	Values   url.Values
+}
+
+// NewTokenServer starts a token server.
+func NewTokenServer() *TokenServer {
+	s := &TokenServer{
+		ExpiresIn:          3599,
+		DeviceCodeInterval: 1,
+		clients:            map[string]string{},
+		deviceCodes:        map[string]*deviceCode{},
+		authCodes:          map[string]authCode{},
+		refreshTokens:      map[string]bool{},
+	}
+	s.server = httptest.NewServer(http.HandlerFunc(s.serve))
+	s.URL = s.server.URL
+	return s
+}
+
+// Close shuts down the server.
+func (s *TokenServer) Close() {
+	s.server.Close()
+}
+
+// AddClient registers an app registration and its secret. When clients are registered, the token endpoint
+// rejects the unknown clients and the wrong secrets, otherwise any client is accepted.
+func (s *TokenServer) AddClient(clientId string, secret string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.clients[clientId] = secret
+}
+
+// ApproveDeviceCode signs the user in for a user code, as if the code was entered on the verification page.
+func (s *TokenServer) ApproveDeviceCode(userCode string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, code := range s.deviceCodes {
+		if code.userCode == userCode {
+			code.approved = true
+		}
+	}
+}
+
+// RevokeRefreshTokens revokes the refresh tokens issued, as when the session of the user ends.
+func (s *TokenServer) RevokeRefreshTokens() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.refreshTokens = map[string]bool{}
+}
+
+// Requests returns the requests received by the server.
+func (s *TokenServer) Requests() []TokenRequest {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]TokenRequest(nil), s.requests...)
+}
+
+// INTERNAL METHODS
+
+func (s *TokenServer) serve(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	request := TokenRequest{Endpoint: r.URL.Path, Values: r.Form}
+	if strings.Contains(r.URL.Path, "/oauth2/v2.0/") {
+		request.Tenant = strings.Split(strings.Trim(r.URL.Path, "/"), "/")[0]
+	}
+
+	switch {
+	case r.Method == "POST" && strings.HasSuffix(r.URL.Path, "/oauth2/v2.0/token"):
+		s.record(request)
+		s.serveToken(w, r)
+	case r.Method == "POST" && strings.HasSuffix(r.URL.Path, "/oauth2/v2.0/devicecode"):
+		s.record(request)
+		s.serveDeviceCode(w, r)
+	case r.Method == "GET" && strings.HasSuffix(r.URL.Path, "/oauth2/v2.0/authorize"):
+		s.record(request)
+		s.serveAuthorize(w, r)
+	case r.Method == "GET" && r.URL.Path == "/metadata/identity/oauth2/token":
+		s.record(request)
+		if r.Header.Get("Metadata") != "true" {
+			writeOAuthError(w, http.StatusBadRequest, "invalid_request", "Required metadata header not specified")
+			return
+		}
+		s.serveManagedIdentity(w, r)
+	case r.Method == "GET" && r.URL.Path == "/msi/token":
+		s.record(request)
+		if r.Header.Get("X-IDENTITY-HEADER") != IdentityHeader {
+			writeOAuthError(w, http.StatusUnauthorized, "invalid_request", "Invalid identity header")
+			return
+		}
+		s.serveManagedIdentity(w, r)
+	default:
+		writeOAuthError(w, http.StatusNotFound, "invalid_request", fmt.Sprintf("Unknown endpoint: %v %v", r.Method, r.URL.Path))
+	}
+}
+
+func (s *TokenServer) serveToken(w http.ResponseWriter, r *http.Request) {
+	switch r.Form.Get("grant_type") {
+	case "client_credentials":
+		if len(r.Form.Get("scope")) == 0 {
+			writeOAuthError(w, http.StatusBadRequest, "invalid_request", "AADSTS90014: The request body must contain the parameter 'scope'.")
+			return
+		}
+		if !s.checkClient(r.Form) {
+			writeOAuthError(w, http.StatusUnauthorized, "invalid_client", "AADSTS7000215: Invalid client secret provided.")
+			return
+		}
+	case "urn:ietf:params:oauth:grant-type:device_code":
+		s.mu.Lock()
+		code, ok := s.deviceCodes[r.Form.Get("device_code")]
+		approved := ok && code.approved
+		s.mu.Unlock()
+		if !ok {
+			writeOAuthError(w, http.StatusBadRequest, "invalid_grant", "AADSTS70000: The device code is invalid.")
+			return
+		}
+		if !approved {
+			writeOAuthError(w, http.StatusBadRequest, "authorization_pending", "AADSTS70016: The user has not yet signed in.")
+			return
+		}
+		s.mu.Lock()
+		delete(s.deviceCodes, r.Form.Get("device_code"))
+		s.mu.Unlock()
+	case "authorization_code":
+		s.mu.Lock()
+		code, ok := s.authCodes[r.Form.Get("code")]
+		delete(s.authCodes, r.Form.Get("code"))
+		s.mu.Unlock()
+		challenge := sha256.Sum256([]byte(r.Form.Get("code_verifier")))
+		if !ok || code.redirectUri != r.Form.Get("redirect_uri") || code.challenge != base64.RawURLEncoding.EncodeToString(challenge[:]) {
+			writeOAuthError(w, http.StatusBadRequest, "invalid_grant", "AADSTS70008: The authorization code or the code verifier is invalid.")
+			return
+		}
+	case "refresh_token":
+		s.mu.Lock()
+		ok := s.refreshTokens[r.Form.Get("refresh_token")]
+		delete(s.refreshTokens, r.Form.Get("refresh_token"))
+		s.mu.Unlock()
+		if !ok {
+			writeOAuthError(w, http.StatusBadRequest, "invalid_grant", "AADSTS700082: The refresh token has expired.")
+			return
+		}
+	default:
+		writeOAuthError(w, http.StatusBadRequest, "unsupported_grant_type", "AADSTS70003: The grant type is not supported.")
+		return
+	}
+
+	response := map[string]any{
+		"access_token": s.issue(),
+		"token_type":   "Bearer",
+		"expires_in":   s.ExpiresIn,
+	}
+	if r.Form.Get("grant_type") != "client_credentials" {
+		response["refresh_token"] = s.issueRefreshToken()
+	}
+	writeJSON(w, http.StatusOK, response)
+}
+
+func (s *TokenServer) serveDeviceCode(w http.ResponseWriter, r *http.Request) {
+	if len(r.Form.Get("client_id")) == 0 || len(r.Form.Get("scope")) == 0 {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_request", "AADSTS900144: The request body must contain the parameters 'client_id' and 'scope'.")
+		return
+	}
+
+	code, userCode := newGUID(), strings.ToUpper(newGUID()[:8])
+	s.mu.Lock()
+	s.deviceCodes[code] = &deviceCode{userCode: userCode}
+	s.mu.Unlock()
+
+	writeJSON(w, http.StatusOK, map[string]any{
+		"device_code":      code,
+		"user_code":        userCode,
+		"verification_uri": s.URL + "/devicelogin",
+		"expires_in":       900,
+		"interval":         s.DeviceCodeInterval,
+		"message":          fmt.Sprintf("To sign in, use a web browser to open the page %v/devicelogin and enter the code %v to authenticate.", s.URL, userCode),
+	})
+}
+
+func (s *TokenServer) serveAuthorize(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	redirectUri, err := url.Parse(query.Get("redirect_uri"))
+	if err != nil || len(query.Get("redirect_uri")) == 0 || query.Get("response_type") != "code" {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_request", "AADSTS50011: Invalid redirect URI or response type.")
+		return
+	}
+
+	redirectQuery := url.Values{"state": {query.Get("state")}}
+	if query.Get("code_challenge_method") != "S256" || len(query.Get("code_challenge")) == 0 {
+		redirectQuery.Set("error", "invalid_request")
+		redirectQuery.Set("error_description", "AADSTS9002325: Proof Key for Code Exchange is required.")
+	} else {
+		code := newGUID()
+		s.mu.Lock()
+		s.authCodes[code] = authCode{challenge: query.Get("code_challenge"), redirectUri: query.Get("redirect_uri")}
+		s.mu.Unlock()
+		redirectQuery.Set("code", code)
+	}
+	redirectUri.RawQuery = redirectQuery.Encode()
+	http.Redirect(w, r, redirectUri.String(), http.StatusFound)
+}
+
+func (s *TokenServer) serveManagedIdentity(w http.ResponseWriter, r *http.Request) {
+	if len(r.Form.Get("resource")) == 0 {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_request", "Required query variable 'resource' is missing")
+		return
+	}
+	// The managed identity endpoints return numbers as strings.
+	writeJSON(w, http.StatusOK, map[string]any{
+		"access_token": s.issue(),
+		"token_type":   "Bearer",
+		"resource":     r.Form.Get("resource"),
+		"expires_in":   strconv.Itoa(s.ExpiresIn),
+		"expires_on":   strconv.FormatInt(time.Now().Add(time.Duration(s.ExpiresIn)*time.Second).Unix(), 10),
+	})
+}
+
+// checkClient checks the credentials of a client: its secret if registered, or a client assertion.
+func (s *TokenServer) checkClient(form url.Values) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(form.Get("client_id")) == 0 {
+		return false
+	}
+	if len(form.Get("client_assertion")) > 0 {
+		return true
+	}
+	if len(s.clients) == 0 {
+		return len(form.Get("client_secret")) > 0
+	}
+	secret, ok := s.clients[form.Get("client_id")]
+	return ok && secret == form.Get("client_secret")
+}
+
+func (s *TokenServer) issue() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.issued++
+	return fmt.Sprintf("token-%v", s.issued)
+}
+
+func (s *TokenServer) issueRefreshToken() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	refreshToken := fmt.Sprintf("refresh-%v", s.issued)
+	s.refreshTokens[refreshToken] = true
+	return refreshToken
+}
+
+func (s *TokenServer) record(request TokenRequest) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests = append(s.requests, request)
+}
+
+// writeOAuthError writes an error in the format of the Microsoft identity platform.
+func writeOAuthError(w http.ResponseWriter, status int, code string, description string) {
+	writeJSON(w, status, map[string]any{
+		"error":             code,
+		"error_description": description,
+		"correlation_id":    newGUID(),
+	})
+}
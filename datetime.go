@@ -0,0 +1,401 @@
+package dataversego
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emaporta/dataversego/requests"
+)
+
+// Behaviors of a date and time column, as returned by the DateTimeBehavior of its metadata.
+//   - DateTimeBehaviorUserLocal: the value is stored in UTC and shown in the time zone of the user
+//   - DateTimeBehaviorDateOnly: the value is a date without time nor time zone (e.g. a birthday)
+//   - DateTimeBehaviorTimeZoneIndependent: the value is stored and shown as entered, without time zone conversion
+const (
+	DateTimeBehaviorUserLocal           = "UserLocal"
+	DateTimeBehaviorDateOnly            = "DateOnly"
+	DateTimeBehaviorTimeZoneIndependent = "TimeZoneIndependent"
+)
+
+// The 'DateTimeColumn' struct represents the metadata of a date and time column, used to format and parse its
+// values according to its behavior.
+// It contains the following fields:
+//   - LogicalName: the logical name of the column (e.g. "birthdate")
+//   - Behavior: the behavior of the column (see the DateTimeBehavior constants)
+//   - DateOnly: a boolean value indicating whether the column shows the date only (Format "DateOnly"), the
+//     behavior being UserLocal or DateOnly
+type DateTimeColumn struct {
+	LogicalName string
+	Behavior    string
+	DateOnly    bool
+}
+
+// The 'UserTimeZone' struct represents the time zone of a user, as set in its personal options.
+// It contains the following fields:
+//   - Code: the time zone code of the user settings (e.g. 110 for "W. Europe Standard Time")
+//   - StandardName: the Windows name of the time zone (e.g. "W. Europe Standard Time")
+//   - Location: the IANA location of the time zone (e.g. "Europe/Berlin"), used to convert the times without
+//     requests. Nil if the time zone has no IANA equivalent or the time zone database isn't available.
+type UserTimeZone struct {
+	Code         int
+	StandardName string
+	Location     *time.Location
+}
+
+// dateTimeColumnCache keeps the date and time columns already retrieved, keyed by organization url, table and column.
+var dateTimeColumnCache sync.Map
+
+// windowsTimeZones maps the Windows names of the time zones to their IANA locations, from the CLDR mapping.
+var windowsTimeZones = map[string]string{
+	"Dateline Standard Time":          "Etc/GMT+12",
+	"Hawaiian Standard Time":          "Pacific/Honolulu",
+	"Alaskan Standard Time":           "America/Anchorage",
+	"Pacific Standard Time":           "America/Los_Angeles",
+	"US Mountain Standard Time":       "America/Phoenix",
+	"Mountain Standard Time":          "America/Denver",
+	"Central America Standard Time":   "America/Guatemala",
+	"Central Standard Time":           "America/Chicago",
+	"Central Standard Time (Mexico)":  "America/Mexico_City",
+	"Canada Central Standard Time":    "America/Regina",
+	"SA Pacific Standard Time":        "America/Bogota",
+	"Eastern Standard Time":           "America/New_York",
+	"US Eastern Standard Time":        "America/Indianapolis",
+	"Venezuela Standard Time":         "America/Caracas",
+	"Atlantic Standard Time":          "America/Halifax",
+	"SA Western Standard Time":        "America/La_Paz",
+	"Pacific SA Standard Time":        "America/Santiago",
+	"Newfoundland Standard Time":      "America/St_Johns",
+	"E. South America Standard Time":  "America/Sao_Paulo",
+	"Argentina Standard Time":         "America/Buenos_Aires",
+	"Greenland Standard Time":         "America/Godthab",
+	"Azores Standard Time":            "Atlantic/Azores",
+	"UTC":                             "Etc/UTC",
+	"GMT Standard Time":               "Europe/London",
+	"Greenwich Standard Time":         "Atlantic/Reykjavik",
+	"W. Europe Standard Time":         "Europe/Berlin",
+	"Central Europe Standard Time":    "Europe/Budapest",
+	"Romance Standard Time":           "Europe/Paris",
+	"Central European Standard Time":  "Europe/Warsaw",
+	"W. Central Africa Standard Time": "Africa/Lagos",
+	"GTB Standard Time":               "Europe/Bucharest",
+	"FLE Standard Time":               "Europe/Kiev",
+	"Egypt Standard Time":             "Africa/Cairo",
+	"South Africa Standard Time":      "Africa/Johannesburg",
+	"Israel Standard Time":            "Asia/Jerusalem",
+	"Turkey Standard Time":            "Europe/Istanbul",
+	"Arab Standard Time":              "Asia/Riyadh",
+	"Russian Standard Time":           "Europe/Moscow",
+	"E. Africa Standard Time":         "Africa/Nairobi",
+	"Iran Standard Time":              "Asia/Tehran",
+	"Arabian Standard Time":           "Asia/Dubai",
+	"Afghanistan Standard Time":       "Asia/Kabul",
+	"Pakistan Standard Time":          "Asia/Karachi",
+	"India Standard Time":             "Asia/Calcutta",
+	"Nepal Standard Time":             "Asia/Katmandu",
+	"Bangladesh Standard Time":        "Asia/Dhaka",
+	"SE Asia Standard Time":           "Asia/Bangkok",
+	"China Standard Time":             "Asia/Shanghai",
+	"Singapore Standard Time":         "Asia/Singapore",
+	"W. Australia Standard Time":      "Australia/Perth",
+	"Taipei Standard Time":            "Asia/Taipei",
+	"Tokyo Standard Time":             "Asia/Tokyo",
+	"Korea Standard Time":             "Asia/Seoul",
+	"Cen. Australia Standard Time":    "Australia/Adelaide",
+	"AUS Central Standard Time":       "Australia/Darwin",
+	"E. Australia Standard Time":      "Australia/Brisbane",
+	"AUS Eastern Standard Time":       "Australia/Sydney",
+	"Tasmania Standard Time":          "Australia/Hobart",
+	"New Zealand Standard Time":       "Pacific/Auckland",
+}
+
+// RetrieveDateTimeColumn retrieves the metadata of a date and time column, to format and parse its values.
+//
+// It takes the following arguments:
+//   - auth: a struct containing authentication information
+//   - tableName: the name of the table (entity set) of the column
+//   - column: the logical name of the column
+//
+// Columns are cached for the lifetime of the process.
+//
+// Example:
+//
+//	birthdate, err := RetrieveDateTimeColumn(auth, "contacts", "birthdate")
+//	if err != nil {
+//	  log.Fatal(err)
+//	}
+//	row := map[string]any{"birthdate": birthdate.Format(time.Date(1990, 5, 17, 0, 0, 0, 0, time.Local))}
+func RetrieveDateTimeColumn(auth Authorization, tableName string, column string) (col DateTimeColumn, err error) {
+	if len(column) == 0 {
+		err = errors.New("Empty column")
+		return
+	}
+	def, err := RetrieveEntityDefinition(auth, tableName)
+	if err != nil {
+		return
+	}
+
+	cacheKey := fmt.Sprintf("%v|%v|%v", auth.Url, def.LogicalName, column)
+	if cached, ok := dateTimeColumnCache.Load(cacheKey); ok {
+		col = cached.(DateTimeColumn)
+		return
+	}
+
+	resp, err := auth.do(requests.Request{
+		Method: "GET",
+		Path:   fmt.Sprintf("%v/EntityDefinitions(LogicalName='%v')/Attributes(LogicalName='%v')/Microsoft.Dynamics.CRM.DateTimeAttributeMetadata", auth.apiPath(), def.LogicalName, column),
+		Query:  url.Values{"$select": {"LogicalName,DateTimeBehavior,Format"}},
+	})
+	if err != nil {
+		return
+	}
+
+	var metadata struct {
+		LogicalName      string
+		DateTimeBehavior struct {
+			Value string
+		}
+		Format string
+	}
+	if err = decodeMap(resp.Value, &metadata); err != nil {
+		return
+	}
+	col = DateTimeColumn{
+		LogicalName: metadata.LogicalName,
+		Behavior:    metadata.DateTimeBehavior.Value,
+		DateOnly:    metadata.Format == "DateOnly" || metadata.DateTimeBehavior.Value == DateTimeBehaviorDateOnly,
+	}
+	dateTimeColumnCache.Store(cacheKey, col)
+	return
+}
+
+// Format returns the value of the column for a time, as set in the Row of a 'CreateUpdateSignature':
+//   - UserLocal: the time in UTC (e.g. "2024-01-31T09:00:00Z" for 10:00 in Berlin)
+//   - DateOnly: the date of the time in its location (e.g. "2024-01-31")
+//   - TimeZoneIndependent: the date and time of the time in its location, without conversion
+//     (e.g. "2024-01-31T10:00:00Z" for 10:00 in Berlin)
+func (c DateTimeColumn) Format(t time.Time) string {
+	switch c.Behavior {
+	case DateTimeBehaviorDateOnly:
+		return t.Format(time.DateOnly)
+	case DateTimeBehaviorTimeZoneIndependent:
+		if c.DateOnly {
+			return t.Format(time.DateOnly) + "T00:00:00Z"
+		}
+		return t.Format("2006-01-02T15:04:05") + "Z"
+	default:
+		return t.UTC().Format(time.RFC3339)
+	}
+}
+
+// Parse returns the time of a value of the column, as read from a 'Record', in the given location (UTC if nil):
+//   - UserLocal: the instant of the value, in the location
+//   - DateOnly and TimeZoneIndependent: the date and time of the value, without conversion, in the location
+//
+// It is the inverse of Format.
+func (c DateTimeColumn) Parse(value string, location *time.Location) (t time.Time, err error) {
+	if location == nil {
+		location = time.UTC
+	}
+	if c.Behavior == DateTimeBehaviorUserLocal || len(c.Behavior) == 0 {
+		if t, err = time.Parse(time.RFC3339Nano, value); err != nil {
+			return
+		}
+		t = t.In(location)
+		return
+	}
+
+	layout := "2006-01-02T15:04:05Z07:00"
+	if !strings.Contains(value, "T") {
+		layout = time.DateOnly
+	}
+	utc, err := time.Parse(layout, value)
+	if err != nil {
+		return
+	}
+	t = time.Date(utc.Year(), utc.Month(), utc.Day(), utc.Hour(), utc.Minute(), utc.Second(), utc.Nanosecond(), location)
+	return
+}
+
+// RetrieveUserTimeZone retrieves the time zone of a user from its settings ("usersettingscollection").
+//
+// It takes a single argument of type 'RetrieveUserTimeZoneSignature', which is a struct containing the following fields:
+//   - Auth: a struct containing authentication information
+//   - UserId: the systemuserid of the user, the calling user if empty
+//   - Options: the 'requests.RequestOptions' of the requests (impersonation, MSCRM headers)
+//
+// The return value is a 'UserTimeZone', with the IANA location of the time zone when known, and an error value,
+// which will be nil if the function completed successfully.
+//
+// Example:
+//
+//	tz, err := RetrieveUserTimeZone(RetrieveUserTimeZoneSignature{Auth: auth})
+//	if err != nil {
+//	  log.Fatal(err)
+//	}
+//	local, err := LocalTimeFromUtcTime(LocalTimeFromUtcTimeSignature{Auth: auth, TimeZone: tz, UtcTime: time.Now()})
+func RetrieveUserTimeZone(parameter RetrieveUserTimeZoneSignature) (tz UserTimeZone, err error) {
+	parameter.Auth = parameter.Auth.withOptions(parameter.Options).withOperation("RetrieveUserTimeZone", "")
+	defer func() { parameter.Auth.endOperation(err) }()
+	if !parameter.Auth.isSet() {
+		err = errors.New("Empty auth")
+		return
+	}
+
+	userId := parameter.UserId
+	if len(userId) == 0 {
+		var whoami struct {
+			UserId string
+		}
+		ent, errWhoAmI := executeFunction(parameter.Auth, "", "", "WhoAmI", nil)
+		if errWhoAmI != nil {
+			err = errWhoAmI
+			return
+		}
+		if err = decodeMap(ent, &whoami); err != nil {
+			return
+		}
+		userId = whoami.UserId
+	}
+
+	settings, err := retrieve(parameter.Auth, "usersettingscollection", userId, "timezonecode", nil)
+	if err != nil {
+		return
+	}
+	if tz.Code, err = Record(settings).GetInt("timezonecode"); err != nil {
+		return
+	}
+
+	definitions, err := retrieveMultiple(parameter.Auth, "timezonedefinitions", "standardname", fmt.Sprintf("timezonecode eq %v", tz.Code), nil)
+	if err != nil {
+		return
+	}
+	records := RecordCollection(definitions).Records()
+	if len(records) == 0 {
+		err = fmt.Errorf("No time zone definition found for code %v", tz.Code)
+		return
+	}
+	if tz.StandardName, err = records[0].GetString("standardname"); err != nil {
+		return
+	}
+	tz.Location = findLocation(tz.StandardName)
+	return
+}
+
+// LocalTimeFromUtcTime converts a time to the local time of a time zone, with the LocalTimeFromUtcTime function
+// of the organization. Without Auth, the time is converted with the Location of the time zone instead.
+//
+// It takes a single argument of type 'LocalTimeFromUtcTimeSignature', which is a struct containing the following fields:
+//   - Auth: a struct containing authentication information, empty to convert without request
+//   - TimeZone: the time zone to convert to, as returned by RetrieveUserTimeZone
+//   - UtcTime: the time to convert
+//   - Options: the 'requests.RequestOptions' of the requests (impersonation, MSCRM headers)
+//
+// The return value is the same instant in the time zone, its location being the Location of the time zone if it
+// agrees with the organization, a fixed zone named after its StandardName otherwise, and an error value, which will be nil if the function completed successfully.
+//
+// Example:
+//
+//	local, err := LocalTimeFromUtcTime(LocalTimeFromUtcTimeSignature{Auth: auth, TimeZone: tz, UtcTime: time.Now()})
+//	if err != nil {
+//	  log.Fatal(err)
+//	}
+//	fmt.Println(local.Format(time.Kitchen))
+func LocalTimeFromUtcTime(parameter LocalTimeFromUtcTimeSignature) (localTime time.Time, err error) {
+	parameter.Auth = parameter.Auth.withOptions(parameter.Options).withOperation("LocalTimeFromUtcTime", "")
+	defer func() { parameter.Auth.endOperation(err) }()
+	if !parameter.Auth.isSet() {
+		if parameter.TimeZone.Location == nil {
+			err = errors.New("Empty auth and time zone location")
+			return
+		}
+		localTime = parameter.UtcTime.In(parameter.TimeZone.Location)
+		return
+	}
+
+	utcTime := parameter.UtcTime.UTC().Truncate(time.Second)
+	ent, err := executeFunction(parameter.Auth, "", "", "LocalTimeFromUtcTime", map[string]any{
+		"TimeZoneCode": parameter.TimeZone.Code,
+		"UtcTime":      utcTime,
+	})
+	if err != nil {
+		return
+	}
+	wallClock, err := Record(ent).GetTime("LocalTime")
+	if err != nil {
+		return
+	}
+
+	// The local time is returned as a UTC time, its offset is the difference with the converted time.
+	offset := int(wallClock.Sub(utcTime).Seconds())
+	localTime = parameter.UtcTime.In(time.FixedZone(parameter.TimeZone.StandardName, offset))
+	if location := parameter.TimeZone.Location; location != nil {
+		if _, locationOffset := parameter.UtcTime.In(location).Zone(); locationOffset == offset {
+			localTime = parameter.UtcTime.In(location)
+		}
+	}
+	return
+}
+
+// UtcTimeFromLocalTime converts the local time of a time zone to UTC, with the UtcTimeFromLocalTime function of
+// the organization. Without Auth, the time is converted with the Location of the time zone instead.
+//
+// It takes a single argument of type 'UtcTimeFromLocalTimeSignature', which is a struct containing the following fields:
+//   - Auth: a struct containing authentication information, empty to convert without request
+//   - TimeZone: the time zone of the local time, as returned by RetrieveUserTimeZone
+//   - LocalTime: the local time to convert, only its date and time are used, not its location
+//   - Options: the 'requests.RequestOptions' of the requests (impersonation, MSCRM headers)
+//
+// The return value is the UTC time, and an error value, which will be nil if the function completed successfully.
+//
+// Example:
+//
+//	utc, err := UtcTimeFromLocalTime(UtcTimeFromLocalTimeSignature{
+//	  Auth: auth,
+//	  TimeZone: tz,
+//	  LocalTime: time.Date(2024, 1, 31, 10, 0, 0, 0, time.UTC),
+//	})
+func UtcTimeFromLocalTime(parameter UtcTimeFromLocalTimeSignature) (utcTime time.Time, err error) {
+	parameter.Auth = parameter.Auth.withOptions(parameter.Options).withOperation("UtcTimeFromLocalTime", "")
+	defer func() { parameter.Auth.endOperation(err) }()
+	l := parameter.LocalTime
+	if !parameter.Auth.isSet() {
+		if parameter.TimeZone.Location == nil {
+			err = errors.New("Empty auth and time zone location")
+			return
+		}
+		utcTime = time.Date(l.Year(), l.Month(), l.Day(), l.Hour(), l.Minute(), l.Second(), l.Nanosecond(), parameter.TimeZone.Location).UTC()
+		return
+	}
+
+	ent, err := executeFunction(parameter.Auth, "", "", "UtcTimeFromLocalTime", map[string]any{
+		"TimeZoneCode": parameter.TimeZone.Code,
+		"LocalTime":    time.Date(l.Year(), l.Month(), l.Day(), l.Hour(), l.Minute(), l.Second(), 0, time.UTC),
+	})
+	if err != nil {
+		return
+	}
+	if utcTime, err = Record(ent).GetTime("UtcTime"); err != nil {
+		return
+	}
+	utcTime = utcTime.UTC()
+	return
+}
+
+// INTERNAL METHODS
+
+// findLocation returns the IANA location of a Windows time zone, nil if unknown or not in the time zone database.
+func findLocation(standardName string) *time.Location {
+	name, ok := windowsTimeZones[standardName]
+	if !ok {
+		return nil
+	}
+	location, err := time.LoadLocation(name)
+	if err != nil {
+		return nil
+	}
+	return location
+}
@@ -0,0 +1,120 @@
+package dataversego
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Decimal is an exact decimal number, as the value of a decimal or currency column. It keeps the digits sent by
+// the Web API instead of rounding them to a float64, and is written as a JSON number in the Row of an operation.
+// The zero value is 0.
+//
+// Example:
+//
+//	total, err := ParseDecimal("1234.5678")
+//	if err != nil {
+//	  log.Fatal(err)
+//	}
+//	id, err := CreateUpdate(CreateUpdateSignature{
+//	  Auth: auth,
+//	  TableName: "invoices",
+//	  Row: map[string]any{"name": "INV-001", "discountamount": total.Round(2)},
+//	})
+type Decimal string
+
+// decimalRegexp matches a JSON number.
+var decimalRegexp = regexp.MustCompile(`^-?(0|[1-9][0-9]*)(\.[0-9]+)?([eE][+-]?[0-9]+)?$`)
+
+// ParseDecimal returns the decimal of a number (e.g. "1234.5678"), an error if it is not a number.
+func ParseDecimal(s string) (d Decimal, err error) {
+	s = strings.TrimPrefix(strings.TrimSpace(s), "+")
+	if !decimalRegexp.MatchString(s) {
+		err = fmt.Errorf("Invalid decimal: %v", s)
+		return
+	}
+	d = Decimal(s)
+	return
+}
+
+// NewDecimal returns the decimal of a float64, with the shortest representation of its value (e.g. 0.1 for 0.1).
+func NewDecimal(f float64) Decimal {
+	return Decimal(strconv.FormatFloat(f, 'f', -1, 64))
+}
+
+// NewDecimalFromRat returns the decimal of a rational number, rounded to the given number of digits after the
+// decimal point.
+func NewDecimalFromRat(r *big.Rat, precision int) Decimal {
+	return Decimal(r.FloatString(precision))
+}
+
+// String returns the decimal as a number, "0" for the zero value.
+func (d Decimal) String() string {
+	if len(d) == 0 {
+		return "0"
+	}
+	return string(d)
+}
+
+// Float64 returns the decimal as a float64, which may not represent it exactly.
+func (d Decimal) Float64() (float64, error) {
+	return strconv.ParseFloat(d.String(), 64)
+}
+
+// Rat returns the decimal as an exact rational number, ok being false if the decimal is not a number.
+func (d Decimal) Rat() (r *big.Rat, ok bool) {
+	return new(big.Rat).SetString(d.String())
+}
+
+// Round returns the decimal rounded to the given number of digits after the decimal point, halves away from zero.
+func (d Decimal) Round(precision int) Decimal {
+	r, ok := d.Rat()
+	if !ok {
+		return d
+	}
+	return NewDecimalFromRat(r, precision)
+}
+
+// MarshalJSON writes the decimal as a JSON number.
+func (d Decimal) MarshalJSON() ([]byte, error) {
+	if _, ok := d.Rat(); !ok {
+		return nil, fmt.Errorf("Invalid decimal: %v", string(d))
+	}
+	return []byte(d.String()), nil
+}
+
+// UnmarshalJSON reads the decimal from a JSON number or string, null being the zero value.
+func (d *Decimal) UnmarshalJSON(data []byte) (err error) {
+	value := string(data)
+	if value == "null" {
+		*d = ""
+		return
+	}
+	if unquoted, errUnquote := strconv.Unquote(value); errUnquote == nil {
+		value = unquoted
+	}
+	*d, err = ParseDecimal(value)
+	return
+}
+
+// INTERNAL METHODS
+
+// readDecimal converts the JSON value of a column into a decimal.
+func readDecimal(value any) (d Decimal, err error) {
+	switch v := value.(type) {
+	case Decimal:
+		d = v
+	case json.Number:
+		d, err = ParseDecimal(v.String())
+	case float64:
+		d = NewDecimal(v)
+	case string:
+		d, err = ParseDecimal(v)
+	default:
+		err = fmt.Errorf("Invalid decimal: %v", value)
+	}
+	return
+}
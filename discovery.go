@@ -0,0 +1,181 @@
+package dataversego
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/emaporta/dataversego/requests"
+)
+
+// Urls of the Global Discovery Service, to be used as 'Url' of the authorization of RetrieveInstances and
+// FindInstance. The token must be requested for the same url, e.g. with a 'requests.DeviceCodeCredential'
+// whose Resource is GlobalDiscoveryUrl, since the service doesn't accept application users.
+const (
+	GlobalDiscoveryUrl                 = "https://globaldisco.crm.dynamics.com"
+	GlobalDiscoveryUrlUSGovernment     = "https://globaldisco.crm9.dynamics.com"
+	GlobalDiscoveryUrlUSGovernmentHigh = "https://globaldisco.crm.microsoftdynamics.us"
+	GlobalDiscoveryUrlUSGovernmentDoD  = "https://globaldisco.crm.appsplatform.us"
+	GlobalDiscoveryUrlChina            = "https://globaldisco.crm.dynamics.cn"
+)
+
+// States of an instance, as returned by the Global Discovery Service.
+const (
+	InstanceStateEnabled  = 0
+	InstanceStateDisabled = 1
+)
+
+// The 'Instance' struct represents an environment returned by the Global Discovery Service.
+// It contains the following fields:
+//   - Id: the ID of the organization
+//   - UniqueName: the unique name of the organization
+//   - UrlName: the name of the organization in its url
+//   - FriendlyName: the display name of the organization, not necessarily unique
+//   - State: the state of the instance (see the InstanceState constants)
+//   - Version: the version of the organization
+//   - Url: the url of the organization, to be used as 'Url' of an authorization
+//   - ApiUrl: the url of the Web API of the organization
+//   - Region: the region of the organization (e.g. "NA", "EMEA")
+//   - TenantId: the ID of the tenant of the organization
+//   - EnvironmentId: the ID of the Power Platform environment
+//   - LastUpdated: the last update of the instance
+type Instance struct {
+	Id            string
+	UniqueName    string
+	UrlName       string
+	FriendlyName  string
+	State         int
+	Version       string
+	Url           string
+	ApiUrl        string
+	Region        string
+	TenantId      string
+	EnvironmentId string
+	LastUpdated   time.Time
+}
+
+// RetrieveInstances retrieves the environments the user has access to from the Global Discovery Service.
+//
+// It takes a single argument of type 'RetrieveInstancesSignature', which is a struct containing the following fields:
+//   - Auth: a struct containing authentication information, its Url being a Global Discovery Service url
+//     (e.g. GlobalDiscoveryUrl)
+//   - Options: the 'requests.RequestOptions' of the requests (impersonation, MSCRM headers)
+//
+// The return value is a slice of 'Instance' structs, and an error value, which will be nil if the function completed successfully.
+//
+// Example:
+//
+//	instances, err := RetrieveInstances(RetrieveInstancesSignature{
+//	  Auth: Authorization{Url: GlobalDiscoveryUrl, Client: &requests.Client{TokenProvider: &requests.DeviceCodeCredential{
+//	    TenantId: "organizations",
+//	    ClientId: "clientid",
+//	    Resource: GlobalDiscoveryUrl,
+//	  }}},
+//	})
+//	if err != nil {
+//	  log.Fatal(err)
+//	}
+//	for _, instance := range instances {
+//	  fmt.Println(instance.FriendlyName, instance.Url)
+//	}
+func RetrieveInstances(parameter RetrieveInstancesSignature) (instances []Instance, err error) {
+	parameter.Auth = parameter.Auth.withOptions(parameter.Options).withOperation("RetrieveInstances", "")
+	defer func() { parameter.Auth.endOperation(err) }()
+	if !parameter.Auth.isSet() {
+		err = errors.New("Empty auth")
+		return
+	}
+
+	instances, err = retrieveInstances(parameter.Auth)
+	return
+}
+
+// FindInstance retrieves the environment with the given name from the Global Discovery Service. The name is
+// compared, ignoring the case, to the unique name, then to the url name, then to the friendly name of the instances.
+//
+// It takes a single argument of type 'FindInstanceSignature', which is a struct containing the following fields:
+//   - Auth: a struct containing authentication information, its Url being a Global Discovery Service url
+//     (e.g. GlobalDiscoveryUrl)
+//   - Name: the unique name, the url name or the friendly name of the instance
+//   - Options: the 'requests.RequestOptions' of the requests (impersonation, MSCRM headers)
+//
+// The return value is an 'Instance', and an error value, which will be nil if the function completed successfully.
+// It is an error if no instance has the name, or if several instances have the friendly name.
+//
+// Example:
+//
+//	instance, err := FindInstance(FindInstanceSignature{Auth: discoveryAuth, Name: "Contoso (Test)"})
+//	if err != nil {
+//	  log.Fatal(err)
+//	}
+//	fmt.Println(instance.Url)
+func FindInstance(parameter FindInstanceSignature) (instance Instance, err error) {
+	parameter.Auth = parameter.Auth.withOptions(parameter.Options).withOperation("FindInstance", "")
+	defer func() { parameter.Auth.endOperation(err) }()
+	if !parameter.Auth.isSet() {
+		err = errors.New("Empty auth")
+		return
+	}
+	if len(parameter.Name) == 0 {
+		err = errors.New("Empty name")
+		return
+	}
+
+	instances, err := retrieveInstances(parameter.Auth)
+	if err != nil {
+		return
+	}
+
+	instance, err = findInstance(instances, parameter.Name)
+	return
+}
+
+// INTERNAL METHODS
+
+func retrieveInstances(auth Authorization) (instances []Instance, err error) {
+	resp, err := auth.do(requests.Request{
+		Method: "GET",
+		Path:   "/api/discovery/v9.2/Instances",
+	})
+	if err != nil {
+		return
+	}
+
+	var result struct {
+		Value []Instance `json:"value"`
+	}
+	if err = decodeMap(resp.Value, &result); err != nil {
+		return
+	}
+	instances = result.Value
+	return
+}
+
+// findInstance returns the instance with the given unique name, url name or friendly name, in this order.
+func findInstance(instances []Instance, name string) (instance Instance, err error) {
+	names := []func(Instance) string{
+		func(i Instance) string { return i.UniqueName },
+		func(i Instance) string { return i.UrlName },
+		func(i Instance) string { return i.FriendlyName },
+	}
+	for _, nameOf := range names {
+		var found []Instance
+		for _, i := range instances {
+			if strings.EqualFold(nameOf(i), name) {
+				found = append(found, i)
+			}
+		}
+		if len(found) > 1 {
+			err = fmt.Errorf("Several instances found with name %v", name)
+			return
+		}
+		if len(found) == 1 {
+			instance = found[0]
+			return
+		}
+	}
+
+	err = fmt.Errorf("No instance found with name %v", name)
+	return
+}
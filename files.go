@@ -0,0 +1,313 @@
+package dataversego
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/url"
+	"path/filepath"
+	"strconv"
+
+	"github.com/emaporta/dataversego/requests"
+)
+
+// fileBlockSize is the size of the blocks used by the chunked upload and download, 4 MB being
+// the maximum accepted by UploadBlock. Files up to this size are transferred in a single request.
+var fileBlockSize = 4 * 1024 * 1024
+
+// UploadFile uploads the content of a file or image column.
+//
+// It takes a single argument of type 'UploadFileSignature', which is a struct containing the following fields:
+//   - Auth: a struct containing authentication information
+//   - TableName: the name of the table of the entry
+//   - Id: the ID of the entry
+//   - Column: the logical name of the file or image column
+//   - FileName: the name of the file
+//   - MimeType: the MIME type of the file, guessed from the file name if empty
+//   - Content: a reader providing the content of the file
+//   - Options: the 'requests.RequestOptions' of the requests (impersonation, MSCRM headers)
+//
+// Small files are uploaded with a single PATCH request, larger ones with the
+// InitializeFileBlocksUpload, UploadBlock and CommitFileBlocksUpload actions. The MIME type is sent as the
+// Content-Type of the PATCH request, or with CommitFileBlocksUpload.
+//
+// The return value is an error value, which will be nil if the function completed successfully.
+//
+// Example:
+//
+//	file, _ := os.Open("contract.pdf")
+//	defer file.Close()
+//	err := UploadFile(UploadFileSignature{
+//	  Auth: Auth{Token: "Token", Url: "https://url.crm.dynamics.com"},
+//	  TableName: "accounts",
+//	  Id: "123",
+//	  Column: "new_contract",
+//	  FileName: "contract.pdf",
+//	  Content: file,
+//	})
+//	if err != nil {
+//	  log.Fatal(err)
+//	}
+func UploadFile(parameter UploadFileSignature) (err error) {
+	parameter.Auth = parameter.Auth.withOptions(parameter.Options).withOperation("UploadFile", parameter.TableName)
+	defer func() { parameter.Auth.endOperation(err) }()
+	err = checkFileParameters(parameter.Auth, parameter.TableName, parameter.Id, parameter.Column)
+	if err != nil {
+		return
+	}
+	if len(parameter.FileName) == 0 {
+		err = errors.New("Empty file name")
+		return
+	}
+	if parameter.Content == nil {
+		err = errors.New("Empty content")
+		return
+	}
+
+	mimeType := parameter.MimeType
+	if len(mimeType) == 0 {
+		mimeType = guessMimeType(parameter.FileName)
+	}
+
+	// Read one byte more than a block to know whether the file fits in a single request.
+	prefix, err := io.ReadAll(io.LimitReader(parameter.Content, int64(fileBlockSize)+1))
+	if err != nil {
+		return
+	}
+	if len(prefix) <= fileBlockSize {
+		err = uploadFile(parameter.Auth, parameter.TableName, parameter.Id, parameter.Column, parameter.FileName, mimeType, bytes.NewReader(prefix))
+		return
+	}
+
+	content := io.MultiReader(bytes.NewReader(prefix), parameter.Content)
+	err = uploadFileBlocks(parameter.Auth, parameter.TableName, parameter.Id, parameter.Column, parameter.FileName, mimeType, content)
+	return
+}
+
+// DownloadFile downloads the content of a file or image column.
+//
+// It takes a single argument of type 'DownloadFileSignature', which is a struct containing the following fields:
+//   - Auth: a struct containing authentication information
+//   - TableName: the name of the table of the entry
+//   - Id: the ID of the entry
+//   - Column: the logical name of the file or image column
+//   - FullSize: a boolean value indicating whether to download the full-size image instead of the thumbnail (image columns only)
+//   - Content: a writer where the content of the file is written
+//   - Options: the 'requests.RequestOptions' of the requests (impersonation, MSCRM headers)
+//
+// The first block of the file is downloaded with a GET request, which is enough for small files. The rest of
+// larger files is downloaded with the InitializeFileBlocksDownload and DownloadBlock actions, which don't serve
+// full-size images: FullSize is an error for images larger than a block.
+//
+// The return value is the name of the file, and an error value, which will be nil if the function completed successfully.
+//
+// Example:
+//
+//	file, _ := os.Create("contract.pdf")
+//	defer file.Close()
+//	fileName, err := DownloadFile(DownloadFileSignature{
+//	  Auth: Auth{Token: "Token", Url: "https://url.crm.dynamics.com"},
+//	  TableName: "accounts",
+//	  Id: "123",
+//	  Column: "new_contract",
+//	  Content: file,
+//	})
+//	if err != nil {
+//	  log.Fatal(err)
+//	}
+//	fmt.Println(fileName)
+func DownloadFile(parameter DownloadFileSignature) (fileName string, err error) {
+	parameter.Auth = parameter.Auth.withOptions(parameter.Options).withOperation("DownloadFile", parameter.TableName)
+	defer func() { parameter.Auth.endOperation(err) }()
+	err = checkFileParameters(parameter.Auth, parameter.TableName, parameter.Id, parameter.Column)
+	if err != nil {
+		return
+	}
+	if parameter.Content == nil {
+		err = errors.New("Empty content")
+		return
+	}
+
+	fileName, err = downloadFile(parameter.Auth, parameter.TableName, parameter.Id, parameter.Column, parameter.FullSize, parameter.Content)
+	return
+}
+
+// INTERNAL METHODS
+
+func checkFileParameters(auth Authorization, tableName string, id string, column string) (err error) {
+	if !auth.isSet() {
+		err = errors.New("Empty auth")
+		return
+	}
+	if len(tableName) == 0 {
+		err = errors.New("Empty table")
+		return
+	}
+	if len(id) == 0 {
+		err = errors.New("Empty Id")
+		return
+	}
+	if len(column) == 0 {
+		err = errors.New("Empty column")
+		return
+	}
+	return
+}
+
+// guessMimeType returns the MIME type of a file from its extension, defaulting to application/octet-stream.
+func guessMimeType(fileName string) string {
+	if mimeType := mime.TypeByExtension(filepath.Ext(fileName)); len(mimeType) > 0 {
+		return mimeType
+	}
+	return "application/octet-stream"
+}
+
+func uploadFile(auth Authorization, tableName string, id string, column string, fileName string, mimeType string, content io.Reader) (err error) {
+	_, err = auth.do(requests.Request{
+		Method: "PATCH",
+		Path:   fmt.Sprintf("%v/%v(%v)/%v", auth.apiPath(), tableName, id, column),
+		Headers: map[string]string{
+			"Content-Type":   mimeType,
+			"x-ms-file-name": fileName,
+		},
+		Body:      content,
+		Operation: "UploadFile",
+	})
+
+	return
+}
+
+func uploadFileBlocks(auth Authorization, tableName string, id string, column string, fileName string, mimeType string, content io.Reader) (err error) {
+	ent, err := executeAction(auth, "", "", "InitializeFileBlocksUpload", map[string]any{
+		"Target":            EntityReference{TableName: tableName, Id: id},
+		"FileAttributeName": column,
+		"FileName":          fileName,
+	})
+	if err != nil {
+		return
+	}
+	token, _ := ent["FileContinuationToken"].(string)
+	if len(token) == 0 {
+		err = errors.New("Empty file continuation token")
+		return
+	}
+
+	var blockList []string
+	block := make([]byte, fileBlockSize)
+	for {
+		n, errRead := io.ReadFull(content, block)
+		if n > 0 {
+			blockId := base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("%08d", len(blockList))))
+			_, err = executeAction(auth, "", "", "UploadBlock", map[string]any{
+				"BlockId":               blockId,
+				"BlockData":             block[:n],
+				"FileContinuationToken": token,
+			})
+			if err != nil {
+				return
+			}
+			blockList = append(blockList, blockId)
+		}
+		if errRead == io.EOF || errRead == io.ErrUnexpectedEOF {
+			break
+		}
+		if errRead != nil {
+			err = errRead
+			return
+		}
+	}
+
+	_, err = executeAction(auth, "", "", "CommitFileBlocksUpload", map[string]any{
+		"FileName":              fileName,
+		"MimeType":              mimeType,
+		"BlockList":             blockList,
+		"FileContinuationToken": token,
+	})
+
+	return
+}
+
+func downloadFile(auth Authorization, tableName string, id string, column string, fullSize bool, content io.Writer) (fileName string, err error) {
+	// The first block is downloaded with a GET request, which returns the size and the name of the file.
+	query := url.Values{}
+	if fullSize {
+		query.Set("size", "full")
+	}
+	written := &countingWriter{w: content}
+	resp, err := auth.do(requests.Request{
+		Method:    "GET",
+		Path:      fmt.Sprintf("%v/%v(%v)/%v/$value", auth.apiPath(), tableName, id, column),
+		Query:     query,
+		Headers:   map[string]string{"Range": fmt.Sprintf("bytes=0-%v", fileBlockSize-1)},
+		Operation: "DownloadFile",
+		Output:    written,
+	})
+	if err != nil {
+		return
+	}
+	fileName = resp.Header.Get("x-ms-file-name")
+	size, errSize := strconv.ParseInt(resp.Header.Get("x-ms-file-size"), 10, 64)
+	if errSize != nil || size <= written.n {
+		return
+	}
+	// The full-size images are only served by the GET request.
+	if fullSize {
+		err = fmt.Errorf("The full-size image is larger than %v bytes", fileBlockSize)
+		return
+	}
+
+	// Larger files are downloaded with the InitializeFileBlocksDownload and DownloadBlock actions.
+	ent, err := executeAction(auth, "", "", "InitializeFileBlocksDownload", map[string]any{
+		"Target":            EntityReference{TableName: tableName, Id: id},
+		"FileAttributeName": column,
+	})
+	if err != nil {
+		return
+	}
+
+	var init struct {
+		FileContinuationToken string
+		FileSizeInBytes       int64
+	}
+	if err = decodeMap(ent, &init); err != nil {
+		return
+	}
+
+	for offset := written.n; offset < init.FileSizeInBytes; offset += int64(fileBlockSize) {
+		ent, err = executeAction(auth, "", "", "DownloadBlock", map[string]any{
+			"Offset":                offset,
+			"BlockLength":           fileBlockSize,
+			"FileContinuationToken": init.FileContinuationToken,
+		})
+		if err != nil {
+			return
+		}
+
+		data, _ := ent["Data"].(string)
+		block, errDecode := base64.StdEncoding.DecodeString(data)
+		if errDecode != nil {
+			err = errDecode
+			return
+		}
+		if _, err = content.Write(block); err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+// countingWriter counts the bytes written to a writer.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (n int, err error) {
+	n, err = c.w.Write(p)
+	c.n += int64(n)
+	return
+}
@@ -0,0 +1,207 @@
+package dataversego
+
+import (
+	"bytes"
+	"fmt"
+	"go/format"
+	"io"
+	"strings"
+	"unicode"
+)
+
+// GenerateCustomAPIStubs writes the Go source of typed request/response structs and invocation functions
+// for the given custom APIs. The generated functions are built on 'ExecuteAction' and 'ExecuteFunction',
+// so a breaking change of a custom API shows up at compile time once the stubs are regenerated.
+//
+// It takes the following arguments:
+//   - w: the writer where the generated source is written
+//   - packageName: the name of the package of the generated source
+//   - apis: a slice of 'CustomAPI' structs, as returned by 'RetrieveCustomAPIs'
+//
+// The return value is an error value, which will be nil if the function completed successfully.
+//
+// Example:
+//
+//	apis, _ := RetrieveCustomAPIs(RetrieveCustomAPIsSignature{Auth: auth})
+//	file, _ := os.Create("customapis.go")
+//	err := GenerateCustomAPIStubs(file, "customapis", apis)
+func GenerateCustomAPIStubs(w io.Writer, packageName string, apis []CustomAPI) (err error) {
+	if len(apis) == 0 {
+		err = fmt.Errorf("Empty custom APIs")
+		return
+	}
+
+	var body bytes.Buffer
+	usesTime := false
+	uniqueNames := make(map[string]string, len(apis))
+
+	for _, api := range apis {
+		if len(api.UniqueName) == 0 {
+			err = fmt.Errorf("Empty unique name")
+			return
+		}
+		name := writeGoIdentifier(api.UniqueName)
+		if other, found := uniqueNames[name]; found {
+			err = fmt.Errorf("The custom APIs %v and %v have the same Go name %v", other, api.UniqueName, name)
+			return
+		}
+		uniqueNames[name] = api.UniqueName
+
+		// Request struct
+		fmt.Fprintf(&body, "// %vRequest represents the request parameters of the %v custom API.\n", name, api.UniqueName)
+		fmt.Fprintf(&body, "type %vRequest struct {\n", name)
+		for _, p := range api.RequestParameters {
+			goType, errType := writeGoType(p.Type, true)
+			if errType != nil {
+				err = fmt.Errorf("%v.%v: %v", api.UniqueName, p.UniqueName, errType)
+				return
+			}
+			usesTime = usesTime || p.Type == CustomAPITypeDateTime
+			if p.IsOptional && !isNilableCustomAPIType(p.Type) {
+				goType = "*" + goType
+			}
+			writeGoComment(&body, "\t", p.Description)
+			fmt.Fprintf(&body, "\t%v %v\n", writeGoIdentifier(p.UniqueName), goType)
+		}
+		fmt.Fprintf(&body, "}\n\n")
+
+		// Response struct
+		fmt.Fprintf(&body, "// %vResponse represents the response properties of the %v custom API.\n", name, api.UniqueName)
+		fmt.Fprintf(&body, "type %vResponse struct {\n", name)
+		for _, p := range api.ResponseProperties {
+			goType, errType := writeGoType(p.Type, false)
+			if errType != nil {
+				err = fmt.Errorf("%v.%v: %v", api.UniqueName, p.UniqueName, errType)
+				return
+			}
+			usesTime = usesTime || p.Type == CustomAPITypeDateTime
+			writeGoComment(&body, "\t", p.Description)
+			fmt.Fprintf(&body, "\t%v %v `json:\"%v\"`\n", writeGoIdentifier(p.UniqueName), goType, p.UniqueName)
+		}
+		fmt.Fprintf(&body, "}\n\n")
+
+		// Invocation function
+		fmt.Fprintf(&body, "// %v invokes the %v custom API.\n", name, api.UniqueName)
+		if len(strings.TrimSpace(api.Description)) > 0 {
+			fmt.Fprintf(&body, "//\n")
+			writeGoComment(&body, "", api.Description)
+		}
+		idParameter := ""
+		if api.BindingType == CustomAPIBindingEntity {
+			idParameter = "id string, "
+		}
+		fmt.Fprintf(&body, "func %v(auth dataversego.Authorization, %vrequest %vRequest) (response %vResponse, err error) {\n", name, idParameter, name, name)
+		fmt.Fprintf(&body, "parameters := map[string]any{}\n")
+		for _, p := range api.RequestParameters {
+			field := writeGoIdentifier(p.UniqueName)
+			switch {
+			case !p.IsOptional:
+				fmt.Fprintf(&body, "parameters[%q] = request.%v\n", p.UniqueName, field)
+			case isNilableCustomAPIType(p.Type):
+				fmt.Fprintf(&body, "if request.%v != nil {\nparameters[%q] = request.%v\n}\n", field, p.UniqueName, field)
+			default:
+				fmt.Fprintf(&body, "if request.%v != nil {\nparameters[%q] = *request.%v\n}\n", field, p.UniqueName, field)
+			}
+		}
+		kind := "Action"
+		if api.IsFunction {
+			kind = "Function"
+		}
+		fmt.Fprintf(&body, "\n_, err = dataversego.Execute%v(dataversego.Execute%vSignature{\n", kind, kind)
+		fmt.Fprintf(&body, "Auth: auth,\nName: %q,\n", api.UniqueName)
+		if api.BindingType != CustomAPIBindingGlobal {
+			if len(api.BoundEntitySetName) == 0 {
+				err = fmt.Errorf("%v: empty bound entity set name", api.UniqueName)
+				return
+			}
+			fmt.Fprintf(&body, "TableName: %q,\n", api.BoundEntitySetName)
+		}
+		if api.BindingType == CustomAPIBindingEntity {
+			fmt.Fprintf(&body, "Id: id,\n")
+		}
+		fmt.Fprintf(&body, "Parameters: parameters,\nResponse: &response,\n})\nreturn\n}\n\n")
+	}
+
+	var source bytes.Buffer
+	fmt.Fprintf(&source, "// Code generated by dataversego. DO NOT EDIT.\n\npackage %v\n\nimport (\n", packageName)
+	if usesTime {
+		fmt.Fprintf(&source, "\"time\"\n\n")
+	}
+	fmt.Fprintf(&source, "\"github.com/emaporta/dataversego\"\n)\n\n")
+	source.Write(body.Bytes())
+
+	formatted, err := format.Source(source.Bytes())
+	if err != nil {
+		return
+	}
+	_, err = w.Write(formatted)
+	return
+}
+
+// writeGoType returns the Go type used for a custom API parameter type.
+// Decimal and currency parameters are passed as 'Decimal' to keep their precision. Entity references are passed as 'EntityReference' in requests and returned as entities in responses.
+func writeGoType(parameterType int, request bool) (goType string, err error) {
+	switch parameterType {
+	case CustomAPITypeBoolean:
+		goType = "bool"
+	case CustomAPITypeDateTime:
+		goType = "time.Time"
+	case CustomAPITypeDecimal, CustomAPITypeMoney:
+		goType = "dataversego.Decimal"
+	case CustomAPITypeFloat:
+		goType = "float64"
+	case CustomAPITypeEntity:
+		goType = "map[string]any"
+	case CustomAPITypeEntityCollection:
+		goType = "[]map[string]any"
+	case CustomAPITypeEntityReference:
+		goType = "map[string]any"
+		if request {
+			goType = "dataversego.EntityReference"
+		}
+	case CustomAPITypeInteger, CustomAPITypePicklist:
+		goType = "int"
+	case CustomAPITypeString, CustomAPITypeGuid:
+		goType = "string"
+	case CustomAPITypeStringArray:
+		goType = "[]string"
+	default:
+		err = fmt.Errorf("Unknown custom API type %v", parameterType)
+	}
+	return
+}
+
+// isNilableCustomAPIType reports whether the Go type of a custom API parameter type can already be nil.
+func isNilableCustomAPIType(parameterType int) bool {
+	switch parameterType {
+	case CustomAPITypeEntity, CustomAPITypeEntityCollection, CustomAPITypeStringArray:
+		return true
+	}
+	return false
+}
+
+// writeGoIdentifier converts a unique name (e.g. "new_do_something") into an exported Go identifier (e.g. "NewDoSomething").
+func writeGoIdentifier(name string) string {
+	parts := strings.FieldsFunc(name, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+
+	identifier := ""
+	for _, part := range parts {
+		runes := []rune(part)
+		runes[0] = unicode.ToUpper(runes[0])
+		identifier += string(runes)
+	}
+	if len(identifier) == 0 || unicode.IsDigit([]rune(identifier)[0]) {
+		identifier = "X" + identifier
+	}
+	return identifier
+}
+
+// writeGoComment writes a description as a single line comment, if not empty.
+func writeGoComment(w io.Writer, indent string, description string) {
+	description = strings.Join(strings.Fields(description), " ")
+	if len(description) > 0 {
+		fmt.Fprintf(w, "%v// %v\n", indent, description)
+	}
+}
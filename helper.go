@@ -1,6 +1,10 @@
 package dataversego
 
-import "fmt"
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
 
 // writeFilter converts a 'Filter' struct into a string representation.
 //
@@ -51,3 +55,117 @@ func writeFilter(filter Filter) (stringFilter string) {
 
 	return
 }
+
+// writeEntityReference converts an 'EntityReference' struct into the path used as "@odata.bind" value.
+//
+// It takes a single argument of type 'EntityReference', which is a struct containing the following fields:
+//   - TableName: the name of the table (entity set) the referenced row belongs to
+//   - Id: the ID of the referenced row
+//   - AlternateKeys: a map of alternate key columns to values, used when the Id is not set
+//
+// The return value is a string representing the path of the referenced row.
+//
+// Example:
+//
+//	path := writeEntityReference(EntityReference{TableName: "accounts", AlternateKeys: map[string]any{"accountnumber": "A01"}})
+//	fmt.Println(path) // /accounts(accountnumber='A01')
+func writeEntityReference(ref EntityReference) (path string) {
+	if len(ref.Id) > 0 {
+		return fmt.Sprintf("/%v(%v)", ref.TableName, ref.Id)
+	}
+
+	keys := make([]string, 0, len(ref.AlternateKeys))
+	for key := range ref.AlternateKeys {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for i, key := range keys {
+		if i != 0 {
+			path += ","
+		}
+		switch value := ref.AlternateKeys[key].(type) {
+		case string:
+			path += fmt.Sprintf("%v='%v'", key, strings.ReplaceAll(value, "'", "''"))
+		default:
+			path += fmt.Sprintf("%v=%v", key, value)
+		}
+	}
+
+	return fmt.Sprintf("/%v(%v)", ref.TableName, path)
+}
+
+// writeEntityUrl converts an 'EntityReference' struct into the absolute url of the referenced row,
+// as expected by the "@odata.id" annotation and the $ref endpoints.
+func writeEntityUrl(auth Authorization, ref EntityReference) string {
+	return fmt.Sprintf("%v%v", auth.apiUrl(), writeEntityReference(ref))
+}
+
+// findNavigationProperty looks for the single-valued navigation property of a lookup in the given table definition.
+//
+// The attribute can be either the logical name of the lookup column (e.g. "parentcustomerid") or the
+// navigation property itself (e.g. "parentcustomerid_account"). For polymorphic lookups the referenced
+// entity is used to pick the right relationship.
+func findNavigationProperty(def EntityDefinition, attribute string, referencedEntity string) (navigationProperty string, err error) {
+	for _, rel := range def.ManyToOneRelationships {
+		if rel.ReferencedEntity != referencedEntity {
+			continue
+		}
+		if rel.ReferencingAttribute == attribute || rel.ReferencingEntityNavigationPropertyName == attribute {
+			navigationProperty = rel.ReferencingEntityNavigationPropertyName
+			return
+		}
+	}
+	err = fmt.Errorf("No navigation property found on %v for %v referencing %v", def.LogicalName, attribute, referencedEntity)
+	return
+}
+
+// bindEntityReferences returns a copy of the row where every 'EntityReference' value is replaced by
+// the corresponding "<navigationproperty>@odata.bind" key, resolved through the relationship metadata.
+func bindEntityReferences(auth Authorization, tableName string, row map[string]any) (boundRow map[string]any, err error) {
+	boundRow = make(map[string]any, len(row))
+
+	for key, value := range row {
+		var ref EntityReference
+		switch v := value.(type) {
+		case EntityReference:
+			ref = v
+		case *EntityReference:
+			if v == nil {
+				err = fmt.Errorf("Empty entity reference for %v", key)
+				return
+			}
+			ref = *v
+		default:
+			boundRow[key] = value
+			continue
+		}
+		if !ref.isSet() {
+			err = fmt.Errorf("Empty entity reference for %v", key)
+			return
+		}
+		if ref, err = ref.resolve(auth); err != nil {
+			return
+		}
+
+		def, errDef := RetrieveEntityDefinition(auth, tableName)
+		if errDef != nil {
+			err = errDef
+			return
+		}
+		target, errDef := RetrieveEntityDefinition(auth, ref.TableName)
+		if errDef != nil {
+			err = errDef
+			return
+		}
+		navigationProperty, errNav := findNavigationProperty(def, key, target.LogicalName)
+		if errNav != nil {
+			err = errNav
+			return
+		}
+
+		boundRow[navigationProperty+"@odata.bind"] = writeEntityReference(ref)
+	}
+
+	return
+}
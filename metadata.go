@@ -0,0 +1,129 @@
+package dataversego
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"sync"
+
+	"github.com/emaporta/dataversego/requests"
+)
+
+// The 'EntityDefinition' struct represents the metadata of a dataverse table.
+// It contains the following fields:
+//   - LogicalName: the logical name of the table (e.g. "account")
+//   - EntitySetName: the name of the entity set used in the Web API urls (e.g. "accounts")
+//   - PrimaryIdAttribute: the logical name of the primary key column (e.g. "accountid")
+//   - ManyToOneRelationships: a slice of 'Relationship' structs representing the lookups of the table
+type EntityDefinition struct {
+	LogicalName            string
+	EntitySetName          string
+	PrimaryIdAttribute     string
+	ManyToOneRelationships []Relationship
+}
+
+// The 'Relationship' struct represents a many-to-one relationship between two dataverse tables.
+// It contains the following fields:
+//   - SchemaName: the schema name of the relationship
+//   - ReferencingAttribute: the logical name of the lookup column
+//   - ReferencedEntity: the logical name of the referenced table
+//   - ReferencingEntityNavigationPropertyName: the single-valued navigation property of the lookup
+type Relationship struct {
+	SchemaName                              string
+	ReferencingAttribute                    string
+	ReferencedEntity                        string
+	ReferencingEntityNavigationPropertyName string
+}
+
+// entityDefinitionCache keeps the definitions already retrieved, keyed by organization url and entity set name.
+var entityDefinitionCache sync.Map
+
+// RetrieveEntityDefinition retrieves the metadata of a dataverse table, including its many-to-one relationships.
+//
+// It takes the following arguments:
+//   - auth: a struct containing authentication information
+//   - tableName: the name of the table (entity set) to retrieve the metadata for
+//
+// Definitions are cached for the lifetime of the process.
+//
+// Example:
+//
+//	def, err := RetrieveEntityDefinition(auth, "contacts")
+//	if err != nil {
+//	  log.Fatal(err)
+//	}
+//	fmt.Println(def.LogicalName)
+func RetrieveEntityDefinition(auth Authorization, tableName string) (def EntityDefinition, err error) {
+	if !auth.isSet() {
+		err = errors.New("Empty auth")
+		return
+	}
+	if len(tableName) == 0 {
+		err = errors.New("Empty table")
+		return
+	}
+
+	cacheKey := auth.Url + "|" + tableName
+	if cached, ok := entityDefinitionCache.Load(cacheKey); ok {
+		def = cached.(EntityDefinition)
+		return
+	}
+
+	resp, err := auth.do(requests.Request{
+		Method: "GET",
+		Path:   auth.apiPath() + "/EntityDefinitions",
+		Query: url.Values{
+			"$select": {"LogicalName,EntitySetName,PrimaryIdAttribute"},
+			"$filter": {fmt.Sprintf("EntitySetName eq '%v'", tableName)},
+			"$expand": {"ManyToOneRelationships($select=SchemaName,ReferencingAttribute,ReferencedEntity,ReferencingEntityNavigationPropertyName)"},
+		},
+	})
+	if err != nil {
+		return
+	}
+	ent := resp.Value
+
+	var result struct {
+		Value []EntityDefinition `json:"value"`
+	}
+	if err = decodeMap(ent, &result); err != nil {
+		return
+	}
+	if len(result.Value) == 0 {
+		err = fmt.Errorf("No entity definition found for table %v", tableName)
+		return
+	}
+
+	def = result.Value[0]
+	entityDefinitionCache.Store(cacheKey, def)
+	return
+}
+
+// decodeMap converts a generic map, as returned by the requests package, into the given typed value.
+func decodeMap(m map[string]any, v any) (err error) {
+	jsonStr, err := json.Marshal(m)
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal(jsonStr, v)
+	return
+}
+
+// retrieveEntitySetName retrieves the entity set name of a dataverse table from its logical name.
+func retrieveEntitySetName(auth Authorization, logicalName string) (entitySetName string, err error) {
+	resp, err := auth.do(requests.Request{
+		Method: "GET",
+		Path:   fmt.Sprintf("%v/EntityDefinitions(LogicalName='%v')", auth.apiPath(), logicalName),
+		Query:  url.Values{"$select": {"EntitySetName"}},
+	})
+	if err != nil {
+		return
+	}
+
+	entitySetName, _ = resp.Value["EntitySetName"].(string)
+	if len(entitySetName) == 0 {
+		err = fmt.Errorf("No entity set found for table %v", logicalName)
+	}
+	return
+}
@@ -1,5 +1,12 @@
 package dataversego
 
+import (
+	"context"
+	"strings"
+
+	"github.com/emaporta/dataversego/requests"
+)
+
 type checkableObject interface {
 	isSet() bool
 }
@@ -9,10 +16,26 @@ type checkableObject interface {
 //   - Token: a string representing the authorization token
 //   - Url: a string representing the organization URL
 //   - Expiration: an int64 representing the expiration time of the token in Unix timestamp format
+//   - Client: an optional 'requests.Client' holding the HTTP configuration (transport, middlewares), requests.DefaultClient if nil.
+//     When Token is empty, the token is provided by the TokenProvider of the client. Its Options are the default
+//     'requests.RequestOptions' of the operations, e.g. to impersonate a user in every request.
+//
+// Example:
+//
+//	auth := Authorization{
+//	  Url: "https://myorg.crm.dynamics.com",
+//	  Client: &requests.Client{TokenProvider: &requests.ManagedIdentityCredential{Resource: "https://myorg.crm.dynamics.com"}},
+//	}
 type Authorization struct {
 	Token      string
 	Url        string
 	Expiration int64
+	Client     *requests.Client
+
+	// options are the request options of the operation, set from the Options of its signature.
+	options requests.RequestOptions
+	// ctx records the requests of the operation as a single span and duration.
+	ctx context.Context
 }
 
 // The 'Condition' struct represents a condition for a filter.
@@ -38,8 +61,93 @@ type Filter struct {
 }
 
 func (a Authorization) isSet() bool {
-	return len(a.Token) > 0
+	return len(a.Token) > 0 || (a.Client != nil && a.Client.TokenProvider != nil)
+}
+
+// client returns the 'requests.Client' used to send the requests of the authorization.
+func (a Authorization) client() *requests.Client {
+	if a.Client != nil {
+		return a.Client
+	}
+	return requests.DefaultClient
+}
+
+// apiPath returns the root path of the Web API, e.g. "/api/data/v9.1".
+func (a Authorization) apiPath() string {
+	return a.client().ApiPath()
 }
+
+// apiUrl returns the root url of the Web API of the organization, e.g. "https://myorg.crm.dynamics.com/api/data/v9.1".
+func (a Authorization) apiUrl() string {
+	return strings.TrimSuffix(a.Url, "/") + a.apiPath()
+}
+
+// withOptions returns the authorization with the request options of an operation.
+func (a Authorization) withOptions(options requests.RequestOptions) Authorization {
+	a.options = a.options.Merge(options)
+	return a
+}
+
+// withOperation returns the authorization of an operation, whose requests (metadata lookups, pages, chunks) are
+// recorded as a single operation until endOperation is called.
+func (a Authorization) withOperation(name string, tableName string) Authorization {
+	a.ctx = a.client().StartOperation(a.context(), name, tableName)
+	return a
+}
+
+// endOperation ends the operation of the authorization with its error.
+func (a Authorization) endOperation(err error) {
+	if a.ctx != nil {
+		requests.EndOperation(a.ctx, err)
+	}
+}
+
+// context returns the context of the requests of the operation.
+func (a Authorization) context() context.Context {
+	if a.ctx != nil {
+		return a.ctx
+	}
+	return context.Background()
+}
+
+// do sends a request to the organization of the authorization, with its client, token and request options.
+func (a Authorization) do(request requests.Request) (*requests.Response, error) {
+	request.Url = strings.TrimSuffix(a.Url, "/")
+	request.Auth = a.Token
+	request.Options = a.options
+	return a.client().Do(a.context(), request)
+}
+
 func (f Filter) isSet() bool {
 	return len(f.Kind) > 0
 }
+
+// The 'EntityReference' struct represents a reference to a dataverse row, used to set lookup columns.
+// It can be placed directly in the Row of a 'CreateUpdateSignature' and will be serialized into the
+// corresponding "@odata.bind" key. A nil '*EntityReference' is an error, a lookup being cleared with 'Disassociate'
+// and no Targets.
+// It contains the following fields:
+//   - TableName: the name of the table (entity set) the referenced row belongs to (e.g. "accounts")
+//   - LogicalName: the logical name of the table (e.g. "account"), as read from a lookup by 'Record.GetEntityReference'.
+//     The TableName is retrieved from it when empty.
+//   - Id: the ID of the referenced row
+//   - AlternateKeys: a map of alternate key columns to values, used when the Id is not set
+type EntityReference struct {
+	TableName     string
+	LogicalName   string
+	Id            string
+	AlternateKeys map[string]any
+}
+
+func (r EntityReference) isSet() bool {
+	return (len(r.TableName) > 0 || len(r.LogicalName) > 0) && (len(r.Id) > 0 || len(r.AlternateKeys) > 0)
+}
+
+// resolve returns the reference with its TableName, retrieved from its LogicalName when empty.
+func (r EntityReference) resolve(auth Authorization) (ref EntityReference, err error) {
+	ref = r
+	if len(ref.TableName) == 0 && len(ref.LogicalName) > 0 {
+		ref.TableName, err = retrieveEntitySetName(auth, ref.LogicalName)
+	}
+	return
+}
@@ -0,0 +1,189 @@
+package dataversego
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"sync"
+
+	"github.com/emaporta/dataversego/requests"
+)
+
+// Sources of the precision of a currency column, as returned by the PrecisionSource of its metadata.
+//   - PrecisionSourceAttribute: the precision of the column
+//   - PrecisionSourceOrganization: the pricing decimal precision of the organization
+//   - PrecisionSourceCurrency: the precision of the transaction currency of the row
+const (
+	PrecisionSourceAttribute    = 0
+	PrecisionSourceOrganization = 1
+	PrecisionSourceCurrency     = 2
+)
+
+// The 'Money' struct represents the value of a currency column.
+// It contains the following fields:
+//   - Amount: the exact amount, in the transaction currency
+//   - Currency: a reference to the transaction currency of the row ("transactioncurrencyid"), empty if not set
+//   - Precision: the number of digits after the decimal point of the column, read from its metadata
+//
+// A 'Money' can be set in the Row of a 'CreateUpdateSignature', where its Amount is written as is. The currency
+// of a row is set with its "transactioncurrencyid" lookup.
+type Money struct {
+	Amount    Decimal
+	Currency  EntityReference
+	Precision int
+}
+
+// moneyMetadata is the metadata of a currency column.
+type moneyMetadata struct {
+	Precision       int
+	PrecisionSource int
+}
+
+// moneyPrecisionCache keeps the metadata of the currency columns and the precisions already retrieved, keyed by
+// organization url and source.
+var moneyPrecisionCache sync.Map
+
+// Rounded returns the amount rounded to the precision of the column.
+func (m Money) Rounded() Decimal {
+	return m.Amount.Round(m.Precision)
+}
+
+// String returns the amount rounded to the precision of the column.
+func (m Money) String() string {
+	return m.Rounded().String()
+}
+
+// MarshalJSON writes the amount as a JSON number.
+func (m Money) MarshalJSON() ([]byte, error) {
+	return m.Amount.MarshalJSON()
+}
+
+// RetrieveMoney reads the value of a currency column of a record, with its transaction currency and the
+// precision of the column. The precision is read from the metadata of the column, then from the organization
+// or the currency according to its PrecisionSource, and cached for the lifetime of the process.
+//
+// It takes a single argument of type 'RetrieveMoneySignature', which is a struct containing the following fields:
+//   - Auth: a struct containing authentication information
+//   - Record: the record holding the column, with its "_transactioncurrencyid_value" column
+//   - TableName: the name of the table (entity set) of the record, read from the record if empty
+//   - Column: the logical name of the currency column (e.g. "totalamount")
+//   - Options: the 'requests.RequestOptions' of the requests (impersonation, MSCRM headers)
+//
+// The return value is a 'Money', and an error value, which will be nil if the function completed successfully.
+//
+// Example:
+//
+//	invoice, err := Retrieve(RetrieveSignature{
+//	  Auth: auth,
+//	  TableName: "invoices",
+//	  Id: "123",
+//	  ColumnsString: "totalamount,_transactioncurrencyid_value",
+//	})
+//	if err != nil {
+//	  log.Fatal(err)
+//	}
+//	total, err := RetrieveMoney(RetrieveMoneySignature{Auth: auth, Record: invoice, Column: "totalamount"})
+//	if err != nil {
+//	  log.Fatal(err)
+//	}
+//	fmt.Println(total, total.Currency.Id)
+func RetrieveMoney(parameter RetrieveMoneySignature) (money Money, err error) {
+	parameter.Auth = parameter.Auth.withOptions(parameter.Options).withOperation("RetrieveMoney", parameter.TableName)
+	defer func() { parameter.Auth.endOperation(err) }()
+	if !parameter.Auth.isSet() {
+		err = errors.New("Empty auth")
+		return
+	}
+	if len(parameter.TableName) == 0 {
+		parameter.TableName = parameter.Record.TableName()
+	}
+	if len(parameter.TableName) == 0 {
+		err = errors.New("Empty table")
+		return
+	}
+	if len(parameter.Column) == 0 {
+		err = errors.New("Empty column")
+		return
+	}
+
+	if money, err = parameter.Record.GetMoney(parameter.Column); err != nil {
+		return
+	}
+	money.Precision, err = retrieveMoneyPrecision(parameter.Auth, parameter.TableName, parameter.Column, money.Currency)
+	return
+}
+
+// INTERNAL METHODS
+
+// retrieveMoneyPrecision retrieves the precision of a currency column, from the column, the organization or the
+// currency according to its precision source.
+func retrieveMoneyPrecision(auth Authorization, tableName string, column string, currency EntityReference) (precision int, err error) {
+	def, err := RetrieveEntityDefinition(auth, tableName)
+	if err != nil {
+		return
+	}
+
+	var metadata moneyMetadata
+	cacheKey := fmt.Sprintf("%v|%v|%v", auth.Url, def.LogicalName, column)
+	if cached, ok := moneyPrecisionCache.Load(cacheKey); ok {
+		metadata = cached.(moneyMetadata)
+	} else {
+		resp, errMeta := auth.do(requests.Request{
+			Method: "GET",
+			Path:   fmt.Sprintf("%v/EntityDefinitions(LogicalName='%v')/Attributes(LogicalName='%v')/Microsoft.Dynamics.CRM.MoneyAttributeMetadata", auth.apiPath(), def.LogicalName, column),
+			Query:  url.Values{"$select": {"Precision,PrecisionSource"}},
+		})
+		if errMeta != nil {
+			err = errMeta
+			return
+		}
+		if err = decodeMap(resp.Value, &metadata); err != nil {
+			return
+		}
+		moneyPrecisionCache.Store(cacheKey, metadata)
+	}
+
+	switch {
+	case metadata.PrecisionSource == PrecisionSourceOrganization:
+		precision, err = retrievePrecision(auth, "organizations", "", "pricingdecimalprecision")
+	case metadata.PrecisionSource == PrecisionSourceCurrency && len(currency.Id) > 0:
+		precision, err = retrievePrecision(auth, "transactioncurrencies", currency.Id, "currencyprecision")
+	default:
+		precision = metadata.Precision
+	}
+	return
+}
+
+// retrievePrecision retrieves a precision column of the organization or of a currency, cached for the lifetime
+// of the process.
+func retrievePrecision(auth Authorization, tableName string, id string, column string) (precision int, err error) {
+	cacheKey := fmt.Sprintf("%v|%v(%v)", auth.Url, tableName, id)
+	if cached, ok := moneyPrecisionCache.Load(cacheKey); ok {
+		precision = cached.(int)
+		return
+	}
+
+	var record Record
+	if len(id) > 0 {
+		record, err = retrieve(auth, tableName, id, column, nil)
+	} else {
+		var collection RecordCollection
+		collection, err = retrieveMultiple(auth, tableName, column, "", nil)
+		if records := collection.Records(); len(records) > 0 {
+			record = records[0]
+		}
+	}
+	if err != nil {
+		return
+	}
+	if record == nil {
+		err = fmt.Errorf("No %v found", tableName)
+		return
+	}
+
+	if precision, err = record.GetInt(column); err != nil {
+		return
+	}
+	moneyPrecisionCache.Store(cacheKey, precision)
+	return
+}
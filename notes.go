@@ -0,0 +1,335 @@
+package dataversego
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultMaxUploadFileSize is the default attachment size limit of an organization, 5 MB.
+const defaultMaxUploadFileSize = 5 * 1024 * 1024
+
+// maxUploadFileSizeCache keeps the attachment size limit already retrieved, keyed by organization url.
+var maxUploadFileSizeCache sync.Map
+
+// The 'Note' struct represents a note (annotation) attached to a dataverse entry.
+// It contains the following fields:
+//   - Id: the ID of the note
+//   - Subject: the title of the note
+//   - NoteText: the text of the note
+//   - FileName: the name of the attached file, if any
+//   - MimeType: the MIME type of the attached file, if any
+//   - FileSize: the size in bytes of the attached file
+//   - IsDocument: a boolean value indicating whether the note has an attached file
+//   - CreatedOn: the creation time of the note
+//   - ModifiedOn: the last modification time of the note
+type Note struct {
+	Id         string    `json:"annotationid"`
+	Subject    string    `json:"subject"`
+	NoteText   string    `json:"notetext"`
+	FileName   string    `json:"filename"`
+	MimeType   string    `json:"mimetype"`
+	FileSize   int64     `json:"filesize"`
+	IsDocument bool      `json:"isdocument"`
+	CreatedOn  time.Time `json:"createdon"`
+	ModifiedOn time.Time `json:"modifiedon"`
+}
+
+// AttachNote attaches a file to a dataverse entry as a note (annotation).
+//
+// It takes a single argument of type 'AttachFileSignature', which is a struct containing the following fields:
+//   - Auth: a struct containing authentication information
+//   - TableName: the name of the table of the entry
+//   - Id: the ID of the entry
+//   - Subject: the title of the note
+//   - NoteText: the text of the note
+//   - FileName: the name of the file
+//   - MimeType: the MIME type of the file, guessed from the file name if empty
+//   - Content: a reader providing the content of the file
+//   - Options: the 'requests.RequestOptions' of the requests (impersonation, MSCRM headers)
+//
+// The size of the file is validated against the attachment size limit of the organization.
+//
+// The return value is the ID of the created note, and an error value, which will be nil if the function completed successfully.
+//
+// Example:
+//
+//	file, _ := os.Open("contract.pdf")
+//	defer file.Close()
+//	id, err := AttachNote(AttachFileSignature{
+//	  Auth: Auth{Token: "Token", Url: "https://url.crm.dynamics.com"},
+//	  TableName: "accounts",
+//	  Id: "123",
+//	  Subject: "Signed contract",
+//	  FileName: "contract.pdf",
+//	  Content: file,
+//	})
+//	if err != nil {
+//	  log.Fatal(err)
+//	}
+//	fmt.Println(id)
+func AttachNote(parameter AttachFileSignature) (id string, err error) {
+	parameter.Auth = parameter.Auth.withOptions(parameter.Options).withOperation("AttachNote", parameter.TableName)
+	defer func() { parameter.Auth.endOperation(err) }()
+	documentBody, mimeType, err := readAttachment(parameter)
+	if err != nil {
+		return
+	}
+
+	id, err = CreateUpdate(CreateUpdateSignature{
+		Auth:      parameter.Auth,
+		TableName: "annotations",
+		Row: map[string]any{
+			"subject":      parameter.Subject,
+			"notetext":     parameter.NoteText,
+			"filename":     parameter.FileName,
+			"mimetype":     mimeType,
+			"documentbody": documentBody,
+			"objectid":     EntityReference{TableName: parameter.TableName, Id: parameter.Id},
+		},
+	})
+	return
+}
+
+// AttachActivityAttachment attaches a file to an activity (e.g. an email) as an activity mime attachment.
+//
+// It takes a single argument of type 'AttachFileSignature', which is a struct containing the following fields:
+//   - Auth: a struct containing authentication information
+//   - TableName: the name of the activity table (e.g. "emails")
+//   - Id: the ID of the activity
+//   - Subject: the title of the attachment
+//   - FileName: the name of the file
+//   - MimeType: the MIME type of the file, guessed from the file name if empty
+//   - Content: a reader providing the content of the file
+//   - Options: the 'requests.RequestOptions' of the requests (impersonation, MSCRM headers)
+//
+// The size of the file is validated against the attachment size limit of the organization.
+//
+// The return value is the ID of the created attachment, and an error value, which will be nil if the function completed successfully.
+//
+// Example:
+//
+//	id, err := AttachActivityAttachment(AttachFileSignature{
+//	  Auth: Auth{Token: "Token", Url: "https://url.crm.dynamics.com"},
+//	  TableName: "emails",
+//	  Id: "123",
+//	  FileName: "invoice.pdf",
+//	  Content: file,
+//	})
+//	if err != nil {
+//	  log.Fatal(err)
+//	}
+func AttachActivityAttachment(parameter AttachFileSignature) (id string, err error) {
+	parameter.Auth = parameter.Auth.withOptions(parameter.Options).withOperation("AttachActivityAttachment", parameter.TableName)
+	defer func() { parameter.Auth.endOperation(err) }()
+	documentBody, mimeType, err := readAttachment(parameter)
+	if err != nil {
+		return
+	}
+
+	def, err := RetrieveEntityDefinition(parameter.Auth, parameter.TableName)
+	if err != nil {
+		return
+	}
+
+	id, err = CreateUpdate(CreateUpdateSignature{
+		Auth:      parameter.Auth,
+		TableName: "activitymimeattachments",
+		Row: map[string]any{
+			"subject":                             parameter.Subject,
+			"filename":                            parameter.FileName,
+			"mimetype":                            mimeType,
+			"body":                                documentBody,
+			"objecttypecode":                      def.LogicalName,
+			"objectid_activitypointer@odata.bind": writeEntityReference(EntityReference{TableName: "activitypointers", Id: parameter.Id}),
+		},
+	})
+	return
+}
+
+// RetrieveNotes retrieves the notes attached to a dataverse entry, without their content.
+//
+// It takes a single argument of type 'RetrieveNotesSignature', which is a struct containing the following fields:
+//   - Auth: a struct containing authentication information
+//   - Id: the ID of the entry
+//   - Options: the 'requests.RequestOptions' of the requests (impersonation, MSCRM headers)
+//
+// The return value is a slice of 'Note' structs, and an error value, which will be nil if the function completed successfully.
+//
+// Example:
+//
+//	notes, err := RetrieveNotes(RetrieveNotesSignature{
+//	  Auth: Auth{Token: "Token", Url: "https://url.crm.dynamics.com"},
+//	  Id: "123",
+//	})
+//	if err != nil {
+//	  log.Fatal(err)
+//	}
+//	fmt.Println(notes)
+func RetrieveNotes(parameter RetrieveNotesSignature) (notes []Note, err error) {
+	parameter.Auth = parameter.Auth.withOptions(parameter.Options).withOperation("RetrieveNotes", "annotations")
+	defer func() { parameter.Auth.endOperation(err) }()
+	if !parameter.Auth.isSet() {
+		err = errors.New("Empty auth")
+		return
+	}
+	if len(parameter.Id) == 0 {
+		err = errors.New("Empty Id")
+		return
+	}
+
+	filter := Filter{
+		Kind:       "and",
+		Conditions: []Condition{{Key: "_objectid_value", Condition: "eq", Value: parameter.Id}},
+	}
+	ent, err := retrieveMultiple(parameter.Auth, "annotations", "annotationid,subject,notetext,filename,mimetype,filesize,isdocument,createdon,modifiedon", writeFilter(filter), nil)
+	if err != nil {
+		return
+	}
+
+	var result struct {
+		Value []Note `json:"value"`
+	}
+	err = decodeMap(ent, &result)
+	notes = result.Value
+	return
+}
+
+// DownloadNote writes the content of the file attached to a note.
+//
+// It takes a single argument of type 'DownloadNoteSignature', which is a struct containing the following fields:
+//   - Auth: a struct containing authentication information
+//   - Id: the ID of the note
+//   - Content: a writer where the content of the file is written
+//   - Options: the 'requests.RequestOptions' of the requests (impersonation, MSCRM headers)
+//
+// The return value is the 'Note' struct with the metadata of the note, and an error value, which will be nil if the function completed successfully.
+//
+// Example:
+//
+//	file, _ := os.Create("contract.pdf")
+//	defer file.Close()
+//	note, err := DownloadNote(DownloadNoteSignature{
+//	  Auth: Auth{Token: "Token", Url: "https://url.crm.dynamics.com"},
+//	  Id: "123",
+//	  Content: file,
+//	})
+//	if err != nil {
+//	  log.Fatal(err)
+//	}
+//	fmt.Println(note.FileName)
+func DownloadNote(parameter DownloadNoteSignature) (note Note, err error) {
+	parameter.Auth = parameter.Auth.withOptions(parameter.Options).withOperation("DownloadNote", "annotations")
+	defer func() { parameter.Auth.endOperation(err) }()
+	if !parameter.Auth.isSet() {
+		err = errors.New("Empty auth")
+		return
+	}
+	if len(parameter.Id) == 0 {
+		err = errors.New("Empty Id")
+		return
+	}
+	if parameter.Content == nil {
+		err = errors.New("Empty content")
+		return
+	}
+
+	ent, err := retrieve(parameter.Auth, "annotations", parameter.Id, "annotationid,subject,notetext,filename,mimetype,filesize,isdocument,createdon,modifiedon,documentbody", nil)
+	if err != nil {
+		return
+	}
+	if err = decodeMap(ent, &note); err != nil {
+		return
+	}
+
+	documentBody, _ := ent["documentbody"].(string)
+	_, err = io.Copy(parameter.Content, base64.NewDecoder(base64.StdEncoding, strings.NewReader(documentBody)))
+	return
+}
+
+// INTERNAL METHODS
+
+// readAttachment validates the parameters of an attachment and reads its content, returning it base64-encoded
+// together with its MIME type. Files larger than the attachment size limit of the organization are refused.
+func readAttachment(parameter AttachFileSignature) (documentBody string, mimeType string, err error) {
+	if !parameter.Auth.isSet() {
+		err = errors.New("Empty auth")
+		return
+	}
+	if len(parameter.TableName) == 0 {
+		err = errors.New("Empty table")
+		return
+	}
+	if len(parameter.Id) == 0 {
+		err = errors.New("Empty Id")
+		return
+	}
+	if len(parameter.FileName) == 0 {
+		err = errors.New("Empty file name")
+		return
+	}
+	if parameter.Content == nil {
+		err = errors.New("Empty content")
+		return
+	}
+
+	maxSize, err := retrieveMaxUploadFileSize(parameter.Auth)
+	if err != nil {
+		return
+	}
+
+	var content bytes.Buffer
+	encoder := base64.NewEncoder(base64.StdEncoding, &content)
+	size, err := io.Copy(encoder, io.LimitReader(parameter.Content, maxSize+1))
+	if err != nil {
+		return
+	}
+	if err = encoder.Close(); err != nil {
+		return
+	}
+	if size > maxSize {
+		err = fmt.Errorf("File %v exceeds the maximum attachment size of %v bytes", parameter.FileName, maxSize)
+		return
+	}
+
+	documentBody = content.String()
+	mimeType = parameter.MimeType
+	if len(mimeType) == 0 {
+		mimeType = guessMimeType(parameter.FileName)
+	}
+	return
+}
+
+// retrieveMaxUploadFileSize retrieves the attachment size limit of the organization, in bytes.
+func retrieveMaxUploadFileSize(auth Authorization) (maxSize int64, err error) {
+	if cached, ok := maxUploadFileSizeCache.Load(auth.Url); ok {
+		maxSize = cached.(int64)
+		return
+	}
+
+	ent, err := retrieveMultiple(auth, "organizations", "maxuploadfilesize", "", nil)
+	if err != nil {
+		return
+	}
+
+	var result struct {
+		Value []struct {
+			MaxUploadFileSize int64 `json:"maxuploadfilesize"`
+		} `json:"value"`
+	}
+	if err = decodeMap(ent, &result); err != nil {
+		return
+	}
+
+	maxSize = defaultMaxUploadFileSize
+	if len(result.Value) > 0 && result.Value[0].MaxUploadFileSize > 0 {
+		maxSize = result.Value[0].MaxUploadFileSize
+	}
+	maxUploadFileSizeCache.Store(auth.Url, maxSize)
+	return
+}
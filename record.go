@@ -0,0 +1,304 @@
+package dataversego
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Annotations of the columns of a record, returned when requested with the IncludeAnnotations option of an operation.
+//   - AnnotationsAll: every annotation
+//   - AnnotationFormattedValue: the formatted value of a column, e.g. the label of a choice, the name of a lookup or a formatted date
+//   - AnnotationLookupLogicalName: the logical name of the table referenced by a lookup column
+//   - AnnotationAssociatedNavigationProperty: the navigation property of a lookup column, used to bind it
+const (
+	AnnotationsAll                         = "*"
+	AnnotationFormattedValue               = "OData.Community.Display.V1.FormattedValue"
+	AnnotationLookupLogicalName            = "Microsoft.Dynamics.CRM.lookuplogicalname"
+	AnnotationAssociatedNavigationProperty = "Microsoft.Dynamics.CRM.associatednavigationproperty"
+)
+
+// Record is an entry of a dataverse table as returned by the Web API, a map of the column names to their values.
+// The typed getters convert the JSON values of the columns (e.g. GetTime for a date and time column), and the
+// annotations of the columns are read with the accessors instead of their raw keys
+// (e.g. "statuscode@OData.Community.Display.V1.FormattedValue").
+//
+// The getters return an error if the record doesn't have the column or if its value can't be converted, and the
+// zero value if the column is null.
+//
+// Example:
+//
+//	ent, err := Retrieve(RetrieveSignature{
+//	  Auth: auth,
+//	  TableName: "contacts",
+//	  Id: "123",
+//	  IncludeAnnotations: AnnotationsAll,
+//	})
+//	if err != nil {
+//	  log.Fatal(err)
+//	}
+//	birthdate, err := ent.GetTime("birthdate")
+//	parent, err := ent.GetEntityReference("parentcustomerid")
+//	label, _ := ent.FormattedValue("statuscode")
+//	fmt.Println(birthdate, parent.Id, label)
+type Record map[string]any
+
+// The 'RecordCollection' type is a page of entries of a dataverse table as returned by RetrieveMultiple, a map
+// holding the entries in its "value" key.
+//
+// Example:
+//
+//	ents, err := RetrieveMultiple(RetrieveMultipleSignature{Auth: auth, TableName: "contacts"})
+//	if err != nil {
+//	  log.Fatal(err)
+//	}
+//	for _, record := range ents.Records() {
+//	  fmt.Println(record.GetString("fullname"))
+//	}
+type RecordCollection map[string]any
+
+// guidRegexp matches a GUID, e.g. the ID of a row.
+var guidRegexp = regexp.MustCompile(`^[a-fA-F0-9]{8}-[a-fA-F0-9]{4}-[a-fA-F0-9]{4}-[a-fA-F0-9]{4}-[a-fA-F0-9]{12}$`)
+
+// Records returns the entries of the collection. The entries without "@odata.context" are copies with the
+// context of the collection, so their TableName is known, the entries of the collection are not modified.
+func (c RecordCollection) Records() []Record {
+	values, _ := c["value"].([]any)
+	context, _ := c["@odata.context"].(string)
+
+	records := make([]Record, 0, len(values))
+	for _, value := range values {
+		row, ok := value.(map[string]any)
+		if !ok {
+			continue
+		}
+		if _, found := row["@odata.context"]; !found && len(context) > 0 {
+			row = maps.Clone(row)
+			row["@odata.context"] = context + "/$entity"
+		}
+		records = append(records, Record(row))
+	}
+	return records
+}
+
+// GetString returns the value of a text column.
+func (r Record) GetString(column string) (value string, err error) {
+	raw, err := r.get(column)
+	if err != nil || raw == nil {
+		return
+	}
+	value, ok := raw.(string)
+	if !ok {
+		err = fmt.Errorf("Column %v is not a string: %v", column, raw)
+	}
+	return
+}
+
+// GetGUID returns the value of a unique identifier column (e.g. "contactid" or "_parentcustomerid_value").
+func (r Record) GetGUID(column string) (value string, err error) {
+	value, err = r.GetString(column)
+	if err != nil || len(value) == 0 {
+		return
+	}
+	if !guidRegexp.MatchString(value) {
+		err = fmt.Errorf("Column %v is not a GUID: %v", column, value)
+		value = ""
+	}
+	return
+}
+
+// GetTime returns the value of a date and time column, sent by the Web API as an Edm.DateTimeOffset
+// (e.g. "2024-01-31T10:00:00Z") or an Edm.Date for the date only columns (e.g. "2024-01-31").
+func (r Record) GetTime(column string) (value time.Time, err error) {
+	raw, err := r.GetString(column)
+	if err != nil || len(raw) == 0 {
+		return
+	}
+	if value, err = time.Parse(time.RFC3339Nano, raw); err == nil {
+		return
+	}
+	if value, err = time.Parse(time.DateOnly, raw); err != nil {
+		err = fmt.Errorf("Column %v is not a date: %v", column, raw)
+	}
+	return
+}
+
+// GetDecimal returns the exact value of a decimal, floating point or currency column.
+func (r Record) GetDecimal(column string) (value Decimal, err error) {
+	raw, err := r.get(column)
+	if err != nil || raw == nil {
+		return
+	}
+	if value, err = readDecimal(raw); err != nil {
+		err = fmt.Errorf("Column %v is not a number: %v", column, raw)
+	}
+	return
+}
+
+// GetInt returns the value of a whole number column.
+func (r Record) GetInt(column string) (value int, err error) {
+	raw, err := r.get(column)
+	if err != nil || raw == nil {
+		return
+	}
+	var number int64
+	switch v := raw.(type) {
+	case json.Number:
+		number, err = v.Int64()
+	case float64:
+		number = int64(v)
+		if v != float64(number) {
+			err = strconv.ErrSyntax
+		}
+	default:
+		err = strconv.ErrSyntax
+	}
+	if err != nil {
+		err = fmt.Errorf("Column %v is not a whole number: %v", column, raw)
+		return
+	}
+	value = int(number)
+	return
+}
+
+// GetOptionSet returns the value of a choice column (e.g. "statuscode"). Its label is read with FormattedValue.
+func (r Record) GetOptionSet(column string) (value int, err error) {
+	if value, err = r.GetInt(column); err != nil {
+		err = fmt.Errorf("Column %v is not a choice: %v", column, r[column])
+	}
+	return
+}
+
+// GetMoney returns the value of a currency column, with the transaction currency of the record read from its
+// "_transactioncurrencyid_value" column. The precision of the column is read from its metadata by RetrieveMoney.
+func (r Record) GetMoney(column string) (value Money, err error) {
+	if value.Amount, err = r.GetDecimal(column); err != nil {
+		return
+	}
+	if _, ok := r["_transactioncurrencyid_value"]; !ok {
+		return
+	}
+	currencyId, err := r.GetGUID("_transactioncurrencyid_value")
+	if err != nil || len(currencyId) == 0 {
+		return
+	}
+	value.Currency = EntityReference{TableName: "transactioncurrencies", LogicalName: "transactioncurrency", Id: currencyId}
+	return
+}
+
+// GetEntityReference returns the row referenced by a lookup column, read from its "_<column>_value" column and its
+// lookuplogicalname annotation, to be requested with the IncludeAnnotations option (e.g. AnnotationsAll). The column
+// is either the logical name of the lookup (e.g. "parentcustomerid") or its value column
+// (e.g. "_parentcustomerid_value"). The reference is empty if the lookup is null.
+//
+// The reference holds the logical name of the referenced table, so it can be set in the Row of a
+// 'CreateUpdateSignature' as is.
+func (r Record) GetEntityReference(column string) (ref EntityReference, err error) {
+	if !strings.HasPrefix(column, "_") || !strings.HasSuffix(column, "_value") {
+		column = fmt.Sprintf("_%v_value", column)
+	}
+	id, err := r.GetGUID(column)
+	if err != nil || len(id) == 0 {
+		return
+	}
+	logicalName := r.LookupLogicalName(column)
+	if len(logicalName) == 0 {
+		err = fmt.Errorf("Missing %v annotation of column %v", AnnotationLookupLogicalName, column)
+		return
+	}
+	ref = EntityReference{LogicalName: logicalName, Id: id}
+	return
+}
+
+// ETag returns the version of the record, read from its "@odata.etag" annotation, empty if the record doesn't have it.
+func (r Record) ETag() string {
+	etag, _ := r["@odata.etag"].(string)
+	return etag
+}
+
+// TableName returns the name of the table (entity set) of the record (e.g. "contacts"), read from its
+// "@odata.context" annotation, empty if the record doesn't have it.
+func (r Record) TableName() string {
+	context, _ := r["@odata.context"].(string)
+	_, fragment, found := strings.Cut(context, "#")
+	if !found {
+		return ""
+	}
+	if i := strings.IndexAny(fragment, "(/"); i >= 0 {
+		fragment = fragment[:i]
+	}
+	return fragment
+}
+
+// Annotation returns the value of an annotation of a column, ok being false if the record doesn't have it.
+func (r Record) Annotation(column string, annotation string) (value any, ok bool) {
+	value, ok = r[fmt.Sprintf("%v@%v", column, annotation)]
+	return
+}
+
+// FormattedValue returns the formatted value of a column (e.g. the label of a choice or the name of a lookup),
+// ok being false if the record doesn't have it.
+func (r Record) FormattedValue(column string) (value string, ok bool) {
+	annotation, ok := r.Annotation(column, AnnotationFormattedValue)
+	value, _ = annotation.(string)
+	return
+}
+
+// FormattedValues returns the formatted values of the columns of the record.
+func (r Record) FormattedValues() map[string]string {
+	values := map[string]string{}
+	suffix := "@" + AnnotationFormattedValue
+	for key, value := range r {
+		if column, found := strings.CutSuffix(key, suffix); found {
+			values[column], _ = value.(string)
+		}
+	}
+	return values
+}
+
+// LookupLogicalName returns the logical name of the table referenced by a lookup column (e.g. "account" for
+// "_parentcustomerid_value"), empty if the record doesn't have the annotation.
+func (r Record) LookupLogicalName(column string) string {
+	value, _ := r.Annotation(column, AnnotationLookupLogicalName)
+	logicalName, _ := value.(string)
+	return logicalName
+}
+
+// AssociatedNavigationProperty returns the navigation property of a lookup column (e.g. "parentcustomerid_account"
+// for "_parentcustomerid_value"), empty if the record doesn't have the annotation.
+func (r Record) AssociatedNavigationProperty(column string) string {
+	value, _ := r.Annotation(column, AnnotationAssociatedNavigationProperty)
+	navigationProperty, _ := value.(string)
+	return navigationProperty
+}
+
+// INTERNAL METHODS
+
+// get returns the value of a column, an error if the record doesn't have it.
+func (r Record) get(column string) (value any, err error) {
+	value, ok := r[column]
+	if !ok {
+		err = fmt.Errorf("Missing column %v", column)
+	}
+	return
+}
+
+// writePrefer returns the Prefer header of an operation returning the record and including the given annotations,
+// nil if none.
+func writePrefer(returnRecord bool, includeAnnotations string) (headers map[string]string) {
+	var preferences []string
+	if returnRecord {
+		preferences = append(preferences, "return=representation")
+	}
+	if len(includeAnnotations) > 0 {
+		preferences = append(preferences, fmt.Sprintf(`odata.include-annotations="%v"`, includeAnnotations))
+	}
+	if len(preferences) == 0 {
+		return
+	}
+	return map[string]string{"Prefer": strings.Join(preferences, ",")}
+}
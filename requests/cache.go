@@ -0,0 +1,185 @@
+package requests
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// The 'CacheKey' struct identifies the tokens of a 'TokenCache'.
+// It contains the following fields:
+//   - TenantId: the tenant ID
+//   - ClientId: the client ID of the app registration
+//   - Resource: the organization URL
+type CacheKey struct {
+	TenantId string
+	ClientId string
+	Resource string
+}
+
+func (k CacheKey) String() string {
+	return strings.ToLower(fmt.Sprintf("%v|%v|%v", k.TenantId, k.ClientId, strings.TrimSuffix(k.Resource, "/")))
+}
+
+// The 'CachedToken' struct is a token stored in a 'TokenCache'.
+// It contains the following fields:
+//   - AccessToken: the access token
+//   - ExpiresOn: the expiration time of the access token
+//   - RefreshToken: the refresh token of the delegated flows, empty for the app-only flows
+type CachedToken struct {
+	AccessToken  string    `json:"access_token"`
+	ExpiresOn    time.Time `json:"expires_on"`
+	RefreshToken string    `json:"refresh_token,omitempty"`
+}
+
+// TokenCache stores the tokens of the credentials across processes, so that a short-lived process reuses the
+// token of the previous one. The credentials ignore the errors of their cache: a token is requested instead.
+type TokenCache interface {
+	Load(key CacheKey) (token CachedToken, ok bool, err error)
+	Store(key CacheKey, token CachedToken) error
+}
+
+// The 'FileTokenCache' struct is a 'TokenCache' storing the tokens in a file encrypted with AES-256-GCM.
+// The file is locked while it is read or written, so it can be shared by concurrent processes.
+// It contains the following fields:
+//   - Path: the path of the file, created with its directory if needed. The lock file is Path + ".lock".
+//   - Key: the encryption key, e.g. 32 random bytes kept in the keychain of the system. The AES key is its SHA-256 hash.
+//
+// Example:
+//
+//	cache := &FileTokenCache{Path: filepath.Join(home, ".dataversego", "tokens"), Key: key}
+//	client := &Client{TokenProvider: &DeviceCodeCredential{
+//	  TenantId: "organizations",
+//	  ClientId: "clientid",
+//	  Resource: "https://org.crm.dynamics.com",
+//	  Cache:    cache,
+//	}}
+type FileTokenCache struct {
+	Path string
+	Key  []byte
+}
+
+// Load returns the token of a key, ok being false if there is none.
+func (c *FileTokenCache) Load(key CacheKey) (token CachedToken, ok bool, err error) {
+	err = c.withLock(func() error {
+		tokens, errRead := c.read()
+		token, ok = tokens[key.String()]
+		return errRead
+	})
+	return
+}
+
+// Store saves the token of a key, replacing the previous one.
+func (c *FileTokenCache) Store(key CacheKey, token CachedToken) error {
+	return c.withLock(func() error {
+		tokens, err := c.read()
+		if err != nil {
+			return err
+		}
+		// The expired tokens without refresh token are useless.
+		for k, t := range tokens {
+			if len(t.RefreshToken) == 0 && time.Now().After(t.ExpiresOn) {
+				delete(tokens, k)
+			}
+		}
+		tokens[key.String()] = token
+		return c.write(tokens)
+	})
+}
+
+// INTERNAL METHODS
+
+// withLock calls f holding the lock of the file.
+func (c *FileTokenCache) withLock(f func() error) error {
+	if len(c.Path) == 0 || len(c.Key) == 0 {
+		return errors.New("Empty cache path or key")
+	}
+	if err := os.MkdirAll(filepath.Dir(c.Path), 0o700); err != nil {
+		return err
+	}
+	lock, err := os.OpenFile(c.Path+".lock", os.O_CREATE|os.O_RDWR, 0o600)
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+	if err = lockFile(lock); err != nil {
+		return err
+	}
+	defer unlockFile(lock)
+
+	return f()
+}
+
+// read decrypts the tokens of the file, none if it does not exist.
+func (c *FileTokenCache) read() (tokens map[string]CachedToken, err error) {
+	tokens = map[string]CachedToken{}
+	data, err := os.ReadFile(c.Path)
+	if errors.Is(err, os.ErrNotExist) {
+		return tokens, nil
+	}
+	if err != nil {
+		return
+	}
+
+	gcm, err := c.cipher()
+	if err != nil {
+		return
+	}
+	if len(data) < gcm.NonceSize() {
+		return tokens, errors.New("Invalid token cache")
+	}
+	plain, err := gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], nil)
+	if err != nil {
+		return tokens, errors.New("Cannot decrypt the token cache, wrong key or corrupted file")
+	}
+	err = json.Unmarshal(plain, &tokens)
+	return
+}
+
+// write encrypts the tokens to a temporary file renamed to the file, so a crash never leaves a partial file.
+func (c *FileTokenCache) write(tokens map[string]CachedToken) (err error) {
+	plain, err := json.Marshal(tokens)
+	if err != nil {
+		return
+	}
+	gcm, err := c.cipher()
+	if err != nil {
+		return
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
+		return
+	}
+
+	temp, err := os.CreateTemp(filepath.Dir(c.Path), filepath.Base(c.Path)+".*.tmp")
+	if err != nil {
+		return
+	}
+	defer os.Remove(temp.Name())
+	if _, err = temp.Write(gcm.Seal(nonce, nonce, plain, nil)); err != nil {
+		temp.Close()
+		return
+	}
+	if err = temp.Close(); err != nil {
+		return
+	}
+	return os.Rename(temp.Name(), c.Path)
+}
+
+func (c *FileTokenCache) cipher() (cipher.AEAD, error) {
+	key := sha256.Sum256(c.Key)
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
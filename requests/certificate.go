@@ -0,0 +1,190 @@
+package requests
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+// ClientAssertionType is the type of the JWT client assertions sent to the token endpoint.
+const ClientAssertionType = "urn:ietf:params:oauth:client-assertion-type:jwt-bearer"
+
+// assertionLifetime is the validity of a client assertion.
+const assertionLifetime = 10 * time.Minute
+
+// The 'Certificate' struct is the credential of an app registration authenticating with a certificate.
+// It contains the following fields:
+//   - Key: the RSA private key signing the client assertions
+//   - Certificate: the X.509 certificate uploaded to the app registration, matching the key
+//   - Chain: the intermediate certificates, if any
+//
+// Example:
+//
+//	cert, err := requests.LoadCertificate("app.pfx", "password")
+//	if err != nil {
+//	  log.Fatal(err)
+//	}
+//	auth, err := requests.GetAuthorizationWithCertificate("clientid", cert, "tenantid", "https://org.crm.dynamics.com")
+type Certificate struct {
+	Key         *rsa.PrivateKey
+	Certificate *x509.Certificate
+	Chain       []*x509.Certificate
+}
+
+// LoadCertificate reads a certificate and its private key from a file, either a PKCS#12 archive (.pfx, .p12)
+// or a PEM file containing the private key (PKCS#1 or PKCS#8, unencrypted) and the certificates.
+// The password is only used for PKCS#12 archives.
+func LoadCertificate(path string, password string) (cert Certificate, err error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return
+	}
+	if bytes.Contains(data, []byte("-----BEGIN")) {
+		return ParseCertificatePEM(data)
+	}
+	return ParseCertificatePKCS12(data, password)
+}
+
+// ParseCertificatePEM parses a PEM encoded private key (PKCS#1 or PKCS#8, unencrypted) and its certificate.
+// The certificate matching the key is the 'Certificate', the other ones are the 'Chain'.
+func ParseCertificatePEM(data []byte) (cert Certificate, err error) {
+	var certificates []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		switch {
+		case block.Type == "CERTIFICATE":
+			c, errParse := x509.ParseCertificate(block.Bytes)
+			if errParse != nil {
+				return cert, errParse
+			}
+			certificates = append(certificates, c)
+		case strings.HasSuffix(block.Type, "PRIVATE KEY"):
+			if cert.Key, err = parsePrivateKey(block.Bytes); err != nil {
+				return
+			}
+		}
+	}
+
+	if cert.Key == nil {
+		return cert, errors.New("No RSA private key found")
+	}
+	for _, c := range certificates {
+		if publicKey, ok := c.PublicKey.(*rsa.PublicKey); ok && cert.Certificate == nil && publicKey.Equal(&cert.Key.PublicKey) {
+			cert.Certificate = c
+			continue
+		}
+		cert.Chain = append(cert.Chain, c)
+	}
+	if cert.Certificate == nil {
+		return cert, errors.New("No certificate matching the private key found")
+	}
+	return
+}
+
+// ParseCertificatePKCS12 parses a PKCS#12 archive (.pfx, .p12) containing a RSA private key, its certificate and
+// optionally its chain. Both the legacy encryption (3DES, RC2) and the PBES2 encryption with AES used by default by
+// OpenSSL 3 and the recent Windows exports are supported.
+func ParseCertificatePKCS12(data []byte, password string) (cert Certificate, err error) {
+	privateKey, certificate, chain, err := pkcs12.DecodeChain(data, password)
+	if err != nil {
+		return
+	}
+	key, ok := privateKey.(*rsa.PrivateKey)
+	if !ok {
+		return cert, errors.New("Only RSA private keys are supported")
+	}
+	cert = Certificate{Key: key, Certificate: certificate, Chain: chain}
+	return
+}
+
+func parsePrivateKey(der []byte) (key *rsa.PrivateKey, err error) {
+	if key, err = x509.ParsePKCS1PrivateKey(der); err == nil {
+		return
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, errors.New("Invalid private key, only unencrypted PKCS#1 and PKCS#8 keys are supported")
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("Only RSA private keys are supported")
+	}
+	return
+}
+
+// Thumbprint returns the base64url encoded SHA-1 thumbprint of the certificate (the 'x5t' header).
+func (c Certificate) Thumbprint() string {
+	sum := sha1.Sum(c.Certificate.Raw)
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// ThumbprintSHA256 returns the base64url encoded SHA-256 thumbprint of the certificate (the 'x5t#S256' header).
+func (c Certificate) ThumbprintSHA256() string {
+	sum := sha256.Sum256(c.Certificate.Raw)
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// ClientAssertion returns a JWT client assertion for a client ID, signed (RS256) with the key of the certificate.
+// The audience is the token endpoint the assertion is sent to. The assertion is valid for 10 minutes.
+//
+// Example:
+//
+//	assertion, err := cert.ClientAssertion("clientid", "https://login.microsoftonline.com/tenantid/oauth2/v2.0/token")
+func (c Certificate) ClientAssertion(client string, audience string) (assertion string, err error) {
+	if c.Key == nil || c.Certificate == nil {
+		return "", errors.New("Empty certificate")
+	}
+
+	now := time.Now()
+	header := map[string]any{
+		"alg":      "RS256",
+		"typ":      "JWT",
+		"x5t":      c.Thumbprint(),
+		"x5t#S256": c.ThumbprintSHA256(),
+	}
+	claims := map[string]any{
+		"aud": audience,
+		"iss": client,
+		"sub": client,
+		"jti": newUUID(),
+		"iat": now.Unix(),
+		"nbf": now.Unix(),
+		"exp": now.Add(assertionLifetime).Unix(),
+	}
+
+	headerJson, err := json.Marshal(header)
+	if err != nil {
+		return
+	}
+	claimsJson, err := json.Marshal(claims)
+	if err != nil {
+		return
+	}
+	signed := base64.RawURLEncoding.EncodeToString(headerJson) + "." + base64.RawURLEncoding.EncodeToString(claimsJson)
+
+	digest := sha256.Sum256([]byte(signed))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, c.Key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", fmt.Errorf("Error signing the client assertion: %v", err)
+	}
+	assertion = signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+	return
+}
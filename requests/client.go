@@ -0,0 +1,433 @@
+package requests
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// DefaultTimeout is the timeout of the requests sent by a 'Client' without an HTTPClient.
+const DefaultTimeout = 2 * time.Minute
+
+// DefaultApiVersion is the version of the Web API used by a 'Client' without an ApiVersion.
+const DefaultApiVersion = "9.1"
+
+// Middleware wraps a RoundTripper to add behaviour (headers, retries, logging...) around every request.
+type Middleware func(next http.RoundTripper) http.RoundTripper
+
+// RoundTripperFunc adapts a function to the http.RoundTripper interface.
+type RoundTripperFunc func(req *http.Request) (*http.Response, error)
+
+// RoundTrip calls f(req).
+func (f RoundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+// The 'Client' struct holds the HTTP configuration used to send the requests.
+// It contains the following fields:
+//   - HTTPClient: the base HTTP client (timeout, cookies...), a client with DefaultTimeout if nil
+//   - Transport: the RoundTripper sending the requests, overriding the transport of HTTPClient if set
+//   - Middlewares: an ordered chain of middlewares, the first one being the outermost
+//   - Logger: the logger of the requests, nothing is logged if nil. Every attempt is logged at debug level
+//     (method, url, status, duration, service request ID), retries at warning level and failures at error level.
+//     Bearer tokens and secrets are never logged.
+//   - TracerProvider: the provider of the tracer recording a span for every operation (table, operation, status code,
+//     batch size, retry count), no-op if nil
+//   - MeterProvider: the provider of the meter recording the duration of the operations and the throttled responses,
+//     no-op if nil
+//   - AuthorityHost: the authority host of the token requests (e.g. AuthorityUSGovernment), inferred from the
+//     organization URL if empty
+//   - TokenProvider: the provider of the bearer token of the requests sent without a token, e.g. a
+//     'ClientSecretCredential' or a 'ManagedIdentityCredential'
+//   - ApiVersion: the version of the Web API (e.g. "9.2", needed by the bulk operations and the elastic tables),
+//     DefaultApiVersion if empty
+//   - Options: the default 'RequestOptions' of the requests (impersonation, MSCRM headers)
+//
+// The zero value is ready to use and the same client can be shared between goroutines. A client must not be
+// copied after first use, its tracer and metrics being created once.
+//
+// Example:
+//
+//	client := &Client{
+//	  HTTPClient: &http.Client{Timeout: 30 * time.Second},
+//	  Middlewares: []Middleware{
+//	    UserAgentMiddleware("myapp/1.0"),
+//	    RetryMiddleware(3),
+//	  },
+//	  ApiVersion: "9.2",
+//	}
+type Client struct {
+	HTTPClient     *http.Client
+	Transport      http.RoundTripper
+	Middlewares    []Middleware
+	Logger         *slog.Logger
+	TracerProvider trace.TracerProvider
+	MeterProvider  metric.MeterProvider
+	AuthorityHost  string
+	TokenProvider  TokenProvider
+	ApiVersion     string
+	Options        RequestOptions
+
+	// telemetryOnce creates the instruments of the client on first use.
+	telemetryOnce sync.Once
+	instruments   *instruments
+}
+
+// DefaultClient is the 'Client' used by the package-level functions.
+var DefaultClient = &Client{}
+
+// ApiPath returns the root path of the Web API, e.g. "/api/data/v9.1".
+func (c *Client) ApiPath() string {
+	if c == nil {
+		c = DefaultClient
+	}
+	version := strings.TrimPrefix(c.ApiVersion, "v")
+	if len(version) == 0 {
+		version = DefaultApiVersion
+	}
+	return "/api/data/v" + version
+}
+
+// httpClient returns the HTTP client to use for a request, with the middleware chain applied to the transport.
+func (c *Client) httpClient() *http.Client {
+	if c == nil {
+		c = DefaultClient
+	}
+
+	client := &http.Client{Timeout: DefaultTimeout}
+	if c.HTTPClient != nil {
+		copied := *c.HTTPClient
+		client = &copied
+	}
+
+	transport := c.Transport
+	if transport == nil {
+		transport = client.Transport
+	}
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	// Every attempt is logged and counted after the user middlewares (e.g. the retry middleware), on the span of
+	// the operation started by Do. The logger is made available to them through the request context.
+	logger := c.logger()
+	transport = attemptsMiddleware(LoggingMiddleware(logger)(transport))
+	if c.TokenProvider != nil {
+		transport = tokenMiddleware(c.TokenProvider)(transport)
+	}
+	for i := len(c.Middlewares) - 1; i >= 0; i-- {
+		transport = c.Middlewares[i](transport)
+	}
+	client.Transport = loggerMiddleware(logger)(transport)
+
+	return client
+}
+
+// discardLogger is used when no logger is configured.
+var discardLogger = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+// logger returns the logger of the client, nothing is logged if it has no logger.
+func (c *Client) logger() *slog.Logger {
+	if c != nil && c.Logger != nil {
+		return c.Logger
+	}
+	return discardLogger
+}
+
+// logError logs an error of a request.
+func (c *Client) logError(msg string, args ...any) {
+	c.logger().Error(msg, args...)
+}
+
+// loggerKey is the context key of the logger of a request.
+type loggerKey struct{}
+
+// loggerMiddleware makes the logger available to the middlewares through the request context.
+func loggerMiddleware(logger *slog.Logger) Middleware {
+	return func(next http.RoundTripper) http.RoundTripper {
+		return RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			return next.RoundTrip(req.WithContext(context.WithValue(req.Context(), loggerKey{}, logger)))
+		})
+	}
+}
+
+// loggerFromContext returns the logger of a request, discarding everything if none.
+func loggerFromContext(ctx context.Context) *slog.Logger {
+	if logger, ok := ctx.Value(loggerKey{}).(*slog.Logger); ok {
+		return logger
+	}
+	return discardLogger
+}
+
+// sensitiveQueryParameters are the query parameters whose value is redacted in the logs.
+var sensitiveQueryParameters = []string{"access_token", "client_secret", "code", "sig", "token", "$deltatoken", "sessiontoken"}
+
+// redactURL returns the url with the password and the sensitive query parameters redacted, to be logged.
+func redactURL(rawURL string) string {
+	parsed, err := url.Parse(rawURL)
+	if err != nil {
+		return "invalid url"
+	}
+	query := parsed.Query()
+	redacted := false
+	for _, key := range sensitiveQueryParameters {
+		if query.Has(key) {
+			query.Set(key, "REDACTED")
+			redacted = true
+		}
+	}
+	if redacted {
+		parsed.RawQuery = query.Encode()
+	}
+	return parsed.Redacted()
+}
+
+// authRequestKey marks the requests sent to the token endpoint, which must not carry a bearer token.
+type authRequestKey struct{}
+
+// setAuthorization sets the bearer token of a request, if any.
+func setAuthorization(req *http.Request, auth string) {
+	if len(auth) > 0 {
+		req.Header.Set("Authorization", fmt.Sprintf("Bearer %v", auth))
+	}
+}
+
+// AuthMiddleware sets the bearer token returned by getToken on the requests without an Authorization header.
+// Requests to the token endpoint are left untouched.
+//
+// Example:
+//
+//	client := &Client{Middlewares: []Middleware{AuthMiddleware(func() (string, error) { return token, nil })}}
+func AuthMiddleware(getToken func() (string, error)) Middleware {
+	return func(next http.RoundTripper) http.RoundTripper {
+		return RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			if len(req.Header.Get("Authorization")) > 0 || req.Context().Value(authRequestKey{}) != nil {
+				return next.RoundTrip(req)
+			}
+			token, err := getToken()
+			if err != nil {
+				return nil, err
+			}
+			req = req.Clone(req.Context())
+			setAuthorization(req, token)
+			return next.RoundTrip(req)
+		})
+	}
+}
+
+// RetryMiddleware retries the requests throttled by the service (429) or temporarily unavailable (502, 503, 504),
+// up to maxRetries times. It waits for the Retry-After header if present, with an exponential backoff otherwise.
+// A throttled request is rejected before it runs, so it is retried whatever its method. An unavailable one may have
+// run, so only the idempotent requests (GET, DELETE, PUT, or PATCH with If-Match) are retried, not the creates,
+// the actions or the batches. Requests whose body can't be replayed are not retried.
+func RetryMiddleware(maxRetries int) Middleware {
+	return func(next http.RoundTripper) http.RoundTripper {
+		return RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			for attempt := 0; ; attempt++ {
+				resp, err := next.RoundTrip(req)
+				if err != nil || attempt >= maxRetries || !isRetryable(req, resp.StatusCode) {
+					return resp, err
+				}
+				if req.Body != nil && req.GetBody == nil {
+					return resp, err
+				}
+
+				wait := retryAfter(resp, attempt)
+				resp.Body.Close()
+				loggerFromContext(req.Context()).Warn("retrying request",
+					"method", req.Method,
+					"url", redactURL(req.URL.String()),
+					"status", resp.StatusCode,
+					"attempt", attempt+1,
+					"wait", wait)
+
+				select {
+				case <-req.Context().Done():
+					return nil, req.Context().Err()
+				case <-time.After(wait):
+				}
+
+				if req.GetBody != nil {
+					body, errBody := req.GetBody()
+					if errBody != nil {
+						return nil, errBody
+					}
+					req = req.Clone(req.Context())
+					req.Body = body
+				}
+			}
+		})
+	}
+}
+
+// isRetryable reports whether a request with the given response status code can be sent again.
+func isRetryable(req *http.Request, statusCode int) bool {
+	switch statusCode {
+	case http.StatusTooManyRequests:
+		return true
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return isIdempotent(req)
+	}
+	return false
+}
+
+// isIdempotent reports whether sending a request twice has the same effect as sending it once.
+func isIdempotent(req *http.Request) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodDelete, http.MethodPut:
+		return true
+	case http.MethodPatch:
+		return len(req.Header.Get("If-Match")) > 0
+	}
+	return false
+}
+
+// retryAfter returns the time to wait before retrying, from the Retry-After header or an exponential backoff.
+func retryAfter(resp *http.Response, attempt int) time.Duration {
+	if secs, err := strconv.ParseInt(resp.Header.Get("Retry-After"), 10, 64); err == nil {
+		return time.Duration(secs) * time.Second
+	}
+	return time.Duration(math.Pow(2, float64(attempt))) * time.Second
+}
+
+// LoggingMiddleware logs the method, url, status code, duration and service request ID of every request
+// at debug level, and the transport errors at error level. Bearer tokens and secrets are never logged.
+//
+// A 'Client' with a Logger already logs every attempt, this middleware is meant for custom chains.
+func LoggingMiddleware(logger *slog.Logger) Middleware {
+	return func(next http.RoundTripper) http.RoundTripper {
+		return RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			start := time.Now()
+			resp, err := next.RoundTrip(req)
+			if err != nil {
+				logger.Error("request failed",
+					"method", req.Method,
+					"url", redactURL(req.URL.String()),
+					"duration", time.Since(start),
+					"error", err)
+				return resp, err
+			}
+			logger.Debug("request completed",
+				"method", req.Method,
+				"url", redactURL(req.URL.String()),
+				"status", resp.StatusCode,
+				"duration", time.Since(start),
+				"service_request_id", resp.Header.Get("x-ms-service-request-id"))
+			return resp, err
+		})
+	}
+}
+
+// UserAgentMiddleware sets the User-Agent header of every request.
+func UserAgentMiddleware(userAgent string) Middleware {
+	return headerMiddleware("User-Agent", func() string { return userAgent })
+}
+
+// CorrelationIdMiddleware sets the x-ms-client-request-id header of the requests without one, so they can be
+// correlated with the service logs. The IDs are generated by newId, random UUIDs if nil.
+func CorrelationIdMiddleware(newId func() string) Middleware {
+	if newId == nil {
+		newId = newUUID
+	}
+	return headerMiddleware("x-ms-client-request-id", newId)
+}
+
+// headerMiddleware sets a header on the requests where it is not already set.
+func headerMiddleware(key string, value func() string) Middleware {
+	return func(next http.RoundTripper) http.RoundTripper {
+		return RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			if len(req.Header.Get(key)) == 0 {
+				req = req.Clone(req.Context())
+				req.Header.Set(key, value())
+			}
+			return next.RoundTrip(req)
+		})
+	}
+}
+
+// newUUID returns a random (version 4) UUID.
+func newUUID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// PACKAGE-LEVEL FUNCTIONS
+
+// GetAuthorization calls GetAuthorization on the DefaultClient.
+func GetAuthorization(client string, secret string, tenant string, target string) (token TokenResponse, err error) {
+	return DefaultClient.GetAuthorization(client, secret, tenant, target)
+}
+
+// GetAuthorizationWithCertificate calls GetAuthorizationWithCertificate on the DefaultClient.
+func GetAuthorizationWithCertificate(client string, cert Certificate, tenant string, target string) (token TokenResponse, err error) {
+	return DefaultClient.GetAuthorizationWithCertificate(client, cert, tenant, target)
+}
+
+// Do calls Do on the DefaultClient.
+func Do(ctx context.Context, request Request) (response *Response, err error) {
+	return DefaultClient.Do(ctx, request)
+}
+
+// SendBatch calls SendBatch on the DefaultClient.
+func SendBatch(ctx context.Context, orgUrl string, auth string, content string, boundary string, options RequestOptions) (response *Response, err error) {
+	return DefaultClient.SendBatch(ctx, orgUrl, auth, content, boundary, options)
+}
+
+// GetRequest calls GetRequest on the DefaultClient.
+func GetRequest(url string, auth string, printerror bool, ch chan<- map[string]any, chErr chan<- error) {
+	DefaultClient.GetRequest(url, auth, printerror, ch, chErr)
+}
+
+// GetRequestWithHeaders calls GetRequestWithHeaders on the DefaultClient.
+func GetRequestWithHeaders(url string, auth string, headers map[string]string, ch chan<- map[string]any, chErr chan<- error) {
+	DefaultClient.GetRequestWithHeaders(url, auth, headers, ch, chErr)
+}
+
+// PostRequest calls PostRequest on the DefaultClient.
+func PostRequest(url string, auth string, row map[string]any, printerror bool, ch chan<- map[string]any, chErr chan<- error) {
+	DefaultClient.PostRequest(url, auth, row, printerror, ch, chErr)
+}
+
+// PostActionRequest calls PostActionRequest on the DefaultClient.
+func PostActionRequest(url string, auth string, payload any, ch chan<- map[string]any, chErr chan<- error) {
+	DefaultClient.PostActionRequest(url, auth, payload, ch, chErr)
+}
+
+// PatchRequest calls PatchRequest on the DefaultClient.
+func PatchRequest(url string, auth string, row map[string]any, printerror bool, ch chan<- map[string]any, chErr chan<- error) {
+	DefaultClient.PatchRequest(url, auth, row, printerror, ch, chErr)
+}
+
+// DeleteRequest calls DeleteRequest on the DefaultClient.
+func DeleteRequest(url string, auth string, printerror bool, chErr chan<- error) {
+	DefaultClient.DeleteRequest(url, auth, printerror, chErr)
+}
+
+// PatchFileRequest calls PatchFileRequest on the DefaultClient.
+func PatchFileRequest(url string, auth string, fileName string, content io.Reader, chErr chan<- error) {
+	DefaultClient.PatchFileRequest(url, auth, fileName, content, chErr)
+}
+
+// GetFileRequest calls GetFileRequest on the DefaultClient.
+func GetFileRequest(url string, auth string, content io.Writer, chErr chan<- error) {
+	DefaultClient.GetFileRequest(url, auth, content, chErr)
+}
+
+// PostBatch calls PostBatch on the DefaultClient.
+func PostBatch(url string, auth string, content string, boundary string, printerror bool, chErr chan<- error) {
+	DefaultClient.PostBatch(url, auth, content, boundary, printerror, chErr)
+}
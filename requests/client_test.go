@@ -0,0 +1,965 @@
+package requests
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/emaporta/dataversego/dataversetest"
+	"go.opentelemetry.io/otel/attribute"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+func TestMiddlewareChain(t *testing.T) {
+	var order []string
+	trace := func(name string) Middleware {
+		return func(next http.RoundTripper) http.RoundTripper {
+			return RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+				order = append(order, name)
+				return next.RoundTrip(req)
+			})
+		}
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("User-Agent") != "dataversego-test" {
+			t.Errorf("Wrong user agent: %v", r.Header.Get("User-Agent"))
+		}
+		if len(r.Header.Get("x-ms-client-request-id")) != 36 {
+			t.Errorf("Wrong correlation id: %v", r.Header.Get("x-ms-client-request-id"))
+		}
+		if r.Header.Get("Authorization") != "Bearer token" {
+			t.Errorf("Wrong authorization: %v", r.Header.Get("Authorization"))
+		}
+		w.Write([]byte(`{"value": []}`))
+	}))
+	defer server.Close()
+
+	client := &Client{
+		Middlewares: []Middleware{
+			trace("first"),
+			UserAgentMiddleware("dataversego-test"),
+			CorrelationIdMiddleware(nil),
+			AuthMiddleware(func() (string, error) { return "token", nil }),
+			trace("last"),
+		},
+	}
+
+	ch := make(chan map[string]any)
+	chErr := make(chan error)
+	go client.GetRequest(server.URL, "", false, ch, chErr)
+	ent, err := <-ch, <-chErr
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if _, ok := ent["value"]; !ok {
+		t.Fatalf("Wrong response: %v", ent)
+	}
+	if strings.Join(order, ",") != "first,last" {
+		t.Fatalf("Wrong middleware order: %v", order)
+	}
+}
+
+func TestRetryMiddleware(t *testing.T) {
+	attempts := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		body := make([]byte, 64)
+		n, _ := r.Body.Read(body)
+		if string(body[:n]) != `{"name":"test"}` {
+			t.Errorf("Body not replayed: %q", body[:n])
+		}
+		if attempts < 3 {
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		w.Header().Set("OData-EntityId", "https://org/api/data/v9.1/accounts(00000000-0000-0000-0000-000000000001)")
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	client := &Client{Middlewares: []Middleware{RetryMiddleware(3)}}
+
+	ch := make(chan map[string]any)
+	chErr := make(chan error)
+	go client.PostRequest(server.URL, "token", map[string]any{"name": "test"}, false, ch, chErr)
+	ent, err := <-ch, <-chErr
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if attempts != 3 || ent["id"] != "00000000-0000-0000-0000-000000000001" {
+		t.Fatalf("Wrong retry: %v attempts, %v", attempts, ent)
+	}
+}
+
+func TestRetryMiddlewareIdempotency(t *testing.T) {
+	var methods []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		methods = append(methods, r.Method)
+		w.Header().Set("Retry-After", "0")
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	client := &Client{Middlewares: []Middleware{RetryMiddleware(2)}}
+	ctx := context.Background()
+
+	// A create may have run before the gateway failed, so it is not sent again.
+	_, err := client.Do(ctx, Request{Method: "POST", Url: server.URL, Path: "/api/data/v9.1/accounts", Body: map[string]any{"name": "test"}})
+	if err == nil || len(methods) != 1 {
+		t.Fatalf("POST resent: %v %v", methods, err)
+	}
+
+	methods = nil
+	_, err = client.Do(ctx, Request{Method: "GET", Url: server.URL, Path: "/api/data/v9.1/accounts"})
+	if err == nil || len(methods) != 3 {
+		t.Fatalf("GET not retried: %v %v", methods, err)
+	}
+
+	methods = nil
+	_, err = client.Do(ctx, Request{Method: "PATCH", Url: server.URL, Path: "/api/data/v9.1/accounts(1)", Headers: map[string]string{"If-Match": "*"}, Body: map[string]any{"name": "test"}})
+	if err == nil || len(methods) != 3 {
+		t.Fatalf("PATCH with If-Match not retried: %v %v", methods, err)
+	}
+}
+
+func TestTransport(t *testing.T) {
+	called := false
+	client := &Client{
+		Transport: RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			called = true
+			return &http.Response{
+				StatusCode: http.StatusNoContent,
+				Header:     http.Header{},
+				Body:       http.NoBody,
+				Request:    req,
+			}, nil
+		}),
+	}
+
+	chErr := make(chan error)
+	go client.DeleteRequest("https://org/api/data/v9.1/accounts(1)", "token", false, chErr)
+	if err := <-chErr; err != nil {
+		t.Fatalf("%v", err)
+	}
+	if !called {
+		t.Fatalf("Transport not used")
+	}
+}
+
+func TestLogger(t *testing.T) {
+	attempts := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		w.Header().Set("x-ms-service-request-id", "service-id")
+		if attempts == 1 {
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"error": {"message": "not found"}}`))
+	}))
+	defer server.Close()
+
+	var logs bytes.Buffer
+	client := &Client{
+		Logger:      slog.New(slog.NewJSONHandler(&logs, &slog.HandlerOptions{Level: slog.LevelDebug})),
+		Middlewares: []Middleware{RetryMiddleware(1)},
+	}
+
+	ch := make(chan map[string]any)
+	chErr := make(chan error)
+	go client.GetRequest(server.URL+"/contacts?$deltatoken=secret", "supersecrettoken", false, ch, chErr)
+	if _, err := <-ch, <-chErr; err == nil {
+		t.Fatalf("Expected error")
+	}
+
+	output := logs.String()
+	for _, expected := range []string{`"msg":"request completed"`, `"status":429`, `"msg":"retrying request"`, `"attempt":1`, `"msg":"request failed"`, `"status":404`, `"service_request_id":"service-id"`, `REDACTED`} {
+		if !strings.Contains(output, expected) {
+			t.Fatalf("Log doesn't contain %v:\n%v", expected, output)
+		}
+	}
+	for _, secret := range []string{"supersecrettoken", "=secret"} {
+		if strings.Contains(output, secret) {
+			t.Fatalf("Log contains a secret:\n%v", output)
+		}
+	}
+}
+
+func TestReadOperation(t *testing.T) {
+	cases := []struct {
+		method    string
+		url       string
+		operation string
+		table     string
+	}{
+		{"GET", "https://org/api/data/v9.1/accounts(123)", "Retrieve", "accounts"},
+		{"GET", "https://org/api/data/v9.1/accounts?$select=name", "RetrieveMultiple", "accounts"},
+		{"GET", "https://org/api/data/v9.1/WhoAmI()", "ExecuteFunction", ""},
+		{"GET", "https://org/api/data/v9.1/accounts(123)/Microsoft.Dynamics.CRM.CalculateRollupField()", "ExecuteFunction", "accounts"},
+		{"POST", "https://org/api/data/v9.1/accounts", "Create", "accounts"},
+		{"PATCH", "https://org/api/data/v9.1/accounts(123)", "Update", "accounts"},
+		{"DELETE", "https://org/api/data/v9.1/accounts(123)", "Delete", "accounts"},
+		{"POST", "https://org/api/data/v9.1/accounts(123)/contact_customer_accounts/$ref", "Associate", "accounts"},
+		{"DELETE", "https://org/api/data/v9.1/accounts(123)/contact_customer_accounts/$ref?$id=x", "Disassociate", "accounts"},
+		{"POST", "https://org/api/data/v9.1/$batch", "Batch", ""},
+	}
+	for _, c := range cases {
+		op := readOperation("", c.method, c.url)
+		if op.name != c.operation || op.table != c.table {
+			t.Errorf("%v %v: got %v %v, expected %v %v", c.method, c.url, op.name, op.table, c.operation, c.table)
+		}
+	}
+}
+
+func TestTelemetry(t *testing.T) {
+	attempts := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		if attempts == 1 {
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	exporter := tracetest.NewInMemoryExporter()
+	reader := sdkmetric.NewManualReader()
+	client := &Client{
+		Middlewares:    []Middleware{RetryMiddleware(1)},
+		TracerProvider: sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter)),
+		MeterProvider:  sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader)),
+	}
+
+	chErr := make(chan error)
+	go client.PostBatch(server.URL, "token", "--batch\nContent-ID: 1\n\n--batch\nContent-ID: 2\n\n--batch--", "batch", false, chErr)
+	if err := <-chErr; err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	spans := exporter.GetSpans()
+	if len(spans) != 1 || spans[0].Name != "dataverse Batch" {
+		t.Fatalf("Wrong spans: %v", spans)
+	}
+	attrs := attribute.NewSet(spans[0].Attributes...)
+	for key, expected := range map[attribute.Key]int64{BatchSizeAttribute: 2, RetryCountAttribute: 1, StatusAttribute: http.StatusNoContent} {
+		if value, ok := attrs.Value(key); !ok || value.AsInt64() != expected {
+			t.Errorf("Wrong attribute %v: %v", key, value.Emit())
+		}
+	}
+	if value, _ := attrs.Value(OperationAttribute); value.AsString() != "Batch" {
+		t.Errorf("Wrong operation: %v", value.Emit())
+	}
+	if len(spans[0].Events) != 1 || spans[0].Events[0].Name != "throttled" {
+		t.Errorf("Wrong events: %v", spans[0].Events)
+	}
+
+	var metrics metricdata.ResourceMetrics
+	if err := reader.Collect(context.Background(), &metrics); err != nil {
+		t.Fatalf("%v", err)
+	}
+	found := map[string]bool{}
+	for _, scope := range metrics.ScopeMetrics {
+		for _, m := range scope.Metrics {
+			switch data := m.Data.(type) {
+			case metricdata.Histogram[float64]:
+				found[m.Name] = len(data.DataPoints) == 1 && data.DataPoints[0].Count == 1
+			case metricdata.Sum[int64]:
+				found[m.Name] = len(data.DataPoints) == 1 && data.DataPoints[0].Value == 1
+			}
+		}
+	}
+	if !found[DurationMetric] || !found[ThrottledMetric] {
+		t.Fatalf("Wrong metrics: %v", found)
+	}
+}
+
+func TestTelemetryOperation(t *testing.T) {
+	attempts := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		if r.URL.Path == "/api/data/v9.1/$batch" && attempts == 1 {
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		w.Write([]byte(`{"value":[]}`))
+	}))
+	defer server.Close()
+
+	exporter := tracetest.NewInMemoryExporter()
+	reader := sdkmetric.NewManualReader()
+	client := &Client{
+		TracerProvider: sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter)),
+		MeterProvider:  sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader)),
+	}
+
+	// A throttled batch sent again is a single operation.
+	if _, err := client.SendBatch(context.Background(), server.URL, "token", "--batch\nContent-ID: 1\n\n--batch--", "batch", RequestOptions{}); err != nil {
+		t.Fatalf("%v", err)
+	}
+	// The requests sent with the context of an operation are part of it.
+	ctx := client.StartOperation(context.Background(), "CreateUpdate", "accounts")
+	for _, path := range []string{"/api/data/v9.1/EntityDefinitions", "/api/data/v9.1/accounts"} {
+		if _, err := client.Do(ctx, Request{Method: "GET", Url: server.URL, Path: path}); err != nil {
+			t.Fatalf("%v", err)
+		}
+	}
+	EndOperation(ctx, nil)
+
+	spans := exporter.GetSpans()
+	if len(spans) != 2 || spans[0].Name != "dataverse Batch" || spans[1].Name != "dataverse CreateUpdate" {
+		t.Fatalf("Wrong spans: %v", spans)
+	}
+	attrs := attribute.NewSet(spans[0].Attributes...)
+	if value, _ := attrs.Value(RetryCountAttribute); value.AsInt64() != 1 {
+		t.Errorf("Wrong retry count: %v", value.Emit())
+	}
+	attrs = attribute.NewSet(spans[1].Attributes...)
+	if value, _ := attrs.Value(RetryCountAttribute); value.AsInt64() != 0 {
+		t.Errorf("Wrong retry count: %v", value.Emit())
+	}
+	if value, _ := attrs.Value(TableAttribute); value.AsString() != "accounts" {
+		t.Errorf("Wrong table: %v", value.Emit())
+	}
+
+	var metrics metricdata.ResourceMetrics
+	if err := reader.Collect(context.Background(), &metrics); err != nil {
+		t.Fatalf("%v", err)
+	}
+	samples := uint64(0)
+	for _, scope := range metrics.ScopeMetrics {
+		for _, m := range scope.Metrics {
+			if data, ok := m.Data.(metricdata.Histogram[float64]); ok && m.Name == DurationMetric {
+				for _, point := range data.DataPoints {
+					samples += point.Count
+				}
+			}
+		}
+	}
+	if samples != 2 {
+		t.Fatalf("Wrong duration samples: %v", samples)
+	}
+}
+
+func TestClientAssertion(t *testing.T) {
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "dataversego"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, _ := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	pemData := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyDer, _ := x509.MarshalPKCS8PrivateKey(key)
+	pemData = append(pemData, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDer})...)
+
+	cert, err := ParseCertificatePEM(pemData)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	var form url.Values
+	client := &Client{
+		Transport: RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			body, _ := io.ReadAll(req.Body)
+			form, _ = url.ParseQuery(string(body))
+			return &http.Response{
+				StatusCode: http.StatusOK,
+				Header:     http.Header{},
+				Body:       io.NopCloser(strings.NewReader(`{"access_token": "AAAA", "token_type": "Bearer", "expires_in": 3599}`)),
+				Request:    req,
+			}, nil
+		}),
+	}
+	token, err := client.GetAuthorizationWithCertificate("clientid", cert, "tenantid", "https://org.crm.dynamics.com")
+	if err != nil || token.AccessToken != "AAAA" {
+		t.Fatalf("Wrong authorization: %v %v", token, err)
+	}
+	if form.Get("client_assertion_type") != ClientAssertionType || form.Has("client_secret") || form.Get("scope") != "https://org.crm.dynamics.com/.default" {
+		t.Fatalf("Wrong token request: %v", form)
+	}
+
+	parts := strings.Split(form.Get("client_assertion"), ".")
+	if len(parts) != 3 {
+		t.Fatalf("Wrong assertion: %v", form.Get("client_assertion"))
+	}
+	var header, claims map[string]any
+	headerJson, _ := base64.RawURLEncoding.DecodeString(parts[0])
+	claimsJson, _ := base64.RawURLEncoding.DecodeString(parts[1])
+	json.Unmarshal(headerJson, &header)
+	json.Unmarshal(claimsJson, &claims)
+	thumbprint := sha1.Sum(der)
+	if header["alg"] != "RS256" || header["x5t"] != base64.RawURLEncoding.EncodeToString(thumbprint[:]) || header["x5t#S256"] == nil {
+		t.Fatalf("Wrong header: %v", header)
+	}
+	if claims["aud"] != "https://login.microsoftonline.com/tenantid/oauth2/v2.0/token" || claims["iss"] != "clientid" || claims["sub"] != "clientid" {
+		t.Fatalf("Wrong claims: %v", claims)
+	}
+
+	signature, _ := base64.RawURLEncoding.DecodeString(parts[2])
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err = rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA256, digest[:], signature); err != nil {
+		t.Fatalf("Invalid signature: %v", err)
+	}
+}
+
+func TestGetAuthorization(t *testing.T) {
+	var requested string
+	var form url.Values
+	client := &Client{
+		Transport: RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			requested = req.URL.String()
+			body, _ := io.ReadAll(req.Body)
+			form, _ = url.ParseQuery(string(body))
+			status, body := http.StatusOK, []byte(`{"access_token": "AAAA", "token_type": "Bearer", "expires_in": 3599}`)
+			if form.Get("client_secret") != "s3cr&t" {
+				status, body = http.StatusUnauthorized, []byte(`{"error": "invalid_client", "error_description": "AADSTS7000215: Invalid client secret provided."}`)
+			}
+			return &http.Response{
+				StatusCode: status,
+				Header:     http.Header{},
+				Body:       io.NopCloser(bytes.NewReader(body)),
+				Request:    req,
+			}, nil
+		}),
+	}
+
+	cases := []struct {
+		authorityHost string
+		target        string
+		expected      string
+	}{
+		{"", "https://org.crm4.dynamics.com/", "https://login.microsoftonline.com/tenantid/oauth2/v2.0/token"},
+		{"", "https://org.crm9.dynamics.com", "https://login.microsoftonline.com/tenantid/oauth2/v2.0/token"},
+		{"", "https://org.crm.microsoftdynamics.us", "https://login.microsoftonline.us/tenantid/oauth2/v2.0/token"},
+		{"", "https://org.crm.appsplatform.us", "https://login.microsoftonline.us/tenantid/oauth2/v2.0/token"},
+		{"", "https://org.crm.dynamics.cn", "https://login.chinacloudapi.cn/tenantid/oauth2/v2.0/token"},
+		{AuthorityUSGovernment + "/", "https://org.crm.dynamics.com", "https://login.microsoftonline.us/tenantid/oauth2/v2.0/token"},
+	}
+	for _, c := range cases {
+		client.AuthorityHost = c.authorityHost
+		before := time.Now()
+		token, err := client.GetAuthorization("clientid", "s3cr&t", "tenantid", c.target)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		if requested != c.expected || form.Get("scope") != strings.TrimSuffix(c.target, "/")+"/.default" {
+			t.Errorf("%v: wrong token request %v %v", c.target, requested, form)
+		}
+		if token.AccessToken != "AAAA" || token.TokenType != "Bearer" || token.ExpiresOn.Before(before.Add(3599*time.Second)) {
+			t.Errorf("Wrong token: %+v", token)
+		}
+	}
+
+	_, err := client.GetAuthorization("clientid", "wrong", "tenantid", "https://org.crm.dynamics.com")
+	var authErr *AuthenticationError
+	if !errors.As(err, &authErr) || authErr.StatusCode != http.StatusUnauthorized || authErr.Code != "invalid_client" {
+		t.Fatalf("Wrong error: %v", err)
+	}
+}
+
+func TestTokenProviders(t *testing.T) {
+	tokens := dataversetest.NewTokenServer()
+	defer tokens.Close()
+	tokens.AddClient("clientid", "secret")
+
+	var bearers []string
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		bearers = append(bearers, r.Header.Get("Authorization"))
+		w.Write([]byte(`{}`))
+	}))
+	defer api.Close()
+
+	client := &Client{AuthorityHost: tokens.URL}
+	client.TokenProvider = &ClientSecretCredential{TenantId: "tenantid", ClientId: "clientid", Secret: "secret", Resource: api.URL, Client: client}
+	for i := 0; i < 2; i++ {
+		ch, chErr := make(chan map[string]any), make(chan error)
+		go client.GetRequest(api.URL+"/api/data/v9.1/accounts", "", false, ch, chErr)
+		<-ch
+		<-chErr
+	}
+	if len(bearers) != 2 || bearers[0] != "Bearer token-1" || bearers[1] != "Bearer token-1" || len(tokens.Requests()) != 1 {
+		t.Fatalf("Token not provided or not cached: %v %v", bearers, tokens.Requests())
+	}
+
+	ctx := context.Background()
+	var authErr *AuthenticationError
+	if _, err := (&ClientSecretCredential{TenantId: "tenantid", ClientId: "clientid", Secret: "wrong", Client: client}).Token(ctx); !errors.As(err, &authErr) {
+		t.Fatalf("Expected authentication error, got %v", err)
+	}
+
+	// Tokens expiring within the refresh margin are not cached.
+	tokens.ExpiresIn = 60
+	imds := &ManagedIdentityCredential{ClientId: "miclientid", Resource: api.URL, Endpoint: tokens.URL + "/metadata/identity/oauth2/token"}
+	first, err := imds.Token(ctx)
+	second, _ := imds.Token(ctx)
+	if err != nil || first.Token == second.Token || time.Until(first.ExpiresOn) > time.Minute {
+		t.Fatalf("Wrong managed identity tokens: %v %v %v", first, second, err)
+	}
+	tokens.ExpiresIn = 3599
+	if request := tokens.Requests()[len(tokens.Requests())-1]; request.Values.Get("client_id") != "miclientid" || request.Values.Get("resource") != api.URL {
+		t.Fatalf("Wrong managed identity request: %v", request)
+	}
+
+	tokenFile := t.TempDir() + "/token"
+	os.WriteFile(tokenFile, []byte("service-account-token\n"), 0o600)
+	t.Setenv(EnvAuthorityHost, tokens.URL)
+	t.Setenv(EnvTenantId, "tenantid")
+	t.Setenv(EnvClientId, "clientid")
+	t.Setenv(EnvClientSecret, "wrong")
+	t.Setenv(EnvFederatedTokenFile, tokenFile)
+	chain := NewEnvironmentTokenProvider(api.URL, nil)
+	if len(chain.Providers) != 3 {
+		t.Fatalf("Wrong chain: %v", chain.Providers)
+	}
+	if token, err := chain.Token(ctx); err != nil || len(token.Token) == 0 {
+		t.Fatalf("Wrong chained token: %v %v", token, err)
+	}
+	if request := tokens.Requests()[len(tokens.Requests())-1]; request.Tenant != "tenantid" || request.Values.Get("client_assertion") != "service-account-token" {
+		t.Fatalf("Wrong workload identity request: %v", request)
+	}
+
+	t.Setenv(EnvIdentityEndpoint, tokens.URL+"/msi/token")
+	t.Setenv(EnvIdentityHeader, dataversetest.IdentityHeader)
+	if token, err := (&ManagedIdentityCredential{Resource: api.URL}).Token(ctx); err != nil || token.ExpiresOn.IsZero() {
+		t.Fatalf("Wrong App Service token: %v %v", token, err)
+	}
+
+	static := StaticTokenProvider{AccessToken: AccessToken{Token: "AAAA", ExpiresOn: time.Now().Add(-time.Minute)}}
+	if _, err := static.Token(ctx); err == nil {
+		t.Fatalf("Expected expired token error")
+	}
+}
+
+func TestManagedIdentityProbe(t *testing.T) {
+	previous := imdsProbeTimeout
+	imdsProbeTimeout = 20 * time.Millisecond
+	defer func() { imdsProbeTimeout = previous }()
+
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		time.Sleep(200 * time.Millisecond)
+	}))
+	defer server.Close()
+
+	// An IMDS endpoint which doesn't answer the probe makes the credential unavailable.
+	imds := &ManagedIdentityCredential{Resource: "https://org.crm.dynamics.com", Endpoint: server.URL}
+	start := time.Now()
+	if _, err := imds.Token(context.Background()); err == nil || time.Since(start) > 150*time.Millisecond {
+		t.Fatalf("Expected a quick probe failure: %v %v", err, time.Since(start))
+	}
+	if _, err := imds.Token(context.Background()); err == nil || requests.Load() != 1 {
+		t.Fatalf("Expected the credential to be unavailable: %v %v", err, requests.Load())
+	}
+}
+
+func TestDelegatedCredentials(t *testing.T) {
+	tokens := dataversetest.NewTokenServer()
+	defer tokens.Close()
+	client := &Client{AuthorityHost: tokens.URL}
+	ctx := context.Background()
+
+	var prompted DeviceCode
+	deviceCode := &DeviceCodeCredential{
+		TenantId: "organizations",
+		ClientId: "clientid",
+		Resource: "https://org.crm.dynamics.com",
+		Client:   client,
+		Prompt: func(code DeviceCode) error {
+			prompted = code
+			tokens.ApproveDeviceCode(code.UserCode)
+			return nil
+		},
+	}
+	token, err := deviceCode.Token(ctx)
+	if err != nil || len(token.Token) == 0 || !strings.Contains(prompted.Message, prompted.UserCode) {
+		t.Fatalf("Wrong device code token: %v %v %v", token, prompted, err)
+	}
+	if cached, _ := deviceCode.Token(ctx); cached != token {
+		t.Fatalf("Token not cached: %v %v", cached, token)
+	}
+
+	var opened string
+	interactive := &InteractiveCredential{
+		TenantId: "organizations",
+		ClientId: "clientid",
+		Resource: "https://org.crm.dynamics.com",
+		Client:   client,
+		OpenBrowser: func(authorizeUrl string) error {
+			// The stand-in server signs the user in and redirects to the loopback listener.
+			opened = authorizeUrl
+			resp, err := http.Get(authorizeUrl)
+			if err == nil {
+				resp.Body.Close()
+			}
+			return err
+		},
+	}
+	if token, err = interactive.Token(ctx); err != nil || len(token.Token) == 0 {
+		t.Fatalf("Wrong interactive token: %v %v", token, err)
+	}
+	authorize, _ := url.Parse(opened)
+	if authorize.Query().Get("code_challenge_method") != "S256" || !strings.HasPrefix(authorize.Query().Get("redirect_uri"), "http://127.0.0.1:") ||
+		!strings.HasSuffix(authorize.Query().Get("scope"), "offline_access") {
+		t.Fatalf("Wrong authorization request: %v", opened)
+	}
+
+	// Expiring tokens are refreshed with the refresh token, without prompting the user.
+	interactive.cache.token.ExpiresOn = time.Now()
+	interactive.OpenBrowser = func(string) error { return errors.New("Browser opened") }
+	refreshed, err := interactive.Token(ctx)
+	last := tokens.Requests()[len(tokens.Requests())-1]
+	if err != nil || refreshed == token || last.Values.Get("grant_type") != "refresh_token" {
+		t.Fatalf("Token not refreshed: %v %v %v", refreshed, last, err)
+	}
+
+	// The user is prompted again when the refresh token is revoked.
+	tokens.RevokeRefreshTokens()
+	interactive.cache.token.ExpiresOn = time.Now()
+	if _, err = interactive.Token(ctx); err == nil || err.Error() != "Browser opened" {
+		t.Fatalf("Expected interactive flow, got %v", err)
+	}
+
+	// An abandoned sign-in times out.
+	abandoned := &InteractiveCredential{TenantId: "organizations", ClientId: "clientid", Resource: "https://org.crm.dynamics.com", Client: client,
+		OpenBrowser: func(string) error { return nil },
+		Timeout:     10 * time.Millisecond,
+	}
+	if _, err = abandoned.Token(ctx); err == nil || err.Error() != "The sign-in timed out" {
+		t.Fatalf("Expected sign-in timeout, got %v", err)
+	}
+}
+
+func TestFileTokenCache(t *testing.T) {
+	tokens := dataversetest.NewTokenServer()
+	defer tokens.Close()
+	client := &Client{AuthorityHost: tokens.URL}
+	ctx := context.Background()
+	path := t.TempDir() + "/cache/tokens"
+	newCache := func() *FileTokenCache {
+		return &FileTokenCache{Path: path, Key: []byte("0123456789abcdef0123456789abcdef")}
+	}
+
+	// A new process reuses the token of the previous one.
+	first, err := (&ClientSecretCredential{TenantId: "tenantid", ClientId: "clientid", Secret: "secret", Resource: "https://org.crm.dynamics.com", Client: client, Cache: newCache()}).Token(ctx)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	second, _ := (&ClientSecretCredential{TenantId: "tenantid", ClientId: "clientid", Secret: "secret", Resource: "https://org.crm.dynamics.com/", Client: client, Cache: newCache()}).Token(ctx)
+	if second.Token != first.Token || !second.ExpiresOn.Equal(first.ExpiresOn) || len(tokens.Requests()) != 1 {
+		t.Fatalf("Token not cached: %v %v", first, second)
+	}
+	if content, _ := os.ReadFile(path); bytes.Contains(content, []byte(first.Token)) {
+		t.Fatalf("Token cache not encrypted")
+	}
+	if _, _, err = (&FileTokenCache{Path: path, Key: []byte("wrong")}).Load(CacheKey{}); err == nil {
+		t.Fatalf("Expected decryption error")
+	}
+
+	// The refresh token of a delegated flow is used by the next process.
+	key := CacheKey{TenantId: "organizations", ClientId: "clientid", Resource: "https://org.crm.dynamics.com"}
+	deviceCode := &DeviceCodeCredential{TenantId: key.TenantId, ClientId: key.ClientId, Resource: key.Resource, Client: client, Cache: newCache(),
+		Prompt: func(code DeviceCode) error {
+			tokens.ApproveDeviceCode(code.UserCode)
+			return nil
+		},
+	}
+	if _, err = deviceCode.Token(ctx); err != nil {
+		t.Fatalf("%v", err)
+	}
+	cached, ok, err := newCache().Load(key)
+	if !ok || err != nil || len(cached.RefreshToken) == 0 {
+		t.Fatalf("Refresh token not cached: %v %v", cached, err)
+	}
+	cached.ExpiresOn = time.Now()
+	newCache().Store(key, cached)
+	next := &DeviceCodeCredential{TenantId: key.TenantId, ClientId: key.ClientId, Resource: key.Resource, Client: client, Cache: newCache(),
+		Prompt: func(code DeviceCode) error { return errors.New("User prompted") },
+	}
+	if token, err := next.Token(ctx); err != nil || token.Token == cached.AccessToken {
+		t.Fatalf("Token not refreshed: %v %v", token, err)
+	}
+
+	// Concurrent writers do not lose tokens.
+	done := make(chan bool)
+	for i := 0; i < 10; i++ {
+		go func(i int) {
+			newCache().Store(CacheKey{TenantId: fmt.Sprint(i)}, CachedToken{AccessToken: "AAAA", ExpiresOn: time.Now().Add(time.Hour)})
+			done <- true
+		}(i)
+	}
+	for i := 0; i < 10; i++ {
+		<-done
+	}
+	for i := 0; i < 10; i++ {
+		if _, ok, err := newCache().Load(CacheKey{TenantId: fmt.Sprint(i)}); !ok || err != nil {
+			t.Fatalf("Token %v lost: %v", i, err)
+		}
+	}
+}
+
+func TestRequestErrors(t *testing.T) {
+	// The network is down.
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	server.Close()
+	client := &Client{}
+	ch := make(chan map[string]any)
+	chErr := make(chan error)
+	go client.GetRequest(server.URL, "AAAA", false, ch, chErr)
+	if ent, err := <-ch, <-chErr; err == nil || ent != nil {
+		t.Fatalf("Expected error: %v %v", ent, err)
+	}
+	go client.PostRequest(server.URL, "AAAA", map[string]any{"name": "test"}, false, ch, chErr)
+	if ent, err := <-ch, <-chErr; err == nil || ent != nil {
+		t.Fatalf("Expected error: %v %v", ent, err)
+	}
+	go client.DeleteRequest(server.URL, "AAAA", false, chErr)
+	if err := <-chErr; err == nil {
+		t.Fatalf("Expected error")
+	}
+	go client.PostBatch(server.URL, "AAAA", "", "batch_1", false, chErr)
+	if err := <-chErr; err == nil {
+		t.Fatalf("Expected error")
+	}
+
+	// The response is malformed.
+	status, body := http.StatusOK, `{"value": [`
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+		w.Write([]byte(body))
+	}))
+	defer server.Close()
+	go client.GetRequest(server.URL, "AAAA", false, ch, chErr)
+	if ent, err := <-ch, <-chErr; err == nil || !strings.Contains(err.Error(), "Invalid JSON") || ent != nil {
+		t.Fatalf("Expected error: %v %v", ent, err)
+	}
+
+	// An error which is not JSON, e.g. from a gateway.
+	status, body = http.StatusBadGateway, "<html>Bad gateway</html>"
+	go client.GetRequest(server.URL, "AAAA", false, ch, chErr)
+	if ent, err := <-ch, <-chErr; err == nil || !strings.Contains(err.Error(), "502") || !strings.Contains(err.Error(), "Bad gateway") || ent != nil {
+		t.Fatalf("Expected error: %v %v", ent, err)
+	}
+
+	// An invalid URL.
+	go client.GetRequest("http://[::1", "AAAA", false, ch, chErr)
+	if ent, err := <-ch, <-chErr; err == nil || ent != nil {
+		t.Fatalf("Expected error: %v %v", ent, err)
+	}
+}
+
+func TestDo(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		switch r.URL.Path {
+		case "/api/data/v9.1/contacts":
+			if r.URL.RawQuery != "$top=1&$filter=lastname+eq+%27fromgo%27&$select=fullname" || r.Header.Get("Prefer") != "odata.include-annotations=*" {
+				t.Errorf("Wrong request: %v %v", r.URL.RawQuery, r.Header)
+			}
+			w.Header().Set("Content-Type", "application/json; odata.metadata=minimal")
+			w.Write([]byte(`{"value": [{"fullname": "test fromgo"}]}`))
+		case "/api/data/v9.1/accounts":
+			if r.Header.Get("Content-Type") != "application/json" || string(body) != `{"name":"test"}` {
+				t.Errorf("Wrong request: %v %s", r.Header, body)
+			}
+			w.Header().Set("OData-EntityId", "https://org/api/data/v9.1/accounts(00000000-0000-0000-0000-000000000001)")
+			w.WriteHeader(http.StatusNoContent)
+		case "/api/data/v9.1/notes(123)/documentbody/$value":
+			w.Write([]byte("file content"))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"error": {"message": "not found"}}`))
+		}
+	}))
+	defer server.Close()
+
+	client := &Client{}
+	ctx := context.Background()
+	resp, err := client.Do(ctx, Request{
+		Method:  "GET",
+		Url:     server.URL,
+		Path:    "/api/data/v9.1/contacts?$top=1",
+		Query:   url.Values{"$select": {"fullname"}, "$filter": {"lastname eq 'fromgo'"}},
+		Headers: map[string]string{"Prefer": "odata.include-annotations=*"},
+		Auth:    "AAAA",
+	})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	values, _ := resp.Value["value"].([]any)
+	if resp.StatusCode != http.StatusOK || len(values) != 1 || !strings.HasPrefix(string(resp.Body), `{"value"`) {
+		t.Fatalf("Wrong response: %+v", resp)
+	}
+
+	resp, err = client.Do(ctx, Request{Method: "POST", Url: server.URL, Path: "/api/data/v9.1/accounts", Body: map[string]any{"name": "test"}})
+	if err != nil || resp.EntityId() != "00000000-0000-0000-0000-000000000001" || resp.Value != nil {
+		t.Fatalf("Wrong response: %+v %v", resp, err)
+	}
+
+	var content bytes.Buffer
+	resp, err = client.Do(ctx, Request{Method: "GET", Path: server.URL + "/api/data/v9.1/notes(123)/documentbody/$value", Output: &content})
+	if err != nil || content.String() != "file content" || len(resp.Body) != 0 {
+		t.Fatalf("Wrong response: %+v %v %v", resp, content.String(), err)
+	}
+
+	// The response of an error is returned with the error.
+	resp, err = client.Do(ctx, Request{Method: "GET", Url: server.URL, Path: "/api/data/v9.1/leads", Output: &content})
+	if err == nil || resp == nil || resp.StatusCode != http.StatusNotFound || resp.Value["error"] == nil {
+		t.Fatalf("Expected error: %+v %v", resp, err)
+	}
+
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err = client.Do(cancelled, Request{Method: "GET", Url: server.URL, Path: "/api/data/v9.1/contacts"}); !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected cancellation: %v", err)
+	}
+}
+
+func TestRequestOptions(t *testing.T) {
+	var received []http.Header
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = append(received, r.Header.Clone())
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	// The options of the request are merged with the options of the client.
+	client := &Client{Options: RequestOptions{CallerId: "00000000-0000-0000-0000-000000000001", Tag: "client"}}
+	_, err := client.Do(context.Background(), Request{
+		Method: "POST",
+		Url:    server.URL,
+		Path:   "/api/data/v9.1/accounts",
+		Body:   map[string]any{"name": "test"},
+		Options: RequestOptions{
+			DetectDuplicates:             Bool(true),
+			BypassCustomPluginExecution:  Bool(true),
+			BypassBusinessLogicExecution: BypassCustomSync + ", " + BypassCustomAsync,
+			SolutionUniqueName:           "mysolution",
+			Tag:                          "request",
+		},
+	})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	expected := map[string]string{
+		"MSCRMCallerID":                      "00000000-0000-0000-0000-000000000001",
+		"MSCRM.SuppressDuplicateDetection":   "false",
+		"MSCRM.BypassCustomPluginExecution":  "true",
+		"MSCRM.BypassBusinessLogicExecution": "CustomSync,CustomAsync",
+		"MSCRM.SolutionUniqueName":           "mysolution",
+		"MSCRM.tag":                          "request",
+	}
+	for key, value := range expected {
+		if received[0].Get(key) != value {
+			t.Fatalf("Wrong header %v: %v", key, received[0].Get(key))
+		}
+	}
+
+	// The impersonation of the request replaces the impersonation of the client.
+	_, err = client.Do(context.Background(), Request{Method: "GET", Url: server.URL, Path: "/api/data/v9.1/accounts", Options: RequestOptions{CallerObjectId: "objectid"}})
+	if err != nil || received[1].Get("CallerObjectId") != "objectid" || received[1].Get("MSCRMCallerID") != "" || received[1].Get("MSCRM.tag") != "client" {
+		t.Fatalf("Wrong headers: %v %v", received[1], err)
+	}
+	client = &Client{Options: RequestOptions{CallerObjectId: "objectid"}}
+	_, err = client.Do(context.Background(), Request{Method: "GET", Url: server.URL, Path: "/api/data/v9.1/accounts", Options: RequestOptions{CallerId: "callerid"}})
+	if err != nil || received[2].Get("MSCRMCallerID") != "callerid" || received[2].Get("CallerObjectId") != "" {
+		t.Fatalf("Wrong headers: %v %v", received[2], err)
+	}
+
+	// A request turns off the booleans set by the client.
+	client = &Client{Options: RequestOptions{BypassCustomPluginExecution: Bool(true), DetectDuplicates: Bool(true)}}
+	_, err = client.Do(context.Background(), Request{
+		Method:  "POST",
+		Url:     server.URL,
+		Path:    "/api/data/v9.1/accounts",
+		Options: RequestOptions{BypassCustomPluginExecution: Bool(false), DetectDuplicates: Bool(false)},
+	})
+	if err != nil || received[3].Get("MSCRM.BypassCustomPluginExecution") != "false" || received[3].Get("MSCRM.SuppressDuplicateDetection") != "true" {
+		t.Fatalf("Wrong headers: %v %v", received[3], err)
+	}
+
+	// A batch doesn't bypass the custom plug-ins unless requested.
+	chErr := make(chan error, 1)
+	(&Client{}).PostBatch(server.URL, "AAAA", "--batch_AAA\n--batch_AAA--", "batch_AAA", false, chErr)
+	if err = <-chErr; err != nil || received[4].Get("MSCRM.BypassCustomPluginExecution") != "" {
+		t.Fatalf("Wrong headers: %v %v", received[4], err)
+	}
+}
+
+func TestNumberPrecision(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"totalamount": 12345678901234.123456789, "quantity": 3}`))
+	}))
+	defer server.Close()
+
+	resp, err := (&Client{}).Do(context.Background(), Request{Method: "GET", Url: server.URL, Path: "/api/data/v9.1/invoices(123)"})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if amount, ok := resp.Value["totalamount"].(json.Number); !ok || amount.String() != "12345678901234.123456789" {
+		t.Fatalf("Wrong amount: %#v", resp.Value["totalamount"])
+	}
+	if quantity, ok := resp.Value["quantity"].(json.Number); !ok || quantity.String() != "3" {
+		t.Fatalf("Wrong quantity: %#v", resp.Value["quantity"])
+	}
+}
+
+func TestLoadCertificatePKCS12(t *testing.T) {
+	// The fixture is exported by OpenSSL 3 with PBES2, PBKDF2 and AES-256-CBC.
+	cert, err := LoadCertificate("testdata/aes256.pfx", "dataversego")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if cert.Key == nil || cert.Certificate.Subject.CommonName != "dataversego-test" || !cert.Key.PublicKey.Equal(cert.Certificate.PublicKey) {
+		t.Fatalf("Wrong certificate: %+v", cert)
+	}
+	if _, err = LoadCertificate("testdata/aes256.pfx", "wrong"); err == nil {
+		t.Fatalf("Expected error")
+	}
+
+	// The legacy encryption is still supported.
+	data, err := pkcs12.LegacyRC2.Encode(cert.Key, cert.Certificate, nil, "legacy")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	legacy, err := ParseCertificatePKCS12(data, "legacy")
+	if err != nil || legacy.Thumbprint() != cert.Thumbprint() {
+		t.Fatalf("Wrong legacy certificate: %v", err)
+	}
+}
@@ -0,0 +1,367 @@
+package requests
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DeviceCodeGrantType is the grant type of the device code flow.
+const DeviceCodeGrantType = "urn:ietf:params:oauth:grant-type:device_code"
+
+// defaultPollInterval is the polling interval of the device code flow when the server does not return one.
+const defaultPollInterval = 5 * time.Second
+
+// The 'DeviceCode' struct is the response of the device code endpoint, to be shown to the user.
+// It contains the following fields:
+//   - UserCode: the code the user enters on the verification page
+//   - DeviceCode: the code exchanged for the token, not to be shown
+//   - VerificationUri: the verification page, e.g. "https://microsoft.com/devicelogin"
+//   - ExpiresIn: the validity of the codes in seconds
+//   - Interval: the polling interval in seconds
+//   - Message: the instructions for the user
+type DeviceCode struct {
+	UserCode        string `json:"user_code"`
+	DeviceCode      string `json:"device_code"`
+	VerificationUri string `json:"verification_uri"`
+	ExpiresIn       int64  `json:"expires_in"`
+	Interval        int64  `json:"interval"`
+	Message         string `json:"message"`
+}
+
+// delegatedCache holds the last token of a delegated flow and its refresh token.
+type delegatedCache struct {
+	mu           sync.Mutex
+	token        AccessToken
+	refreshToken string
+}
+
+// get returns the cached token, a token redeemed with the refresh token if the cached one expires soon,
+// or a token from the interactive flow if there is no refresh token or it was refused. The token and the
+// refresh token are loaded from and saved to the persistent cache, if any.
+func (c *delegatedCache) get(ctx context.Context, client *Client, persistent TokenCache, key CacheKey, interactive func(ctx context.Context) (TokenResponse, error)) (token AccessToken, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(c.token.Token) == 0 && persistent != nil {
+		if cached, ok, _ := persistent.Load(key); ok {
+			c.token = AccessToken{Token: cached.AccessToken, ExpiresOn: cached.ExpiresOn}
+			c.refreshToken = cached.RefreshToken
+		}
+	}
+	if isValid(c.token) {
+		return c.token, nil
+	}
+	tenant, clientId, resource := key.TenantId, key.ClientId, key.Resource
+
+	var response TokenResponse
+	if len(c.refreshToken) > 0 {
+		response, err = client.postToken(ctx, tenant, resource, url.Values{
+			"grant_type":    {"refresh_token"},
+			"client_id":     {clientId},
+			"refresh_token": {c.refreshToken},
+			"scope":         {delegatedScope(resource)},
+		})
+	}
+	if len(c.refreshToken) == 0 || err != nil {
+		if response, err = interactive(ctx); err != nil {
+			return
+		}
+	}
+
+	c.token = AccessToken{Token: response.AccessToken, ExpiresOn: response.ExpiresOn}
+	// The refresh token is kept if the server does not rotate it.
+	if len(response.RefreshToken) > 0 {
+		c.refreshToken = response.RefreshToken
+	}
+	if persistent != nil {
+		persistent.Store(key, CachedToken{AccessToken: c.token.Token, ExpiresOn: c.token.ExpiresOn, RefreshToken: c.refreshToken})
+	}
+	return c.token, nil
+}
+
+// delegatedScope returns the scope of a delegated flow, with offline_access to get a refresh token.
+func delegatedScope(resource string) string {
+	return Scope(resource) + " offline_access"
+}
+
+// The 'DeviceCodeCredential' struct provides the tokens of a user signing in on another device, e.g. from a
+// terminal without browser: the user opens the verification page and enters the code shown by Prompt.
+// The app registration must allow public client flows.
+// It contains the following fields:
+//   - TenantId: the tenant ID, or "organizations"
+//   - ClientId: the client ID of the app registration
+//   - Resource: the organization URL
+//   - Prompt: shows the code to the user, the message is printed to the standard error if nil
+//   - Client: the 'Client' sending the token requests (authority host, transport), DefaultClient if nil
+//   - Cache: an optional 'TokenCache' keeping the token and the refresh token for the next processes
+//
+// The token is refreshed with the refresh token when it expires, the user is prompted again only if it is refused.
+//
+// Example:
+//
+//	auth, err := dataversego.AuthenticateWithProvider(&requests.DeviceCodeCredential{
+//	  TenantId: "tenantid",
+//	  ClientId: "clientid",
+//	  Resource: "https://org.crm.dynamics.com",
+//	}, "https://org.crm.dynamics.com")
+type DeviceCodeCredential struct {
+	TenantId string
+	ClientId string
+	Resource string
+	Prompt   func(code DeviceCode) error
+	Client   *Client
+	Cache    TokenCache
+
+	cache delegatedCache
+}
+
+// Token returns the cached token, a refreshed one, or a token from the device code flow.
+func (p *DeviceCodeCredential) Token(ctx context.Context) (AccessToken, error) {
+	key := CacheKey{TenantId: p.TenantId, ClientId: p.ClientId, Resource: p.Resource}
+	return p.cache.get(ctx, p.Client, p.Cache, key, p.deviceCodeFlow)
+}
+
+func (p *DeviceCodeCredential) deviceCodeFlow(ctx context.Context) (token TokenResponse, err error) {
+	code, err := p.Client.postDeviceCode(ctx, p.TenantId, p.Resource, url.Values{
+		"client_id": {p.ClientId},
+		"scope":     {delegatedScope(p.Resource)},
+	})
+	if err != nil {
+		return
+	}
+
+	prompt := p.Prompt
+	if prompt == nil {
+		prompt = func(code DeviceCode) error {
+			_, err := fmt.Fprintln(os.Stderr, code.Message)
+			return err
+		}
+	}
+	if err = prompt(code); err != nil {
+		return
+	}
+
+	interval := time.Duration(code.Interval) * time.Second
+	if interval <= 0 {
+		interval = defaultPollInterval
+	}
+	expiration := time.Now().Add(time.Duration(code.ExpiresIn) * time.Second)
+	for {
+		select {
+		case <-ctx.Done():
+			return token, ctx.Err()
+		case <-time.After(interval):
+		}
+
+		token, err = p.Client.postToken(ctx, p.TenantId, p.Resource, url.Values{
+			"grant_type":  {DeviceCodeGrantType},
+			"client_id":   {p.ClientId},
+			"device_code": {code.DeviceCode},
+		})
+		var authErr *AuthenticationError
+		if err == nil || !errors.As(err, &authErr) {
+			return
+		}
+		switch authErr.Code {
+		case "authorization_pending":
+		case "slow_down":
+			interval += 5 * time.Second
+		default:
+			return
+		}
+		if time.Now().After(expiration) {
+			return token, errors.New("The device code expired")
+		}
+	}
+}
+
+// postDeviceCode requests a device code.
+func (c *Client) postDeviceCode(ctx context.Context, tenant string, resource string, form url.Values) (code DeviceCode, err error) {
+	ctx = context.WithValue(ctx, authRequestKey{}, true)
+	ctx, scope := c.newOperation(ctx, operation{name: "Authenticate"})
+	defer func() { scope.end(err) }()
+	endpoint := fmt.Sprintf("%v/%v/oauth2/v2.0/devicecode", c.authorityHost(resource), tenant)
+	req, err := http.NewRequestWithContext(ctx, "POST", endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return
+	}
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := scope.send(c.httpClient(), req)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode > 300 {
+		authErr := &AuthenticationError{StatusCode: resp.StatusCode}
+		json.NewDecoder(resp.Body).Decode(authErr)
+		return code, authErr
+	}
+	err = json.NewDecoder(resp.Body).Decode(&code)
+	return
+}
+
+// DefaultSignInTimeout is the time a user has to sign in with an 'InteractiveCredential' without a Timeout.
+const DefaultSignInTimeout = 5 * time.Minute
+
+// The 'InteractiveCredential' struct provides the tokens of a user signing in with the browser, with the
+// authorization code flow and PKCE. The authorization code is received by a listener on the loopback interface,
+// so the app registration must have "http://127.0.0.1" as mobile and desktop redirect URI.
+// It contains the following fields:
+//   - TenantId: the tenant ID, or "organizations"
+//   - ClientId: the client ID of the app registration
+//   - Resource: the organization URL
+//   - RedirectPort: the port of the loopback listener, a random one if 0
+//   - OpenBrowser: opens the authorization page, the default browser of the system is used if nil
+//   - Timeout: the time the user has to sign in before the loopback listener is closed, DefaultSignInTimeout if 0
+//   - Client: the 'Client' sending the token requests (authority host, transport), DefaultClient if nil
+//   - Cache: an optional 'TokenCache' keeping the token and the refresh token for the next processes
+//
+// The token is refreshed with the refresh token when it expires, the user signs in again only if it is refused.
+//
+// Example:
+//
+//	client := &requests.Client{}
+//	client.TokenProvider = &requests.InteractiveCredential{
+//	  TenantId: "organizations",
+//	  ClientId: "clientid",
+//	  Resource: "https://org.crm.dynamics.com",
+//	}
+type InteractiveCredential struct {
+	TenantId     string
+	ClientId     string
+	Resource     string
+	RedirectPort int
+	OpenBrowser  func(authorizeUrl string) error
+	Timeout      time.Duration
+	Client       *Client
+	Cache        TokenCache
+
+	cache delegatedCache
+}
+
+// Token returns the cached token, a refreshed one, or a token from the authorization code flow.
+func (p *InteractiveCredential) Token(ctx context.Context) (AccessToken, error) {
+	key := CacheKey{TenantId: p.TenantId, ClientId: p.ClientId, Resource: p.Resource}
+	return p.cache.get(ctx, p.Client, p.Cache, key, p.authorizationCodeFlow)
+}
+
+// The 'authorizationResult' struct is the query received by the redirect listener.
+type authorizationResult struct {
+	code string
+	err  error
+}
+
+func (p *InteractiveCredential) authorizationCodeFlow(ctx context.Context) (token TokenResponse, err error) {
+	listener, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%v", p.RedirectPort))
+	if err != nil {
+		return
+	}
+	redirectUri := fmt.Sprintf("http://127.0.0.1:%v", listener.Addr().(*net.TCPAddr).Port)
+	verifier, state := randomString(32), randomString(16)
+	challenge := sha256.Sum256([]byte(verifier))
+
+	results := make(chan authorizationResult, 1)
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		result := authorizationResult{code: query.Get("code")}
+		switch {
+		case query.Get("state") != state:
+			result.err = errors.New("Invalid state in the authorization response")
+		case len(query.Get("error")) > 0:
+			result.err = &AuthenticationError{StatusCode: http.StatusUnauthorized, Code: query.Get("error"), Description: query.Get("error_description")}
+		case len(result.code) == 0:
+			result.err = errors.New("No authorization code in the authorization response")
+		}
+		if result.err != nil {
+			http.Error(w, "Authentication failed, you can close this window.", http.StatusBadRequest)
+		} else {
+			fmt.Fprint(w, "Authentication complete, you can close this window.")
+		}
+		select {
+		case results <- result:
+		default:
+		}
+	})}
+	go server.Serve(listener)
+	defer server.Close()
+
+	authorizeUrl := fmt.Sprintf("%v/%v/oauth2/v2.0/authorize?%v", p.Client.authorityHost(p.Resource), p.TenantId, url.Values{
+		"client_id":             {p.ClientId},
+		"response_type":         {"code"},
+		"response_mode":         {"query"},
+		"redirect_uri":          {redirectUri},
+		"scope":                 {delegatedScope(p.Resource)},
+		"state":                 {state},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}.Encode())
+	openBrowser := p.OpenBrowser
+	if openBrowser == nil {
+		openBrowser = openDefaultBrowser
+	}
+	if err = openBrowser(authorizeUrl); err != nil {
+		return
+	}
+
+	timeout := p.Timeout
+	if timeout <= 0 {
+		timeout = DefaultSignInTimeout
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	var result authorizationResult
+	select {
+	case <-ctx.Done():
+		return token, ctx.Err()
+	case <-timer.C:
+		return token, errors.New("The sign-in timed out")
+	case result = <-results:
+	}
+	if result.err != nil {
+		return token, result.err
+	}
+
+	return p.Client.postToken(ctx, p.TenantId, p.Resource, url.Values{
+		"grant_type":    {"authorization_code"},
+		"client_id":     {p.ClientId},
+		"code":          {result.code},
+		"redirect_uri":  {redirectUri},
+		"code_verifier": {verifier},
+		"scope":         {delegatedScope(p.Resource)},
+	})
+}
+
+// openDefaultBrowser opens a URL with the default browser of the system.
+func openDefaultBrowser(rawUrl string) error {
+	switch runtime.GOOS {
+	case "windows":
+		return exec.Command("rundll32", "url.dll,FileProtocolHandler", rawUrl).Start()
+	case "darwin":
+		return exec.Command("open", rawUrl).Start()
+	default:
+		return exec.Command("xdg-open", rawUrl).Start()
+	}
+}
+
+// randomString returns n random bytes encoded in base64url, e.g. for a PKCE code verifier.
+func randomString(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
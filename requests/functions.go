@@ -1,51 +1,19 @@
 package requests
 
 import (
-	"bytes"
-	"encoding/json"
-	"errors"
-	"fmt"
-	"net/http"
-	"regexp"
-	"strconv"
-	"strings"
-	"time"
+	"context"
+	"io"
 )
 
-// GetAuthorization retrieves an authorization token for a given client ID, secret, tenant ID, and resource URL.
-//
-// It takes four arguments:
-//   - client: a string representing the client ID
-//   - secret: a string representing the secret
-//   - tenant: a string representing the tenant ID
-//   - target: a string representing the resource URL
-//
-// The return value is a map of strings to interface{} values representing the authorization information.
-//
-// Example:
-//
-//	auth := GetAuthorization("clientid", "secret", "tenantid", "https://myresource.com")
-//	fmt.Println(auth["access_token"])
-func GetAuthorization(client string, secret string, tenant string, target string) (auth map[string]any) {
-	urlGraph := fmt.Sprintf("https://login.microsoftonline.com/%v/oauth2/token", tenant)
-	body := fmt.Sprintf("grant_type=client_credentials&client_id=%v&client_secret=%v&resource=%v", client, secret, target)
-
-	resp, _ := http.Post(urlGraph, "application/x-www-form-urlencoded", strings.NewReader(body))
-
-	json.NewDecoder(resp.Body).Decode(&auth)
-	return
-}
-
 // GetRequest sends a GET request to the specified URL with the given authorization header and returns the
-// response body as a map[string]any value through the given channel. If the printerror parameter is true
-// and the response has a status code greater than 300, it will also print the request URL and the status
-// code and response body. If the URL starts with "fakeurl", it will send a "fake" response through the
-// channel and return without making an actual HTTP request.
+// response body as a map[string]any value through the given channel.
+// If the response has a status code greater than 300, the request URL, the status code and the response body
+// are logged by the Logger of the client.
 //
 // The function takes the following parameters:
 //   - url: a string value representing the URL to send the request to.
 //   - auth: a string value representing the authorization header to include in the request.
-//   - printerror: a boolean value indicating whether to print errors.
+//   - printerror: deprecated and ignored, the errors are logged by the Logger of the client.
 //   - ch: a channel of type chan<- map[string]any to send the response body through.
 //   - chErr: a channel of type chan<- error to send any errors through.
 //
@@ -56,284 +24,184 @@ func GetAuthorization(client string, secret string, tenant string, target string
 //	go GetRequest("https://myresource.com/data", "authtoken", true, ch, chErr)
 //	resp := <-ch
 //	fmt.Println(resp)
-func GetRequest(url string, auth string, printerror bool, ch chan<- map[string]any, chErr chan<- error) {
-	if checkFake(url) {
-		responseBody := map[string]any{
-			"isfake": true,
-		}
-		ch <- responseBody
-		chErr <- nil
-		return
-	}
-
-	bearerToken := fmt.Sprintf("Bearer %v", auth)
-	client := &http.Client{}
-	req, _ := http.NewRequest("GET", url, nil)
-	req.Header.Add("Authorization", bearerToken)
-	resp, _ := client.Do(req)
-
-	var responseBody map[string]any
-	json.NewDecoder(resp.Body).Decode(&responseBody)
+func (c *Client) GetRequest(url string, auth string, printerror bool, ch chan<- map[string]any, chErr chan<- error) {
+	c.GetRequestWithHeaders(url, auth, nil, ch, chErr)
+}
 
-	// If the request returned an error status code and `printerror` is true,
-	// print the error message to the console and send the error through the `chErr` channel.
-	if resp.StatusCode > 300 {
-		if printerror {
-			fmt.Printf("Request url: %v", url)
-			fmt.Printf("Statuscode: %v - %v", resp.StatusCode, responseBody)
-		}
+// GetRequestWithHeaders sends a GET request to the specified URL with the given authorization header and the
+// additional headers (e.g. "Prefer"), and returns the response body as a map[string]any value through the given
+// channel. It behaves like GetRequest otherwise.
+//
+// The function takes the following parameters:
+//   - url: a string value representing the URL to send the request to.
+//   - auth: a string value representing the authorization header to include in the request.
+//   - headers: a map of strings to strings representing the additional headers of the request.
+//   - ch: a channel of type chan<- map[string]any to send the response body through.
+//   - chErr: a channel of type chan<- error to send any errors through.
+func (c *Client) GetRequestWithHeaders(url string, auth string, headers map[string]string, ch chan<- map[string]any, chErr chan<- error) {
+	resp, err := c.Do(context.Background(), Request{Method: "GET", Path: url, Headers: headers, Auth: auth})
+	if err != nil {
 		ch <- nil
-		chErr <- errors.New(fmt.Sprintf("HTTP ERROR %v - MESSAGE: %v", resp.StatusCode, responseBody))
-	} else {
-		ch <- responseBody
-		chErr <- nil
+		chErr <- err
+		return
 	}
+	ch <- resp.Value
+	chErr <- nil
 }
 
-// GetRequest sends a POST request to the specified URL with the given authorization header and returns the
-// url and id as a map[string]any value through the given channel. If the printerror parameter is true
-// and the response has a status code greater than 300, it will also print the request URL and the status
-// code and response body. If the URL starts with "fakeurl", it will send a "fake" response through the
-// channel and return without making an actual HTTP request.
+// PostRequest sends a POST request to the specified URL with the given authorization header and returns the
+// url and id as a map[string]any value through the given channel.
+// If the response has a status code greater than 300, the request URL, the status code and the response body
+// are logged by the Logger of the client.
 //
 // The function takes the following parameters:
 //   - url: a string value representing the URL to send the request to.
 //   - auth: a string value representing the authorization header to include in the request.
 //   - row: a map of strings to any type representing the data that will be included in the request body
-//   - printerror: a boolean value indicating whether to print errors.
+//   - printerror: deprecated and ignored, the errors are logged by the Logger of the client.
 //   - ch: a channel of type chan<- map[string]any to send the response body through.
 //   - chErr: a channel of type chan<- error to send any errors through.
-func PostRequest(url string, auth string, row map[string]any, printerror bool, ch chan<- map[string]any, chErr chan<- error) {
-	// Check if the request is a "fake" url and handle it accordingly.
-	if checkFake(url) {
-		responseBody := map[string]any{
-			"isfake": true,
-		}
-		ch <- responseBody
-		chErr <- nil
-		return
-	}
-
-	// Marshal the `row` data into a JSON string.
-	jsonStr, err := json.Marshal(row)
+func (c *Client) PostRequest(url string, auth string, row map[string]any, printerror bool, ch chan<- map[string]any, chErr chan<- error) {
+	resp, err := c.Do(context.Background(), Request{Method: "POST", Path: url, Body: row, Auth: auth})
 	if err != nil {
-		if printerror {
-			fmt.Println(err)
-		}
 		ch <- nil
 		chErr <- err
 		return
 	}
 
-	// Set up the request with the proper headers and body.
-	bearerToken := fmt.Sprintf("Bearer %v", auth)
-	client := &http.Client{}
-	req, _ := http.NewRequest("POST", url, bytes.NewReader(jsonStr))
-	req.Header.Add("Authorization", bearerToken)
-	req.Header.Add("Content-Type", "application/json")
-	resp, _ := client.Do(req)
-
-	// Decode the response body into a map[string]any.
-	var responseBody map[string]any
-	json.NewDecoder(resp.Body).Decode(&responseBody)
-
-	// If the request returned an error status code and `printerror` is true,
-	// print the error message to the console and send the error through the `chErr` channel.
-	if resp.StatusCode > 300 {
-		if printerror {
-			fmt.Printf("Request url: %v", url)
-			fmt.Printf("Statuscode: %v - %v", resp.StatusCode, responseBody)
-		}
-		ch <- nil
-		chErr <- errors.New(fmt.Sprintf("HTTP ERROR %v - MESSAGE: %v", resp.StatusCode, responseBody))
-	} else {
-		// Otherwise, extract the entity URL and ID from the response header and
-		// send the response through the `ch` channel.
-		entityUrl := resp.Header["Odata-Entityid"][0]
-		re := regexp.MustCompile(`[a-fA-F0-9]{8}-[a-fA-F0-9]{4}-[a-fA-F0-9]{4}-[a-fA-F0-9]{4}-[a-fA-F0-9]{12}`)
-		// Find the regular expression in the string
-		matches := re.FindString(entityUrl)
-
-		ch <- map[string]any{
-			"url": entityUrl,
-			"id":  matches,
-		}
-		chErr <- nil
+	// Requests that don't create a row (e.g. associations) have no OData-EntityId header.
+	ch <- map[string]any{
+		"url": resp.EntityUrl(),
+		"id":  resp.EntityId(),
 	}
+	chErr <- nil
 }
 
-// GetRequest sends a PATCH request to the specified URL with the given authorization header and returns the
-// url and id as a map[string]any value through the given channel. If the printerror parameter is true
-// and the response has a status code greater than 300, it will also print the request URL and the status
-// code and response body. If the URL starts with "fakeurl", it will send a "fake" response through the
-// channel and return without making an actual HTTP request.
+// PostActionRequest sends a POST request with a JSON payload to the specified URL with the given authorization
+// header and returns the response body as a map[string]any value through the given channel. It is meant for
+// Dataverse actions, which return their output parameters in the body instead of an OData-EntityId header.
+// If the response has a status code greater than 300, the request URL, the status code and the response body
+// are logged by the Logger of the client.
 //
 // The function takes the following parameters:
 //   - url: a string value representing the URL to send the request to.
 //   - auth: a string value representing the authorization header to include in the request.
-//   - row: a map of strings to any type representing the data that will be included in the request body
-//   - printerror: a boolean value indicating whether to print errors.
+//   - payload: a value that will be marshalled as JSON and included in the request body, nil for no body
 //   - ch: a channel of type chan<- map[string]any to send the response body through.
 //   - chErr: a channel of type chan<- error to send any errors through.
-func PatchRequest(url string, auth string, row map[string]any, printerror bool, ch chan<- map[string]any, chErr chan<- error) {
-	if checkFake(url) {
-		responseBody := map[string]any{
-			"isfake": true,
-		}
-		ch <- responseBody
-		chErr <- nil
-		return
+func (c *Client) PostActionRequest(url string, auth string, payload any, ch chan<- map[string]any, chErr chan<- error) {
+	var body any = []byte("{}")
+	if payload != nil {
+		body = payload
 	}
-
-	jsonStr, err := json.Marshal(row)
+	resp, err := c.Do(context.Background(), Request{
+		Method:    "POST",
+		Path:      url,
+		Headers:   map[string]string{"Content-Type": "application/json"},
+		Body:      body,
+		Auth:      auth,
+		Operation: "ExecuteAction",
+	})
 	if err != nil {
-		if printerror {
-			fmt.Println(err)
-		}
 		ch <- nil
 		chErr <- err
 		return
 	}
+	ch <- resp.Value
+	chErr <- nil
+}
 
-	bearerToken := fmt.Sprintf("Bearer %v", auth)
-	client := &http.Client{}
-	req, _ := http.NewRequest("PATCH", url, bytes.NewReader(jsonStr))
-	req.Header.Add("Authorization", bearerToken)
-	req.Header.Add("Content-Type", "application/json")
-	resp, _ := client.Do(req)
-
-	var responseBody map[string]any
-	json.NewDecoder(resp.Body).Decode(&responseBody)
-
-	// If the request returned an error status code and `printerror` is true,
-	// print the error message to the console and send the error through the `chErr` channel.
-	if resp.StatusCode > 300 {
-		if printerror {
-			fmt.Printf("Request url: %v", url)
-			fmt.Printf("Statuscode: %v - %v", resp.StatusCode, responseBody)
-		}
+// PatchRequest sends a PATCH request to the specified URL with the given authorization header and returns the
+// url and id as a map[string]any value through the given channel.
+// If the response has a status code greater than 300, the request URL, the status code and the response body
+// are logged by the Logger of the client.
+//
+// The function takes the following parameters:
+//   - url: a string value representing the URL to send the request to.
+//   - auth: a string value representing the authorization header to include in the request.
+//   - row: a map of strings to any type representing the data that will be included in the request body
+//   - printerror: deprecated and ignored, the errors are logged by the Logger of the client.
+//   - ch: a channel of type chan<- map[string]any to send the response body through.
+//   - chErr: a channel of type chan<- error to send any errors through.
+func (c *Client) PatchRequest(url string, auth string, row map[string]any, printerror bool, ch chan<- map[string]any, chErr chan<- error) {
+	_, err := c.Do(context.Background(), Request{Method: "PATCH", Path: url, Body: row, Auth: auth})
+	if err != nil {
 		ch <- nil
-		chErr <- errors.New(fmt.Sprintf("HTTP ERROR %v - MESSAGE: %v", resp.StatusCode, responseBody))
-	} else {
-		re := regexp.MustCompile(`[a-fA-F0-9]{8}-[a-fA-F0-9]{4}-[a-fA-F0-9]{4}-[a-fA-F0-9]{4}-[a-fA-F0-9]{12}`)
-		// Find the regular expression in the string
-		matches := re.FindString(url)
-
-		ch <- map[string]any{
-			"url": url,
-			"id":  matches,
-		}
-		chErr <- nil
+		chErr <- err
+		return
+	}
+	ch <- map[string]any{
+		"url": url,
+		"id":  guidRegexp.FindString(url),
 	}
+	chErr <- nil
 }
 
-// GetRequest sends a GET request to the specified URL with the given authorization header and returns the
-// response body as a map[string]any value through the given channel. If the printerror parameter is true
-// and the response has a status code greater than 300, it will also print the request URL and the status
-// code and response body. If the URL starts with "fakeurl", it will send a "fake" response through the
-// channel and return without making an actual HTTP request.
+// DeleteRequest sends a DELETE request to the specified URL with the given authorization header and sends the
+// error, nil if the row was deleted, through the given channel.
+// If the response has a status code greater than 300, the request URL, the status code and the response body
+// are logged by the Logger of the client.
 //
 // The function takes the following parameters:
 //   - url: a string value representing the URL to send the request to.
 //   - auth: a string value representing the authorization header to include in the request.
-//   - printerror: a boolean value indicating whether to print errors.
-//   - ch: a channel of type chan<- map[string]any to send the response body through.
+//   - printerror: deprecated and ignored, the errors are logged by the Logger of the client.
 //   - chErr: a channel of type chan<- error to send any errors through.
 //
 // Example:
 //
-//	ch := make(chan map[string]any)
-//	chErr := make(error)
-//	go GetRequest("https://myresource.com/data", "authtoken", true, ch, chErr)
-//	resp := <-ch
-//	fmt.Println(resp)
-func DeleteRequest(url string, auth string, printerror bool, chErr chan<- error) {
-	if checkFake(url) {
-		chErr <- nil
-		return
-	}
-
-	bearerToken := fmt.Sprintf("Bearer %v", auth)
-	client := &http.Client{}
-	req, _ := http.NewRequest("DELETE", url, nil)
-	req.Header.Add("Authorization", bearerToken)
-	resp, _ := client.Do(req)
-
-	var responseBody map[string]any
-	json.NewDecoder(resp.Body).Decode(&responseBody)
-
-	// If the request returned an error status code and `printerror` is true,
-	// print the error message to the console and send the error through the `chErr` channel.
-	if resp.StatusCode > 300 {
-		if printerror {
-			fmt.Printf("Request url: %v", url)
-			fmt.Printf("Statuscode: %v - %v", resp.StatusCode, responseBody)
-		}
-		chErr <- errors.New(fmt.Sprintf("HTTP ERROR %v - MESSAGE: %v", resp.StatusCode, responseBody))
-	} else {
-		chErr <- nil
-	}
+//	chErr := make(chan error)
+//	go DeleteRequest("https://myresource.com/data(123)", "authtoken", false, chErr)
+//	err := <-chErr
+//	fmt.Println(err)
+func (c *Client) DeleteRequest(url string, auth string, printerror bool, chErr chan<- error) {
+	_, err := c.Do(context.Background(), Request{Method: "DELETE", Path: url, Auth: auth})
+	chErr <- err
 }
 
-func PostBatch(url string, auth string, content string, boundary string, printerror bool, chErr chan<- error) {
-
-	contentType := fmt.Sprintf("multipart/mixed;boundary=%v", boundary)
-	bearerToken := fmt.Sprintf("Bearer %v", auth)
-	client := &http.Client{}
-	req, _ := http.NewRequest("POST", url+"/api/data/v9.1/$batch", strings.NewReader(content))
-	req.Header.Add("Content-Type", contentType)
-	req.Header.Add("Authorization", bearerToken)
-	req.Header.Add("MSCRM.BypassCustomPluginExecution", "true")
-	resp, _ := client.Do(req)
-
-	var responseBody map[string]any
-	json.NewDecoder(resp.Body).Decode(&responseBody)
-
-	fmt.Println(responseBody)
-
-	if resp.StatusCode == 429 {
-		retrySecsStr := resp.Header.Get("Retry-After")
-
-		fmt.Printf("Will retry after %v seconds", retrySecsStr)
-
-		retrySecs, err := strconv.ParseInt(retrySecsStr, 10, 64)
-		if err != nil {
-			fmt.Printf("Error during conversion: %v", err)
-			chErr <- err
-			return
-		}
-		time.Sleep(time.Second * time.Duration(retrySecs))
-		go PostBatch(url, auth, content, boundary, printerror, chErr)
-	}
-
-	if resp.StatusCode > 300 {
-		if printerror {
-			fmt.Printf("Request url: %v", url)
-			fmt.Printf("Statuscode: %v - %v", resp.StatusCode, responseBody)
-		}
-		chErr <- errors.New(fmt.Sprintf("HTTP ERROR %v - MESSAGE: %v", resp.StatusCode, responseBody))
-	} else {
-		chErr <- nil
-	}
+// PatchFileRequest sends a PATCH request with a binary body to the specified URL with the given authorization
+// header, as used to upload the content of a file or image column in a single request. If the response has a status code greater than
+// 300, the request URL, the status code and the response body are logged by the Logger of the client.
+//
+// The function takes the following parameters:
+//   - url: a string value representing the URL to send the request to.
+//   - auth: a string value representing the authorization header to include in the request.
+//   - fileName: a string value representing the name of the file.
+//   - content: a reader providing the content of the file.
+//   - chErr: a channel of type chan<- error to send any errors through.
+func (c *Client) PatchFileRequest(url string, auth string, fileName string, content io.Reader, chErr chan<- error) {
+	_, err := c.Do(context.Background(), Request{
+		Method: "PATCH",
+		Path:   url,
+		Headers: map[string]string{
+			"Content-Type":   "application/octet-stream",
+			"x-ms-file-name": fileName,
+		},
+		Body:      content,
+		Auth:      auth,
+		Operation: "UploadFile",
+	})
+	chErr <- err
 }
 
-// checkFake checks if a given URL is a "fake" URL.
-//
-// It takes two arguments:
-//   - url: a string representing the URL to check
+// GetFileRequest sends a GET request to the specified URL with the given authorization header and copies the
+// binary response body to the given writer, as used to download the content of a file or image column.
+// If the response has a status code greater than 300, the request URL, the status code and the response body
+// are logged by the Logger of the client.
 //
-// The return value is a boolean value indicating whether or not the URL is fake.
-//
-// Example:
-//
-//	isFake := checkFake("fakeurl.com")
-//	if isFake {
-//	  fmt.Println("URL is fake")
-//	}
-func checkFake(url string) bool {
-	if strings.HasPrefix(url, "fakeurl") {
-		fmt.Printf(url)
-		return true
-	}
-	return false
+// The function takes the following parameters:
+//   - url: a string value representing the URL to send the request to.
+//   - auth: a string value representing the authorization header to include in the request.
+//   - content: a writer where the content of the file is copied.
+//   - chErr: a channel of type chan<- error to send any errors through.
+func (c *Client) GetFileRequest(url string, auth string, content io.Writer, chErr chan<- error) {
+	_, err := c.Do(context.Background(), Request{Method: "GET", Path: url, Auth: auth, Operation: "DownloadFile", Output: content})
+	chErr <- err
+}
+
+// PostBatch sends the content of a $batch request to the organization URL with the given authorization header.
+// It calls SendBatch and sends its error through the given channel.
+func (c *Client) PostBatch(url string, auth string, content string, boundary string, printerror bool, chErr chan<- error) {
+	_, err := c.SendBatch(context.Background(), url, auth, content, boundary, RequestOptions{})
+	chErr <- err
 }
@@ -0,0 +1,14 @@
+//go:build !unix && !windows
+
+package requests
+
+import "os"
+
+// lockFile does nothing on the systems without file locks (e.g. js/wasm), where the cache is used by a single process.
+func lockFile(f *os.File) error {
+	return nil
+}
+
+func unlockFile(f *os.File) error {
+	return nil
+}
@@ -0,0 +1,118 @@
+package requests
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Values of the BypassBusinessLogicExecution option, the custom logic to bypass. Both can be combined,
+// e.g. BypassCustomSync + "," + BypassCustomAsync.
+const (
+	BypassCustomSync  = "CustomSync"
+	BypassCustomAsync = "CustomAsync"
+)
+
+// The 'RequestOptions' struct holds the optional Dataverse headers of a request.
+// It contains the following fields:
+//   - CallerObjectId: the Microsoft Entra object ID of the user to impersonate (CallerObjectId header)
+//   - CallerId: the systemuserid of the user to impersonate (MSCRMCallerID header), ignored if CallerObjectId is set
+//   - DetectDuplicates: whether the duplicate detection rules run on create and update
+//     (MSCRM.SuppressDuplicateDetection), unset to keep the default of the organization
+//   - BypassCustomPluginExecution: whether the synchronous custom plug-ins are bypassed
+//     (MSCRM.BypassCustomPluginExecution), unset to keep the default. Bypassing requires the prvBypassCustomPlugins
+//     privilege.
+//   - BypassBusinessLogicExecution: the custom logic to bypass, BypassCustomSync and/or BypassCustomAsync
+//     (MSCRM.BypassBusinessLogicExecution)
+//   - SolutionUniqueName: the unique name of the unmanaged solution the created components are added to
+//     (MSCRM.SolutionUniqueName)
+//   - Tag: a value passed to the plug-ins in the shared variable "tag" (MSCRM.tag)
+//
+// The options of a 'Client' are the defaults of its requests: the options of a request override the fields they set,
+// the booleans being set with 'Bool' (e.g. Bool(false) to run the plug-ins bypassed by default). A request setting
+// CallerObjectId or CallerId replaces the impersonation of the defaults.
+//
+// Example:
+//
+//	client := &Client{Options: RequestOptions{Tag: "integration", BypassCustomPluginExecution: Bool(true)}}
+//	resp, err := client.Do(ctx, Request{
+//	  Method:  "POST",
+//	  Url:     "https://myorg.crm.dynamics.com",
+//	  Path:    "/api/data/v9.1/accounts",
+//	  Body:    map[string]any{"name": "My Account"},
+//	  Options: RequestOptions{CallerObjectId: "00000000-0000-0000-0000-000000000001"},
+//	})
+type RequestOptions struct {
+	CallerObjectId               string
+	CallerId                     string
+	DetectDuplicates             *bool
+	BypassCustomPluginExecution  *bool
+	BypassBusinessLogicExecution string
+	SolutionUniqueName           string
+	Tag                          string
+}
+
+// Bool returns a pointer to a boolean value, to set the booleans of the 'RequestOptions'.
+func Bool(value bool) *bool {
+	return &value
+}
+
+// Merge returns the options with the fields set in other overriding them. The impersonation (CallerObjectId and
+// CallerId) is replaced as a whole when other sets either of them.
+func (o RequestOptions) Merge(other RequestOptions) RequestOptions {
+	if len(other.CallerObjectId) > 0 || len(other.CallerId) > 0 {
+		o.CallerObjectId = other.CallerObjectId
+		o.CallerId = other.CallerId
+	}
+	if other.DetectDuplicates != nil {
+		o.DetectDuplicates = other.DetectDuplicates
+	}
+	if other.BypassCustomPluginExecution != nil {
+		o.BypassCustomPluginExecution = other.BypassCustomPluginExecution
+	}
+	if len(other.BypassBusinessLogicExecution) > 0 {
+		o.BypassBusinessLogicExecution = other.BypassBusinessLogicExecution
+	}
+	if len(other.SolutionUniqueName) > 0 {
+		o.SolutionUniqueName = other.SolutionUniqueName
+	}
+	if len(other.Tag) > 0 {
+		o.Tag = other.Tag
+	}
+	return o
+}
+
+// INTERNAL METHODS
+
+// options returns the default options of the client.
+func (c *Client) options() RequestOptions {
+	if c == nil {
+		c = DefaultClient
+	}
+	return c.Options
+}
+
+// setHeaders sets the headers of the options on a request.
+func (o RequestOptions) setHeaders(header http.Header) {
+	switch {
+	case len(o.CallerObjectId) > 0:
+		header.Set("CallerObjectId", o.CallerObjectId)
+	case len(o.CallerId) > 0:
+		header.Set("MSCRMCallerID", o.CallerId)
+	}
+	if o.DetectDuplicates != nil {
+		header.Set("MSCRM.SuppressDuplicateDetection", strconv.FormatBool(!*o.DetectDuplicates))
+	}
+	if o.BypassCustomPluginExecution != nil {
+		header.Set("MSCRM.BypassCustomPluginExecution", strconv.FormatBool(*o.BypassCustomPluginExecution))
+	}
+	if len(o.BypassBusinessLogicExecution) > 0 {
+		header.Set("MSCRM.BypassBusinessLogicExecution", strings.ReplaceAll(o.BypassBusinessLogicExecution, " ", ""))
+	}
+	if len(o.SolutionUniqueName) > 0 {
+		header.Set("MSCRM.SolutionUniqueName", o.SolutionUniqueName)
+	}
+	if len(o.Tag) > 0 {
+		header.Set("MSCRM.tag", o.Tag)
+	}
+}
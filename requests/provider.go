@@ -0,0 +1,456 @@
+package requests
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Environment variables read by the credentials, the same as the Azure SDKs.
+const (
+	EnvTenantId            = "AZURE_TENANT_ID"
+	EnvClientId            = "AZURE_CLIENT_ID"
+	EnvClientSecret        = "AZURE_CLIENT_SECRET"
+	EnvCertificatePath     = "AZURE_CLIENT_CERTIFICATE_PATH"
+	EnvCertificatePassword = "AZURE_CLIENT_CERTIFICATE_PASSWORD"
+	EnvFederatedTokenFile  = "AZURE_FEDERATED_TOKEN_FILE"
+	EnvAuthorityHost       = "AZURE_AUTHORITY_HOST"
+	EnvIdentityEndpoint    = "IDENTITY_ENDPOINT"
+	EnvIdentityHeader      = "IDENTITY_HEADER"
+)
+
+// IMDSEndpoint is the token endpoint of the Azure Instance Metadata Service, used by the managed identities
+// of virtual machines and containers.
+const IMDSEndpoint = "http://169.254.169.254/metadata/identity/oauth2/token"
+
+// imdsProbeTimeout is the timeout of the first request to the IMDS endpoint, which doesn't answer outside Azure.
+var imdsProbeTimeout = time.Second
+
+// tokenRefreshMargin is the time before the expiration of a token from which a new token is requested.
+const tokenRefreshMargin = 5 * time.Minute
+
+// The 'AccessToken' struct is a token returned by a 'TokenProvider'.
+// It contains the following fields:
+//   - Token: the access token, sent as bearer token
+//   - ExpiresOn: the expiration time of the token, the zero time if unknown
+type AccessToken struct {
+	Token     string
+	ExpiresOn time.Time
+}
+
+// TokenProvider provides the access tokens of the requests. The providers of this package cache their token
+// until 5 minutes before its expiration, so they can be called before every request.
+type TokenProvider interface {
+	Token(ctx context.Context) (AccessToken, error)
+}
+
+// tokenCache holds the last token of a provider.
+type tokenCache struct {
+	mu    sync.Mutex
+	token AccessToken
+}
+
+// get returns the cached token, the one of the persistent cache, or a new one from fetch if they expire soon.
+func (c *tokenCache) get(ctx context.Context, persistent TokenCache, key CacheKey, fetch func(ctx context.Context) (AccessToken, error)) (token AccessToken, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if isValid(c.token) {
+		return c.token, nil
+	}
+	if persistent != nil {
+		if cached, ok, _ := persistent.Load(key); ok && isValid(AccessToken{Token: cached.AccessToken, ExpiresOn: cached.ExpiresOn}) {
+			c.token = AccessToken{Token: cached.AccessToken, ExpiresOn: cached.ExpiresOn}
+			return c.token, nil
+		}
+	}
+
+	if token, err = fetch(ctx); err != nil {
+		return
+	}
+	c.token = token
+	if persistent != nil {
+		persistent.Store(key, CachedToken{AccessToken: token.Token, ExpiresOn: token.ExpiresOn})
+	}
+	return
+}
+
+// isValid reports whether a token can be used, not expiring within the refresh margin.
+func isValid(token AccessToken) bool {
+	return len(token.Token) > 0 && (token.ExpiresOn.IsZero() || time.Until(token.ExpiresOn) > tokenRefreshMargin)
+}
+
+// tokenMiddleware sets the bearer token of the provider on the requests without an Authorization header.
+// Requests to the token endpoints are left untouched.
+func tokenMiddleware(provider TokenProvider) Middleware {
+	return func(next http.RoundTripper) http.RoundTripper {
+		return RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			if len(req.Header.Get("Authorization")) > 0 || req.Context().Value(authRequestKey{}) != nil {
+				return next.RoundTrip(req)
+			}
+			token, err := provider.Token(req.Context())
+			if err != nil {
+				return nil, err
+			}
+			req = req.Clone(req.Context())
+			setAuthorization(req, token.Token)
+			return next.RoundTrip(req)
+		})
+	}
+}
+
+// The 'StaticTokenProvider' struct provides a token acquired elsewhere, e.g. by the Azure CLI.
+// It contains the following fields:
+//   - AccessToken: the token
+type StaticTokenProvider struct {
+	AccessToken AccessToken
+}
+
+// Token returns the static token, or an error if it is expired.
+func (p StaticTokenProvider) Token(ctx context.Context) (AccessToken, error) {
+	if len(p.AccessToken.Token) == 0 {
+		return AccessToken{}, errors.New("Empty token")
+	}
+	if !p.AccessToken.ExpiresOn.IsZero() && time.Now().After(p.AccessToken.ExpiresOn) {
+		return AccessToken{}, errors.New("Expired token")
+	}
+	return p.AccessToken, nil
+}
+
+// The 'ClientSecretCredential' struct provides the tokens of an app registration authenticating with a secret.
+// It contains the following fields:
+//   - TenantId: the tenant ID
+//   - ClientId: the client ID
+//   - Secret: the client secret
+//   - Resource: the organization URL
+//   - Client: the 'Client' sending the token requests (authority host, transport), DefaultClient if nil
+//   - Cache: an optional 'TokenCache' sharing the token with the next processes
+//
+// Example:
+//
+//	client := &Client{TokenProvider: &ClientSecretCredential{
+//	  TenantId: "tenantid",
+//	  ClientId: "clientid",
+//	  Secret:   "secret",
+//	  Resource: "https://org.crm.dynamics.com",
+//	}}
+type ClientSecretCredential struct {
+	TenantId string
+	ClientId string
+	Secret   string
+	Resource string
+	Client   *Client
+	Cache    TokenCache
+
+	cache tokenCache
+}
+
+// Token returns a token from the v2.0 token endpoint.
+func (p *ClientSecretCredential) Token(ctx context.Context) (AccessToken, error) {
+	key := CacheKey{TenantId: p.TenantId, ClientId: p.ClientId, Resource: p.Resource}
+	return p.cache.get(ctx, p.Cache, key, func(ctx context.Context) (AccessToken, error) {
+		return readToken(p.Client.GetAuthorization(p.ClientId, p.Secret, p.TenantId, p.Resource))
+	})
+}
+
+// The 'ClientCertificateCredential' struct provides the tokens of an app registration authenticating with a
+// certificate, see GetAuthorizationWithCertificate.
+// It contains the following fields:
+//   - TenantId: the tenant ID
+//   - ClientId: the client ID
+//   - Certificate: the certificate, read from CertificatePath if empty
+//   - CertificatePath: the path of a PEM or PKCS#12 file, see LoadCertificate
+//   - CertificatePassword: the password of the PKCS#12 file
+//   - Resource: the organization URL
+//   - Client: the 'Client' sending the token requests (authority host, transport), DefaultClient if nil
+//   - Cache: an optional 'TokenCache' sharing the token with the next processes
+type ClientCertificateCredential struct {
+	TenantId            string
+	ClientId            string
+	Certificate         Certificate
+	CertificatePath     string
+	CertificatePassword string
+	Resource            string
+	Client              *Client
+	Cache               TokenCache
+
+	cache tokenCache
+}
+
+// Token returns a token from the v2.0 token endpoint.
+func (p *ClientCertificateCredential) Token(ctx context.Context) (AccessToken, error) {
+	key := CacheKey{TenantId: p.TenantId, ClientId: p.ClientId, Resource: p.Resource}
+	return p.cache.get(ctx, p.Cache, key, func(ctx context.Context) (token AccessToken, err error) {
+		cert := p.Certificate
+		if cert.Key == nil && len(p.CertificatePath) > 0 {
+			if cert, err = LoadCertificate(p.CertificatePath, p.CertificatePassword); err != nil {
+				return
+			}
+		}
+		return readToken(p.Client.GetAuthorizationWithCertificate(p.ClientId, cert, p.TenantId, p.Resource))
+	})
+}
+
+// The 'WorkloadIdentityCredential' struct provides the tokens of a federated workload identity, e.g. of a
+// Kubernetes service account: the token of the service account, read from a file, is exchanged for an access token.
+// It contains the following fields:
+//   - TenantId: the tenant ID, AZURE_TENANT_ID if empty
+//   - ClientId: the client ID, AZURE_CLIENT_ID if empty
+//   - TokenFile: the path of the service account token, AZURE_FEDERATED_TOKEN_FILE if empty. It is read again
+//     for every token request, as it is rotated by the kubelet.
+//   - Resource: the organization URL
+//   - Client: the 'Client' sending the token requests (authority host, transport), DefaultClient if nil
+type WorkloadIdentityCredential struct {
+	TenantId  string
+	ClientId  string
+	TokenFile string
+	Resource  string
+	Client    *Client
+
+	cache tokenCache
+}
+
+// Token exchanges the service account token for an access token.
+func (p *WorkloadIdentityCredential) Token(ctx context.Context) (AccessToken, error) {
+	return p.cache.get(ctx, nil, CacheKey{}, func(ctx context.Context) (token AccessToken, err error) {
+		tenant, client, tokenFile := orEnv(p.TenantId, EnvTenantId), orEnv(p.ClientId, EnvClientId), orEnv(p.TokenFile, EnvFederatedTokenFile)
+		if len(tenant) == 0 || len(client) == 0 || len(tokenFile) == 0 {
+			return token, errors.New("Workload identity not configured")
+		}
+		assertion, err := os.ReadFile(tokenFile)
+		if err != nil {
+			return
+		}
+		return readToken(p.Client.postToken(ctx, tenant, p.Resource, url.Values{
+			"grant_type":            {"client_credentials"},
+			"client_id":             {client},
+			"client_assertion_type": {ClientAssertionType},
+			"client_assertion":      {strings.TrimSpace(string(assertion))},
+			"scope":                 {Scope(p.Resource)},
+		}))
+	})
+}
+
+// The 'ManagedIdentityCredential' struct provides the tokens of the managed identity of an Azure resource.
+// The App Service and Functions endpoint is used when the IDENTITY_ENDPOINT and IDENTITY_HEADER environment
+// variables are set, the Instance Metadata Service (IMDS) otherwise.
+// It contains the following fields:
+//   - ClientId: the client ID of a user-assigned identity, the system-assigned identity if empty
+//   - Resource: the organization URL
+//   - Endpoint: the IMDS token endpoint, IMDSEndpoint if empty
+//   - Client: the 'Client' sending the token requests, DefaultClient if nil
+//
+// The first request to the IMDS endpoint is a probe with a timeout of one second. If it gets no response, the
+// credential is unavailable and fails immediately afterwards, so that a 'ChainedTokenProvider' moves on quickly
+// outside Azure.
+type ManagedIdentityCredential struct {
+	ClientId string
+	Resource string
+	Endpoint string
+	Client   *Client
+
+	cache tokenCache
+
+	mu          sync.Mutex
+	probed      bool
+	unavailable error
+}
+
+// Token returns a token from the managed identity endpoint.
+func (p *ManagedIdentityCredential) Token(ctx context.Context) (AccessToken, error) {
+	return p.cache.get(ctx, nil, CacheKey{}, func(ctx context.Context) (token AccessToken, err error) {
+		endpoint, query := p.Endpoint, url.Values{"resource": {strings.TrimSuffix(p.Resource, "/")}}
+		header := http.Header{}
+		if len(os.Getenv(EnvIdentityEndpoint)) > 0 && len(os.Getenv(EnvIdentityHeader)) > 0 {
+			endpoint = os.Getenv(EnvIdentityEndpoint)
+			query.Set("api-version", "2019-08-01")
+			header.Set("X-IDENTITY-HEADER", os.Getenv(EnvIdentityHeader))
+		} else {
+			if len(endpoint) == 0 {
+				endpoint = IMDSEndpoint
+			}
+			query.Set("api-version", "2018-02-01")
+			header.Set("Metadata", "true")
+		}
+		if len(p.ClientId) > 0 {
+			query.Set("client_id", p.ClientId)
+		}
+
+		// The IMDS endpoint is probed with a short timeout until it answers once.
+		p.mu.Lock()
+		probe, unavailable := !p.probed && header.Get("Metadata") == "true", p.unavailable
+		p.mu.Unlock()
+		if unavailable != nil {
+			return token, unavailable
+		}
+		parent := ctx
+		if probe {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, imdsProbeTimeout)
+			defer cancel()
+		}
+
+		ctx = context.WithValue(ctx, authRequestKey{}, true)
+		ctx, scope := p.Client.newOperation(ctx, operation{name: "Authenticate"})
+		defer func() { scope.end(err) }()
+		req, err := http.NewRequestWithContext(ctx, "GET", endpoint+"?"+query.Encode(), nil)
+		if err != nil {
+			return
+		}
+		req.Header = header
+		resp, err := scope.send(p.Client.httpClient(), req)
+		if probe && parent.Err() == nil {
+			p.mu.Lock()
+			if err != nil {
+				p.unavailable = fmt.Errorf("The managed identity endpoint is unavailable: %w", err)
+				err = p.unavailable
+			}
+			p.probed = err == nil
+			p.mu.Unlock()
+		}
+		if err != nil {
+			return
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode > 300 {
+			authErr := &AuthenticationError{StatusCode: resp.StatusCode}
+			json.NewDecoder(resp.Body).Decode(authErr)
+			return token, authErr
+		}
+		// The managed identity endpoints return the expiration as strings.
+		var response struct {
+			AccessToken string      `json:"access_token"`
+			ExpiresOn   json.Number `json:"expires_on"`
+			ExpiresIn   json.Number `json:"expires_in"`
+		}
+		if err = json.NewDecoder(resp.Body).Decode(&response); err != nil {
+			return
+		}
+		token.Token = response.AccessToken
+		if expiresOn, errParse := response.ExpiresOn.Int64(); errParse == nil {
+			token.ExpiresOn = time.Unix(expiresOn, 0)
+		} else if expiresIn, errParse := response.ExpiresIn.Int64(); errParse == nil {
+			token.ExpiresOn = time.Now().Add(time.Duration(expiresIn) * time.Second)
+		}
+		return
+	})
+}
+
+// The 'ChainedTokenProvider' struct tries its providers in order and returns the token of the first one succeeding.
+// The last provider succeeding is used first for the next tokens.
+// It contains the following fields:
+//   - Providers: the providers
+type ChainedTokenProvider struct {
+	Providers []TokenProvider
+
+	mu      sync.Mutex
+	current TokenProvider
+}
+
+// Token returns the token of the first provider succeeding, or the errors of all the providers.
+func (p *ChainedTokenProvider) Token(ctx context.Context) (token AccessToken, err error) {
+	p.mu.Lock()
+	current := p.current
+	p.mu.Unlock()
+	if current != nil {
+		if token, err = current.Token(ctx); err == nil {
+			return
+		}
+	}
+
+	var errs []error
+	for _, provider := range p.Providers {
+		if token, err = provider.Token(ctx); err == nil {
+			p.mu.Lock()
+			p.current = provider
+			p.mu.Unlock()
+			return
+		}
+		errs = append(errs, err)
+	}
+	if len(errs) == 0 {
+		return token, errors.New("No token provider")
+	}
+	return token, fmt.Errorf("No token provider succeeded: %w", errors.Join(errs...))
+}
+
+// NewEnvironmentTokenProvider returns a chain of the credentials configured by the environment variables of the
+// Azure SDKs, tried in order:
+//   - a 'ClientSecretCredential' if AZURE_TENANT_ID, AZURE_CLIENT_ID and AZURE_CLIENT_SECRET are set
+//   - a 'ClientCertificateCredential' if AZURE_TENANT_ID, AZURE_CLIENT_ID and AZURE_CLIENT_CERTIFICATE_PATH
+//     (and AZURE_CLIENT_CERTIFICATE_PASSWORD) are set
+//   - a 'WorkloadIdentityCredential' if AZURE_TENANT_ID, AZURE_CLIENT_ID and AZURE_FEDERATED_TOKEN_FILE are set
+//   - a 'ManagedIdentityCredential', user-assigned if AZURE_CLIENT_ID is set
+//
+// AZURE_AUTHORITY_HOST overrides the authority host of the client. The client sends the token requests,
+// DefaultClient if nil.
+//
+// Example:
+//
+//	client := &Client{}
+//	client.TokenProvider = NewEnvironmentTokenProvider("https://org.crm.dynamics.com", client)
+func NewEnvironmentTokenProvider(resource string, client *Client) *ChainedTokenProvider {
+	if client == nil {
+		client = DefaultClient
+	}
+	if authority := os.Getenv(EnvAuthorityHost); len(authority) > 0 {
+		// The copy only sends token requests, it has no token provider.
+		client = &Client{
+			HTTPClient:     client.HTTPClient,
+			Transport:      client.Transport,
+			Middlewares:    client.Middlewares,
+			Logger:         client.Logger,
+			TracerProvider: client.TracerProvider,
+			MeterProvider:  client.MeterProvider,
+			AuthorityHost:  authority,
+			ApiVersion:     client.ApiVersion,
+			Options:        client.Options,
+		}
+	}
+
+	tenant, clientId := os.Getenv(EnvTenantId), os.Getenv(EnvClientId)
+	chain := &ChainedTokenProvider{}
+	if len(tenant) > 0 && len(clientId) > 0 {
+		if secret := os.Getenv(EnvClientSecret); len(secret) > 0 {
+			chain.Providers = append(chain.Providers, &ClientSecretCredential{
+				TenantId: tenant, ClientId: clientId, Secret: secret, Resource: resource, Client: client,
+			})
+		}
+		if path := os.Getenv(EnvCertificatePath); len(path) > 0 {
+			chain.Providers = append(chain.Providers, &ClientCertificateCredential{
+				TenantId: tenant, ClientId: clientId, CertificatePath: path, CertificatePassword: os.Getenv(EnvCertificatePassword),
+				Resource: resource, Client: client,
+			})
+		}
+		if tokenFile := os.Getenv(EnvFederatedTokenFile); len(tokenFile) > 0 {
+			chain.Providers = append(chain.Providers, &WorkloadIdentityCredential{
+				TenantId: tenant, ClientId: clientId, TokenFile: tokenFile, Resource: resource, Client: client,
+			})
+		}
+	}
+	chain.Providers = append(chain.Providers, &ManagedIdentityCredential{ClientId: clientId, Resource: resource, Client: client})
+	return chain
+}
+
+// readToken converts a token response to an 'AccessToken'.
+func readToken(response TokenResponse, err error) (AccessToken, error) {
+	if err != nil {
+		return AccessToken{}, err
+	}
+	return AccessToken{Token: response.AccessToken, ExpiresOn: response.ExpiresOn}, nil
+}
+
+func orEnv(value string, key string) string {
+	if len(value) > 0 {
+		return value
+	}
+	return os.Getenv(key)
+}
@@ -0,0 +1,289 @@
+package requests
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The 'Request' struct describes a request sent by 'Do'.
+// It contains the following fields:
+//   - Method: the HTTP method (e.g. "GET", "POST")
+//   - Url: the organization URL (e.g. "https://myorg.crm.dynamics.com"), empty if Path is an absolute URL
+//   - Path: the path of the request appended to Url, optionally with a query (e.g. "/api/data/v9.1/contacts(123)")
+//   - Query: the query parameters appended to the query of Path. The OData system query options (e.g. "$select")
+//     keep their "$" prefix.
+//   - Headers: the additional headers of the request (e.g. "Prefer")
+//   - Body: the body of the request, nil for no body. An io.Reader, a []byte or a string is sent as is, any other
+//     value is marshalled as JSON and sent with the "application/json" content type.
+//   - Auth: the bearer token of the request, empty to use the TokenProvider of the client
+//   - Operation: the name of the dataverse operation recorded by the telemetry (e.g. "ExecuteAction"), read from
+//     the method and the path if empty
+//   - Options: the 'RequestOptions' of the request (impersonation, MSCRM headers), merged with the options of the client
+//   - Output: a writer where the body of a successful response is copied instead of being read in memory,
+//     as used to download the content of a file
+type Request struct {
+	Method    string
+	Url       string
+	Path      string
+	Query     url.Values
+	Headers   map[string]string
+	Body      any
+	Auth      string
+	Operation string
+	Options   RequestOptions
+	Output    io.Writer
+}
+
+// The 'Response' struct is the response of a request sent by 'Do'.
+// It contains the following fields:
+//   - StatusCode: the HTTP status code
+//   - Header: the headers of the response
+//   - Body: the raw body of the response, empty if it was copied to the Output of the request
+//   - Value: the body decoded from JSON, its numbers as json.Number, nil if the body is empty or not JSON
+//     (e.g. a batch response)
+type Response struct {
+	StatusCode int
+	Header     http.Header
+	Body       []byte
+	Value      map[string]any
+}
+
+// guidRegexp matches a GUID, e.g. the ID of a row.
+var guidRegexp = regexp.MustCompile(`[a-fA-F0-9]{8}-[a-fA-F0-9]{4}-[a-fA-F0-9]{4}-[a-fA-F0-9]{4}-[a-fA-F0-9]{12}`)
+
+// EntityUrl returns the URL of the row created or updated by the request, read from the OData-EntityId header.
+// It is empty for the requests which don't create a row (e.g. associations).
+func (r *Response) EntityUrl() string {
+	return r.Header.Get("OData-EntityId")
+}
+
+// EntityId returns the ID of the row created or updated by the request, read from the OData-EntityId header.
+// It is empty for the requests which don't create a row (e.g. associations).
+func (r *Response) EntityId() string {
+	return guidRegexp.FindString(r.EntityUrl())
+}
+
+// Do sends a request and returns its response. It is the primitive the other functions of the package are built on.
+//
+// It takes two arguments:
+//   - ctx: the context of the request, cancelling it cancels the request
+//   - request: a 'Request' describing the request
+//
+// The return value is a pointer to a 'Response', and an error value, which will be nil if the function completed
+// successfully. The error is the error of the transport (e.g. the network is down), an HTTP ERROR if the response
+// has a status code greater than 300, in which case the response is returned as well, or an error if the body of a
+// successful response is not valid JSON.
+//
+// Example:
+//
+//	resp, err := client.Do(ctx, Request{
+//	  Method: "GET",
+//	  Url:    "https://myorg.crm.dynamics.com",
+//	  Path:   "/api/data/v9.1/contacts",
+//	  Query:  url.Values{"$select": {"fullname"}, "$top": {"10"}},
+//	  Auth:   "authtoken",
+//	})
+//	if err != nil {
+//	  log.Fatal(err)
+//	}
+//	fmt.Println(resp.Value["value"])
+func (c *Client) Do(ctx context.Context, request Request) (response *Response, err error) {
+	rawURL := request.Url + request.Path
+	if len(request.Query) > 0 {
+		separator := "?"
+		if strings.Contains(rawURL, "?") {
+			separator = "&"
+		}
+		rawURL += separator + encodeQuery(request.Query)
+	}
+
+	body, data, contentType, err := readBody(request.Body)
+	if err != nil {
+		c.logError("cannot marshal request body", "url", redactURL(rawURL), "error", err)
+		return
+	}
+
+	op := readOperation(request.Operation, request.Method, rawURL)
+	if op.name == "Batch" {
+		op.batchSize = bytes.Count(data, []byte("Content-ID:"))
+	}
+	ctx, scope := c.startOperation(ctx, op)
+	defer func() { scope.end(err) }()
+	scope.setBatchSize(op.batchSize)
+
+	req, err := http.NewRequestWithContext(ctx, request.Method, rawURL, body)
+	if err != nil {
+		return
+	}
+	setAuthorization(req, request.Auth)
+	if len(contentType) > 0 {
+		req.Header.Set("Content-Type", contentType)
+	}
+	c.options().Merge(request.Options).setHeaders(req.Header)
+	for key, value := range request.Headers {
+		req.Header.Set(key, value)
+	}
+
+	resp, err := scope.send(c.httpClient(), req)
+	if err != nil {
+		c.logError("request failed", "method", request.Method, "url", redactURL(rawURL), "error", err)
+		return
+	}
+	defer resp.Body.Close()
+
+	response = &Response{StatusCode: resp.StatusCode, Header: resp.Header}
+	if request.Output != nil && resp.StatusCode <= 300 {
+		_, err = io.Copy(request.Output, resp.Body)
+		return
+	}
+	if response.Body, err = io.ReadAll(resp.Body); err != nil {
+		return
+	}
+	response.Value, err = readJSON(response)
+
+	// If the request returned an error status code, log the error message.
+	if resp.StatusCode > 300 {
+		c.logError("request failed", "method", request.Method, "url", redactURL(rawURL), "status", resp.StatusCode, "response", response.Value)
+		err = errors.New(fmt.Sprintf("HTTP ERROR %v - MESSAGE: %v", resp.StatusCode, response.Value))
+		return
+	}
+	if err != nil {
+		c.logError("invalid response", "method", request.Method, "url", redactURL(rawURL), "status", resp.StatusCode, "error", err)
+	}
+	return
+}
+
+// SendBatch sends the content of a $batch request to the organization URL. A throttled batch (429) is sent again
+// after the time of the Retry-After header. The headers of the options apply to every operation of the batch.
+//
+// It takes the following arguments:
+//   - ctx: the context of the request
+//   - orgUrl: the organization URL
+//   - auth: the bearer token of the request
+//   - content: the multipart content of the batch
+//   - boundary: the boundary of the multipart content
+//   - options: the 'RequestOptions' of the batch, e.g. to bypass the custom plug-ins
+func (c *Client) SendBatch(ctx context.Context, orgUrl string, auth string, content string, boundary string, options RequestOptions) (response *Response, err error) {
+	// The throttled batches sent again are retries of the same operation.
+	ctx, scope := c.startOperation(ctx, operation{name: "Batch"})
+	defer func() { scope.end(err) }()
+	for i := 0; ; i++ {
+		if i > 0 {
+			scope.resend()
+		}
+		response, err = c.Do(ctx, Request{
+			Method: "POST",
+			Url:    strings.TrimSuffix(orgUrl, "/"),
+			Path:   c.ApiPath() + "/$batch",
+			Headers: map[string]string{
+				"Content-Type": fmt.Sprintf("multipart/mixed;boundary=%v", boundary),
+			},
+			Body:    content,
+			Auth:    auth,
+			Options: options,
+		})
+		if response == nil || response.StatusCode != http.StatusTooManyRequests {
+			return
+		}
+
+		retrySecsStr := response.Header.Get("Retry-After")
+		c.logger().Warn("batch throttled, will retry", "url", redactURL(orgUrl), "retry_after", retrySecsStr)
+
+		retrySecs, errParse := strconv.ParseInt(retrySecsStr, 10, 64)
+		if errParse != nil {
+			c.logError("cannot parse Retry-After header", "url", redactURL(orgUrl), "retry_after", retrySecsStr, "error", errParse)
+			err = errParse
+			return
+		}
+		select {
+		case <-ctx.Done():
+			err = ctx.Err()
+			return
+		case <-time.After(time.Second * time.Duration(retrySecs)):
+		}
+	}
+}
+
+// INTERNAL METHODS
+
+// readBody returns the reader of the body of a request, its content unless it is a reader, and its content type.
+func readBody(value any) (body io.Reader, data []byte, contentType string, err error) {
+	switch v := value.(type) {
+	case nil:
+		return
+	case io.Reader:
+		return v, nil, "", nil
+	case []byte:
+		data = v
+	case string:
+		data = []byte(v)
+	default:
+		if data, err = json.Marshal(v); err != nil {
+			return
+		}
+		contentType = "application/json"
+	}
+	return bytes.NewReader(data), data, contentType, nil
+}
+
+// encodeQuery encodes the query parameters sorted by key, keeping the "$" prefix of the OData system query options.
+func encodeQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var parts []string
+	for _, key := range keys {
+		escapedKey := strings.Replace(url.QueryEscape(key), "%24", "$", 1)
+		for _, value := range query[key] {
+			parts = append(parts, escapedKey+"="+url.QueryEscape(value))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// readJSON decodes the JSON body of a response, nil if the body is empty or multipart (e.g. a batch response).
+// The numbers are decoded as json.Number, so the decimal and currency columns keep their precision.
+// An error response which is not JSON (e.g. from a gateway) is returned as the "message" of the body.
+func readJSON(response *Response) (value map[string]any, err error) {
+	if len(bytes.TrimSpace(response.Body)) == 0 {
+		return
+	}
+	isJson := !strings.HasPrefix(response.Header.Get("Content-Type"), "multipart/")
+
+	if !isJson || unmarshalNumber(response.Body, &value) != nil {
+		if response.StatusCode > 300 {
+			return map[string]any{"message": string(response.Body)}, nil
+		}
+		if isJson {
+			return nil, fmt.Errorf("Invalid JSON response: %.100s", response.Body)
+		}
+	}
+	return
+}
+
+// unmarshalNumber decodes JSON data like json.Unmarshal, decoding the numbers as json.Number instead of float64.
+func unmarshalNumber(data []byte, v any) (err error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err = decoder.Decode(v); err != nil {
+		return
+	}
+	if _, err = decoder.Token(); err != io.EOF {
+		return errors.New("invalid character after top-level value")
+	}
+	return nil
+}
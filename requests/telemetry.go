@@ -0,0 +1,309 @@
+package requests
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/metric"
+	metricnoop "go.opentelemetry.io/otel/metric/noop"
+	"go.opentelemetry.io/otel/trace"
+	tracenoop "go.opentelemetry.io/otel/trace/noop"
+)
+
+// instrumentationName is the name of the tracer and the meter of the package.
+const instrumentationName = "github.com/emaporta/dataversego"
+
+// Attributes recorded on the spans and the metrics of the requests.
+const (
+	OperationAttribute  = attribute.Key("dataverse.operation")
+	TableAttribute      = attribute.Key("dataverse.table")
+	BatchSizeAttribute  = attribute.Key("dataverse.batch.size")
+	RetryCountAttribute = attribute.Key("dataverse.retry.count")
+	StatusAttribute     = attribute.Key("http.response.status_code")
+)
+
+// Metrics recorded for the requests.
+const (
+	// DurationMetric is the histogram of the duration of the operations in seconds, retries included.
+	DurationMetric = "dataverse.client.operation.duration"
+	// ThrottledMetric is the counter of the responses throttled by the service (429).
+	ThrottledMetric = "dataverse.client.throttled"
+)
+
+// The 'operation' struct describes the dataverse operation performed by a request.
+type operation struct {
+	name      string
+	table     string
+	batchSize int
+}
+
+// readOperation returns the dataverse operation of a request from its method and url.
+//
+// Example:
+//
+//	op := readOperation("", "GET", "https://url.crm.dynamics.com/api/data/v9.1/accounts(123)")
+//	fmt.Println(op.name, op.table) // Retrieve accounts
+func readOperation(name string, method string, rawURL string) (op operation) {
+	op.name = method
+	parsed, err := url.Parse(rawURL)
+	if err != nil {
+		return
+	}
+	_, path, found := strings.Cut(parsed.Path, "/api/data/")
+	if !found {
+		return
+	}
+	// The first segment is the version of the api.
+	segments := strings.Split(path, "/")[1:]
+	if len(segments) == 0 {
+		return
+	}
+
+	op.table = strings.SplitN(segments[0], "(", 2)[0]
+	last := segments[len(segments)-1]
+	switch {
+	case len(name) > 0:
+		op.name = name
+	case last == "$batch":
+		op.name = "Batch"
+	case last == "$ref" && method == http.MethodDelete:
+		op.name = "Disassociate"
+	case last == "$ref":
+		op.name = "Associate"
+	case method == http.MethodGet && isFunctionCall(last):
+		op.name = "ExecuteFunction"
+	case method == http.MethodGet && strings.HasSuffix(last, ")"):
+		op.name = "Retrieve"
+	case method == http.MethodGet:
+		op.name = "RetrieveMultiple"
+	case method == http.MethodPost:
+		op.name = "Create"
+	case method == http.MethodPatch:
+		op.name = "Update"
+	case method == http.MethodDelete:
+		op.name = "Delete"
+	}
+
+	// Unbound functions and actions are not related to a table.
+	if (op.name == "ExecuteFunction" || op.name == "ExecuteAction" || op.name == "Batch") && len(segments) == 1 {
+		op.table = ""
+	}
+	return
+}
+
+// isFunctionCall reports whether a path segment is a function call rather than an entry (e.g. "accounts(123)").
+func isFunctionCall(segment string) bool {
+	return strings.HasPrefix(segment, "Microsoft.Dynamics.CRM.") || strings.HasSuffix(segment, "()") || strings.Contains(segment, "=@p")
+}
+
+// The 'operationScope' struct records a dataverse operation, from its first request to the read of its last
+// response. The requests sent with its context (retries, throttled batches, metadata lookups) are part of it.
+type operationScope struct {
+	mu        sync.Mutex
+	attrs     []attribute.KeyValue
+	span      trace.Span
+	start     time.Time
+	refs      int
+	requests  int
+	attempts  int
+	throttled int
+	status    int
+	telemetry *instruments
+}
+
+// scopeKey is the context key of the operation of a request.
+type scopeKey struct{}
+
+// The 'instruments' struct holds the tracer and the metrics of a client, created once per client.
+type instruments struct {
+	tracer    trace.Tracer
+	duration  metric.Float64Histogram
+	throttled metric.Int64Counter
+}
+
+// tracerProvider returns the tracer provider of the client, a no-op provider if nil.
+func (c *Client) tracerProvider() trace.TracerProvider {
+	if c != nil && c.TracerProvider != nil {
+		return c.TracerProvider
+	}
+	return tracenoop.NewTracerProvider()
+}
+
+// meterProvider returns the meter provider of the client, a no-op provider if nil.
+func (c *Client) meterProvider() metric.MeterProvider {
+	if c != nil && c.MeterProvider != nil {
+		return c.MeterProvider
+	}
+	return metricnoop.NewMeterProvider()
+}
+
+// telemetry returns the tracer and the metrics of the client, created on first use.
+func (c *Client) telemetry() *instruments {
+	if c == nil {
+		c = DefaultClient
+	}
+	c.telemetryOnce.Do(func() {
+		meter := c.meterProvider().Meter(instrumentationName)
+		duration, _ := meter.Float64Histogram(DurationMetric,
+			metric.WithUnit("s"),
+			metric.WithDescription("Duration of the dataverse operations, retries included."))
+		throttled, _ := meter.Int64Counter(ThrottledMetric,
+			metric.WithUnit("{response}"),
+			metric.WithDescription("Number of responses throttled by the service."))
+		c.instruments = &instruments{
+			tracer:    c.tracerProvider().Tracer(instrumentationName),
+			duration:  duration,
+			throttled: throttled,
+		}
+	})
+	return c.instruments
+}
+
+// StartOperation starts a dataverse operation made of several requests, such as a create and the metadata lookups
+// it needs. The requests sent with the returned context are recorded in the span and the duration of the operation
+// instead of their own, until EndOperation is called. When the context already records an operation, it is
+// returned as is and the requests are part of the enclosing operation.
+//
+// It takes the following arguments:
+//   - ctx: the context of the operation
+//   - name: the name of the operation (e.g. "CreateUpdate")
+//   - table: the table of the operation, empty if it is not related to a table
+//
+// Example:
+//
+//	ctx := client.StartOperation(context.Background(), "CreateUpdate", "accounts")
+//	_, err := client.Do(ctx, Request{Method: "GET", Url: orgUrl, Path: client.ApiPath() + "/EntityDefinitions"})
+//	if err == nil {
+//	  _, err = client.Do(ctx, Request{Method: "POST", Url: orgUrl, Path: client.ApiPath() + "/accounts", Body: row})
+//	}
+//	EndOperation(ctx, err)
+func (c *Client) StartOperation(ctx context.Context, name string, table string) context.Context {
+	ctx, _ = c.startOperation(ctx, operation{name: name, table: table})
+	return ctx
+}
+
+// EndOperation ends the operation started by 'StartOperation' on the context, with its error, recording its span
+// and its duration. It does nothing if the context records no operation.
+func EndOperation(ctx context.Context, err error) {
+	if scope, ok := ctx.Value(scopeKey{}).(*operationScope); ok {
+		scope.end(err)
+	}
+}
+
+// startOperation returns a context recording an operation, joining the operation of the context if any.
+func (c *Client) startOperation(ctx context.Context, op operation) (context.Context, *operationScope) {
+	if scope, ok := ctx.Value(scopeKey{}).(*operationScope); ok {
+		scope.mu.Lock()
+		scope.refs++
+		scope.mu.Unlock()
+		return ctx, scope
+	}
+	return c.newOperation(ctx, op)
+}
+
+// newOperation returns a context recording a new operation, a child of the operation of the context if any.
+func (c *Client) newOperation(ctx context.Context, op operation) (context.Context, *operationScope) {
+	telemetry := c.telemetry()
+	scope := &operationScope{attrs: []attribute.KeyValue{OperationAttribute.String(op.name)}, refs: 1, telemetry: telemetry}
+	if len(op.table) > 0 {
+		scope.attrs = append(scope.attrs, TableAttribute.String(op.table))
+	}
+	ctx, scope.span = telemetry.tracer.Start(ctx, fmt.Sprintf("dataverse %v", op.name),
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(scope.attrs...))
+	scope.start = time.Now()
+	return context.WithValue(ctx, scopeKey{}, scope), scope
+}
+
+// send sends a request of the operation with an HTTP client, recording its method, url and status code on the
+// span of the operation.
+func (s *operationScope) send(client *http.Client, req *http.Request) (resp *http.Response, err error) {
+	s.mu.Lock()
+	s.requests++
+	s.mu.Unlock()
+
+	s.span.SetAttributes(
+		attribute.String("http.request.method", req.Method),
+		attribute.String("url.full", redactURL(req.URL.String())))
+	resp, err = client.Do(req)
+	if err == nil {
+		s.mu.Lock()
+		s.status = resp.StatusCode
+		s.mu.Unlock()
+	}
+	return
+}
+
+// setBatchSize records the number of operations of a batch.
+func (s *operationScope) setBatchSize(size int) {
+	if size > 0 {
+		s.span.SetAttributes(BatchSizeAttribute.Int(size))
+	}
+}
+
+// resend records that the last request of the operation is sent again, its next attempt being a retry.
+func (s *operationScope) resend() {
+	s.mu.Lock()
+	s.requests--
+	s.mu.Unlock()
+}
+
+// end ends a request of the operation, and the operation with its span and duration once all its requests ended.
+func (s *operationScope) end(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.refs--; s.refs > 0 {
+		return
+	}
+
+	ctx := trace.ContextWithSpan(context.Background(), s.span)
+	attrs := s.attrs
+	if s.attempts > 0 {
+		s.span.SetAttributes(RetryCountAttribute.Int(s.attempts - s.requests))
+	}
+	if s.throttled > 0 {
+		s.telemetry.throttled.Add(ctx, int64(s.throttled), metric.WithAttributes(attrs...))
+	}
+	if s.status > 0 {
+		attrs = append(attrs, StatusAttribute.Int(s.status))
+		s.span.SetAttributes(StatusAttribute.Int(s.status))
+	}
+	switch {
+	case s.status >= 400:
+		s.span.SetStatus(codes.Error, http.StatusText(s.status))
+	case err != nil:
+		s.span.RecordError(err)
+		s.span.SetStatus(codes.Error, err.Error())
+	}
+	s.telemetry.duration.Record(ctx, time.Since(s.start).Seconds(), metric.WithAttributes(attrs...))
+	s.span.End()
+}
+
+// attemptsMiddleware counts the attempts of the requests of an operation and its throttled responses, recording
+// an event on the span of the operation for every throttled response.
+func attemptsMiddleware(next http.RoundTripper) http.RoundTripper {
+	return RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		resp, err := next.RoundTrip(req)
+
+		scope, ok := req.Context().Value(scopeKey{}).(*operationScope)
+		if !ok {
+			return resp, err
+		}
+		scope.mu.Lock()
+		defer scope.mu.Unlock()
+		scope.attempts++
+		if err == nil && resp.StatusCode == http.StatusTooManyRequests {
+			scope.throttled++
+			scope.span.AddEvent("throttled",
+				trace.WithAttributes(attribute.String("retry_after", resp.Header.Get("Retry-After"))))
+		}
+		return resp, err
+	})
+}
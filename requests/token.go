@@ -0,0 +1,183 @@
+package requests
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Authority hosts of the Microsoft identity platform, for the public and the sovereign clouds.
+const (
+	// AuthorityPublic is the authority host of the public cloud (and GCC).
+	AuthorityPublic = "https://login.microsoftonline.com"
+	// AuthorityUSGovernment is the authority host of the US Government clouds (GCC High and DoD).
+	AuthorityUSGovernment = "https://login.microsoftonline.us"
+	// AuthorityChina is the authority host of the China cloud operated by 21Vianet.
+	AuthorityChina = "https://login.chinacloudapi.cn"
+)
+
+// The 'TokenResponse' struct is the response of the token endpoint.
+// It contains the following fields:
+//   - AccessToken: the access token, sent as bearer token to the organization
+//   - TokenType: the type of the token, "Bearer"
+//   - ExpiresIn: the validity of the token in seconds
+//   - ExpiresOn: the expiration time of the token, computed from ExpiresIn when the response is received
+//   - Scope: the scopes of the token
+//   - RefreshToken: the refresh token, only returned by the delegated flows
+type TokenResponse struct {
+	AccessToken  string    `json:"access_token"`
+	TokenType    string    `json:"token_type"`
+	ExpiresIn    int64     `json:"expires_in"`
+	ExpiresOn    time.Time `json:"-"`
+	Scope        string    `json:"scope,omitempty"`
+	RefreshToken string    `json:"refresh_token,omitempty"`
+}
+
+// The 'AuthenticationError' struct is the error returned by the token endpoint.
+// It contains the following fields:
+//   - StatusCode: the status code of the response
+//   - Code: the OAuth error code (e.g. "invalid_client")
+//   - Description: the description of the error, with the AADSTS code
+//   - CorrelationId: the correlation ID of the request, to be provided to the support
+type AuthenticationError struct {
+	StatusCode    int    `json:"-"`
+	Code          string `json:"error"`
+	Description   string `json:"error_description"`
+	CorrelationId string `json:"correlation_id"`
+}
+
+func (e *AuthenticationError) Error() string {
+	return fmt.Sprintf("Authentication failed: %v %v %v", e.StatusCode, e.Code, e.Description)
+}
+
+// AuthorityHostForURL returns the authority host of the cloud of an organization URL: the US Government
+// clouds for "crm.microsoftdynamics.us" (GCC High) and "crm.appsplatform.us" (DoD), the China cloud
+// for "crm.dynamics.cn", and the public cloud otherwise.
+func AuthorityHostForURL(orgUrl string) string {
+	u, err := url.Parse(orgUrl)
+	if err != nil {
+		return AuthorityPublic
+	}
+	host := strings.ToLower(u.Hostname())
+	switch {
+	case strings.HasSuffix(host, ".microsoftdynamics.us"), strings.HasSuffix(host, ".appsplatform.us"):
+		return AuthorityUSGovernment
+	case strings.HasSuffix(host, ".dynamics.cn"):
+		return AuthorityChina
+	}
+	return AuthorityPublic
+}
+
+// Scope returns the scope of the default permissions of a resource, e.g. "https://org.crm.dynamics.com/.default".
+func Scope(target string) string {
+	if strings.HasSuffix(target, "/.default") {
+		return target
+	}
+	return strings.TrimSuffix(target, "/") + "/.default"
+}
+
+// GetAuthorization retrieves an authorization token for a given client ID, secret, tenant ID, and resource URL,
+// from the v2.0 token endpoint with the scope "{target}/.default".
+//
+// It takes four arguments:
+//   - client: a string representing the client ID
+//   - secret: a string representing the secret
+//   - tenant: a string representing the tenant ID
+//   - target: a string representing the resource URL
+//
+// The return value is a 'TokenResponse' representing the authorization information, and an error value, which will
+// be nil if the function completed successfully (an *AuthenticationError if the token endpoint refused the request).
+//
+// Example:
+//
+//	token, err := GetAuthorization("clientid", "secret", "tenantid", "https://myresource.com")
+//	if err != nil {
+//	  log.Fatal(err)
+//	}
+//	fmt.Println(token.AccessToken)
+func (c *Client) GetAuthorization(client string, secret string, tenant string, target string) (token TokenResponse, err error) {
+	return c.postToken(context.Background(), tenant, target, url.Values{
+		"grant_type":    {"client_credentials"},
+		"client_id":     {client},
+		"client_secret": {secret},
+		"scope":         {Scope(target)},
+	})
+}
+
+// GetAuthorizationWithCertificate retrieves an authorization token for a given client ID, certificate, tenant ID,
+// and resource URL. The client authenticates with a JWT client assertion signed with the key of the certificate,
+// which must be uploaded to the app registration.
+//
+// It takes four arguments:
+//   - client: a string representing the client ID
+//   - cert: a 'Certificate' holding the private key and the certificate
+//   - tenant: a string representing the tenant ID
+//   - target: a string representing the resource URL
+//
+// The return value is a 'TokenResponse' representing the authorization information, and an error value, which will
+// be nil if the function completed successfully.
+//
+// Example:
+//
+//	cert, _ := LoadCertificate("app.pem", "")
+//	token, err := GetAuthorizationWithCertificate("clientid", cert, "tenantid", "https://myresource.com")
+//	fmt.Println(token.AccessToken)
+func (c *Client) GetAuthorizationWithCertificate(client string, cert Certificate, tenant string, target string) (token TokenResponse, err error) {
+	assertion, err := cert.ClientAssertion(client, c.tokenEndpoint(tenant, target))
+	if err != nil {
+		return
+	}
+	return c.postToken(context.Background(), tenant, target, url.Values{
+		"grant_type":            {"client_credentials"},
+		"client_id":             {client},
+		"client_assertion_type": {ClientAssertionType},
+		"client_assertion":      {assertion},
+		"scope":                 {Scope(target)},
+	})
+}
+
+// authorityHost returns the authority host of the client, or the one of the cloud of the target.
+func (c *Client) authorityHost(target string) string {
+	if c != nil && len(c.AuthorityHost) > 0 {
+		return strings.TrimSuffix(c.AuthorityHost, "/")
+	}
+	return AuthorityHostForURL(target)
+}
+
+// tokenEndpoint returns the v2.0 token endpoint of a tenant.
+func (c *Client) tokenEndpoint(tenant string, target string) string {
+	return fmt.Sprintf("%v/%v/oauth2/v2.0/token", c.authorityHost(target), tenant)
+}
+
+// postToken sends a token request to the token endpoint of a tenant and returns the token response.
+func (c *Client) postToken(ctx context.Context, tenant string, target string, form url.Values) (token TokenResponse, err error) {
+	ctx = context.WithValue(ctx, authRequestKey{}, true)
+	ctx, scope := c.newOperation(ctx, operation{name: "Authenticate"})
+	defer func() { scope.end(err) }()
+	req, err := http.NewRequestWithContext(ctx, "POST", c.tokenEndpoint(tenant, target), strings.NewReader(form.Encode()))
+	if err != nil {
+		return
+	}
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	received := time.Now()
+	resp, err := scope.send(c.httpClient(), req)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode > 300 {
+		authErr := &AuthenticationError{StatusCode: resp.StatusCode}
+		json.NewDecoder(resp.Body).Decode(authErr)
+		return token, authErr
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return
+	}
+	token.ExpiresOn = received.Add(time.Duration(token.ExpiresIn) * time.Second)
+	return
+}
@@ -1,5 +1,12 @@
 package dataversego
 
+import (
+	"io"
+	"time"
+
+	"github.com/emaporta/dataversego/requests"
+)
+
 // The 'RetrieveSignature' struct represents the signature of a 'Retrieve' function.
 // It contains the following fields:
 //   - Auth: a struct containing authentication information
@@ -7,14 +14,19 @@ package dataversego
 //   - Id: the ID of the entry to be retrieved
 //   - Columns: a slice of strings representing the columns to be retrieved
 //   - ColumnsString: a string representing the columns to be retrieved
-//   - Printerror: a boolean value indicating whether or not to print errors
+//   - IncludeAnnotations: the annotations to include (e.g. AnnotationsAll or AnnotationFormattedValue), none if empty
+//   - Options: the 'requests.RequestOptions' of the requests (impersonation, MSCRM headers)
+//   - Printerror: deprecated and ignored, the errors are logged by the Logger of the client of the authorization
 type RetrieveSignature struct {
-	Auth          Authorization
-	TableName     string
-	Id            string
-	Columns       []string
-	ColumnsString string
-	Printerror    bool
+	Auth               Authorization
+	TableName          string
+	Id                 string
+	Columns            []string
+	ColumnsString      string
+	IncludeAnnotations string
+	Options            requests.RequestOptions
+	// Deprecated: ignored, the errors are logged by the Logger of the client of the authorization.
+	Printerror bool
 }
 
 // The 'RetrieveMultipleSignature' struct represents the signature of a 'RetrieveMultiple' function.
@@ -25,15 +37,20 @@ type RetrieveSignature struct {
 //   - ColumnsString: a string representing the columns to be retrieved
 //   - Filter: a struct containing filter criteria for the entries to be retrieved
 //   - FilterString: a string representing the filter criteria
-//   - Printerror: a boolean value indicating whether or not to print errors
+//   - IncludeAnnotations: the annotations to include (e.g. AnnotationsAll or AnnotationFormattedValue), none if empty
+//   - Options: the 'requests.RequestOptions' of the requests (impersonation, MSCRM headers)
+//   - Printerror: deprecated and ignored, the errors are logged by the Logger of the client of the authorization
 type RetrieveMultipleSignature struct {
-	Auth          Authorization
-	TableName     string
-	Columns       []string
-	ColumnsString string
-	Filter        Filter
-	FilterString  string
-	Printerror    bool
+	Auth               Authorization
+	TableName          string
+	Columns            []string
+	ColumnsString      string
+	Filter             Filter
+	FilterString       string
+	IncludeAnnotations string
+	Options            requests.RequestOptions
+	// Deprecated: ignored, the errors are logged by the Logger of the client of the authorization.
+	Printerror bool
 }
 
 // The 'CreateUpdateSignature' struct represents the signature of a 'CreateUpdate' function.
@@ -41,13 +58,21 @@ type RetrieveMultipleSignature struct {
 //   - Auth: a struct containing authentication information
 //   - TableName: the name of the table to create or update the entry in
 //   - Id: the ID of the entry to be updated
-//   - Row: a map of strings to interface{} values representing the data for the entry
-//   - Printerror: a boolean value indicating whether or not to print errors
+//   - Row: a map of strings to interface{} values representing the data for the entry, lookups can be set with an 'EntityReference'
+//   - Record: a pointer to a 'Record' where the created or updated entry is stored, returned by the same request
+//     (Prefer: return=representation), nil to only return the ID
+//   - IncludeAnnotations: the annotations to include in the Record (e.g. AnnotationsAll or AnnotationFormattedValue), none if empty
+//   - Options: the 'requests.RequestOptions' of the requests (impersonation, MSCRM headers)
+//   - Printerror: deprecated and ignored, the errors are logged by the Logger of the client of the authorization
 type CreateUpdateSignature struct {
-	Auth       Authorization
-	TableName  string
-	Id         string
-	Row        map[string]any
+	Auth               Authorization
+	TableName          string
+	Id                 string
+	Row                map[string]any
+	Record             *Record
+	IncludeAnnotations string
+	Options            requests.RequestOptions
+	// Deprecated: ignored, the errors are logged by the Logger of the client of the authorization.
 	Printerror bool
 }
 
@@ -56,11 +81,14 @@ type CreateUpdateSignature struct {
 //   - Auth: a struct containing authentication information
 //   - TableName: the name of the table to Delete the entry from
 //   - Id: the ID of the entry to be Deleted
-//   - Printerror: a boolean value indicating whether or not to print errors
+//   - Options: the 'requests.RequestOptions' of the requests (impersonation, MSCRM headers)
+//   - Printerror: deprecated and ignored, the errors are logged by the Logger of the client of the authorization
 type DeleteSignature struct {
-	Auth       Authorization
-	TableName  string
-	Id         string
+	Auth      Authorization
+	TableName string
+	Id        string
+	Options   requests.RequestOptions
+	// Deprecated: ignored, the errors are logged by the Logger of the client of the authorization.
 	Printerror bool
 }
 
@@ -68,9 +96,292 @@ type DeleteSignature struct {
 // It contains the following fields:
 //   - Auth: a struct containing authentication information
 //   - Objects: an array of BatchObject that are the operations to be performed
-//   - Printerror: a boolean value indicating whether or not to print errors
+//   - Options: the 'requests.RequestOptions' of the requests (impersonation, MSCRM headers)
+//   - Printerror: deprecated and ignored, the errors are logged by the Logger of the client of the authorization
 type BatchOperationSignature struct {
-	Auth       Authorization
-	Objects    []BatchObject
+	Auth    Authorization
+	Objects []BatchObject
+	Options requests.RequestOptions
+	// Deprecated: ignored, the errors are logged by the Logger of the client of the authorization.
 	Printerror bool
 }
+
+// The 'AssociateSignature' struct represents the signature of an 'Associate' function.
+// It contains the following fields:
+//   - Auth: a struct containing authentication information
+//   - TableName: the name of the table of the source entry
+//   - Id: the ID of the source entry
+//   - Relationship: the navigation property of the relationship (e.g. "listcontact_association")
+//   - Targets: a slice of 'EntityReference' structs representing the entries to associate
+//   - Options: the 'requests.RequestOptions' of the requests (impersonation, MSCRM headers)
+type AssociateSignature struct {
+	Auth         Authorization
+	TableName    string
+	Id           string
+	Relationship string
+	Targets      []EntityReference
+	Options      requests.RequestOptions
+}
+
+// The 'DisassociateSignature' struct represents the signature of a 'Disassociate' function.
+// It contains the following fields:
+//   - Auth: a struct containing authentication information
+//   - TableName: the name of the table of the source entry
+//   - Id: the ID of the source entry
+//   - Relationship: the navigation property of the relationship (e.g. "listcontact_association")
+//   - Targets: a slice of 'EntityReference' structs representing the entries to disassociate, empty for single-valued navigation properties
+//   - Options: the 'requests.RequestOptions' of the requests (impersonation, MSCRM headers)
+type DisassociateSignature struct {
+	Auth         Authorization
+	TableName    string
+	Id           string
+	Relationship string
+	Targets      []EntityReference
+	Options      requests.RequestOptions
+}
+
+// The 'ExecuteFunctionSignature' struct represents the signature of an 'ExecuteFunction' function.
+// It contains the following fields:
+//   - Auth: a struct containing authentication information
+//   - Name: the name of the function
+//   - TableName: the name of the table the function is bound to, empty for unbound functions
+//   - Id: the ID of the entry the function is bound to
+//   - Parameters: a map of strings to interface{} values representing the parameters of the function
+//   - Response: an optional pointer to a struct where the response will be decoded
+//   - Options: the 'requests.RequestOptions' of the requests (impersonation, MSCRM headers)
+type ExecuteFunctionSignature struct {
+	Auth       Authorization
+	Name       string
+	TableName  string
+	Id         string
+	Parameters map[string]any
+	Response   any
+	Options    requests.RequestOptions
+}
+
+// The 'ExecuteActionSignature' struct represents the signature of an 'ExecuteAction' function.
+// It contains the following fields:
+//   - Auth: a struct containing authentication information
+//   - Name: the name of the action
+//   - TableName: the name of the table the action is bound to, empty for unbound actions
+//   - Id: the ID of the entry the action is bound to
+//   - Parameters: a map of strings to interface{} values representing the parameters of the action
+//   - Response: an optional pointer to a struct where the response will be decoded
+//   - Options: the 'requests.RequestOptions' of the requests (impersonation, MSCRM headers)
+type ExecuteActionSignature struct {
+	Auth       Authorization
+	Name       string
+	TableName  string
+	Id         string
+	Parameters map[string]any
+	Response   any
+	Options    requests.RequestOptions
+}
+
+// The 'RetrieveCustomAPIsSignature' struct represents the signature of a 'RetrieveCustomAPIs' function.
+// It contains the following fields:
+//   - Auth: a struct containing authentication information
+//   - UniqueNames: an optional slice of strings representing the unique names of the custom APIs to retrieve
+//   - Options: the 'requests.RequestOptions' of the requests (impersonation, MSCRM headers)
+type RetrieveCustomAPIsSignature struct {
+	Auth        Authorization
+	UniqueNames []string
+	Options     requests.RequestOptions
+}
+
+// The 'UploadFileSignature' struct represents the signature of an 'UploadFile' function.
+// It contains the following fields:
+//   - Auth: a struct containing authentication information
+//   - TableName: the name of the table of the entry
+//   - Id: the ID of the entry
+//   - Column: the logical name of the file or image column
+//   - FileName: the name of the file
+//   - MimeType: the MIME type of the file, guessed from the file name if empty
+//   - Content: a reader providing the content of the file
+//   - Options: the 'requests.RequestOptions' of the requests (impersonation, MSCRM headers)
+type UploadFileSignature struct {
+	Auth      Authorization
+	TableName string
+	Id        string
+	Column    string
+	FileName  string
+	MimeType  string
+	Content   io.Reader
+	Options   requests.RequestOptions
+}
+
+// The 'DownloadFileSignature' struct represents the signature of a 'DownloadFile' function.
+// It contains the following fields:
+//   - Auth: a struct containing authentication information
+//   - TableName: the name of the table of the entry
+//   - Id: the ID of the entry
+//   - Column: the logical name of the file or image column
+//   - FullSize: a boolean value indicating whether to download the full-size image instead of the thumbnail
+//   - Content: a writer where the content of the file is written
+//   - Options: the 'requests.RequestOptions' of the requests (impersonation, MSCRM headers)
+type DownloadFileSignature struct {
+	Auth      Authorization
+	TableName string
+	Id        string
+	Column    string
+	FullSize  bool
+	Content   io.Writer
+	Options   requests.RequestOptions
+}
+
+// The 'AttachFileSignature' struct represents the signature of the 'AttachNote' and 'AttachActivityAttachment' functions.
+// It contains the following fields:
+//   - Auth: a struct containing authentication information
+//   - TableName: the name of the table of the entry
+//   - Id: the ID of the entry
+//   - Subject: the title of the note or attachment
+//   - NoteText: the text of the note
+//   - FileName: the name of the file
+//   - MimeType: the MIME type of the file, guessed from the file name if empty
+//   - Content: a reader providing the content of the file
+//   - Options: the 'requests.RequestOptions' of the requests (impersonation, MSCRM headers)
+type AttachFileSignature struct {
+	Auth      Authorization
+	TableName string
+	Id        string
+	Subject   string
+	NoteText  string
+	FileName  string
+	MimeType  string
+	Content   io.Reader
+	Options   requests.RequestOptions
+}
+
+// The 'RetrieveNotesSignature' struct represents the signature of a 'RetrieveNotes' function.
+// It contains the following fields:
+//   - Auth: a struct containing authentication information
+//   - Id: the ID of the entry the notes are attached to
+//   - Options: the 'requests.RequestOptions' of the requests (impersonation, MSCRM headers)
+type RetrieveNotesSignature struct {
+	Auth    Authorization
+	Id      string
+	Options requests.RequestOptions
+}
+
+// The 'DownloadNoteSignature' struct represents the signature of a 'DownloadNote' function.
+// It contains the following fields:
+//   - Auth: a struct containing authentication information
+//   - Id: the ID of the note
+//   - Content: a writer where the content of the file is written
+//   - Options: the 'requests.RequestOptions' of the requests (impersonation, MSCRM headers)
+type DownloadNoteSignature struct {
+	Auth    Authorization
+	Id      string
+	Content io.Writer
+	Options requests.RequestOptions
+}
+
+// The 'RetrieveChangesSignature' struct represents the signature of a 'RetrieveChanges' function.
+// It contains the following fields:
+//   - Auth: a struct containing authentication information
+//   - TableName: the name of the table to retrieve the changes from
+//   - Columns: a slice of strings representing the columns to be retrieved
+//   - ColumnsString: a string representing the columns to be retrieved
+//   - DeltaToken: the delta token returned by the previous call, empty to retrieve all the entries
+//   - Options: the 'requests.RequestOptions' of the requests (impersonation, MSCRM headers)
+type RetrieveChangesSignature struct {
+	Auth          Authorization
+	TableName     string
+	Columns       []string
+	ColumnsString string
+	DeltaToken    string
+	Options       requests.RequestOptions
+}
+
+// The 'SyncChangesSignature' struct represents the signature of a 'SyncChanges' function.
+// It contains the following fields:
+//   - Auth: a struct containing authentication information
+//   - TableName: the name of the table to sync
+//   - Columns: a slice of strings representing the columns to be retrieved
+//   - ColumnsString: a string representing the columns to be retrieved
+//   - Store: the 'DeltaTokenStore' where the delta token is persisted
+//   - Key: the key of the delta token in the store, TableName if empty
+//   - Handler: a function called for every change
+//   - Options: the 'requests.RequestOptions' of the requests (impersonation, MSCRM headers)
+type SyncChangesSignature struct {
+	Auth          Authorization
+	TableName     string
+	Columns       []string
+	ColumnsString string
+	Store         DeltaTokenStore
+	Key           string
+	Handler       func(ChangeEvent) error
+	Options       requests.RequestOptions
+}
+
+// The 'RetrieveInstancesSignature' struct represents the signature of a 'RetrieveInstances' function.
+// It contains the following fields:
+//   - Auth: a struct containing authentication information, its Url being a Global Discovery Service url
+//   - Options: the 'requests.RequestOptions' of the requests (impersonation, MSCRM headers)
+type RetrieveInstancesSignature struct {
+	Auth    Authorization
+	Options requests.RequestOptions
+}
+
+// The 'FindInstanceSignature' struct represents the signature of a 'FindInstance' function.
+// It contains the following fields:
+//   - Auth: a struct containing authentication information, its Url being a Global Discovery Service url
+//   - Name: the unique name, the url name or the friendly name of the instance
+//   - Options: the 'requests.RequestOptions' of the requests (impersonation, MSCRM headers)
+type FindInstanceSignature struct {
+	Auth    Authorization
+	Name    string
+	Options requests.RequestOptions
+}
+
+// The 'RetrieveMoneySignature' struct represents the signature of a 'RetrieveMoney' function.
+// It contains the following fields:
+//   - Auth: a struct containing authentication information
+//   - Record: the record holding the currency column
+//   - TableName: the name of the table (entity set) of the record, read from the record if empty
+//   - Column: the logical name of the currency column
+//   - Options: the 'requests.RequestOptions' of the requests (impersonation, MSCRM headers)
+type RetrieveMoneySignature struct {
+	Auth      Authorization
+	Record    Record
+	TableName string
+	Column    string
+	Options   requests.RequestOptions
+}
+
+// The 'RetrieveUserTimeZoneSignature' struct represents the signature of a 'RetrieveUserTimeZone' function.
+// It contains the following fields:
+//   - Auth: a struct containing authentication information
+//   - UserId: the systemuserid of the user, the calling user if empty
+//   - Options: the 'requests.RequestOptions' of the requests (impersonation, MSCRM headers)
+type RetrieveUserTimeZoneSignature struct {
+	Auth    Authorization
+	UserId  string
+	Options requests.RequestOptions
+}
+
+// The 'LocalTimeFromUtcTimeSignature' struct represents the signature of a 'LocalTimeFromUtcTime' function.
+// It contains the following fields:
+//   - Auth: a struct containing authentication information, empty to convert with the Location of the time zone
+//   - TimeZone: the time zone to convert to
+//   - UtcTime: the time to convert
+//   - Options: the 'requests.RequestOptions' of the requests (impersonation, MSCRM headers)
+type LocalTimeFromUtcTimeSignature struct {
+	Auth     Authorization
+	TimeZone UserTimeZone
+	UtcTime  time.Time
+	Options  requests.RequestOptions
+}
+
+// The 'UtcTimeFromLocalTimeSignature' struct represents the signature of a 'UtcTimeFromLocalTime' function.
+// It contains the following fields:
+//   - Auth: a struct containing authentication information, empty to convert with the Location of the time zone
+//   - TimeZone: the time zone of the local time
+//   - LocalTime: the local time to convert, only its date and time are used
+//   - Options: the 'requests.RequestOptions' of the requests (impersonation, MSCRM headers)
+type UtcTimeFromLocalTimeSignature struct {
+	Auth      Authorization
+	TimeZone  UserTimeZone
+	LocalTime time.Time
+	Options   requests.RequestOptions
+}